@@ -1,51 +1,90 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"io/fs"
 	"log"
+	"os"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/controller/httpserver"
-	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
-	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqlrepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/cacherepository"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
-	"github.com/BurntSushi/toml"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/webhook"
 	"github.com/joho/godotenv"
 )
 
-var configPath string
-
-func init() {
-	flag.StringVar(&configPath, "config-path", "configs/httpserver.toml", "path to config file")
-}
-
 func Run() {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
 
-	// PostgreSQL
-	if err := godotenv.Load(); err != nil {
+	config, args, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
-	configDB := repository.NewConfig()
-	db, err := repository.NewDB(configDB)
+
+	if len(args) > 0 {
+		if err := runCommand(config, args, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Storage
+	b, err := openBackend(config.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer b.close()
 
 	// Repository
-	r := sqlrepository.NewSegmentRepository(db)
+	r := b.segmentRepository
+	wr := b.webhookRepository
+	er := b.eventRepository
+
+	var cache *cacherepository.SegmentRepository
+	if config.Database.CacheSize > 0 {
+		cache = cacherepository.NewSegmentRepository(r, config.Database.CacheSize, config.Database.CacheTTL)
+		publishCacheStats(cache)
+		r = cache
+	}
 
 	// UseCase
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(config.Membership, r, wr, er)
+	go runHistorySnapshots(uc, config.Database.HistorySnapshotInterval)
 
-	// Controller
-	flag.Parse()
-	configServer := httpserver.NewConfig()
-	_, err = toml.DecodeFile(configPath, configServer)
-	if err != nil {
-		log.Fatal(err)
+	// Event stream
+	go func() {
+		if err := uc.RunEventBroker(context.Background(), b.notify); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if cache != nil {
+		go runCacheInvalidation(context.Background(), uc, cache)
 	}
 
-	s := httpserver.NewServer(configServer, uc)
+	// Webhooks
+	go webhook.NewDispatcher(config.Webhook, wr).Run(context.Background())
+
+	// Event relay
+	if config.Relay.Sink != "" {
+		sink, err := NewEventSink(config.Relay.Sink)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sink.Close()
+
+		go newRelay(er, sink).run(context.Background(), config.Relay.Interval)
+	}
+
+	// Controller
+	s := httpserver.NewServer(config.HTTP, uc)
 	if err := s.StartServer(); err != nil {
 		log.Fatal(err)
 	}
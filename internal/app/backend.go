@@ -0,0 +1,126 @@
+package app
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqliterepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqlrepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/sirupsen/logrus"
+)
+
+// backend is the set of repositories of the storage selected by the config.
+// notify fires when new events are written to the outbox.
+type backend struct {
+	segmentRepository repository.SegmentRepository
+	webhookRepository repository.WebhookRepository
+	eventRepository   repository.EventRepository
+	notify            <-chan struct{}
+	close             func()
+}
+
+func openBackend(config *repository.Config) (*backend, error) {
+	switch config.Driver() {
+	case repository.DriverMemory:
+		r, err := testrepository.Open(config.MemoryDir())
+		if err != nil {
+			return nil, err
+		}
+
+		if config.MemoryDir() != "" {
+			go runMemorySnapshots(r, config.MemorySnapshotInterval)
+		}
+
+		return &backend{
+			segmentRepository: r,
+			webhookRepository: testrepository.NewWebhookRepository(r),
+			eventRepository:   testrepository.NewEventRepository(r),
+			notify:            r.Notify(),
+			close: func() {
+				if err := r.Close(); err != nil {
+					logrus.Errorf("Memory: close error: %s", err)
+				}
+			},
+		}, nil
+
+	case repository.DriverSQLite:
+		db, err := repository.NewDB(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := sqliterepository.Migrate(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		r := sqliterepository.NewSegmentRepository(db)
+		return &backend{
+			segmentRepository: r,
+			webhookRepository: sqliterepository.NewWebhookRepository(db),
+			eventRepository:   sqliterepository.NewEventRepository(db),
+			notify:            r.Notify(),
+			close: func() {
+				db.Close()
+			},
+		}, nil
+
+	default:
+		db, err := repository.NewDB(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkPostgresSchema(db, config.SchemaCheck); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		listener, err := sqlrepository.NewEventListener(config.PostgresURL())
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		return &backend{
+			segmentRepository: sqlrepository.NewSegmentRepository(db),
+			webhookRepository: sqlrepository.NewWebhookRepository(db),
+			eventRepository:   sqlrepository.NewEventRepository(db),
+			notify:            listener.Notify(),
+			close: func() {
+				listener.Close()
+				db.Close()
+			},
+		}, nil
+	}
+}
+
+// checkPostgresSchema makes sure the migrations were run, see checkSchema.
+// SQLite is migrated on start instead, it is a single-process backend.
+func checkPostgresSchema(db *sql.DB, mode string) error {
+	src, err := sqlrepository.MigrationSource()
+	if err != nil {
+		return err
+	}
+
+	version, dirty, err := sqlrepository.SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	return checkSchema(src, version, dirty, mode)
+}
+
+// runMemorySnapshots periodically compacts the write-ahead log
+// of the in-memory backend into a snapshot.
+func runMemorySnapshots(r *testrepository.SegmentRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := r.Snapshot(); err != nil {
+			logrus.Errorf("Memory: snapshot error: %s", err)
+		}
+	}
+}
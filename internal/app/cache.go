@@ -0,0 +1,37 @@
+package app
+
+import (
+	"context"
+	"expvar"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/cacherepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+)
+
+// runCacheInvalidation keeps the cache coherent with the writes of other
+// instances, which reach this one as outbox events. If events were dropped
+// for being read too slowly, the whole cache is purged.
+func runCacheInvalidation(ctx context.Context, uc usecase.UseCase, cache *cacherepository.SegmentRepository) {
+	sub := uc.EventSubscribe(&entity.EventFilter{})
+	defer uc.EventUnsubscribe(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sub.Events:
+			if sub.Lagged() {
+				cache.Purge()
+				continue
+			}
+			cache.InvalidateEvent(e)
+		}
+	}
+}
+
+func publishCacheStats(cache *cacherepository.SegmentRepository) {
+	expvar.Publish("segment_cache", expvar.Func(func() interface{} {
+		return cache.Stats()
+	}))
+}
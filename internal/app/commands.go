@@ -0,0 +1,48 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errUnknownCommand = errors.New("unknown command")
+
+// runCommand runs a one-off command instead of the server.
+func runCommand(config *Config, args []string, w io.Writer) error {
+	switch {
+	case args[0] == "migrate":
+		return runMigrate(config.Database, args[1:], w)
+	case contains(operatorCommands, args[0]):
+		return runOperatorCommand(config, args, w)
+	case strings.Join(args, " ") == "config print":
+		return config.Print(w)
+	default:
+		return fmt.Errorf("%w: %s", errUnknownCommand, strings.Join(args, " "))
+	}
+}
+
+// parseArgs parses the flags of a command wherever they are placed,
+// migrate down 1 -dry-run, and returns the positional arguments.
+// Numbers are never taken for flags: migrate force -1.
+func parseArgs(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for len(args) > 0 {
+		if _, err := strconv.Atoi(args[0]); err == nil {
+			positional, args = append(positional, args[0]), args[1:]
+			continue
+		}
+
+		if err := flagSet.Parse(args); err != nil {
+			return nil, err
+		}
+		if flagSet.NArg() == 0 {
+			break
+		}
+		positional, args = append(positional, flagSet.Arg(0)), flagSet.Args()[1:]
+	}
+	return positional, nil
+}
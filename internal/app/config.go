@@ -0,0 +1,340 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/controller/httpserver"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/webhook"
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+// envPrefix starts the environment variable of every setting,
+// database.url is overridden by SEGMENTS_DATABASE_URL.
+const envPrefix = "SEGMENTS_"
+
+const (
+	defaultConfigPath = "configs/config.toml"
+	configPathEnv     = envPrefix + "CONFIG_PATH"
+)
+
+var (
+	sslModes     = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+	schemaChecks = []string{repository.SchemaCheckFail, repository.SchemaCheckWarn, repository.SchemaCheckOff}
+
+	conflictPolicies     = []string{usecase.ConflictPolicyReject, usecase.ConflictPolicyLastWins}
+	prerequisitePolicies = []string{usecase.PrerequisitePolicyReject, usecase.PrerequisitePolicyCascade}
+	overflowPolicies     = []string{entity.OverflowPolicyReject, entity.OverflowPolicyWaitlist}
+)
+
+// Config is the whole service configuration. Every setting is taken from
+// the first of these that sets it: a command line flag, the prefixed
+// environment variable, the unprefixed variable kept for existing
+// deployments, the TOML file, the default.
+type Config struct {
+	HTTP       *httpserver.Config `toml:"http"`
+	Database   *repository.Config `toml:"database"`
+	Membership *usecase.Config    `toml:"membership"`
+	Webhook    *webhook.Config    `toml:"webhook"`
+	Relay      *relayConfig       `toml:"relay"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		HTTP:       httpserver.NewConfig(),
+		Database:   repository.NewConfig(),
+		Membership: usecase.NewConfig(),
+		Webhook:    webhook.NewConfig(),
+		Relay:      newRelayConfig(),
+	}
+}
+
+// LoadConfig builds the configuration from the command line arguments and
+// the environment and validates it. All the problems found are reported
+// together. The arguments left after the flags are returned.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	c := NewConfig()
+	settings := c.settings()
+
+	flagSet := flag.NewFlagSet("app", flag.ContinueOnError)
+	configPath := flagSet.String("config-path", "", fmt.Sprintf("path to config file (env %s, default %s)", configPathEnv, defaultConfigPath))
+
+	flags := make(map[string]string)
+	for _, s := range settings {
+		flagSet.Var(&flagValue{key: s.key, flags: flags}, s.flag(), fmt.Sprintf("%s (env %s)", s.key, s.env()))
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	errs := make([]error, 0)
+	if err := c.decodeFile(*configPath, lookupEnv); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, s := range settings {
+		if s.legacyEnv != "" {
+			if raw, ok := lookupEnv(s.legacyEnv); ok && raw != "" {
+				errs = appendSetError(errs, s, raw, s.legacyEnv)
+			}
+		}
+
+		if raw, ok := lookupEnv(s.env()); ok {
+			errs = appendSetError(errs, s, raw, s.env())
+		}
+
+		if raw, ok := flags[s.key]; ok {
+			errs = appendSetError(errs, s, raw, "-"+s.flag())
+		}
+	}
+
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return c, flagSet.Args(), nil
+}
+
+// decodeFile reads the TOML file. Without an explicit path a missing
+// default file is not an error, the rest of the sources still apply.
+func (c *Config) decodeFile(path string, lookupEnv func(string) (string, bool)) error {
+	if path == "" {
+		path, _ = lookupEnv(configPathEnv)
+	}
+
+	optional := path == ""
+	if optional {
+		path = defaultConfigPath
+	}
+
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, key := range md.Undecoded() {
+		errs = append(errs, fmt.Errorf("%s: %s: unknown setting", path, key))
+	}
+	return errors.Join(errs...)
+}
+
+// Print writes the effective configuration as TOML with the secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	httpCfg, databaseCfg, membershipCfg, webhookCfg, relayCfg := *c.HTTP, *c.Database, *c.Membership, *c.Webhook, *c.Relay
+	printed := &Config{
+		HTTP:       &httpCfg,
+		Database:   &databaseCfg,
+		Membership: &membershipCfg,
+		Webhook:    &webhookCfg,
+		Relay:      &relayCfg,
+	}
+
+	for _, s := range printed.settings() {
+		if s.secret {
+			s.value.SetString(redact(s.value.String()))
+		}
+	}
+	return toml.NewEncoder(w).Encode(printed)
+}
+
+// redact hides the password of a URL, or the whole value
+// if it is not a URL.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return "xxxxx"
+	}
+	return u.Redacted()
+}
+
+func (c *Config) validate() []error {
+	errs := make([]error, 0)
+	check := func(key string, ok bool, msg string) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, msg))
+		}
+	}
+
+	check("http.bind_addr", c.HTTP.BindAddr != "", "must not be empty")
+	_, err := logrus.ParseLevel(c.HTTP.LogLevel)
+	check("http.log_level", err == nil, "unknown log level")
+	check("http.max_batch_size", c.HTTP.MaxBatchSize > 0, "must be positive")
+
+	check("database.url", validDatabaseURL(c.Database), "must be a postgres://, memory:// or sqlite:// URL")
+	check("database.ssl_mode", contains(sslModes, c.Database.SSLMode), "must be one of "+strings.Join(sslModes, ", "))
+	check("database.ssl_root_cert", fileExists(c.Database.SSLRootCert), "file does not exist")
+	check("database.ssl_cert", fileExists(c.Database.SSLCert), "file does not exist")
+	check("database.ssl_key", fileExists(c.Database.SSLKey), "file does not exist")
+	check("database.ssl_key", (c.Database.SSLCert == "") == (c.Database.SSLKey == ""), "must be set together with database.ssl_cert")
+	check("database.max_open_conns", c.Database.MaxOpenConns >= 0, "must not be negative")
+	check("database.max_idle_conns", c.Database.MaxIdleConns >= 0, "must not be negative")
+	check("database.conn_max_lifetime", c.Database.ConnMaxLifetime >= 0, "must not be negative")
+	check("database.conn_max_idle_time", c.Database.ConnMaxIdleTime >= 0, "must not be negative")
+	check("database.connect_timeout", c.Database.ConnectTimeout >= 0, "must not be negative")
+	check("database.statement_timeout", c.Database.StatementTimeout >= 0, "must not be negative")
+	check("database.connect_attempts", c.Database.ConnectAttempts > 0, "must be positive")
+	check("database.connect_backoff", c.Database.ConnectBackoff > 0, "must be positive")
+	check("database.schema_check", contains(schemaChecks, c.Database.SchemaCheck), "must be one of "+strings.Join(schemaChecks, ", "))
+	check("database.history_snapshot_interval", c.Database.HistorySnapshotInterval > 0, "must be positive")
+	check("database.cache_size", c.Database.CacheSize >= 0, "must not be negative")
+	check("database.cache_ttl", c.Database.CacheTTL > 0, "must be positive")
+	check("database.memory_snapshot_interval", c.Database.MemorySnapshotInterval > 0, "must be positive")
+
+	check("membership.conflict_policy", contains(conflictPolicies, c.Membership.ConflictPolicy), "must be one of "+strings.Join(conflictPolicies, ", "))
+	check("membership.prerequisite_policy", contains(prerequisitePolicies, c.Membership.PrerequisitePolicy), "must be one of "+strings.Join(prerequisitePolicies, ", "))
+	check("membership.overflow_policy", contains(overflowPolicies, c.Membership.OverflowPolicy), "must be one of "+strings.Join(overflowPolicies, ", "))
+
+	check("webhook.poll_interval", c.Webhook.PollInterval > 0, "must be positive")
+	check("webhook.batch_size", c.Webhook.BatchSize > 0, "must be positive")
+	check("webhook.max_attempts", c.Webhook.MaxAttempts > 0, "must be positive")
+	check("webhook.base_backoff", c.Webhook.BaseBackoff > 0, "must be positive")
+	check("webhook.max_backoff", c.Webhook.MaxBackoff >= c.Webhook.BaseBackoff, "must not be less than webhook.base_backoff")
+	check("webhook.timeout", c.Webhook.Timeout > 0, "must be positive")
+
+	check("relay.sink", validEventSink(c.Relay.Sink), "must be empty, stdout, a file:// or an http(s):// URL")
+	check("relay.interval", c.Relay.Interval > 0, "must be positive")
+
+	return errs
+}
+
+func validDatabaseURL(c *repository.Config) bool {
+	switch c.Driver() {
+	case repository.DriverMemory:
+		return true
+	case repository.DriverSQLite:
+		return c.SQLitePath() != ""
+	default:
+		u, err := url.Parse(c.DatabaseURL)
+		return err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") && u.Host != ""
+	}
+}
+
+// fileExists reports whether an optional file is either not set or there.
+func fileExists(path string) bool {
+	if path == "" {
+		return true
+	}
+
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func validEventSink(addr string) bool {
+	return addr == "" || addr == "stdout" ||
+		strings.HasPrefix(addr, "file://") ||
+		strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setting is a single configurable field, addressed by its TOML section and key.
+type setting struct {
+	key       string
+	legacyEnv string
+	secret    bool
+	value     reflect.Value
+}
+
+// settings lists the fields of every section in declaration order.
+func (c *Config) settings() []*setting {
+	settings := make([]*setting, 0)
+
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Type().Field(i).Tag.Get("toml")
+		fields := sections.Field(i).Elem()
+
+		for j := 0; j < fields.NumField(); j++ {
+			field := fields.Type().Field(j)
+			settings = append(settings, &setting{
+				key:       section + "." + field.Tag.Get("toml"),
+				legacyEnv: field.Tag.Get("env"),
+				secret:    field.Tag.Get("secret") == "true",
+				value:     fields.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+func (s *setting) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+func (s *setting) flag() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+func (s *setting) set(raw string) error {
+	switch s.value.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(n))
+	case string:
+		s.value.SetString(raw)
+	default:
+		return fmt.Errorf("unsupported type %s", s.value.Type())
+	}
+	return nil
+}
+
+func appendSetError(errs []error, s *setting, raw string, source string) []error {
+	if err := s.set(raw); err != nil {
+		return append(errs, fmt.Errorf("%s: %s: %w", s.key, source, err))
+	}
+	return errs
+}
+
+// flagValue keeps the raw flag value, it is applied after the file
+// and the environment so that flags take precedence.
+type flagValue struct {
+	key   string
+	flags map[string]string
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) Set(raw string) error {
+	v.flags[v.key] = raw
+	return nil
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+var errUnknownEventSink = errors.New("unknown event sink")
+
+// EventSink receives the outbox events in order. Publish must either take
+// the whole batch or return an error, then the batch is published again.
+// Name identifies the sink offset, so it should not change between restarts,
+// and is logged, so it should hold no secrets.
+type EventSink interface {
+	Name() string
+	Publish([]*entity.Event) error
+	Close() error
+}
+
+// NewEventSink builds a sink from its address: "stdout", "file://<path>"
+// or an http(s) URL.
+func NewEventSink(addr string) (EventSink, error) {
+	switch {
+	case addr == "stdout":
+		return NewStdoutSink(), nil
+	case strings.HasPrefix(addr, "file://"):
+		return NewFileSink(strings.TrimPrefix(addr, "file://"))
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		return NewHTTPSink(addr), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownEventSink, addr)
+	}
+}
+
+// writerSink writes events as NDJSON.
+type writerSink struct {
+	name string
+	w    io.Writer
+	sync func() error
+}
+
+func NewStdoutSink() EventSink {
+	return &writerSink{name: "stdout", w: os.Stdout}
+}
+
+// NewFileSink appends events to the file and syncs it after every batch.
+func NewFileSink(path string) (EventSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{name: "file://" + path, w: f, sync: f.Sync}, nil
+}
+
+func (s *writerSink) Name() string {
+	return s.name
+}
+
+func (s *writerSink) Publish(events []*entity.Event) error {
+	bw := bufio.NewWriter(s.w)
+	if err := encodeEvents(bw, events); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	if s.sync != nil {
+		return s.sync()
+	}
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// httpSink posts every batch as one NDJSON request.
+type httpSink struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSink(rawURL string) EventSink {
+	return &httpSink{
+		name:   httpSinkName(rawURL),
+		url:    rawURL,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// httpSinkName names the sink by the scheme, host and path of its URL. The
+// credentials, query and fragment may hold secrets, which must not reach the
+// logs or the offset table, and rotating them must not reset the offset.
+func httpSinkName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "http"
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+func (s *httpSink) Name() string {
+	return s.name
+}
+
+func (s *httpSink) Publish(events []*entity.Event) error {
+	body := &bytes.Buffer{}
+	if err := encodeEvents(body, events); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/x-ndjson", body)
+	if err != nil {
+		// the URL error quotes the whole URL, the name leaves the secrets out
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = fmt.Errorf("%s %s: %w", urlErr.Op, s.name, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+func encodeEvents(w io.Writer, events []*entity.Event) error {
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package app
+
+import (
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+	"github.com/sirupsen/logrus"
+)
+
+// runHistorySnapshots periodically snapshots the membership history
+// so that point-in-time lookups only replay the events after the last snapshot.
+func runHistorySnapshots(uc usecase.UseCase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := uc.TakeHistorySnapshot(); err != nil {
+			logrus.Errorf("History: snapshot error: %s", err)
+		}
+	}
+}
@@ -1,69 +1,347 @@
-//go:build migrate
-
 package app
 
 import (
+	"database/sql"
 	"errors"
-	"os"
-	"time"
-
-	"github.com/joho/godotenv"
-	"github.com/sirupsen/logrus"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
 
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqliterepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqlrepository"
 	"github.com/golang-migrate/migrate/v4"
-	// migrate tools
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/sirupsen/logrus"
 )
 
-const (
-	_defaultAttempts = 20
-	_defaultTimeout  = time.Second
+const migrateUsage = "migrate [-dry-run] up | down N | goto V | version | force V"
+
+var (
+	errNoSchema       = errors.New("the memory backend has no schema to migrate")
+	errSchemaMismatch = errors.New("schema mismatch")
 )
 
-func init() {
-	if err := godotenv.Load(); err != nil {
-		logrus.Fatal(err)
+// migration is a single step of a migration plan.
+type migration struct {
+	version    uint
+	identifier string
+	up         bool
+}
+
+func (m migration) String() string {
+	direction := "up"
+	if !m.up {
+		direction = "down"
 	}
+	return fmt.Sprintf("%-4s %d %s", direction, m.version, m.identifier)
+}
+
+// runMigrate runs the migrate command against the configured database.
+// The migrations are embedded into the binary. With -dry-run the
+// migrations that would run are listed and nothing is applied.
+func runMigrate(config *repository.Config, args []string, w io.Writer) error {
+	flagSet := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flagSet.Bool("dry-run", false, "list the migrations that would run without applying them")
 
-	databaseURL, ok := os.LookupEnv("DATABASE_URL")
-	if !ok || len(databaseURL) == 0 {
-		logrus.Fatalf("migrate: environment variable not declared: %s", databaseURL)
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
 	}
 
-	databaseURL += "?sslmode=disable"
+	if len(positional) == 0 {
+		return fmt.Errorf("%w: usage: %s", errUnknownCommand, migrateUsage)
+	}
 
-	var (
-		attempts = _defaultAttempts
-		err      error
-		m        *migrate.Migrate
-	)
+	cmd, arg, err := parseMigrateArgs(positional)
+	if err != nil {
+		return err
+	}
 
-	for attempts > 0 {
-		m, err = migrate.New("file://migrations", databaseURL)
-		if err == nil {
-			break
+	m, src, err := openMigrate(config)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	latest, err := latestVersion(src)
+	if err != nil {
+		return err
+	}
+
+	current, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		current, dirty, err = 0, false, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "version":
+		fmt.Fprintf(w, "%s, latest %d\n", describeVersion(current, dirty), latest)
+		return nil
+	case "force":
+		if *dryRun {
+			fmt.Fprintf(w, "force %d\n", arg)
+			return nil
 		}
+		return m.Force(arg)
+	}
 
-		logrus.Printf("Migrate: postgres is trying to connect, attempts left: %d", attempts)
-		time.Sleep(_defaultTimeout)
-		attempts--
+	if dirty {
+		return fmt.Errorf("database is dirty at version %d, fix it and run migrate force %d", current, current)
 	}
 
+	var target uint
+	switch cmd {
+	case "up":
+		target = latest
+	case "down":
+		if target, err = stepDown(src, current, arg); err != nil {
+			return err
+		}
+	case "goto":
+		target = uint(arg)
+		if _, err := readMigration(src, target, true); err != nil {
+			return fmt.Errorf("goto %d: no such migration", target)
+		}
+	}
+
+	plan, err := planMigrations(src, current, target)
 	if err != nil {
-		logrus.Fatalf("Migrate: postgres connect error: %s", err)
+		return err
 	}
 
-	err = m.Up()
-	defer m.Close()
+	if len(plan) == 0 {
+		fmt.Fprintln(w, "no change")
+		return nil
+	}
+
+	for _, step := range plan {
+		fmt.Fprintln(w, step)
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	if target == 0 {
+		err = m.Down()
+	} else {
+		err = m.Migrate(target)
+	}
 	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		logrus.Fatalf("Migrate: up error: %s", err)
+		return err
+	}
+
+	fmt.Fprintf(w, "version %d\n", target)
+	return nil
+}
+
+// parseMigrateArgs checks the subcommand and parses its argument:
+// the number of steps for down, the version for goto and force.
+func parseMigrateArgs(args []string) (string, int, error) {
+	cmd := args[0]
+
+	wantArg := 0
+	switch cmd {
+	case "up", "version":
+	case "down", "goto", "force":
+		wantArg = 1
+	default:
+		return "", 0, fmt.Errorf("%w: migrate %s: usage: %s", errUnknownCommand, cmd, migrateUsage)
+	}
+
+	if len(args)-1 != wantArg {
+		return "", 0, fmt.Errorf("%w: migrate %s: usage: %s", errUnknownCommand, cmd, migrateUsage)
+	}
+	if wantArg == 0 {
+		return cmd, 0, nil
+	}
+
+	n, err := strconv.Atoi(args[1])
+	switch {
+	case err != nil:
+		return "", 0, fmt.Errorf("migrate %s: %w", cmd, err)
+	case cmd == "down" && n <= 0:
+		return "", 0, fmt.Errorf("migrate down: the number of steps must be positive")
+	case cmd == "goto" && n <= 0:
+		return "", 0, fmt.Errorf("migrate goto: the version must be positive")
+	case cmd == "force" && n < -1:
+		// -1 forgets the version, as if no migration was applied
+		return "", 0, fmt.Errorf("migrate force: the version must be positive or -1")
+	}
+	return cmd, n, nil
+}
+
+// openMigrate returns a migrate instance for the configured database
+// along with a separate migration source to plan with.
+// Closing the migrate instance closes the database.
+func openMigrate(config *repository.Config) (*migrate.Migrate, source.Driver, error) {
+	var (
+		newMigrate      func(*sql.DB) (*migrate.Migrate, error)
+		migrationSource func() (source.Driver, error)
+	)
+
+	switch config.Driver() {
+	case repository.DriverMemory:
+		return nil, nil, errNoSchema
+	case repository.DriverSQLite:
+		newMigrate, migrationSource = sqliterepository.NewMigrate, sqliterepository.MigrationSource
+	default:
+		newMigrate, migrationSource = sqlrepository.NewMigrate, sqlrepository.MigrationSource
+	}
+
+	src, err := migrationSource()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := repository.NewDB(config)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if errors.Is(err, migrate.ErrNoChange) {
-		logrus.Printf("Migrate: no change")
-		return
+	m, err := newMigrate(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
 	}
+	return m, src, nil
+}
+
+// checkSchema compares the schema version with the newest embedded
+// migration. Depending on mode a mismatch stops the server or is logged.
+func checkSchema(src source.Driver, version uint, dirty bool, mode string) error {
+	if mode == repository.SchemaCheckOff {
+		return nil
+	}
+
+	latest, err := latestVersion(src)
+	if err != nil {
+		return err
+	}
+
+	var problem string
+	switch {
+	case dirty:
+		problem = fmt.Sprintf("schema is dirty at version %d, fix it and run migrate force", version)
+	case version != latest:
+		problem = fmt.Sprintf("schema is at %s, the code expects %d, run migrate", describeVersion(version, dirty), latest)
+	default:
+		return nil
+	}
+
+	if mode == repository.SchemaCheckWarn {
+		logrus.Warnf("Database: %s", problem)
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errSchemaMismatch, problem)
+}
+
+// planMigrations lists the migrations between the current version
+// and the target one, zero standing for an empty schema.
+func planMigrations(src source.Driver, current, target uint) ([]migration, error) {
+	plan := make([]migration, 0)
+
+	if target > current {
+		v, err := nextVersion(src, current)
+		for err == nil && v <= target {
+			identifier, readErr := readMigration(src, v, true)
+			if readErr != nil {
+				return nil, readErr
+			}
+			plan = append(plan, migration{version: v, identifier: identifier, up: true})
+			v, err = src.Next(v)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return plan, nil
+	}
+
+	for v := current; v > target; {
+		identifier, err := readMigration(src, v, false)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, migration{version: v, identifier: identifier})
 
-	logrus.Printf("Migrate: up success")
+		if v, err = prevVersion(src, v); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// stepDown returns the version n migrations below the current one.
+func stepDown(src source.Driver, current uint, n int) (uint, error) {
+	v := current
+	for i := 0; i < n && v > 0; i++ {
+		var err error
+		if v, err = prevVersion(src, v); err != nil {
+			return 0, err
+		}
+	}
+	return v, nil
+}
+
+// latestVersion returns the version of the newest migration,
+// the one the code expects the schema to be at.
+func latestVersion(src source.Driver) (uint, error) {
+	v, err := src.First()
+	for err == nil {
+		var next uint
+		if next, err = src.Next(v); err == nil {
+			v = next
+		}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return v, nil
+}
+
+func nextVersion(src source.Driver, v uint) (uint, error) {
+	if v == 0 {
+		return src.First()
+	}
+	return src.Next(v)
+}
+
+// prevVersion returns zero below the first migration.
+func prevVersion(src source.Driver, v uint) (uint, error) {
+	prev, err := src.Prev(v)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	return prev, err
+}
+
+func readMigration(src source.Driver, v uint, up bool) (string, error) {
+	read := src.ReadDown
+	if up {
+		read = src.ReadUp
+	}
+
+	r, identifier, err := read(v)
+	if err != nil {
+		return "", err
+	}
+	r.Close()
+	return identifier, nil
+}
+
+func describeVersion(version uint, dirty bool) string {
+	switch {
+	case version == 0:
+		return "no version"
+	case dirty:
+		return fmt.Sprintf("%d (dirty)", version)
+	default:
+		return strconv.FormatUint(uint64(version), 10)
+	}
 }
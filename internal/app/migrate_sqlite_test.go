@@ -0,0 +1,69 @@
+//go:build cgo
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqliterepository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunMigrate(t *testing.T) {
+	c := NewConfig()
+	c.Database.DatabaseURL = "sqlite://" + filepath.Join(t.TempDir(), "segments.db")
+
+	run := func(args ...string) string {
+		t.Helper()
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, runCommand(c, append([]string{"migrate"}, args...), buf))
+		return buf.String()
+	}
+
+	up := embeddedMigrations(t, sqliterepository.Migrations, "migrations")
+	down := reverseMigrations(up)
+	first, latest := up[0].version, up[len(up)-1].version
+	noVersion := fmt.Sprintf("no version, latest %d\n", latest)
+
+	assert.Equal(t, noVersion, run("version"))
+	assert.Equal(t, formatMigrations(up), run("-dry-run", "up"))
+	assert.Equal(t, noVersion, run("version"))
+
+	assert.Equal(t, formatMigrations(up)+fmt.Sprintf("version %d\n", latest), run("up"))
+	assert.Equal(t, "no change\n", run("up"))
+	assert.Equal(t, fmt.Sprintf("%d, latest %d\n", latest, latest), run("version"))
+
+	assert.Equal(t, formatMigrations(down[:1]), run("down", "1", "-dry-run"))
+	assert.Equal(t, formatMigrations(down)+"version 0\n", run("down", fmt.Sprint(len(down)+1)))
+	assert.Equal(t, formatMigrations(up[:1])+fmt.Sprintf("version %d\n", first), run("goto", fmt.Sprint(first)))
+
+	run("force", "-1")
+	assert.Equal(t, noVersion, run("version"))
+}
+
+func TestRunMigrate_Errors(t *testing.T) {
+	c := NewConfig()
+	c.Database.DatabaseURL = "sqlite://" + filepath.Join(t.TempDir(), "segments.db")
+
+	for _, args := range [][]string{
+		{"migrate"},
+		{"migrate", "sideways"},
+		{"migrate", "down"},
+		{"migrate", "up", "1"},
+	} {
+		assert.ErrorIs(t, runCommand(c, args, &bytes.Buffer{}), errUnknownCommand, args)
+	}
+
+	up := embeddedMigrations(t, sqliterepository.Migrations, "migrations")
+	missing := up[len(up)-1].version + 1
+
+	assert.Error(t, runCommand(c, []string{"migrate", "down", "0"}, &bytes.Buffer{}))
+	assert.Error(t, runCommand(c, []string{"migrate", "goto", fmt.Sprint(missing)}, &bytes.Buffer{}))
+
+	c.Database.DatabaseURL = "memory://"
+	assert.ErrorIs(t, runCommand(c, []string{"migrate", "up"}, &bytes.Buffer{}), errNoSchema)
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqliterepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqlrepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/migrations"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// embeddedMigrations lists the up migrations in the directory of fsys by
+// version. Every version must have exactly one up and one down file of
+// the same name, the files of no migration are skipped.
+func embeddedMigrations(t *testing.T, fsys fs.FS, dir string) []migration {
+	t.Helper()
+
+	entries, err := fs.ReadDir(fsys, dir)
+	require.NoError(t, err)
+
+	up := make(map[uint]string)
+	down := make(map[uint]string)
+	for _, e := range entries {
+		m, err := source.Parse(e.Name())
+		if err != nil {
+			continue
+		}
+
+		files := up
+		if m.Direction == source.Down {
+			files = down
+		}
+		_, dup := files[m.Version]
+		require.False(t, dup, "migration %d has two %s files", m.Version, m.Direction)
+		files[m.Version] = m.Identifier
+	}
+
+	require.NotEmpty(t, up)
+	require.Equal(t, up, down, "every migration needs an up and a down file of the same name")
+
+	list := make([]migration, 0, len(up))
+	for version, identifier := range up {
+		list = append(list, migration{version: version, identifier: identifier, up: true})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+	return list
+}
+
+// reverseMigrations turns the up migrations into the down ones in the order they are undone.
+func reverseMigrations(up []migration) []migration {
+	down := make([]migration, len(up))
+	for i, m := range up {
+		m.up = false
+		down[len(up)-1-i] = m
+	}
+	return down
+}
+
+func formatMigrations(list []migration) string {
+	var b strings.Builder
+	for _, m := range list {
+		fmt.Fprintln(&b, m)
+	}
+	return b.String()
+}
+
+func TestMigrationSources(t *testing.T) {
+	testCases := []struct {
+		name   string
+		fsys   fs.FS
+		dir    string
+		source func() (source.Driver, error)
+	}{
+		{name: "postgres", fsys: migrations.FS, dir: ".", source: sqlrepository.MigrationSource},
+		{name: "sqlite", fsys: sqliterepository.Migrations, dir: "migrations", source: sqliterepository.MigrationSource},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			up := embeddedMigrations(t, tc.fsys, tc.dir)
+
+			src, err := tc.source()
+			require.NoError(t, err)
+
+			latest, err := latestVersion(src)
+			assert.NoError(t, err)
+			assert.Equal(t, up[len(up)-1].version, latest)
+
+			plan, err := planMigrations(src, 0, latest)
+			assert.NoError(t, err)
+			assert.Equal(t, up, plan)
+
+			plan, err = planMigrations(src, latest, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, reverseMigrations(up), plan)
+		})
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	src, err := sqlrepository.MigrationSource()
+	require.NoError(t, err)
+
+	up := embeddedMigrations(t, migrations.FS, ".")
+	latest := up[len(up)-1].version
+
+	plan, err := planMigrations(src, 0, up[1].version)
+	assert.NoError(t, err)
+	assert.Equal(t, up[:2], plan)
+
+	down, err := stepDown(src, latest, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, up[len(up)-3].version, down)
+
+	plan, err = planMigrations(src, latest, down)
+	assert.NoError(t, err)
+	assert.Equal(t, reverseMigrations(up)[:2], plan)
+}
+
+func TestCheckSchema(t *testing.T) {
+	src, err := sqliterepository.MigrationSource()
+	require.NoError(t, err)
+
+	up := embeddedMigrations(t, sqliterepository.Migrations, "migrations")
+	latest := up[len(up)-1].version
+
+	testCases := []struct {
+		name    string
+		version uint
+		dirty   bool
+		mode    string
+		wantErr bool
+	}{
+		{name: "up to date", version: latest, mode: repository.SchemaCheckFail},
+		{name: "not migrated", version: 0, mode: repository.SchemaCheckFail, wantErr: true},
+		{name: "dirty", version: latest, dirty: true, mode: repository.SchemaCheckFail, wantErr: true},
+		{name: "newer", version: latest + 1, mode: repository.SchemaCheckFail, wantErr: true},
+		{name: "warn", version: 0, mode: repository.SchemaCheckWarn},
+		{name: "off", version: 0, mode: repository.SchemaCheckOff},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkSchema(src, tc.version, tc.dirty, tc.mode)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, errSchemaMismatch)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// operatorCommands work on the data directly, without the server,
+// so that it can be fixed by hand during an incident.
+var operatorCommands = []string{"segment", "user", "import", "export", "history"}
+
+const operatorUsage = `segment create SLUG [-parent SLUG] | segment list | segment delete SLUG [-children reject|reparent] | segment describe SLUG
+user show USER | user add USER SLUG... [-active-from TIME] | user remove USER SLUG...
+import SLUG [FILE] [-format csv|ndjson]
+export [SLUG]
+history USER [-as-of TIME]
+every command takes -output table|json`
+
+// runOperatorCommand opens the configured backend and runs an operator command on it.
+func runOperatorCommand(config *Config, args []string, w io.Writer) error {
+	b, err := openBackend(config.Database)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	uc := usecase.NewAppUseCase(config.Membership, b.segmentRepository, b.webhookRepository, b.eventRepository)
+	return runOperator(uc, args, w)
+}
+
+// operator runs the operator commands through the use cases,
+// the same way as the HTTP handlers do.
+type operator struct {
+	uc         usecase.UseCase
+	out        *printer
+	activeFrom string
+	asOf       string
+	format     string
+	parent     string
+	children   string
+}
+
+func runOperator(uc usecase.UseCase, args []string, w io.Writer) error {
+	op := &operator{uc: uc, out: &printer{w: w}}
+
+	flagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flagSet.StringVar(&op.out.format, "output", outputTable, "output format: table or json")
+	flagSet.StringVar(&op.activeFrom, "active-from", "", "user add: RFC 3339 time the membership starts at")
+	flagSet.StringVar(&op.asOf, "as-of", "", "history: RFC 3339 time to show the segments of the user at")
+	flagSet.StringVar(&op.format, "format", usecase.FormatCSV, "import: csv or ndjson")
+	flagSet.StringVar(&op.parent, "parent", "", "segment create: slug of the parent segment")
+	flagSet.StringVar(&op.children, "children", entity.ChildrenPolicyReject, "segment delete: reject or reparent the child segments")
+
+	positional, err := parseArgs(flagSet, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if op.out.format != outputTable && op.out.format != outputJSON {
+		return fmt.Errorf("-output: must be %s or %s", outputTable, outputJSON)
+	}
+
+	cmd := args[0]
+	if (cmd == "segment" || cmd == "user") && len(positional) > 0 {
+		cmd, positional = cmd+" "+positional[0], positional[1:]
+	}
+
+	switch cmd {
+	case "segment create":
+		return op.withArgs(cmd, positional, 1, 1, op.segmentCreate)
+	case "segment list":
+		return op.withArgs(cmd, positional, 0, 0, op.segmentList)
+	case "segment delete":
+		return op.withArgs(cmd, positional, 1, 1, op.segmentDelete)
+	case "segment describe":
+		return op.withArgs(cmd, positional, 1, 1, op.segmentDescribe)
+	case "user show":
+		return op.withArgs(cmd, positional, 1, 1, op.userShow)
+	case "user add":
+		return op.withArgs(cmd, positional, 2, -1, op.userAdd)
+	case "user remove":
+		return op.withArgs(cmd, positional, 2, -1, op.userRemove)
+	case "import":
+		return op.withArgs(cmd, positional, 1, 2, op.importUsers)
+	case "export":
+		return op.withArgs(cmd, positional, 0, 1, op.export)
+	case "history":
+		return op.withArgs(cmd, positional, 1, 1, op.history)
+	default:
+		return fmt.Errorf("%w: %s\nusage:\n%s", errUnknownCommand, cmd, operatorUsage)
+	}
+}
+
+// withArgs checks the number of arguments, max -1 allows any number.
+func (op *operator) withArgs(cmd string, args []string, min, max int, fn func([]string) error) error {
+	if len(args) < min || max >= 0 && len(args) > max {
+		return fmt.Errorf("%w: %s: wrong number of arguments\nusage:\n%s", errUnknownCommand, cmd, operatorUsage)
+	}
+	return fn(args)
+}
+
+func (op *operator) segmentCreate(args []string) error {
+	seg := &entity.Segment{Slug: args[0], Parent: op.parent}
+	if err := op.uc.SegmentCreate(seg); err != nil {
+		return err
+	}
+	return op.printSegments([]*entity.Segment{seg})
+}
+
+func (op *operator) segmentList([]string) error {
+	segList, err := op.uc.SegmentFindAll()
+	if err != nil {
+		return err
+	}
+	return op.printSegments(segList)
+}
+
+func (op *operator) segmentDelete(args []string) error {
+	seg, err := op.uc.SegmentFindBySlug(args[0])
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", args[0], err)
+	}
+
+	if op.children != entity.ChildrenPolicyReject && op.children != entity.ChildrenPolicyReparent {
+		return fmt.Errorf("-children: must be %s or %s", entity.ChildrenPolicyReject, entity.ChildrenPolicyReparent)
+	}
+
+	if err := op.uc.SegmentDelete(seg, op.children); err != nil {
+		return err
+	}
+	return op.printSegments([]*entity.Segment{seg})
+}
+
+func (op *operator) segmentDescribe(args []string) error {
+	seg, err := op.uc.SegmentFindBySlug(args[0])
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", args[0], err)
+	}
+
+	members := 0
+	if err := op.uc.ExportSegmentMembers(seg, func(int) error {
+		members++
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	description := struct {
+		*entity.Segment
+		Members int `json:"members"`
+	}{seg, members}
+
+	return op.out.print(description, func(tw io.Writer) {
+		fmt.Fprintf(tw, "SEG_ID\t%d\n", seg.SegID)
+		fmt.Fprintf(tw, "SLUG\t%s\n", seg.Slug)
+		if seg.Parent != "" {
+			fmt.Fprintf(tw, "PARENT\t%s\n", seg.Parent)
+		}
+		fmt.Fprintf(tw, "MEMBERS\t%d\n", members)
+	})
+}
+
+func (op *operator) userShow(args []string) error {
+	userID, err := parseUserID(args[0])
+	if err != nil {
+		return err
+	}
+	return op.printUser(userID)
+}
+
+func (op *operator) userAdd(args []string) error {
+	userID, err := parseUserID(args[0])
+	if err != nil {
+		return err
+	}
+
+	var activeFrom *time.Time
+	if op.activeFrom != "" {
+		t, err := time.Parse(time.RFC3339, op.activeFrom)
+		if err != nil {
+			return fmt.Errorf("-active-from: %w", err)
+		}
+		activeFrom = &t
+	}
+
+	if _, err := op.uc.UpdateUserSegments(userID, args[1:], nil, activeFrom); err != nil {
+		return err
+	}
+	return op.printUser(userID)
+}
+
+func (op *operator) userRemove(args []string) error {
+	userID, err := parseUserID(args[0])
+	if err != nil {
+		return err
+	}
+
+	if _, err := op.uc.UpdateUserSegments(userID, nil, args[1:], nil); err != nil {
+		return err
+	}
+	return op.printUser(userID)
+}
+
+func (op *operator) importUsers(args []string) error {
+	seg, err := op.uc.SegmentFindBySlug(args[0])
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", args[0], err)
+	}
+
+	var r io.Reader = os.Stdin
+	if len(args) > 1 && args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	res, err := op.uc.ImportUsersToSegment(seg, r, op.format)
+	if err != nil {
+		return err
+	}
+
+	return op.out.print(res, func(tw io.Writer) {
+		fmt.Fprintln(tw, "SLUG\tACCEPTED\tDUPLICATE\tINVALID\tMALFORMED")
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", res.Slug, res.Accepted, res.Duplicate, res.Invalid, res.Malformed)
+	})
+}
+
+// export streams the rows as they are read: tab-separated lines,
+// or a JSON document per line.
+func (op *operator) export(args []string) error {
+	rows := op.out.stream()
+
+	if len(args) == 0 {
+		rows.header("USER_ID\tSLUG")
+		return op.uc.ExportMemberships(func(m *entity.Membership) error {
+			return rows.row(m, "%d\t%s\n", m.UserID, m.Slug)
+		})
+	}
+
+	seg, err := op.uc.SegmentFindBySlug(args[0])
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", args[0], err)
+	}
+
+	rows.header("USER_ID")
+	return op.uc.ExportSegmentMembers(seg, func(userID int) error {
+		return rows.row(map[string]int{"user_id": userID}, "%d\n", userID)
+	})
+}
+
+// history lists the membership events of the user, or with -as-of
+// the segments the user was in at that time.
+func (op *operator) history(args []string) error {
+	userID, err := parseUserID(args[0])
+	if err != nil {
+		return err
+	}
+
+	if op.asOf != "" {
+		asOf, err := time.Parse(time.RFC3339, op.asOf)
+		if err != nil {
+			return fmt.Errorf("-as-of: %w", err)
+		}
+
+		segList, err := op.uc.SegmentFindByUserAsOf(userID, asOf)
+		if err != nil && !errors.Is(err, repository.ErrRecordNotFound) {
+			return err
+		}
+		if segList == nil {
+			segList = make([]*entity.Segment, 0)
+		}
+		return op.printSegments(segList)
+	}
+
+	events := make([]*entity.Event, 0)
+	if _, err := op.uc.EventReplay(0, &entity.EventFilter{UserID: userID}, func(e *entity.Event) error {
+		events = append(events, e)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return op.out.print(events, func(tw io.Writer) {
+		fmt.Fprintln(tw, "SEQ\tEVENT\tSLUG\tEFFECTIVE_AT")
+		for _, e := range events {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", e.Seq, e.Type, e.Slug, e.EffectiveAt.Format(time.RFC3339))
+		}
+	})
+}
+
+// printUser shows the active and pending segments of the user.
+func (op *operator) printUser(userID int) error {
+	segList, err := op.uc.SegmentFindByUser(userID)
+	if err != nil && !errors.Is(err, repository.ErrRecordNotFound) {
+		return err
+	}
+	if segList == nil {
+		segList = make([]*entity.Segment, 0)
+	}
+
+	pendingList, err := op.uc.SegmentFindPendingByUser(userID)
+	if err != nil {
+		return err
+	}
+
+	user := struct {
+		UserID   int                         `json:"user_id"`
+		Segments []*entity.Segment           `json:"segments"`
+		Pending  []*entity.PendingMembership `json:"pending"`
+	}{userID, segList, pendingList}
+
+	return op.out.print(user, func(tw io.Writer) {
+		fmt.Fprintln(tw, "SEG_ID\tSLUG\tACTIVE_FROM")
+		for _, seg := range segList {
+			fmt.Fprintf(tw, "%d\t%s\tactive\n", seg.SegID, seg.Slug)
+		}
+		for _, p := range pendingList {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", p.SegID, p.Slug, p.ActiveFrom.Format(time.RFC3339))
+		}
+	})
+}
+
+func (op *operator) printSegments(segList []*entity.Segment) error {
+	return op.out.print(segList, func(tw io.Writer) {
+		fmt.Fprintln(tw, "SEG_ID\tSLUG")
+		for _, seg := range segList {
+			fmt.Fprintf(tw, "%d\t%s\n", seg.SegID, seg.Slug)
+		}
+	})
+}
+
+func parseUserID(raw string) (int, error) {
+	userID, err := strconv.Atoi(raw)
+	if err != nil || userID <= 0 {
+		return 0, fmt.Errorf("%w: %s", usecase.ErrInvalidUserID, raw)
+	}
+	return userID, nil
+}
+
+// printer writes command results as an aligned table or as indented JSON.
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+func (p *printer) print(v interface{}, table func(tw io.Writer)) error {
+	if p.format == outputJSON {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := newTabWriter(p.w)
+	table(tw)
+	return tw.Flush()
+}
+
+func (p *printer) stream() *rowWriter {
+	if p.format == outputJSON {
+		return &rowWriter{enc: json.NewEncoder(p.w)}
+	}
+	return &rowWriter{w: p.w}
+}
+
+// rowWriter writes rows one by one, as text lines or JSON lines.
+type rowWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func (rw *rowWriter) header(columns string) {
+	if rw.enc == nil {
+		fmt.Fprintln(rw.w, columns)
+	}
+}
+
+func (rw *rowWriter) row(v interface{}, format string, args ...interface{}) error {
+	if rw.enc != nil {
+		return rw.enc.Encode(v)
+	}
+	_, err := fmt.Fprintf(rw.w, format, args...)
+	return err
+}
+
+func newTabWriter(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOperatorRunner(t *testing.T) func(args ...string) (string, error) {
+	t.Helper()
+
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	return func(args ...string) (string, error) {
+		buf := &bytes.Buffer{}
+		err := runOperator(uc, args, buf)
+		return buf.String(), err
+	}
+}
+
+func TestRunOperator_Segments(t *testing.T) {
+	run := newOperatorRunner(t)
+
+	out, err := run("segment", "create", "AVITO_VOICE_MESSAGES")
+	assert.NoError(t, err)
+	assert.Equal(t, "SEG_ID  SLUG\n1       AVITO_VOICE_MESSAGES\n", out)
+
+	_, err = run("segment", "create", "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+
+	_, err = run("segment", "create", "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, repository.ErrRecordExists)
+
+	out, err = run("segment", "list", "-output", "json")
+	assert.NoError(t, err)
+
+	segList := make([]*entity.Segment, 0)
+	require.NoError(t, json.Unmarshal([]byte(out), &segList))
+	assert.Equal(t, []*entity.Segment{{SegID: 1, Slug: "AVITO_VOICE_MESSAGES"}, {SegID: 2, Slug: "AVITO_DISCOUNT_30"}}, segList)
+
+	_, err = run("user", "add", "1000", "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+
+	out, err = run("segment", "describe", "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Equal(t, "SEG_ID   2\nSLUG     AVITO_DISCOUNT_30\nMEMBERS  1\n", out)
+
+	_, err = run("segment", "create", "AVITO_DISCOUNT_30_PLUS", "-parent", "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+
+	out, err = run("segment", "describe", "AVITO_DISCOUNT_30_PLUS")
+	assert.NoError(t, err)
+	assert.Equal(t, "SEG_ID   3\nSLUG     AVITO_DISCOUNT_30_PLUS\nPARENT   AVITO_DISCOUNT_30\nMEMBERS  0\n", out)
+
+	_, err = run("segment", "delete", "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, repository.ErrHasChildren)
+
+	_, err = run("segment", "delete", "AVITO_DISCOUNT_30", "-children", "reparent")
+	assert.NoError(t, err)
+
+	_, err = run("segment", "describe", "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, repository.ErrRecordNotFound)
+}
+
+func TestRunOperator_Users(t *testing.T) {
+	run := newOperatorRunner(t)
+	for _, slug := range []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		_, err := run("segment", "create", slug)
+		require.NoError(t, err)
+	}
+
+	out, err := run("user", "add", "1000", "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "1       AVITO_VOICE_MESSAGES  active")
+
+	activeFrom := time.Now().Add(time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	out, err = run("user", "add", "1000", "AVITO_DISCOUNT_50", "-active-from", activeFrom)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "3       AVITO_DISCOUNT_50     "+activeFrom)
+
+	_, err = run("user", "remove", "1000", "AVITO_VOICE_MESSAGES")
+	assert.NoError(t, err)
+
+	out, err = run("user", "show", "1000", "-output", "json")
+	assert.NoError(t, err)
+
+	user := struct {
+		UserID   int                         `json:"user_id"`
+		Segments []*entity.Segment           `json:"segments"`
+		Pending  []*entity.PendingMembership `json:"pending"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(out), &user))
+	assert.Equal(t, 1000, user.UserID)
+	assert.Equal(t, []*entity.Segment{{SegID: 2, Slug: "AVITO_DISCOUNT_30"}}, user.Segments)
+	assert.Len(t, user.Pending, 1)
+
+	out, err = run("history", "1000")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Len(t, lines, 5)
+	assert.Contains(t, lines[4], "user.removed")
+
+	_, err = run("user", "add", "1000", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, usecase.ErrSlugConflict)
+
+	_, err = run("user", "add", "1000", "AVITO_UNKNOWN")
+	assert.ErrorIs(t, err, repository.ErrRecordNotFound)
+
+	_, err = run("user", "show", "alice")
+	assert.ErrorIs(t, err, usecase.ErrInvalidUserID)
+}
+
+func TestRunOperator_ImportExport(t *testing.T) {
+	run := newOperatorRunner(t)
+	_, err := run("segment", "create", "AVITO_DISCOUNT_30")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "users.csv")
+	require.NoError(t, os.WriteFile(path, []byte("user_id\n1000\n1002\n1000\nalice\n"), 0644))
+
+	out, err := run("import", "AVITO_DISCOUNT_30", path, "-output", "json")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"slug":"AVITO_DISCOUNT_30","accepted":2,"duplicate":1,"invalid":1,"malformed":0,"rejected":0}`, out)
+
+	out, err = run("export", "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Equal(t, "USER_ID\n1000\n1002\n", out)
+
+	out, err = run("export", "-output", "json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"user_id":1000,"seg_id":1,"slug":"AVITO_DISCOUNT_30"}`+"\n"+`{"user_id":1002,"seg_id":1,"slug":"AVITO_DISCOUNT_30"}`+"\n", out)
+}
+
+func TestRunOperator_Usage(t *testing.T) {
+	run := newOperatorRunner(t)
+
+	for _, args := range [][]string{
+		{"segment"},
+		{"segment", "rename", "AVITO_DISCOUNT_30"},
+		{"segment", "list", "AVITO_DISCOUNT_30"},
+		{"user", "add", "1000"},
+		{"history"},
+	} {
+		_, err := run(args...)
+		assert.ErrorIs(t, err, errUnknownCommand, args)
+	}
+
+	_, err := run("segment", "list", "-output", "yaml")
+	assert.Error(t, err)
+}
+
+func TestRunCommand_Operator(t *testing.T) {
+	c := NewConfig()
+	c.Database.DatabaseURL = "memory://" + t.TempDir()
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, runCommand(c, []string{"segment", "create", "AVITO_DISCOUNT_30"}, buf))
+
+	buf.Reset()
+	assert.NoError(t, runCommand(c, []string{"segment", "list"}, buf))
+	assert.Contains(t, buf.String(), "AVITO_DISCOUNT_30")
+}
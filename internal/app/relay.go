@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const relayBatchSize = 500
+
+type relayConfig struct {
+	Sink     string        `toml:"sink" env:"EVENT_SINK" secret:"true"`
+	Interval time.Duration `toml:"interval" env:"EVENT_RELAY_INTERVAL"`
+}
+
+func newRelayConfig() *relayConfig {
+	return &relayConfig{
+		Interval: time.Second,
+	}
+}
+
+// relay publishes the outbox events to a sink. The offset is saved only
+// after the sink takes a batch, so every event is published at least once.
+type relay struct {
+	repo repository.EventRepository
+	sink EventSink
+}
+
+func newRelay(r repository.EventRepository, sink EventSink) *relay {
+	return &relay{
+		repo: r,
+		sink: sink,
+	}
+}
+
+// run relays events every interval until ctx is done.
+func (r *relay) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.relayOnce(); err != nil {
+			logrus.Errorf("Relay: %s: %s", r.sink.Name(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayOnce sequences new events and publishes everything after the sink
+// offset. It returns the number of published events.
+func (r *relay) relayOnce() (int, error) {
+	for {
+		n, err := r.repo.SequenceEvents(relayBatchSize)
+		if err != nil {
+			return 0, err
+		}
+
+		if n < relayBatchSize {
+			break
+		}
+	}
+
+	offset, err := r.repo.FindOffset(r.sink.Name())
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for {
+		events, err := r.repo.FindAfter(offset, relayBatchSize)
+		if err != nil {
+			return published, err
+		}
+
+		if len(events) == 0 {
+			return published, nil
+		}
+
+		if err := r.sink.Publish(events); err != nil {
+			return published, err
+		}
+
+		offset = events[len(events)-1].Seq
+		if err := r.repo.SaveOffset(r.sink.Name(), offset); err != nil {
+			return published, err
+		}
+		published += len(events)
+
+		if len(events) < relayBatchSize {
+			return published, nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSink struct {
+	EventSink
+}
+
+func (s *failingSink) Publish([]*entity.Event) error {
+	return errors.New("sink is down")
+}
+
+func TestRelay_RelayOnce(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	er := testrepository.NewEventRepository(r)
+
+	buf := &bytes.Buffer{}
+	sink := &writerSink{name: "test", w: buf}
+	rl := newRelay(er, sink)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	r.AddUserToSegments(1, segList)
+
+	n, err := rl.relayOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	r.DeleteUserFromSegments(1, segList)
+	n, err = rl.relayOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	events := make([]*entity.Event, 0)
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		e := &entity.Event{}
+		assert.NoError(t, json.Unmarshal(sc.Bytes(), e))
+		events = append(events, e)
+	}
+
+	assert.Len(t, events, 3)
+	for i, e := range events {
+		assert.Equal(t, i+1, e.Seq)
+	}
+	assert.Equal(t, entity.EventUserRemoved, events[2].Type)
+}
+
+func TestRelay_RelayOnce_SinkError(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	er := testrepository.NewEventRepository(r)
+
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+
+	_, err := newRelay(er, &failingSink{&writerSink{name: "test"}}).relayOnce()
+	assert.Error(t, err)
+
+	offset, _ := er.FindOffset("test")
+	assert.Zero(t, offset)
+
+	buf := &bytes.Buffer{}
+	n, err := newRelay(er, &writerSink{name: "test", w: buf}).relayOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
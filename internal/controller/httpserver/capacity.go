@@ -0,0 +1,83 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+func (s *server) handleCapacitySet() http.HandlerFunc {
+	type request struct {
+		Slug       string `json:"slug"`
+		MaxMembers int    `json:"max_members"`
+		Overflow   string `json:"overflow"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		if err := decodeRequest(r, req, func() error {
+			return validation.ValidateStruct(
+				req,
+				validation.Field(&req.Slug, validation.Required),
+				validation.Field(&req.MaxMembers, validation.Required, validation.Min(1)),
+				validation.Field(&req.Overflow, validation.In(entity.OverflowPolicyReject, entity.OverflowPolicyWaitlist)),
+			)
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		c := &entity.Capacity{Slug: req.Slug, MaxMembers: req.MaxMembers, Overflow: req.Overflow}
+		if err := s.uc.CapacitySet(c); err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+
+		c, err := s.uc.CapacityFind(c.Slug)
+		if err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, c)
+	}
+}
+
+func (s *server) handleCapacityGet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.URL.Query().Get("slug")
+		if err := validation.Validate(slug, validation.Required); err != nil {
+			s.requestError(w, r, validation.Errors{"slug": err})
+			return
+		}
+
+		c, err := s.uc.CapacityFind(slug)
+		if err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, c)
+	}
+}
+
+func (s *server) handleCapacityDelete() http.HandlerFunc {
+	type request struct {
+		Slug string `json:"slug"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		if err := decodeRequest(r, req, func() error {
+			return validation.ValidateStruct(req, validation.Field(&req.Slug, validation.Required))
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		if err := s.uc.CapacityDelete(&entity.Capacity{Slug: req.Slug}); err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, map[string]string{"delete capacity": req.Slug})
+	}
+}
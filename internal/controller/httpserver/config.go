@@ -1,13 +1,15 @@
 package httpserver
 
 type Config struct {
-	BindAddr string `toml:"bind_addr"`
-	LogLevel string `toml:"log_level"`
+	BindAddr     string `toml:"bind_addr"`
+	LogLevel     string `toml:"log_level"`
+	MaxBatchSize int    `toml:"max_batch_size"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BindAddr: ":8080",
-		LogLevel: "debug",
+		BindAddr:     ":8080",
+		LogLevel:     "debug",
+		MaxBatchSize: 50000,
 	}
 }
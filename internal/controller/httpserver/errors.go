@@ -0,0 +1,14 @@
+package httpserver
+
+import "errors"
+
+var (
+	errEmptyBatch    = errors.New("batch is empty")
+	errBatchTooLarge = errors.New("batch exceeds max batch size")
+
+	errInvalidRequest = errors.New("invalid request")
+	errTrailingData   = errors.New("unexpected data after the request body")
+	errInvalidUserID  = errors.New("must be a positive integer")
+
+	errStreamingUnsupported = errors.New("streaming unsupported")
+)
@@ -0,0 +1,129 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+const (
+	// streamHeartbeat keeps idle connections open through proxies.
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout drops a client that does not read for this long.
+	streamWriteTimeout = 30 * time.Second
+)
+
+// handleEventsStream sends the outbox events as Server-Sent Events with the
+// event sequence number as the event ID. A client that reconnects with
+// Last-Event-ID gets the events it missed before the live ones.
+func (s *server) handleEventsStream() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := &entity.EventFilter{Slugs: r.URL.Query()["slug"]}
+		if v := r.URL.Query().Get("user_id"); v != "" {
+			userID, err := strconv.Atoi(v)
+			if err != nil {
+				s.error(w, r, http.StatusBadRequest, err)
+				return
+			}
+			filter.UserID = userID
+		}
+
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+
+		lastSeq := -1
+		if lastEventID != "" {
+			seq, err := strconv.Atoi(lastEventID)
+			if err != nil {
+				s.error(w, r, http.StatusBadRequest, err)
+				return
+			}
+			lastSeq = seq
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.error(w, r, http.StatusInternalServerError, errStreamingUnsupported)
+			return
+		}
+		rc := http.NewResponseController(w)
+
+		sub := s.uc.EventSubscribe(filter)
+		defer s.uc.EventUnsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		send := func(e *entity.Event) error {
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+			return err
+		}
+
+		catchUp := func() error {
+			seq, err := s.uc.EventReplay(lastSeq, filter, send)
+			lastSeq = seq
+			flusher.Flush()
+			return err
+		}
+
+		if lastSeq >= 0 {
+			if err := catchUp(); err != nil {
+				s.logger.Warnf("Events: stream replay: %s", err)
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+
+			case e := <-sub.Events:
+				if sub.Lagged() && lastSeq >= 0 {
+					if err := catchUp(); err != nil {
+						s.logger.Warnf("Events: stream catch-up: %s", err)
+						return
+					}
+					continue
+				}
+
+				if e.Seq <= lastSeq {
+					continue
+				}
+
+				if err := send(e); err != nil {
+					return
+				}
+				lastSeq = e.Seq
+				flusher.Flush()
+
+			case <-heartbeat.C:
+				rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
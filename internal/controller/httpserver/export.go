@@ -0,0 +1,153 @@
+package httpserver
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+)
+
+// exportFlushEvery is the number of rows written between flushes of the response.
+const exportFlushEvery = 1000
+
+// exportStatusTrailer is the trailer that tells a finished export from one
+// cut short: the status line is sent before the first row, so an error
+// that stops the export half way can not change it.
+const (
+	exportStatusTrailer  = "X-Export-Status"
+	exportStatusComplete = "complete"
+	exportStatusFailed   = "failed"
+)
+
+// exportWriter streams rows to the response in CSV or NDJSON
+// and flushes them to the client as it goes.
+type exportWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	json    *json.Encoder
+	columns []string
+	rows    int
+}
+
+func newExportWriter(w http.ResponseWriter, format string, columns ...string) (*exportWriter, error) {
+	ew := &exportWriter{
+		w:       w,
+		columns: columns,
+	}
+
+	switch format {
+	case usecase.FormatCSV:
+		ew.csv = csv.NewWriter(w)
+		w.Header().Set("Content-Type", "text/csv")
+	case usecase.FormatNDJSON:
+		ew.json = json.NewEncoder(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		return nil, usecase.ErrUnsupportedFormat
+	}
+
+	return ew, nil
+}
+
+// begin declares the status trailer and sends the status line and the CSV header row.
+func (ew *exportWriter) begin() error {
+	ew.w.Header().Set("Trailer", exportStatusTrailer)
+	ew.w.WriteHeader(http.StatusOK)
+	if ew.csv != nil {
+		return ew.csv.Write(ew.columns)
+	}
+	return nil
+}
+
+// writeRow writes one row, values must follow the column order.
+func (ew *exportWriter) writeRow(values ...interface{}) error {
+	if ew.csv != nil {
+		record := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case int:
+				record[i] = strconv.Itoa(v)
+			case string:
+				record[i] = v
+			}
+		}
+
+		if err := ew.csv.Write(record); err != nil {
+			return err
+		}
+	} else {
+		row := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			row[ew.columns[i]] = v
+		}
+
+		if err := ew.json.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	ew.rows++
+	if ew.rows%exportFlushEvery == 0 {
+		return ew.flush()
+	}
+	return nil
+}
+
+// end flushes the rows left and reports the export as complete.
+func (ew *exportWriter) end() error {
+	if err := ew.flush(); err != nil {
+		return err
+	}
+	ew.w.Header().Set(exportStatusTrailer, exportStatusComplete)
+	return nil
+}
+
+// fail reports the export as cut short by err. NDJSON also gets
+// a terminating {"error": "message"} line after the rows sent.
+func (ew *exportWriter) fail(err error) error {
+	if ew.json != nil {
+		if err := ew.json.Encode(map[string]string{"error": err.Error()}); err != nil {
+			return err
+		}
+	}
+
+	ew.w.Header().Set(exportStatusTrailer, exportStatusFailed)
+	return ew.flush()
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+		if err := ew.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := ew.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// responseFormat picks the export format from the format query param,
+// falling back to the Accept header and then to CSV.
+func responseFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		switch mediaType {
+		case "application/x-ndjson", "application/ndjson":
+			return usecase.FormatNDJSON
+		case "text/csv":
+			return usecase.FormatCSV
+		}
+	}
+	return usecase.FormatCSV
+}
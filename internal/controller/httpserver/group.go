@@ -0,0 +1,62 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/gorilla/mux"
+)
+
+func (s *server) handleGroupsCreate() http.HandlerFunc {
+	type request struct {
+		Name   string   `json:"name"`
+		Policy string   `json:"policy"`
+		Slugs  []string `json:"slugs"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		g := &entity.Group{}
+		if err := decodeRequest(r, req, func() error {
+			g.Name, g.Policy, g.Slugs = req.Name, req.Policy, req.Slugs
+			return g.Validate()
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		if err := s.uc.GroupCreate(g); err != nil {
+			if err == repository.ErrRecordNotFound {
+				s.error(w, r, http.StatusNotFound, err)
+				return
+			}
+			s.error(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		s.respond(w, r, http.StatusCreated, g)
+	}
+}
+
+func (s *server) handleGroupsList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := s.uc.GroupFindAll()
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, groups)
+	}
+}
+
+func (s *server) handleGroupsDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		if err := s.uc.GroupDelete(&entity.Group{Name: name}); err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, map[string]string{"delete group": name})
+	}
+}
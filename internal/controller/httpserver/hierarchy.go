@@ -0,0 +1,52 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+func (s *server) handleSegmentsSetParent() http.HandlerFunc {
+	type request struct {
+		Slug   string `json:"slug"`
+		Parent string `json:"parent"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		if err := decodeRequest(r, req, func() error {
+			return validation.ValidateStruct(req, validation.Field(&req.Slug, validation.Required))
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		seg := &entity.Segment{
+			Slug:   req.Slug,
+			Parent: req.Parent,
+		}
+
+		if err := s.uc.SegmentSetParent(seg); err != nil {
+			s.error(w, r, hierarchyErrorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, seg)
+	}
+}
+
+// hierarchyErrorCode maps the errors of a change to the segment hierarchy.
+func hierarchyErrorCode(err error) int {
+	switch err {
+	case repository.ErrSegmentCycle, repository.ErrHasChildren:
+		return http.StatusConflict
+	case repository.ErrRecordNotFound:
+		return http.StatusNotFound
+	}
+
+	if _, ok := err.(validation.Errors); ok {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
@@ -2,10 +2,17 @@ package httpserver
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+	validation "github.com/go-ozzo/ozzo-validation"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
@@ -37,6 +44,38 @@ func (s *server) configureRouter() {
 	s.router.HandleFunc("/seg", s.handleSegmentsDelete()).Methods(http.MethodDelete)
 	s.router.HandleFunc("/seg", s.handleSegmentsUpdateUser()).Methods(http.MethodPut)
 	s.router.HandleFunc("/seg", s.handleSegmentsGetByUser()).Methods(http.MethodGet)
+
+	s.router.HandleFunc("/seg/parent", s.handleSegmentsSetParent()).Methods(http.MethodPut)
+	s.router.HandleFunc("/seg/capacity", s.handleCapacitySet()).Methods(http.MethodPut)
+	s.router.HandleFunc("/seg/capacity", s.handleCapacityGet()).Methods(http.MethodGet)
+	s.router.HandleFunc("/seg/capacity", s.handleCapacityDelete()).Methods(http.MethodDelete)
+	s.router.HandleFunc("/seg/pending", s.handleSegmentsGetPendingByUser()).Methods(http.MethodGet)
+	s.router.HandleFunc("/seg/pending", s.handleSegmentsCancelPending()).Methods(http.MethodDelete)
+	s.router.HandleFunc("/seg/batch", s.handleSegmentsUpdateUsers()).Methods(http.MethodPut)
+	s.router.HandleFunc("/seg/import", s.handleSegmentsImport()).Methods(http.MethodPost)
+	s.router.HandleFunc("/seg/export", s.handleSegmentsExport()).Methods(http.MethodGet)
+	s.router.HandleFunc("/users/export", s.handleUsersExport()).Methods(http.MethodGet)
+
+	s.router.HandleFunc("/groups", s.handleGroupsCreate()).Methods(http.MethodPost)
+	s.router.HandleFunc("/groups", s.handleGroupsList()).Methods(http.MethodGet)
+	s.router.HandleFunc("/groups/{name}", s.handleGroupsDelete()).Methods(http.MethodDelete)
+
+	s.router.HandleFunc("/prerequisites", s.handlePrerequisitesCreate()).Methods(http.MethodPost)
+	s.router.HandleFunc("/prerequisites", s.handlePrerequisitesList()).Methods(http.MethodGet)
+	s.router.HandleFunc("/prerequisites/{slug}/{requires}", s.handlePrerequisitesDelete()).Methods(http.MethodDelete)
+
+	s.router.HandleFunc("/webhooks", s.handleWebhooksCreate()).Methods(http.MethodPost)
+	s.router.HandleFunc("/webhooks", s.handleWebhooksList()).Methods(http.MethodGet)
+	s.router.HandleFunc("/webhooks/{id:[0-9]+}", s.handleWebhooksDelete()).Methods(http.MethodDelete)
+	s.router.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", s.handleWebhooksDeliveries()).Methods(http.MethodGet)
+	s.router.HandleFunc("/webhooks/deliveries/{id:[0-9]+}/redeliver", s.handleWebhooksRedeliver()).Methods(http.MethodPost)
+
+	s.router.HandleFunc("/events/stream", s.handleEventsStream()).Methods(http.MethodGet)
+
+	s.router.HandleFunc("/openapi.json", s.handleOpenAPI()).Methods(http.MethodGet)
+	s.router.HandleFunc("/docs", s.handleDocs()).Methods(http.MethodGet)
+
+	s.router.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
 }
 
 func (s *server) configureLogger() error {
@@ -70,21 +109,29 @@ func (s *server) handleHello() http.HandlerFunc {
 
 func (s *server) handleSegmentsCreate() http.HandlerFunc {
 	type request struct {
-		Slug string `json:"slug"`
+		Slug   string `json:"slug"`
+		Parent string `json:"parent"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		req := &request{}
-		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
+		if err := decodeRequest(r, req, func() error {
+			return validation.ValidateStruct(req, validation.Field(&req.Slug, validation.Required))
+		}); err != nil {
+			s.requestError(w, r, err)
 			return
 		}
 
 		seg := &entity.Segment{
-			Slug: req.Slug,
+			Slug:   req.Slug,
+			Parent: req.Parent,
 		}
 
 		if err := s.uc.SegmentCreate(seg); err != nil {
+			if err == repository.ErrRecordNotFound {
+				s.error(w, r, http.StatusNotFound, err)
+				return
+			}
 			s.error(w, r, http.StatusUnprocessableEntity, err)
 			return
 		}
@@ -94,13 +141,20 @@ func (s *server) handleSegmentsCreate() http.HandlerFunc {
 
 func (s *server) handleSegmentsDelete() http.HandlerFunc {
 	type request struct {
-		Slug string `json:"slug"`
+		Slug     string `json:"slug"`
+		Children string `json:"children"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		req := &request{}
-		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
+		if err := decodeRequest(r, req, func() error {
+			return validation.ValidateStruct(
+				req,
+				validation.Field(&req.Slug, validation.Required),
+				validation.Field(&req.Children, validation.In(entity.ChildrenPolicyReject, entity.ChildrenPolicyReparent)),
+			)
+		}); err != nil {
+			s.requestError(w, r, err)
 			return
 		}
 
@@ -110,8 +164,9 @@ func (s *server) handleSegmentsDelete() http.HandlerFunc {
 			return
 		}
 
-		if err := s.uc.SegmentDelete(seg); err != nil {
-			s.error(w, r, http.StatusInternalServerError, err)
+		if err := s.uc.SegmentDelete(seg, req.Children); err != nil {
+			s.error(w, r, hierarchyErrorCode(err), err)
+			return
 		}
 		s.respond(w, r, http.StatusOK, map[string]string{"delete segment": seg.Slug})
 	}
@@ -119,77 +174,362 @@ func (s *server) handleSegmentsDelete() http.HandlerFunc {
 
 func (s *server) handleSegmentsUpdateUser() http.HandlerFunc {
 	type request struct {
-		SlugListAdd []string `json:"slug_list_add"`
-		SlugListDel []string `json:"slug_list_del"`
-		UserID      int      `json:"user_id"`
+		SlugListAdd []string   `json:"slug_list_add"`
+		SlugListDel []string   `json:"slug_list_del"`
+		UserID      int        `json:"user_id"`
+		ActiveFrom  *time.Time `json:"active_from"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		req := &request{}
-		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
+		if err := decodeRequest(r, req, func() error {
+			addRules := []validation.Rule{validation.Each(entity.SlugRule)}
+			if len(req.SlugListDel) == 0 {
+				addRules = append(addRules, validation.Required.Error("slug_list_add or slug_list_del must not be empty"))
+			}
+
+			return validation.ValidateStruct(
+				req,
+				validation.Field(&req.UserID, validation.Required, validation.Min(1)),
+				validation.Field(&req.SlugListAdd, addRules...),
+				validation.Field(&req.SlugListDel, validation.Each(entity.SlugRule)),
+			)
+		}); err != nil {
+			s.requestError(w, r, err)
 			return
 		}
 
-		segListAdd := make([]*entity.Segment, 0)
-		segListDel := make([]*entity.Segment, 0)
-
-		for _, slug := range req.SlugListAdd {
-			seg, err := s.uc.SegmentFindBySlug(slug)
-			if err != nil {
+		change, err := s.uc.UpdateUserSegments(req.UserID, req.SlugListAdd, req.SlugListDel, req.ActiveFrom)
+		if err != nil {
+			switch {
+			case errors.Is(err, repository.ErrRecordNotFound):
 				s.error(w, r, http.StatusNotFound, err)
-				return
+			case isMembershipConflict(err):
+				s.conflictError(w, r, err)
+			default:
+				s.error(w, r, http.StatusInternalServerError, err)
 			}
-			segListAdd = append(segListAdd, seg)
+			return
 		}
 
-		for _, slug := range req.SlugListDel {
+		res := map[string]interface{}{
+			"add segments":    segmentSlugs(change.SegListAdd),
+			"delete segments": segmentSlugs(change.SegListDel),
+			"user_id":         req.UserID}
+		if req.ActiveFrom != nil {
+			res["active_from"] = req.ActiveFrom
+		}
+		s.respond(w, r, http.StatusOK, res)
+	}
+}
+
+func (s *server) handleSegmentsGetPendingByUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil || userID < 1 {
+			s.requestError(w, r, validation.Errors{"user_id": errInvalidUserID})
+			return
+		}
+
+		pendingList, err := s.uc.SegmentFindPendingByUser(userID)
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, pendingList)
+	}
+}
+
+func (s *server) handleSegmentsCancelPending() http.HandlerFunc {
+	type request struct {
+		SlugList []string `json:"slug_list"`
+		UserID   int      `json:"user_id"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		if err := decodeRequest(r, req, func() error {
+			return validation.ValidateStruct(
+				req,
+				validation.Field(&req.UserID, validation.Required, validation.Min(1)),
+				validation.Field(&req.SlugList, validation.Required, validation.Each(entity.SlugRule)),
+			)
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		segList := make([]*entity.Segment, 0)
+		for _, slug := range req.SlugList {
 			seg, err := s.uc.SegmentFindBySlug(slug)
 			if err != nil {
 				s.error(w, r, http.StatusNotFound, err)
 				return
 			}
-			segListDel = append(segListDel, seg)
+			segList = append(segList, seg)
 		}
 
-		if err := s.uc.DeleteUserFromSegments(req.UserID, segListDel); err != nil {
+		if err := s.uc.CancelPendingUserSegments(req.UserID, segList); err != nil {
 			s.error(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		if err := s.uc.AddUserToSegments(req.UserID, segListAdd); err != nil {
-			s.error(w, r, http.StatusInternalServerError, err)
+		s.respond(w, r, http.StatusOK, map[string]interface{}{
+			"cancel segments": req.SlugList,
+			"user_id":         req.UserID})
+	}
+}
+
+func (s *server) handleSegmentsUpdateUsers() http.HandlerFunc {
+	type request struct {
+		Items       []*entity.BatchItem `json:"items"`
+		UserIDs     []int               `json:"user_ids"`
+		SlugListAdd []string            `json:"add"`
+		SlugListDel []string            `json:"remove"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		if err := decodeRequest(r, req, func() error {
+			sharedRules := []validation.Rule{validation.Each(entity.SlugRule)}
+			if len(req.UserIDs) > 0 && len(req.SlugListDel) == 0 {
+				sharedRules = append(sharedRules, validation.Required.Error("add or remove must not be empty"))
+			}
+
+			return validation.ValidateStruct(
+				req,
+				validation.Field(&req.Items),
+				validation.Field(&req.UserIDs, validation.Each(validation.Required, validation.Min(1))),
+				validation.Field(&req.SlugListAdd, sharedRules...),
+				validation.Field(&req.SlugListDel, validation.Each(entity.SlugRule)),
+			)
+		}); err != nil {
+			s.requestError(w, r, err)
 			return
 		}
 
-		s.respond(w, r, http.StatusOK, map[string]interface{}{
-			"add segments":    req.SlugListAdd,
-			"delete segments": req.SlugListDel,
-			"user_id":         req.UserID})
+		items := req.Items
+		for _, userID := range req.UserIDs {
+			items = append(items, &entity.BatchItem{
+				UserID:      userID,
+				SlugListAdd: req.SlugListAdd,
+				SlugListDel: req.SlugListDel,
+			})
+		}
+
+		if len(items) == 0 {
+			s.error(w, r, http.StatusBadRequest, errEmptyBatch)
+			return
+		}
+
+		if len(items) > s.config.MaxBatchSize {
+			s.error(w, r, http.StatusRequestEntityTooLarge, errBatchTooLarge)
+			return
+		}
+
+		s.respond(w, r, http.StatusOK, s.uc.ApplyMembershipBatch(items))
 	}
 }
 
 func (s *server) handleSegmentsGetByUser() http.HandlerFunc {
 	type request struct {
-		UserID int `json:"user_id"`
+		UserID int        `json:"user_id"`
+		AsOf   *time.Time `json:"as_of"`
+		Expand bool       `json:"expand"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		req := &request{}
-		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
+		if err := decodeRequest(r, req, func() error {
+			expandRules := []validation.Rule{}
+			if req.AsOf != nil {
+				expandRules = append(expandRules, validation.In(false).Error("can not be combined with as_of"))
+			}
+
+			return validation.ValidateStruct(
+				req,
+				validation.Field(&req.UserID, validation.Required, validation.Min(1)),
+				validation.Field(&req.Expand, expandRules...),
+			)
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		if req.Expand {
+			segList, err := s.uc.SegmentFindByUserExpanded(req.UserID)
+			if err != nil {
+				s.error(w, r, errorCode(err), err)
+				return
+			}
+			s.respond(w, r, http.StatusOK, segList)
 			return
 		}
 
-		segList, err := s.uc.SegmentFindByUser(req.UserID)
+		var (
+			segList []*entity.Segment
+			err     error
+		)
+
+		if req.AsOf != nil {
+			segList, err = s.uc.SegmentFindByUserAsOf(req.UserID, *req.AsOf)
+		} else {
+			segList, err = s.uc.SegmentFindByUser(req.UserID)
+		}
 		if err != nil {
-			s.error(w, r, http.StatusNotFound, err)
+			s.error(w, r, errorCode(err), err)
 			return
 		}
 		s.respond(w, r, http.StatusOK, segList)
 	}
 }
 
+func (s *server) handleSegmentsImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seg, err := s.uc.SegmentFindBySlug(r.URL.Query().Get("slug"))
+		if err != nil {
+			s.error(w, r, http.StatusNotFound, err)
+			return
+		}
+
+		res, err := s.uc.ImportUsersToSegment(seg, r.Body, requestFormat(r))
+		if err != nil {
+			if err == usecase.ErrUnsupportedFormat {
+				s.error(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, res)
+	}
+}
+
+func (s *server) handleSegmentsExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seg, err := s.uc.SegmentFindBySlug(r.URL.Query().Get("slug"))
+		if err != nil {
+			s.error(w, r, http.StatusNotFound, err)
+			return
+		}
+
+		ew, err := newExportWriter(w, responseFormat(r), "user_id")
+		if err != nil {
+			s.error(w, r, http.StatusNotAcceptable, err)
+			return
+		}
+
+		if err := ew.begin(); err != nil {
+			s.logger.Error(err)
+			return
+		}
+
+		if err := s.uc.ExportSegmentMembers(seg, func(userID int) error {
+			return ew.writeRow(userID)
+		}); err != nil {
+			s.logger.Errorf("export of segment %s aborted: %s", seg.Slug, err)
+			if err := ew.fail(err); err != nil {
+				s.logger.Error(err)
+			}
+			return
+		}
+
+		if err := ew.end(); err != nil {
+			s.logger.Error(err)
+		}
+	}
+}
+
+func (s *server) handleUsersExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ew, err := newExportWriter(w, responseFormat(r), "user_id", "slug")
+		if err != nil {
+			s.error(w, r, http.StatusNotAcceptable, err)
+			return
+		}
+
+		if err := ew.begin(); err != nil {
+			s.logger.Error(err)
+			return
+		}
+
+		if err := s.uc.ExportMemberships(func(m *entity.Membership) error {
+			return ew.writeRow(m.UserID, m.Slug)
+		}); err != nil {
+			s.logger.Errorf("export of memberships aborted: %s", err)
+			if err := ew.fail(err); err != nil {
+				s.logger.Error(err)
+			}
+			return
+		}
+
+		if err := ew.end(); err != nil {
+			s.logger.Error(err)
+		}
+	}
+}
+
+// requestFormat picks the body format from the format query param,
+// falling back to the Content-Type header and then to CSV.
+func requestFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson":
+		return usecase.FormatNDJSON
+	default:
+		return usecase.FormatCSV
+	}
+}
+
+// conflictError responds 409 listing the conflicting slugs.
+func (s *server) conflictError(w http.ResponseWriter, r *http.Request, err error) {
+	var slugs []string
+
+	var conflictErr *usecase.SlugConflictError
+	var groupErr *repository.GroupConflictError
+	var prereqErr *repository.PrerequisiteError
+	var capErr *repository.CapacityError
+	switch {
+	case errors.As(err, &conflictErr):
+		slugs = conflictErr.Slugs
+	case errors.As(err, &groupErr):
+		slugs = groupErr.Slugs
+	case errors.As(err, &prereqErr):
+		slugs = prereqErr.Missing
+	case errors.As(err, &capErr):
+		slugs = []string{capErr.Slug}
+	default:
+		s.error(w, r, http.StatusConflict, err)
+		return
+	}
+
+	s.respond(w, r, http.StatusConflict, map[string]interface{}{
+		"error":     err.Error(),
+		"conflicts": slugs,
+	})
+}
+
+func segmentSlugs(segList []*entity.Segment) []string {
+	slugs := make([]string, 0, len(segList))
+	for _, seg := range segList {
+		slugs = append(slugs, seg.Slug)
+	}
+	return slugs
+}
+
+// isMembershipConflict reports whether a membership change was rejected for
+// a repeated slug, by an exclusion group, a missing prerequisite or a full segment.
+func isMembershipConflict(err error) bool {
+	return errors.Is(err, usecase.ErrSlugConflict) ||
+		errors.Is(err, repository.ErrGroupConflict) ||
+		errors.Is(err, repository.ErrPrerequisiteMissing) ||
+		errors.Is(err, repository.ErrSegmentFull)
+}
+
 func (s *server) error(w http.ResponseWriter, r *http.Request, code int, err error) {
 	s.respond(w, r, code, map[string]string{"error": err.Error()})
 }
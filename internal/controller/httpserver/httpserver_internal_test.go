@@ -1,21 +1,29 @@
 package httpserver
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestServer_HandleHello(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	s := NewServer(NewConfig(), uc)
 
 	rec := httptest.NewRecorder()
@@ -28,7 +36,7 @@ func TestServer_HandleHello(t *testing.T) {
 
 func TestServer_HandleSegmentsCreate(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	s := NewServer(NewConfig(), uc)
 
 	testCases := []struct {
@@ -72,7 +80,7 @@ func TestServer_HandleSegmentsCreate(t *testing.T) {
 
 func TestServer_HandleSegmentsDelete(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	s := NewServer(NewConfig(), uc)
 
 	userID := 1
@@ -128,7 +136,7 @@ func TestServer_HandleSegmentsUpdateUser(t *testing.T) {
 	}
 
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	s := NewServer(NewConfig(), uc)
 
 	userID := 1
@@ -219,6 +227,19 @@ func TestServer_HandleSegmentsUpdateUser(t *testing.T) {
 			},
 			expectedCode: http.StatusNotFound,
 		},
+		{
+			name: "slug added and deleted",
+			payload: &request{
+				SlugListAdd: []string{
+					"AVITO_DISCOUNT_30",
+				},
+				SlugListDel: []string{
+					"AVITO_DISCOUNT_30",
+				},
+				UserID: userID,
+			},
+			expectedCode: http.StatusConflict,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -236,7 +257,7 @@ func TestServer_HandleSegmentsUpdateUser(t *testing.T) {
 
 func TestServer_HandleSegmentsGetByUser(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	s := NewServer(NewConfig(), uc)
 
 	userID := 1
@@ -269,6 +290,22 @@ func TestServer_HandleSegmentsGetByUser(t *testing.T) {
 			},
 			expectedCode: http.StatusNotFound,
 		},
+		{
+			name: "as of now",
+			payload: map[string]interface{}{
+				"user_id": 1,
+				"as_of":   time.Now(),
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "as of before add",
+			payload: map[string]interface{}{
+				"user_id": 1,
+				"as_of":   time.Now().Add(-time.Hour),
+			},
+			expectedCode: http.StatusNotFound,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -283,3 +320,1082 @@ func TestServer_HandleSegmentsGetByUser(t *testing.T) {
 		})
 	}
 }
+
+// failingHistoryRepository fails the lookups of user segments.
+type failingHistoryRepository struct {
+	repository.SegmentRepository
+}
+
+func (r *failingHistoryRepository) FindByUser(int) ([]*entity.Segment, error) {
+	return nil, errLookupFailed
+}
+
+func (r *failingHistoryRepository) FindByUserAsOf(int, time.Time) ([]*entity.Segment, error) {
+	return nil, errLookupFailed
+}
+
+var errLookupFailed = errors.New("connection reset")
+
+func TestServer_HandleSegmentsGetByUserFailure(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), &failingHistoryRepository{r}, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	for _, body := range []string{
+		`{"user_id": 1}`,
+		`{"user_id": 1, "as_of": "2023-08-30T12:00:00Z"}`,
+		`{"user_id": 1, "expand": true}`,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/seg", strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusInternalServerError, rec.Code, body)
+	}
+}
+
+func TestServer_HandleSegmentsImport(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	s.uc.SegmentCreate(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+
+	testCases := []struct {
+		name         string
+		target       string
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "csv",
+			target:       "/seg/import?slug=AVITO_DISCOUNT_30",
+			contentType:  "text/csv",
+			body:         "1\n2\n",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "ndjson by content type",
+			target:       "/seg/import?slug=AVITO_DISCOUNT_30",
+			contentType:  "application/x-ndjson",
+			body:         "{\"user_id\": 3}\n",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "unsupported format",
+			target:       "/seg/import?slug=AVITO_DISCOUNT_30&format=xml",
+			body:         "1\n",
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:         "seg not found",
+			target:       "/seg/import?slug=AVITO_DISCOUNT_50",
+			body:         "1\n",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, tc.target, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_HandleSegmentsExport(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	s.uc.SegmentCreate(segList[0])
+	s.uc.AddUserToSegments(1, segList)
+	s.uc.AddUserToSegments(2, segList)
+
+	testCases := []struct {
+		name         string
+		target       string
+		accept       string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "csv",
+			target:       "/seg/export?slug=AVITO_DISCOUNT_30",
+			expectedCode: http.StatusOK,
+			expectedBody: "user_id\n1\n2\n",
+		},
+		{
+			name:         "ndjson by accept",
+			target:       "/seg/export?slug=AVITO_DISCOUNT_30",
+			accept:       "application/x-ndjson",
+			expectedCode: http.StatusOK,
+			expectedBody: "{\"user_id\":1}\n{\"user_id\":2}\n",
+		},
+		{
+			name:         "unsupported format",
+			target:       "/seg/export?slug=AVITO_DISCOUNT_30&format=xml",
+			expectedCode: http.StatusNotAcceptable,
+		},
+		{
+			name:         "seg not found",
+			target:       "/seg/export?slug=AVITO_DISCOUNT_50",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tc.target, nil)
+			req.Header.Set("Accept", tc.accept)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_HandleUsersExport(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	s.uc.SegmentCreate(segList[0])
+	s.uc.AddUserToSegments(1, segList)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/users/export?format=ndjson", nil)
+
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "{\"slug\":\"AVITO_DISCOUNT_30\",\"user_id\":1}\n", rec.Body.String())
+	assert.Equal(t, exportStatusComplete, rec.Result().Trailer.Get(exportStatusTrailer))
+}
+
+// failingExportRepository fails the exports after the first row.
+type failingExportRepository struct {
+	repository.SegmentRepository
+}
+
+func (r *failingExportRepository) ExportSegmentMembers(seg *entity.Segment, fn func(int) error) error {
+	return r.SegmentRepository.ExportSegmentMembers(seg, func(userID int) error {
+		if err := fn(userID); err != nil {
+			return err
+		}
+		return errExportFailed
+	})
+}
+
+func (r *failingExportRepository) ExportMemberships(fn func(*entity.Membership) error) error {
+	return r.SegmentRepository.ExportMemberships(func(m *entity.Membership) error {
+		if err := fn(m); err != nil {
+			return err
+		}
+		return errExportFailed
+	})
+}
+
+var errExportFailed = errors.New("connection reset")
+
+func TestServer_HandleExportFailure(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), &failingExportRepository{r}, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	s.uc.SegmentCreate(segList[0])
+	s.uc.AddUserToSegments(1, segList)
+	s.uc.AddUserToSegments(2, segList)
+
+	testCases := []struct {
+		name         string
+		target       string
+		expectedBody string
+	}{
+		{
+			name:         "csv",
+			target:       "/seg/export?slug=AVITO_DISCOUNT_30",
+			expectedBody: "user_id\n1\n",
+		},
+		{
+			name:         "ndjson",
+			target:       "/seg/export?slug=AVITO_DISCOUNT_30&format=ndjson",
+			expectedBody: "{\"user_id\":1}\n{\"error\":\"connection reset\"}\n",
+		},
+		{
+			name:         "memberships",
+			target:       "/users/export?format=ndjson",
+			expectedBody: "{\"slug\":\"AVITO_DISCOUNT_30\",\"user_id\":1}\n{\"error\":\"connection reset\"}\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tc.target, nil)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tc.expectedBody, rec.Body.String())
+			assert.Equal(t, exportStatusFailed, rec.Result().Trailer.Get(exportStatusTrailer))
+		})
+	}
+}
+
+func TestServer_HandleSegmentsUpdateUsers(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	config := NewConfig()
+	config.MaxBatchSize = 3
+	s := NewServer(config, uc)
+
+	s.uc.SegmentCreate(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+
+	testCases := []struct {
+		name         string
+		payload      interface{}
+		expectedCode int
+	}{
+		{
+			name: "items",
+			payload: map[string]interface{}{
+				"items": []map[string]interface{}{
+					{"user_id": 1, "add": []string{"AVITO_DISCOUNT_30"}},
+					{"user_id": 2, "add": []string{"NOT_FOUND"}},
+				},
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "users to segment",
+			payload: map[string]interface{}{
+				"user_ids": []int{1, 2, 3},
+				"add":      []string{"AVITO_DISCOUNT_30"},
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "invalid payload",
+			payload:      "",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "empty batch",
+			payload:      map[string]interface{}{},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "batch too large",
+			payload: map[string]interface{}{
+				"user_ids": []int{1, 2, 3, 4},
+				"add":      []string{"AVITO_DISCOUNT_30"},
+			},
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			b := &bytes.Buffer{}
+			json.NewEncoder(b).Encode(tc.payload)
+			req, _ := http.NewRequest(http.MethodPut, "/seg/batch", b)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_HandleSegmentsGetPendingByUser(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	s.uc.SegmentCreate(segList[0])
+	s.uc.ScheduleUserToSegments(1, segList, time.Now().Add(time.Hour))
+
+	testCases := []struct {
+		name         string
+		target       string
+		expectedCode int
+	}{
+		{
+			name:         "valid",
+			target:       "/seg/pending?user_id=1",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "invalid user_id",
+			target:       "/seg/pending?user_id=abc",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tc.target, nil)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_HandleSegmentsCancelPending(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	s.uc.SegmentCreate(segList[0])
+	s.uc.ScheduleUserToSegments(1, segList, time.Now().Add(time.Hour))
+
+	testCases := []struct {
+		name         string
+		payload      interface{}
+		expectedCode int
+	}{
+		{
+			name: "valid",
+			payload: map[string]interface{}{
+				"slug_list": []string{"AVITO_DISCOUNT_30"},
+				"user_id":   1,
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "invalid payload",
+			payload:      "",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "seg not found",
+			payload: map[string]interface{}{
+				"slug_list": []string{"NOT_FOUND"},
+				"user_id":   1,
+			},
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			b := &bytes.Buffer{}
+			json.NewEncoder(b).Encode(tc.payload)
+			req, _ := http.NewRequest(http.MethodDelete, "/seg/pending", b)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_HandleWebhooksCreate(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	testCases := []struct {
+		name         string
+		payload      interface{}
+		expectedCode int
+	}{
+		{
+			name: "valid",
+			payload: map[string]interface{}{
+				"url":         "https://pricing.example.com/hooks",
+				"secret":      "0123456789abcdef",
+				"event_types": []string{"user.added"},
+			},
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "invalid payload",
+			payload:      "",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "invalid params",
+			payload: map[string]interface{}{
+				"url":    "pricing",
+				"secret": "qwerty",
+			},
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			b := &bytes.Buffer{}
+			json.NewEncoder(b).Encode(tc.payload)
+			req, _ := http.NewRequest(http.MethodPost, "/webhooks", b)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_HandleWebhooksDelete(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	s.uc.WebhookCreate(&entity.Webhook{URL: "https://pricing.example.com/hooks", Secret: "0123456789abcdef"})
+
+	testCases := []struct {
+		name         string
+		target       string
+		expectedCode int
+	}{
+		{
+			name:         "valid",
+			target:       "/webhooks/1",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "webhook not found",
+			target:       "/webhooks/1",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodDelete, tc.target, nil)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_HandleWebhooksRedeliver(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/webhooks/deliveries/1/redeliver", nil)
+
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServer_HandleEventsStream(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	s.uc.SegmentCreate(segList[0])
+	s.uc.AddUserToSegments(1, segList)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notify := make(chan struct{})
+	go s.uc.RunEventBroker(ctx, notify)
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events/stream?user_id=1", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	sc := bufio.NewScanner(resp.Body)
+	readEvent := func() []string {
+		lines := make([]string, 0)
+		for sc.Scan() && sc.Text() != "" {
+			lines = append(lines, sc.Text())
+		}
+		return lines
+	}
+
+	assert.Equal(t, []string{"id: 2", "event: user.added"}, readEvent()[:2])
+
+	s.uc.DeleteUserFromSegments(1, segList)
+	notify <- struct{}{}
+	assert.Equal(t, []string{"id: 3", "event: user.removed"}, readEvent()[:2])
+}
+
+func TestServer_HandleEventsStream_BadRequest(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	testCases := []struct {
+		name   string
+		target string
+	}{
+		{
+			name:   "invalid user_id",
+			target: "/events/stream?user_id=abc",
+		},
+		{
+			name:   "invalid last_event_id",
+			target: "/events/stream?last_event_id=abc",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tc.target, nil)
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
+
+func TestServer_OpenAPICoversRoutes(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/openapi.json", nil)
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	spec := struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// /webhooks/{id:[0-9]+} is /webhooks/{id} in the spec
+	pattern := regexp.MustCompile(`\{(\w+):[^}]+\}`)
+	routes := make(map[string]bool)
+
+	err := s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+
+		path := pattern.ReplaceAllString(tpl, "{$1}")
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			routes[method+" "+path] = true
+			assert.Contains(t, spec.Paths[path], method, "%s %s is not in openapi.json", method, path)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			assert.True(t, routes[method+" "+path], "%s %s is in openapi.json but not routed", method, path)
+		}
+	}
+}
+
+func TestServer_HandleDocs(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/docs", nil)
+
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "/openapi.json")
+}
+
+func TestServer_RequestValidation(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	s.uc.SegmentCreate(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+
+	testCases := []struct {
+		name           string
+		method         string
+		target         string
+		body           string
+		expectedFields []*fieldError
+	}{
+		{
+			name:           "unknown field",
+			method:         http.MethodPost,
+			target:         "/seg",
+			body:           `{"slug": "AVITO_DISCOUNT_50", "name": "discount"}`,
+			expectedFields: []*fieldError{{Field: "name", Error: "unknown field"}},
+		},
+		{
+			name:   "trailing data",
+			method: http.MethodPost,
+			target: "/seg",
+			body:   `{"slug": "AVITO_DISCOUNT_50"} {"slug": "AVITO_DISCOUNT_70"}`,
+		},
+		{
+			name:           "wrong type",
+			method:         http.MethodPut,
+			target:         "/seg",
+			body:           `{"user_id": "1000", "slug_list_add": ["AVITO_DISCOUNT_30"]}`,
+			expectedFields: []*fieldError{{Field: "user_id", Error: "must be a number"}},
+		},
+		{
+			name:   "zero user_id and empty slug lists",
+			method: http.MethodPut,
+			target: "/seg",
+			body:   `{"user_id": 0, "slug_list_add": []}`,
+			expectedFields: []*fieldError{
+				{Field: "slug_list_add", Error: "slug_list_add or slug_list_del must not be empty"},
+				{Field: "user_id", Error: "cannot be blank"},
+			},
+		},
+		{
+			name:   "malformed slugs",
+			method: http.MethodPut,
+			target: "/seg",
+			body:   `{"user_id": -1, "slug_list_add": ["AVITO_DISCOUNT_30", "?#@", ""]}`,
+			expectedFields: []*fieldError{
+				{Field: "slug_list_add[1]", Error: `"?#@" must be in a valid format`},
+				{Field: "slug_list_add[2]", Error: `"" cannot be blank`},
+				{Field: "user_id", Error: "must be no less than 1"},
+			},
+		},
+		{
+			name:           "empty cancel list",
+			method:         http.MethodDelete,
+			target:         "/seg/pending",
+			body:           `{"user_id": 1000}`,
+			expectedFields: []*fieldError{{Field: "slug_list", Error: "cannot be blank"}},
+		},
+		{
+			name:           "pending of negative user_id",
+			method:         http.MethodGet,
+			target:         "/seg/pending?user_id=-1",
+			expectedFields: []*fieldError{{Field: "user_id", Error: "must be a positive integer"}},
+		},
+		{
+			name:   "batch items",
+			method: http.MethodPut,
+			target: "/seg/batch",
+			body:   `{"items": [{"user_id": 1000, "add": ["AVITO_DISCOUNT_30"]}, {"user_id": 1001, "add": ["AVITO DISCOUNT"]}, {"user_id": 0, "remove": ["AVITO_DISCOUNT_30"]}]}`,
+			expectedFields: []*fieldError{
+				{Field: "items[1].add[0]", Error: `"AVITO DISCOUNT" must be in a valid format`},
+				{Field: "items[2].user_id", Error: "cannot be blank"},
+			},
+		},
+		{
+			name:   "batch user_ids",
+			method: http.MethodPut,
+			target: "/seg/batch",
+			body:   `{"user_ids": [1000, -5]}`,
+			expectedFields: []*fieldError{
+				{Field: "add", Error: "add or remove must not be empty"},
+				{Field: "user_ids[1]", Error: "must be no less than 1"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+			resp := struct {
+				Error  string        `json:"error"`
+				Fields []*fieldError `json:"fields"`
+			}{}
+			assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.NotEmpty(t, resp.Error)
+			assert.Equal(t, tc.expectedFields, resp.Fields)
+		})
+	}
+}
+
+func TestServer_HandleSegmentsUpdateUser_Conflicts(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	config := usecase.NewConfig()
+	s := NewServer(NewConfig(), usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r)))
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		s.uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+
+	update := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPut, "/seg", strings.NewReader(`{
+			"user_id": 1,
+			"slug_list_add": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"],
+			"slug_list_del": ["AVITO_DISCOUNT_50"]
+		}`))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := update()
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.JSONEq(t, `{
+		"error": "conflicting slugs: AVITO_DISCOUNT_30, AVITO_DISCOUNT_50",
+		"conflicts": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"]
+	}`, rec.Body.String())
+
+	config.ConflictPolicy = usecase.ConflictPolicyLastWins
+	rec = update()
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	segList, err := s.uc.SegmentFindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList, 2)
+}
+
+func TestServer_HandleSegmentsUpdateUser_Rejected(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES"} {
+		s.uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+	assert.NoError(t, s.uc.CapacitySet(&entity.Capacity{Slug: "AVITO_DISCOUNT_30", MaxMembers: 1, Overflow: entity.OverflowPolicyReject}))
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/seg", `{"user_id": 1, "slug_list_add": ["AVITO_DISCOUNT_30"]}`).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/seg", `{"user_id": 2, "slug_list_add": ["AVITO_VOICE_MESSAGES"]}`).Code)
+
+	// the conflict is returned before the removal is applied
+	rec := serve(http.MethodPut, "/seg", `{"user_id": 2, "slug_list_add": ["AVITO_DISCOUNT_30"], "slug_list_del": ["AVITO_VOICE_MESSAGES"]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	segList, err := s.uc.SegmentFindByUser(2)
+	assert.NoError(t, err)
+	assert.Len(t, segList, 1)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", segList[0].Slug)
+}
+
+func TestServer_HandleGroups(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		s.uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "valid",
+			body:         `{"name": "discounts", "policy": "reject", "slugs": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"]}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "name taken",
+			body:         `{"name": "discounts", "policy": "reject", "slugs": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"]}`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "segment not found",
+			body:         `{"name": "other", "policy": "replace", "slugs": ["NOT_FOUND", "NOT_FOUND_2"]}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "invalid params",
+			body:         `{"name": "other", "policy": "sometimes", "slugs": ["AVITO_DISCOUNT_30"]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedCode, serve(http.MethodPost, "/groups", tc.body).Code)
+		})
+	}
+
+	rec := serve(http.MethodGet, "/groups", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"group_id": 1, "name": "discounts", "policy": "reject", "slugs": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"]}]`, rec.Body.String())
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/seg", `{"user_id": 1, "slug_list_add": ["AVITO_DISCOUNT_30"]}`).Code)
+
+	rec = serve(http.MethodPut, "/seg", `{"user_id": 1, "slug_list_add": ["AVITO_DISCOUNT_50"]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.JSONEq(t, `{
+		"error": "exclusion group conflict discounts: AVITO_DISCOUNT_30, AVITO_DISCOUNT_50",
+		"conflicts": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"]
+	}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/groups/discounts", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/groups/discounts", "").Code)
+}
+
+func TestServer_HandleSegmentsHierarchy(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/seg", `{"slug": "AVITO_DISCOUNT"}`).Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/seg", `{"slug": "AVITO_DISCOUNT_30", "parent": "AVITO_DISCOUNT"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/seg", `{"slug": "AVITO_DISCOUNT_50", "parent": "NOT_FOUND"}`).Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/seg", `{"slug": "AVITO"}`).Code)
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "valid",
+			body:         `{"slug": "AVITO_DISCOUNT", "parent": "AVITO"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "cycle",
+			body:         `{"slug": "AVITO", "parent": "AVITO_DISCOUNT_30"}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "own parent",
+			body:         `{"slug": "AVITO", "parent": "AVITO"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "segment not found",
+			body:         `{"slug": "NOT_FOUND", "parent": "AVITO"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "invalid params",
+			body:         `{"parent": "AVITO"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedCode, serve(http.MethodPut, "/seg/parent", tc.body).Code)
+		})
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/seg", `{"user_id": 1, "slug_list_add": ["AVITO_DISCOUNT_30"]}`).Code)
+
+	rec := serve(http.MethodGet, "/seg", `{"user_id": 1, "expand": true}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[
+		{"seg_id": 1, "slug": "AVITO_DISCOUNT", "source": "inherited", "via": ["AVITO_DISCOUNT_30"]},
+		{"seg_id": 2, "slug": "AVITO_DISCOUNT_30", "source": "direct"},
+		{"seg_id": 3, "slug": "AVITO", "source": "inherited", "via": ["AVITO_DISCOUNT_30"]}
+	]`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/seg", `{"user_id": 1, "expand": true, "as_of": "2023-08-30T12:00:00Z"}`).Code)
+
+	assert.Equal(t, http.StatusConflict, serve(http.MethodDelete, "/seg", `{"slug": "AVITO_DISCOUNT"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodDelete, "/seg", `{"slug": "AVITO_DISCOUNT", "children": "orphan"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/seg", `{"slug": "AVITO_DISCOUNT", "children": "reparent"}`).Code)
+
+	rec = serve(http.MethodGet, "/seg", `{"user_id": 1, "expand": true}`)
+	assert.JSONEq(t, `[
+		{"seg_id": 2, "slug": "AVITO_DISCOUNT_30", "source": "direct"},
+		{"seg_id": 3, "slug": "AVITO", "source": "inherited", "via": ["AVITO_DISCOUNT_30"]}
+	]`, rec.Body.String())
+}
+
+func TestServer_HandlePrerequisites(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	for _, slug := range []string{"AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA"} {
+		s.uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "valid",
+			body:         `{"slug": "AVITO_PERFORMANCE_VAS_BETA", "requires": "AVITO_PERFORMANCE_VAS"}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "already required",
+			body:         `{"slug": "AVITO_PERFORMANCE_VAS_BETA", "requires": "AVITO_PERFORMANCE_VAS"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "cycle",
+			body:         `{"slug": "AVITO_PERFORMANCE_VAS", "requires": "AVITO_PERFORMANCE_VAS_BETA"}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "segment not found",
+			body:         `{"slug": "NOT_FOUND", "requires": "AVITO_PERFORMANCE_VAS"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "invalid params",
+			body:         `{"slug": "AVITO_PERFORMANCE_VAS", "requires": "AVITO_PERFORMANCE_VAS"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedCode, serve(http.MethodPost, "/prerequisites", tc.body).Code)
+		})
+	}
+
+	rec := serve(http.MethodGet, "/prerequisites", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"slug": "AVITO_PERFORMANCE_VAS_BETA", "requires": "AVITO_PERFORMANCE_VAS"}]`, rec.Body.String())
+
+	rec = serve(http.MethodPut, "/seg", `{"user_id": 1, "slug_list_add": ["AVITO_PERFORMANCE_VAS_BETA"]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.JSONEq(t, `{
+		"error": "missing prerequisite of AVITO_PERFORMANCE_VAS_BETA: AVITO_PERFORMANCE_VAS",
+		"conflicts": ["AVITO_PERFORMANCE_VAS"]
+	}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/prerequisites/AVITO_PERFORMANCE_VAS_BETA/AVITO_PERFORMANCE_VAS", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/prerequisites/AVITO_PERFORMANCE_VAS_BETA/AVITO_PERFORMANCE_VAS", "").Code)
+}
+
+func TestServer_HandleCapacity(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+	s := NewServer(NewConfig(), uc)
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		s.uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "valid",
+			body:         `{"slug": "AVITO_DISCOUNT_30", "max_members": 1}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "waitlist",
+			body:         `{"slug": "AVITO_DISCOUNT_50", "max_members": 1, "overflow": "waitlist"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "segment not found",
+			body:         `{"slug": "NOT_FOUND", "max_members": 1}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "invalid params",
+			body:         `{"slug": "AVITO_DISCOUNT_30", "max_members": 0, "overflow": "drop"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedCode, serve(http.MethodPut, "/seg/capacity", tc.body).Code)
+		})
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/seg", `{"user_id": 1, "slug_list_add": ["AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"]}`).Code)
+
+	rec := serve(http.MethodPut, "/seg", `{"user_id": 2, "slug_list_add": ["AVITO_DISCOUNT_30"]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.JSONEq(t, `{
+		"error": "segment is full: AVITO_DISCOUNT_30",
+		"conflicts": ["AVITO_DISCOUNT_30"]
+	}`, rec.Body.String())
+
+	// a full segment with the waitlist policy puts the user on the waitlist
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/seg", `{"user_id": 2, "slug_list_add": ["AVITO_DISCOUNT_50"]}`).Code)
+
+	rec = serve(http.MethodGet, "/seg/capacity?slug=AVITO_DISCOUNT_50", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"slug": "AVITO_DISCOUNT_50",
+		"max_members": 1,
+		"overflow": "waitlist",
+		"members": 1,
+		"remaining": 0,
+		"waitlisted": 1
+	}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/seg/capacity", "").Code)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/seg/capacity", `{"slug": "AVITO_DISCOUNT_30"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/seg/capacity", `{"slug": "AVITO_DISCOUNT_30"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/seg/capacity?slug=AVITO_DISCOUNT_30", "").Code)
+}
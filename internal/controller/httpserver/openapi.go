@@ -0,0 +1,31 @@
+package httpserver
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route of configureRouter,
+// TestServer_OpenAPICoversRoutes keeps the two in sync.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders the spec with Swagger UI loaded from a CDN.
+//
+//go:embed docs.html
+var docsPage []byte
+
+func (s *server) handleOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	}
+}
+
+func (s *server) handleDocs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docsPage)
+	}
+}
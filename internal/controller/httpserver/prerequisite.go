@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/gorilla/mux"
+)
+
+func (s *server) handlePrerequisitesCreate() http.HandlerFunc {
+	type request struct {
+		Slug     string `json:"slug"`
+		Requires string `json:"requires"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		p := &entity.Prerequisite{}
+		if err := decodeRequest(r, req, func() error {
+			p.Slug, p.Requires = req.Slug, req.Requires
+			return p.Validate()
+		}); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		if err := s.uc.PrerequisiteAdd(p); err != nil {
+			switch {
+			case err == repository.ErrRecordNotFound:
+				s.error(w, r, http.StatusNotFound, err)
+			case errors.Is(err, repository.ErrPrerequisiteCycle):
+				s.error(w, r, http.StatusConflict, err)
+			default:
+				s.error(w, r, http.StatusUnprocessableEntity, err)
+			}
+			return
+		}
+		s.respond(w, r, http.StatusCreated, p)
+	}
+}
+
+func (s *server) handlePrerequisitesList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prereqs, err := s.uc.PrerequisiteFindAll()
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, prereqs)
+	}
+}
+
+func (s *server) handlePrerequisitesDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := &entity.Prerequisite{Slug: mux.Vars(r)["slug"], Requires: mux.Vars(r)["requires"]}
+
+		if err := s.uc.PrerequisiteDelete(p); err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, map[string]string{"delete prerequisite": p.Slug + " -> " + p.Requires})
+	}
+}
@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// decodeRequest decodes the JSON body into req, rejecting unknown fields
+// and anything after the first value, and then runs validate if set.
+func decodeRequest(r *http.Request, req interface{}, validate func() error) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(req); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+
+	if validate == nil {
+		return nil
+	}
+	return validate()
+}
+
+// requestError responds 400, listing the offending fields when the error
+// names them.
+func (s *server) requestError(w http.ResponseWriter, r *http.Request, err error) {
+	fields := requestFieldErrors(err)
+	if len(fields) == 0 {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	s.respond(w, r, http.StatusBadRequest, map[string]interface{}{
+		"error":  errInvalidRequest.Error(),
+		"fields": fields,
+	})
+}
+
+func requestFieldErrors(err error) []*fieldError {
+	var (
+		validationErrs validation.Errors
+		typeErr        *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.As(err, &validationErrs):
+		return flattenErrors("", validationErrs)
+	case errors.As(err, &typeErr):
+		return []*fieldError{{Field: typeErr.Field, Error: "must be " + jsonType(typeErr.Type.Kind())}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return []*fieldError{{Field: field, Error: "unknown field"}}
+	}
+	return nil
+}
+
+// flattenErrors turns nested validation errors into a flat list with
+// paths like items[0].add[1], ordered by field and then by index.
+func flattenErrors(prefix string, errs validation.Errors) []*fieldError {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, aErr := strconv.Atoi(keys[i])
+		b, bErr := strconv.Atoi(keys[j])
+		if aErr == nil && bErr == nil {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+
+	fields := make([]*fieldError, 0, len(errs))
+	for _, key := range keys {
+		path := prefix + "." + key
+		if _, err := strconv.Atoi(key); err == nil {
+			path = prefix + "[" + key + "]"
+		}
+		path = strings.TrimPrefix(path, ".")
+
+		if nested, ok := errs[key].(validation.Errors); ok {
+			fields = append(fields, flattenErrors(path, nested)...)
+			continue
+		}
+		fields = append(fields, &fieldError{Field: path, Error: errs[key].Error()})
+	}
+	return fields
+}
+
+// jsonType names a Go kind the way the JSON body spells it.
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -0,0 +1,96 @@
+package httpserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/gorilla/mux"
+)
+
+func (s *server) handleWebhooksCreate() http.HandlerFunc {
+	type request struct {
+		URL        string   `json:"url"`
+		Secret     string   `json:"secret"`
+		EventTypes []string `json:"event_types"`
+		Slugs      []string `json:"slugs"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &request{}
+		if err := decodeRequest(r, req, nil); err != nil {
+			s.requestError(w, r, err)
+			return
+		}
+
+		webhook := &entity.Webhook{
+			URL:        req.URL,
+			Secret:     req.Secret,
+			EventTypes: req.EventTypes,
+			Slugs:      req.Slugs,
+		}
+
+		if err := s.uc.WebhookCreate(webhook); err != nil {
+			s.error(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		s.respond(w, r, http.StatusCreated, webhook)
+	}
+}
+
+func (s *server) handleWebhooksList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhooks, err := s.uc.WebhookFindAll()
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, webhooks)
+	}
+}
+
+func (s *server) handleWebhooksDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		if err := s.uc.WebhookDelete(webhookID); err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, map[string]int{"delete webhook": webhookID})
+	}
+}
+
+func (s *server) handleWebhooksDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		deliveries, err := s.uc.WebhookFindDeliveries(webhookID, r.URL.Query().Get("status"))
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, deliveries)
+	}
+}
+
+func (s *server) handleWebhooksRedeliver() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deliveryID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		if err := s.uc.WebhookRedeliver(deliveryID); err != nil {
+			s.error(w, r, errorCode(err), err)
+			return
+		}
+		s.respond(w, r, http.StatusAccepted, map[string]int{"redeliver": deliveryID})
+	}
+}
+
+// errorCode maps repository errors to the response status.
+func errorCode(err error) int {
+	if err == repository.ErrRecordNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
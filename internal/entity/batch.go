@@ -0,0 +1,55 @@
+package entity
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+const (
+	BatchStatusOK    = "ok"
+	BatchStatusError = "error"
+)
+
+type BatchItem struct {
+	UserID      int      `json:"user_id"`
+	SlugListAdd []string `json:"add"`
+	SlugListDel []string `json:"remove"`
+}
+
+// Validate checks the shape of the item, the slugs are resolved later.
+func (b *BatchItem) Validate() error {
+	addRules := []validation.Rule{validation.Each(SlugRule)}
+	if len(b.SlugListDel) == 0 {
+		addRules = append(addRules, validation.Required.Error("add or remove must not be empty"))
+	}
+
+	return validation.ValidateStruct(
+		b,
+		validation.Field(&b.UserID, validation.Required, validation.Min(1)),
+		validation.Field(&b.SlugListAdd, addRules...),
+		validation.Field(&b.SlugListDel, validation.Each(SlugRule)),
+	)
+}
+
+// MembershipChange is a batch item with its slugs resolved to segments.
+// ActiveFrom schedules the additions, the zero time adds right away.
+type MembershipChange struct {
+	UserID     int
+	SegListAdd []*Segment
+	SegListDel []*Segment
+	ActiveFrom time.Time
+}
+
+type BatchItemResult struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+	Total     int                `json:"total"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Items     []*BatchItemResult `json:"items"`
+}
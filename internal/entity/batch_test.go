@@ -0,0 +1,57 @@
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchItem_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		item    *entity.BatchItem
+		isValid bool
+	}{
+		{
+			name:    "valid",
+			item:    &entity.BatchItem{UserID: 1000, SlugListAdd: []string{"AVITO_DISCOUNT_30"}},
+			isValid: true,
+		},
+		{
+			name:    "remove only",
+			item:    &entity.BatchItem{UserID: 1000, SlugListDel: []string{"AVITO_DISCOUNT_30"}},
+			isValid: true,
+		},
+		{
+			name:    "zero user_id",
+			item:    &entity.BatchItem{SlugListAdd: []string{"AVITO_DISCOUNT_30"}},
+			isValid: false,
+		},
+		{
+			name:    "negative user_id",
+			item:    &entity.BatchItem{UserID: -1, SlugListAdd: []string{"AVITO_DISCOUNT_30"}},
+			isValid: false,
+		},
+		{
+			name:    "empty slug lists",
+			item:    &entity.BatchItem{UserID: 1000},
+			isValid: false,
+		},
+		{
+			name:    "malformed slug",
+			item:    &entity.BatchItem{UserID: 1000, SlugListAdd: []string{"AVITO_DISCOUNT_30", "?#@"}},
+			isValid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.isValid {
+				assert.NoError(t, tc.item.Validate())
+			} else {
+				assert.Error(t, tc.item.Validate())
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package entity
+
+import validation "github.com/go-ozzo/ozzo-validation"
+
+// OverflowPolicy values: what adding a user to a segment that is full does.
+const (
+	OverflowPolicyReject   = "reject"
+	OverflowPolicyWaitlist = "waitlist"
+)
+
+// Capacity limits the number of users in a segment, active or pending.
+// A user added to a full segment is rejected or put on its waitlist and
+// added once a place is freed. Members, Remaining and Waitlisted are filled
+// in when the capacity is read.
+type Capacity struct {
+	Slug       string `json:"slug"`
+	MaxMembers int    `json:"max_members"`
+	Overflow   string `json:"overflow"`
+	Members    int    `json:"members"`
+	Remaining  int    `json:"remaining"`
+	Waitlisted int    `json:"waitlisted"`
+}
+
+func (c *Capacity) Validate() error {
+	return validation.ValidateStruct(
+		c,
+		validation.Field(&c.Slug, slugRules...),
+		validation.Field(&c.MaxMembers, validation.Required, validation.Min(1)),
+		validation.Field(
+			&c.Overflow,
+			validation.Required,
+			validation.In(OverflowPolicyReject, OverflowPolicyWaitlist),
+		),
+	)
+}
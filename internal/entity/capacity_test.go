@@ -0,0 +1,52 @@
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapacity_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		c       *entity.Capacity
+		isValid bool
+	}{
+		{
+			name:    "valid",
+			c:       &entity.Capacity{Slug: "AVITO_DISCOUNT_50", MaxMembers: 10000, Overflow: entity.OverflowPolicyWaitlist},
+			isValid: true,
+		},
+		{
+			name:    "no limit",
+			c:       &entity.Capacity{Slug: "AVITO_DISCOUNT_50", Overflow: entity.OverflowPolicyReject},
+			isValid: false,
+		},
+		{
+			name:    "negative limit",
+			c:       &entity.Capacity{Slug: "AVITO_DISCOUNT_50", MaxMembers: -1, Overflow: entity.OverflowPolicyReject},
+			isValid: false,
+		},
+		{
+			name:    "unknown overflow",
+			c:       &entity.Capacity{Slug: "AVITO_DISCOUNT_50", MaxMembers: 10, Overflow: "queue"},
+			isValid: false,
+		},
+		{
+			name:    "malformed slug",
+			c:       &entity.Capacity{Slug: "AVITO DISCOUNT 50", MaxMembers: 10, Overflow: entity.OverflowPolicyReject},
+			isValid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.isValid {
+				assert.NoError(t, tc.c.Validate())
+			} else {
+				assert.Error(t, tc.c.Validate())
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package entity
+
+import "time"
+
+const (
+	EventSegmentCreated = "segment.created"
+	EventSegmentDeleted = "segment.deleted"
+	EventUserAdded      = "user.added"
+	EventUserRemoved    = "user.removed"
+)
+
+var EventTypes = []string{
+	EventSegmentCreated,
+	EventSegmentDeleted,
+	EventUserAdded,
+	EventUserRemoved,
+}
+
+// Event is a domain change taken from the outbox.
+// Segment events carry no user ID. Seq is the position of the event
+// in the relay order and is zero until the event is sequenced.
+type Event struct {
+	EventID     int       `json:"event_id"`
+	Seq         int       `json:"seq,omitempty"`
+	Type        string    `json:"event_type"`
+	UserID      int       `json:"user_id,omitempty"`
+	SegID       int       `json:"seg_id"`
+	Slug        string    `json:"slug"`
+	EffectiveAt time.Time `json:"effective_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// EventFilter selects the events of one user and/or some segments.
+// Zero values match everything.
+type EventFilter struct {
+	UserID int
+	Slugs  []string
+}
+
+func (f *EventFilter) Matches(e *Event) bool {
+	if f.UserID != 0 && f.UserID != e.UserID {
+		return false
+	}
+	return len(f.Slugs) == 0 || contains(f.Slugs, e.Slug)
+}
@@ -0,0 +1,60 @@
+package entity
+
+import (
+	"errors"
+	"regexp"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// GroupPolicy values: what adding a user to a segment of an exclusion group
+// does when the user is already in another segment of the group.
+const (
+	GroupPolicyReject  = "reject"
+	GroupPolicyReplace = "replace"
+)
+
+// Group is an exclusion group: a user is in at most one of its segments.
+// A segment belongs to one group at most.
+type Group struct {
+	GroupID int      `json:"group_id"`
+	Name    string   `json:"name"`
+	Policy  string   `json:"policy"`
+	Slugs   []string `json:"slugs"`
+}
+
+func (g *Group) Validate() error {
+	return validation.ValidateStruct(
+		g,
+		validation.Field(
+			&g.Name,
+			validation.Required,
+			validation.Match(regexp.MustCompile(`^[\w-]+$`)),
+			validation.Length(0, 50),
+		),
+		validation.Field(
+			&g.Policy,
+			validation.Required,
+			validation.In(GroupPolicyReject, GroupPolicyReplace),
+		),
+		validation.Field(
+			&g.Slugs,
+			validation.Required,
+			validation.Length(2, 0),
+			validation.Each(SlugRule),
+			validation.By(uniqueSlugs),
+		),
+	)
+}
+
+func uniqueSlugs(value interface{}) error {
+	slugs, _ := value.([]string)
+	seen := make(map[string]bool, len(slugs))
+	for _, slug := range slugs {
+		if seen[slug] {
+			return errors.New("must not repeat a slug")
+		}
+		seen[slug] = true
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup_Validate(t *testing.T) {
+	slugs := []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}
+
+	testCases := []struct {
+		name    string
+		g       *entity.Group
+		isValid bool
+	}{
+		{
+			name:    "valid",
+			g:       &entity.Group{Name: "discounts", Policy: entity.GroupPolicyReplace, Slugs: slugs},
+			isValid: true,
+		},
+		{
+			name:    "empty name",
+			g:       &entity.Group{Policy: entity.GroupPolicyReject, Slugs: slugs},
+			isValid: false,
+		},
+		{
+			name:    "malformed name",
+			g:       &entity.Group{Name: "spring discounts", Policy: entity.GroupPolicyReject, Slugs: slugs},
+			isValid: false,
+		},
+		{
+			name:    "unknown policy",
+			g:       &entity.Group{Name: "discounts", Policy: "sometimes", Slugs: slugs},
+			isValid: false,
+		},
+		{
+			name:    "single segment",
+			g:       &entity.Group{Name: "discounts", Policy: entity.GroupPolicyReject, Slugs: slugs[:1]},
+			isValid: false,
+		},
+		{
+			name:    "repeated slug",
+			g:       &entity.Group{Name: "discounts", Policy: entity.GroupPolicyReject, Slugs: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_30"}},
+			isValid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.isValid {
+				assert.NoError(t, tc.g.Validate())
+			} else {
+				assert.Error(t, tc.g.Validate())
+			}
+		})
+	}
+}
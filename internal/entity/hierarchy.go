@@ -0,0 +1,26 @@
+package entity
+
+// UserSegment sources: a user is added to a segment directly, or inherits
+// the segment from one of its descendants.
+const (
+	SourceDirect    = "direct"
+	SourceInherited = "inherited"
+)
+
+// UserSegment is a segment of the user with the way the user is in it.
+type UserSegment struct {
+	SegID  int    `json:"seg_id"`
+	Slug   string `json:"slug"`
+	Source string `json:"source"`
+	// Via lists the segments the user is in directly that imply
+	// an inherited segment, ordered by ID.
+	Via []string `json:"via,omitempty"`
+}
+
+// ChildrenPolicy values: what deleting a segment with child segments does.
+// The children are kept as they are and the delete fails, or they are moved
+// to the parent of the deleted segment.
+const (
+	ChildrenPolicyReject   = "reject"
+	ChildrenPolicyReparent = "reparent"
+)
@@ -0,0 +1,6 @@
+package entity
+
+const (
+	OperationAdd    = "add"
+	OperationRemove = "remove"
+)
@@ -0,0 +1,14 @@
+package entity
+
+type ImportResult struct {
+	Slug      string `json:"slug"`
+	Accepted  int    `json:"accepted"`
+	Duplicate int    `json:"duplicate"`
+	Invalid   int    `json:"invalid"`
+	// Malformed counts the rows that could not be parsed, such as a broken
+	// JSON line or one longer than the line limit.
+	Malformed int `json:"malformed"`
+	// Rejected counts the users left out by an exclusion group, a missing
+	// prerequisite or the capacity of the segment.
+	Rejected int `json:"rejected"`
+}
@@ -0,0 +1,16 @@
+package entity
+
+import "time"
+
+type Membership struct {
+	UserID int    `json:"user_id"`
+	SegID  int    `json:"seg_id"`
+	Slug   string `json:"slug"`
+}
+
+// PendingMembership is a scheduled membership that is not active yet.
+type PendingMembership struct {
+	SegID      int       `json:"seg_id"`
+	Slug       string    `json:"slug"`
+	ActiveFrom time.Time `json:"active_from"`
+}
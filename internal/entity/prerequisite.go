@@ -0,0 +1,22 @@
+package entity
+
+import validation "github.com/go-ozzo/ozzo-validation"
+
+// Prerequisite makes a segment require another one: a user is added to
+// the segment only if already in the required one, and leaves it along
+// with the required one.
+type Prerequisite struct {
+	Slug     string `json:"slug"`
+	Requires string `json:"requires"`
+}
+
+func (p *Prerequisite) Validate() error {
+	return validation.ValidateStruct(
+		p,
+		validation.Field(&p.Slug, slugRules...),
+		validation.Field(
+			&p.Requires,
+			append(slugRules, validation.NotIn(p.Slug).Error("must not be the segment itself"))...,
+		),
+	)
+}
@@ -0,0 +1,47 @@
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrerequisite_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		p       *entity.Prerequisite
+		isValid bool
+	}{
+		{
+			name:    "valid",
+			p:       &entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"},
+			isValid: true,
+		},
+		{
+			name:    "empty requires",
+			p:       &entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA"},
+			isValid: false,
+		},
+		{
+			name:    "malformed slug",
+			p:       &entity.Prerequisite{Slug: "AVITO PERFORMANCE VAS BETA", Requires: "AVITO_PERFORMANCE_VAS"},
+			isValid: false,
+		},
+		{
+			name:    "requires itself",
+			p:       &entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS", Requires: "AVITO_PERFORMANCE_VAS"},
+			isValid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.isValid {
+				assert.NoError(t, tc.p.Validate())
+			} else {
+				assert.Error(t, tc.p.Validate())
+			}
+		})
+	}
+}
@@ -1,15 +1,35 @@
 package entity
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 
 	validation "github.com/go-ozzo/ozzo-validation"
 )
 
+var slugRules = []validation.Rule{
+	validation.Required,
+	validation.Match(regexp.MustCompile(`^[\w]+$`)),
+	validation.Length(0, 50),
+}
+
+// SlugRule validates a slug referring to an existing segment,
+// the error quotes the slug so it can be found in a list.
+var SlugRule = validation.By(func(value interface{}) error {
+	slug, _ := value.(string)
+	if err := validation.Validate(slug, slugRules...); err != nil {
+		return fmt.Errorf("%q %s", slug, err)
+	}
+	return nil
+})
+
+// Segment is a user segment. A segment may have a parent, the segments form
+// a forest: a user in a segment is implied to be in all of its ancestors.
 type Segment struct {
-	SegID int    `json:"seg_id"`
-	Slug  string `json:"slug"`
+	SegID  int    `json:"seg_id"`
+	Slug   string `json:"slug"`
+	Parent string `json:"parent,omitempty"`
 }
 
 func (s *Segment) Validate() error {
@@ -18,11 +38,12 @@ func (s *Segment) Validate() error {
 
 	return validation.ValidateStruct(
 		s,
+		validation.Field(&s.Slug, slugRules...),
 		validation.Field(
-			&s.Slug,
-			validation.Required,
+			&s.Parent,
 			validation.Match(regexp.MustCompile(`^[\w]+$`)),
 			validation.Length(0, 50),
+			validation.NotIn(s.Slug).Error("must not be the segment itself"),
 		),
 	)
 }
@@ -51,3 +51,9 @@ func TestSegment_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestSegment_ValidateParent(t *testing.T) {
+	assert.NoError(t, (&entity.Segment{Slug: "AVITO_DISCOUNT_30", Parent: "AVITO_DISCOUNT"}).Validate())
+	assert.Error(t, (&entity.Segment{Slug: "AVITO_DISCOUNT", Parent: "AVITO_DISCOUNT"}).Validate())
+	assert.Error(t, (&entity.Segment{Slug: "AVITO_DISCOUNT_30", Parent: "AVITO DISCOUNT"}).Validate())
+}
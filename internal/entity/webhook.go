@@ -0,0 +1,76 @@
+package entity
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/go-ozzo/ozzo-validation/is"
+)
+
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusDead      = "dead"
+)
+
+// Webhook is a subscription to events. Empty EventTypes or Slugs match everything.
+type Webhook struct {
+	WebhookID  int       `json:"webhook_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"`
+	EventTypes []string  `json:"event_types"`
+	Slugs      []string  `json:"slugs"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (w *Webhook) Validate() error {
+	eventTypes := make([]interface{}, len(EventTypes))
+	for i, eventType := range EventTypes {
+		eventTypes[i] = eventType
+	}
+
+	return validation.ValidateStruct(
+		w,
+		validation.Field(
+			&w.URL,
+			validation.Required,
+			is.URL,
+		),
+		validation.Field(
+			&w.Secret,
+			validation.Required,
+			validation.Length(16, 0),
+		),
+		validation.Field(
+			&w.EventTypes,
+			validation.Each(validation.In(eventTypes...)),
+		),
+	)
+}
+
+// Matches reports whether the event passes the webhook filters.
+func (w *Webhook) Matches(e *Event) bool {
+	return (len(w.EventTypes) == 0 || contains(w.EventTypes, e.Type)) &&
+		(len(w.Slugs) == 0 || contains(w.Slugs, e.Slug))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	DeliveryID    int       `json:"delivery_id"`
+	WebhookID     int       `json:"webhook_id"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	Event         *Event    `json:"event"`
+	URL           string    `json:"-"`
+	Secret        string    `json:"-"`
+}
@@ -0,0 +1,72 @@
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		webhook *entity.Webhook
+		isValid bool
+	}{
+		{
+			name: "valid",
+			webhook: &entity.Webhook{
+				URL:        "https://pricing.example.com/hooks/segments",
+				Secret:     "0123456789abcdef",
+				EventTypes: []string{entity.EventUserAdded, entity.EventUserRemoved},
+			},
+			isValid: true,
+		},
+		{
+			name: "empty url",
+			webhook: &entity.Webhook{
+				Secret: "0123456789abcdef",
+			},
+			isValid: false,
+		},
+		{
+			name: "short secret",
+			webhook: &entity.Webhook{
+				URL:    "https://pricing.example.com/hooks/segments",
+				Secret: "qwerty",
+			},
+			isValid: false,
+		},
+		{
+			name: "unknown event type",
+			webhook: &entity.Webhook{
+				URL:        "https://pricing.example.com/hooks/segments",
+				Secret:     "0123456789abcdef",
+				EventTypes: []string{"user.updated"},
+			},
+			isValid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.isValid {
+				assert.NoError(t, tc.webhook.Validate())
+			} else {
+				assert.Error(t, tc.webhook.Validate())
+			}
+		})
+	}
+}
+
+func TestWebhook_Matches(t *testing.T) {
+	w := &entity.Webhook{
+		EventTypes: []string{entity.EventUserAdded},
+		Slugs:      []string{"AVITO_DISCOUNT_30"},
+	}
+
+	assert.True(t, w.Matches(&entity.Event{Type: entity.EventUserAdded, Slug: "AVITO_DISCOUNT_30"}))
+	assert.False(t, w.Matches(&entity.Event{Type: entity.EventUserRemoved, Slug: "AVITO_DISCOUNT_30"}))
+	assert.False(t, w.Matches(&entity.Event{Type: entity.EventUserAdded, Slug: "AVITO_DISCOUNT_50"}))
+	assert.True(t, (&entity.Webhook{}).Matches(&entity.Event{Type: entity.EventSegmentCreated}))
+}
@@ -0,0 +1,149 @@
+package cacherepository
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// Stats are the cache counters since start.
+type Stats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Size          int    `json:"size"`
+}
+
+type cacheEntry struct {
+	userID    int
+	segList   []*entity.Segment
+	expiresAt time.Time
+	token     uint64
+	loaded    bool
+}
+
+// userCache is an LRU of user segment lists with a TTL. It is not safe for
+// concurrent use. A miss leaves a placeholder with a token, and the loaded
+// list is stored only if the placeholder survives until then: an invalidation
+// that lands while the repository is being read removes the placeholder,
+// so the stale result is dropped instead of cached. deadlines keeps the
+// upcoming starts of the pending memberships of every user, earliest first,
+// an entry never outlives the first of them.
+type userCache struct {
+	size      int
+	ttl       time.Duration
+	entries   map[int]*list.Element
+	order     *list.List
+	deadlines map[int][]time.Time
+	lastToken uint64
+	stats     Stats
+}
+
+func newUserCache(size int, ttl time.Duration) *userCache {
+	return &userCache{
+		size:      size,
+		ttl:       ttl,
+		entries:   make(map[int]*list.Element),
+		order:     list.New(),
+		deadlines: make(map[int][]time.Time),
+	}
+}
+
+// get returns the cached list of the user. On a miss it returns the token
+// to pass to set with the loaded list.
+func (c *userCache) get(userID int, now time.Time) ([]*entity.Segment, uint64, bool) {
+	if el, ok := c.entries[userID]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.loaded && now.Before(e.expiresAt) {
+			c.order.MoveToFront(el)
+			c.stats.Hits++
+			return e.segList, 0, true
+		}
+		c.remove(el)
+	}
+	c.stats.Misses++
+
+	c.lastToken++
+	c.entries[userID] = c.order.PushFront(&cacheEntry{userID: userID, token: c.lastToken})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+	return nil, c.lastToken, false
+}
+
+func (c *userCache) set(userID int, token uint64, segList []*entity.Segment, now time.Time) {
+	el, ok := c.entries[userID]
+	if !ok {
+		return
+	}
+
+	e := el.Value.(*cacheEntry)
+	if e.loaded || e.token != token {
+		return
+	}
+
+	e.loaded = true
+	e.segList = segList
+	e.expiresAt = now.Add(c.ttl)
+
+	if deadlines := c.upcoming(userID, now); len(deadlines) > 0 && deadlines[0].Before(e.expiresAt) {
+		e.expiresAt = deadlines[0]
+	}
+}
+
+// invalidate drops the user entry. A non-zero activeFrom in the future
+// also keeps later entries of the user from outliving that moment.
+func (c *userCache) invalidate(userID int, activeFrom time.Time, now time.Time) {
+	if el, ok := c.entries[userID]; ok {
+		c.remove(el)
+	}
+	c.stats.Invalidations++
+
+	if !activeFrom.After(now) {
+		return
+	}
+
+	deadlines := c.upcoming(userID, now)
+	i := sort.Search(len(deadlines), func(i int) bool {
+		return !deadlines[i].Before(activeFrom)
+	})
+	if i < len(deadlines) && deadlines[i].Equal(activeFrom) {
+		return
+	}
+
+	deadlines = append(deadlines, time.Time{})
+	copy(deadlines[i+1:], deadlines[i:])
+	deadlines[i] = activeFrom
+	c.deadlines[userID] = deadlines
+}
+
+// upcoming drops the passed deadlines of the user and returns the rest.
+func (c *userCache) upcoming(userID int, now time.Time) []time.Time {
+	deadlines := c.deadlines[userID]
+	i := 0
+	for i < len(deadlines) && !deadlines[i].After(now) {
+		i++
+	}
+
+	if i == len(deadlines) {
+		delete(c.deadlines, userID)
+		return nil
+	}
+	c.deadlines[userID] = deadlines[i:]
+	return deadlines[i:]
+}
+
+func (c *userCache) purge() {
+	c.entries = make(map[int]*list.Element)
+	c.order.Init()
+	c.stats.Invalidations++
+}
+
+func (c *userCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).userID)
+}
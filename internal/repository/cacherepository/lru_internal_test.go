@@ -0,0 +1,82 @@
+package cacherepository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserCache_Eviction(t *testing.T) {
+	c := newUserCache(2, time.Minute)
+	now := time.Now()
+	segList := []*entity.Segment{{SegID: 1, Slug: "AVITO_DISCOUNT_30"}}
+
+	for userID := 1; userID <= 2; userID++ {
+		_, token, _ := c.get(userID, now)
+		c.set(userID, token, segList, now)
+	}
+
+	_, _, ok := c.get(1, now)
+	assert.True(t, ok)
+
+	_, token, _ := c.get(3, now)
+	c.set(3, token, segList, now)
+
+	_, _, ok = c.get(1, now)
+	assert.True(t, ok)
+	_, _, ok = c.get(3, now)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), c.stats.Evictions)
+	assert.Equal(t, 2, c.order.Len())
+}
+
+func TestUserCache_InvalidateWhileLoading(t *testing.T) {
+	c := newUserCache(2, time.Minute)
+	now := time.Now()
+
+	_, token, ok := c.get(1, now)
+	assert.False(t, ok)
+
+	c.invalidate(1, time.Time{}, now)
+	c.set(1, token, []*entity.Segment{{SegID: 1}}, now)
+
+	_, _, ok = c.get(1, now)
+	assert.False(t, ok)
+}
+
+func TestUserCache_Deadline(t *testing.T) {
+	c := newUserCache(2, time.Minute)
+	now := time.Now()
+
+	c.invalidate(1, now.Add(time.Second), now)
+	_, token, _ := c.get(1, now)
+	c.set(1, token, nil, now)
+
+	_, _, ok := c.get(1, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	_, _, ok = c.get(1, now.Add(time.Second))
+	assert.False(t, ok)
+}
+
+func TestUserCache_Deadlines(t *testing.T) {
+	c := newUserCache(2, time.Minute)
+	now := time.Now()
+
+	c.invalidate(1, now.Add(2*time.Second), now)
+	c.invalidate(1, now.Add(time.Second), now)
+
+	for _, at := range []time.Time{now, now.Add(time.Second)} {
+		_, token, ok := c.get(1, at)
+		assert.False(t, ok)
+		c.set(1, token, nil, at)
+
+		_, _, ok = c.get(1, at.Add(500*time.Millisecond))
+		assert.True(t, ok)
+	}
+
+	// the later start still ends the entry loaded after the first one
+	_, _, ok := c.get(1, now.Add(2*time.Second))
+	assert.False(t, ok)
+}
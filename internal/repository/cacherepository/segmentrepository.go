@@ -0,0 +1,134 @@
+package cacherepository
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// SegmentRepository caches the segments of a user in front of another
+// repository. Writes made through it invalidate the cache right away,
+// writes made by other instances are applied with InvalidateEvent.
+type SegmentRepository struct {
+	repository.SegmentRepository
+	mu    sync.Mutex
+	cache *userCache
+}
+
+func NewSegmentRepository(r repository.SegmentRepository, size int, ttl time.Duration) *SegmentRepository {
+	return &SegmentRepository{
+		SegmentRepository: r,
+		cache:             newUserCache(size, ttl),
+	}
+}
+
+func (r *SegmentRepository) FindByUser(userID int) ([]*entity.Segment, error) {
+	r.mu.Lock()
+	segList, token, ok := r.cache.get(userID, time.Now())
+	r.mu.Unlock()
+
+	if ok {
+		if len(segList) == 0 {
+			return nil, repository.ErrRecordNotFound
+		}
+		return append([]*entity.Segment(nil), segList...), nil
+	}
+
+	segList, err := r.SegmentRepository.FindByUser(userID)
+	if err != nil && err != repository.ErrRecordNotFound {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.cache.set(userID, token, append([]*entity.Segment(nil), segList...), time.Now())
+	r.mu.Unlock()
+
+	return segList, err
+}
+
+func (r *SegmentRepository) Delete(seg *entity.Segment) error {
+	defer r.Purge()
+	return r.SegmentRepository.Delete(seg)
+}
+
+func (r *SegmentRepository) DeleteReparent(seg *entity.Segment) error {
+	defer r.Purge()
+	return r.SegmentRepository.DeleteReparent(seg)
+}
+
+func (r *SegmentRepository) AddUserToSegments(userID int, segList []*entity.Segment) error {
+	defer r.invalidate(userID, time.Time{})
+	return r.SegmentRepository.AddUserToSegments(userID, segList)
+}
+
+func (r *SegmentRepository) DeleteUserFromSegments(userID int, segList []*entity.Segment) error {
+	defer r.invalidate(userID, time.Time{})
+	return r.SegmentRepository.DeleteUserFromSegments(userID, segList)
+}
+
+func (r *SegmentRepository) ImportUsersToSegment(seg *entity.Segment, src repository.UserIDReader) (*entity.ImportResult, error) {
+	defer r.Purge()
+	return r.SegmentRepository.ImportUsersToSegment(seg, src)
+}
+
+func (r *SegmentRepository) ApplyMembershipChanges(changes []*entity.MembershipChange) error {
+	defer func() {
+		for _, c := range changes {
+			r.invalidate(c.UserID, c.ActiveFrom)
+		}
+	}()
+	return r.SegmentRepository.ApplyMembershipChanges(changes)
+}
+
+func (r *SegmentRepository) ScheduleUserToSegments(userID int, segList []*entity.Segment, activeFrom time.Time) error {
+	defer r.invalidate(userID, activeFrom)
+	return r.SegmentRepository.ScheduleUserToSegments(userID, segList, activeFrom)
+}
+
+func (r *SegmentRepository) CancelPendingUserSegments(userID int, segList []*entity.Segment) error {
+	defer r.invalidate(userID, time.Time{})
+	return r.SegmentRepository.CancelPendingUserSegments(userID, segList)
+}
+
+// SetCapacity purges the cache, as a higher limit adds waitlisted users. The
+// users a removal promotes from a waitlist are invalidated by their events.
+func (r *SegmentRepository) SetCapacity(c *entity.Capacity) error {
+	defer r.Purge()
+	return r.SegmentRepository.SetCapacity(c)
+}
+
+// InvalidateEvent drops what the event makes stale.
+func (r *SegmentRepository) InvalidateEvent(e *entity.Event) {
+	switch e.Type {
+	case entity.EventUserAdded, entity.EventUserRemoved:
+		r.invalidate(e.UserID, e.EffectiveAt)
+	case entity.EventSegmentDeleted:
+		r.Purge()
+	}
+}
+
+// Purge drops every cached entry.
+func (r *SegmentRepository) Purge() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache.purge()
+}
+
+func (r *SegmentRepository) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.cache.stats
+	stats.Size = r.cache.order.Len()
+	return stats
+}
+
+func (r *SegmentRepository) invalidate(userID int, activeFrom time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache.invalidate(userID, activeFrom, time.Now())
+}
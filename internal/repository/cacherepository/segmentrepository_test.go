@@ -0,0 +1,126 @@
+package cacherepository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/cacherepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentRepository_FindByUser(t *testing.T) {
+	tr := testrepository.NewSegmentRepository()
+	r := cacherepository.NewSegmentRepository(tr, 100, time.Minute)
+
+	_, err := r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	tr.AddUserToSegments(1, segList)
+
+	_, err = r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	r.InvalidateEvent(&entity.Event{Type: entity.EventUserAdded, UserID: 1})
+	segList2, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+
+	segList2, err = r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 1, stats.Size)
+}
+
+func TestSegmentRepository_Invalidation(t *testing.T) {
+	r := cacherepository.NewSegmentRepository(testrepository.NewSegmentRepository(), 100, time.Minute)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	r.FindByUser(1)
+
+	assert.NoError(t, r.AddUserToSegments(1, segList))
+	segList2, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+
+	assert.NoError(t, r.DeleteUserFromSegments(1, segList))
+	_, err = r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	assert.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{{UserID: 1, SegListAdd: segList}}))
+	segList2, err = r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+
+	assert.NoError(t, r.Delete(segList[0]))
+	_, err = r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+	assert.Equal(t, 1, r.Stats().Size)
+}
+
+func TestSegmentRepository_ScheduledActivation(t *testing.T) {
+	r := cacherepository.NewSegmentRepository(testrepository.NewSegmentRepository(), 100, time.Minute)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	r.ScheduleUserToSegments(1, segList, time.Now().Add(50*time.Millisecond))
+
+	_, err := r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	time.Sleep(60 * time.Millisecond)
+	segList2, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+}
+
+func TestSegmentRepository_ScheduledChanges(t *testing.T) {
+	r := cacherepository.NewSegmentRepository(testrepository.NewSegmentRepository(), 100, time.Minute)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}, {Slug: "AVITO_DISCOUNT_50"}}
+	r.Create(segList[0])
+	r.Create(segList[1])
+
+	now := time.Now()
+	assert.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[1:], ActiveFrom: now.Add(100 * time.Millisecond)},
+	}))
+	assert.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[:1], ActiveFrom: now.Add(50 * time.Millisecond)},
+	}))
+
+	_, err := r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	time.Sleep(time.Until(now.Add(60 * time.Millisecond)))
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	time.Sleep(time.Until(now.Add(110 * time.Millisecond)))
+	found, err = r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+}
+
+func TestSegmentRepository_TTL(t *testing.T) {
+	r := cacherepository.NewSegmentRepository(testrepository.NewSegmentRepository(), 100, 10*time.Millisecond)
+
+	r.FindByUser(1)
+	r.FindByUser(1)
+	time.Sleep(20 * time.Millisecond)
+	r.FindByUser(1)
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+}
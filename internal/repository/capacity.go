@@ -0,0 +1,138 @@
+package repository
+
+import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+
+// Capacities maps the ID of a segment with a member limit to its capacity,
+// Members counting the users in the segment, active or pending.
+type Capacities map[int]*entity.Capacity
+
+// Resolve checks the segments a user is added to against the capacities.
+// memberships are the segments the user is in, active or pending, adding
+// one of them takes no place. It returns the segments to add the user to and
+// those to put the user on the waitlist of, or a *CapacityError for a full
+// segment with the reject policy. The places taken are counted in Members,
+// so that the next call sees them.
+func (c Capacities) Resolve(memberships map[int]bool, add []*entity.Segment) ([]*entity.Segment, []*entity.Segment, error) {
+	if len(c) == 0 {
+		return add, nil, nil
+	}
+
+	admitted := make([]*entity.Segment, 0, len(add))
+	waitlisted := make([]*entity.Segment, 0)
+	taken := make([]*entity.Capacity, 0)
+	seen := make(map[int]bool, len(add))
+	for _, seg := range add {
+		if seen[seg.SegID] {
+			continue
+		}
+		seen[seg.SegID] = true
+
+		capacity, ok := c[seg.SegID]
+		if !ok || memberships[seg.SegID] {
+			admitted = append(admitted, seg)
+			continue
+		}
+
+		if capacity.Members < capacity.MaxMembers {
+			admitted = append(admitted, seg)
+			taken = append(taken, capacity)
+			continue
+		}
+
+		if capacity.Overflow != entity.OverflowPolicyWaitlist {
+			return nil, nil, &CapacityError{Slug: seg.Slug}
+		}
+		waitlisted = append(waitlisted, seg)
+	}
+
+	for _, capacity := range taken {
+		capacity.Members++
+	}
+	return admitted, waitlisted, nil
+}
+
+// Check is Resolve for the additions that can not wait for a place: a full
+// segment gives a *CapacityError whatever its policy.
+func (c Capacities) Check(memberships map[int]bool, add []*entity.Segment) error {
+	_, waitlisted, err := c.Resolve(memberships, add)
+	if err == nil && len(waitlisted) > 0 {
+		err = &CapacityError{Slug: waitlisted[0].Slug}
+	}
+	return err
+}
+
+// ResolveChanges resolves the changes in order, see Resolve. memberships
+// maps a user to the segments the user is in. The places freed by the
+// removals are not given out to the additions of the same changes, they
+// go to the waitlists once the changes are applied. It returns the changes
+// with the additions that fit and the segments to waitlist the users of the
+// changes for, by index. The changes with a full segment of the reject
+// policy are left out and their errors returned by index, and so are the
+// scheduled ones with any full segment, see Check.
+func (c Capacities) ResolveChanges(memberships map[int]map[int]bool, changes []*entity.MembershipChange) ([]*entity.MembershipChange, map[int][]*entity.Segment, MembershipChangeErrors) {
+	resolved := make([]*entity.MembershipChange, 0, len(changes))
+	waitlist := make(map[int][]*entity.Segment)
+	errs := make(MembershipChangeErrors)
+
+	for i, ch := range changes {
+		admitted, waitlisted, err := c.Resolve(memberships[ch.UserID], ch.SegListAdd)
+		if err == nil && !ch.ActiveFrom.IsZero() && len(waitlisted) > 0 {
+			err = &CapacityError{Slug: waitlisted[0].Slug}
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if memberships[ch.UserID] == nil {
+			memberships[ch.UserID] = make(map[int]bool)
+		}
+		for _, seg := range admitted {
+			memberships[ch.UserID][seg.SegID] = true
+		}
+
+		if len(waitlisted) > 0 {
+			waitlist[i] = waitlisted
+		}
+
+		resolved = append(resolved, &entity.MembershipChange{
+			UserID:     ch.UserID,
+			SegListAdd: admitted,
+			SegListDel: ch.SegListDel,
+			ActiveFrom: ch.ActiveFrom,
+		})
+	}
+
+	if len(errs) == 0 {
+		return resolved, waitlist, nil
+	}
+	return resolved, waitlist, errs
+}
+
+// Promote picks the waitlisted users to add to the segment, in the order of
+// the waitlist, until it is full. eligible reports whether the user may be
+// added, a user who may not is skipped and keeps the place on the waitlist.
+func (c Capacities) Promote(segID int, waitlist []int, eligible func(int) (bool, error)) ([]int, error) {
+	capacity, ok := c[segID]
+	if !ok {
+		return nil, nil
+	}
+
+	promoted := make([]int, 0)
+	for _, userID := range waitlist {
+		if capacity.Members >= capacity.MaxMembers {
+			break
+		}
+
+		ok, err := eligible(userID)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			promoted = append(promoted, userID)
+			capacity.Members++
+		}
+	}
+	return promoted, nil
+}
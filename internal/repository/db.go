@@ -2,19 +2,82 @@ package repository
 
 import (
 	"database/sql"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
+// sqliteMemory is the path of a SQLite database that lives in memory.
+const sqliteMemory = ":memory:"
+
+// maxConnectBackoff caps the delay between connection attempts.
+const maxConnectBackoff = 10 * time.Second
+
+// NewDB opens the database selected by the config, sets up the connection
+// pool and waits for the database to answer, see Retry.
 func NewDB(config *Config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", config.DatabaseURL)
+	driverName, dsn := "postgres", config.PostgresURL()
+	if config.Driver() == DriverSQLite {
+		if !sqliteSupported {
+			return nil, ErrSQLiteNotSupported
+		}
+		driverName, dsn = "sqlite3", sqliteDSN(config.SQLitePath())
+	}
+
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+
+	// every connection to an in-memory database opens a new one,
+	// and the data is gone once the connection is closed
+	if config.Driver() == DriverSQLite && config.SQLitePath() == sqliteMemory {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+
+	if err := Retry(config.ConnectAttempts, config.ConnectBackoff, db.Ping); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// Retry calls fn until it succeeds or the attempts run out. The delay
+// between attempts starts at backoff and doubles up to maxConnectBackoff.
+// It is used wherever the service waits for the database at startup.
+func Retry(attempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= attempts {
+			return err
+		}
+
+		logrus.Printf("Database: connect error: %s, attempts left: %d", err, attempts-attempt)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// sqliteDSN turns on foreign keys, so that memberships are deleted with
+// their segment, and takes the write lock when a transaction begins,
+// so that concurrent transactions wait instead of failing to upgrade.
+func sqliteDSN(path string) string {
+	dsn := "file:" + path + "?_foreign_keys=on&_txlock=immediate&_busy_timeout=5000"
+	if path != sqliteMemory {
+		dsn += "&_journal_mode=WAL"
+	}
+	return dsn
+}
@@ -0,0 +1,5 @@
+//go:build !cgo
+
+package repository
+
+const sqliteSupported = false
@@ -0,0 +1,18 @@
+//go:build !cgo
+
+package repository_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDB_SQLite(t *testing.T) {
+	c := repository.NewConfig()
+	c.DatabaseURL = "sqlite://:memory:"
+
+	_, err := repository.NewDB(c)
+	assert.ErrorIs(t, err, repository.ErrSQLiteNotSupported)
+}
@@ -0,0 +1,9 @@
+//go:build cgo
+
+package repository
+
+import _ "github.com/mattn/go-sqlite3"
+
+// sqliteSupported reports whether the SQLite driver is built in,
+// it needs cgo.
+const sqliteSupported = true
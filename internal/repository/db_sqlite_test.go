@@ -0,0 +1,21 @@
+//go:build cgo
+
+package repository_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDB_SQLite(t *testing.T) {
+	c := repository.NewConfig()
+	c.DatabaseURL = "sqlite://:memory:"
+
+	db, err := repository.NewDB(c)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, 1, db.Stats().MaxOpenConnections)
+}
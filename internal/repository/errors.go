@@ -1,7 +1,76 @@
 package repository
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrRecordExists   = errors.New("record already exists")
+	ErrGroupConflict  = errors.New("exclusion group conflict")
+	ErrSegmentCycle   = errors.New("segment would be its own ancestor")
+	ErrHasChildren    = errors.New("segment has child segments")
+
+	ErrPrerequisiteMissing = errors.New("missing prerequisite")
+	ErrPrerequisiteCycle   = errors.New("segment would require itself")
+
+	ErrSegmentFull = errors.New("segment is full")
+
+	// ErrSQLiteNotSupported is returned for a SQLite database by a binary
+	// built without cgo, which the SQLite driver requires.
+	ErrSQLiteNotSupported = errors.New("sqlite not supported in this build")
 )
+
+// GroupConflictError names the segments of an exclusion group that
+// a change would give the user together.
+type GroupConflictError struct {
+	Group string
+	Slugs []string
+}
+
+func (e *GroupConflictError) Error() string {
+	return fmt.Sprintf("%s %s: %s", ErrGroupConflict, e.Group, strings.Join(e.Slugs, ", "))
+}
+
+func (e *GroupConflictError) Is(target error) bool {
+	return target == ErrGroupConflict
+}
+
+// PrerequisiteError names the prerequisites of a segment that a user
+// would be added to without.
+type PrerequisiteError struct {
+	Slug    string
+	Missing []string
+}
+
+func (e *PrerequisiteError) Error() string {
+	return fmt.Sprintf("%s of %s: %s", ErrPrerequisiteMissing, e.Slug, strings.Join(e.Missing, ", "))
+}
+
+func (e *PrerequisiteError) Is(target error) bool {
+	return target == ErrPrerequisiteMissing
+}
+
+// CapacityError names a full segment that a user would be added to.
+type CapacityError struct {
+	Slug string
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrSegmentFull, e.Slug)
+}
+
+func (e *CapacityError) Is(target error) bool {
+	return target == ErrSegmentFull
+}
+
+// MembershipChangeErrors is returned by ApplyMembershipChanges when some
+// of the changes are rejected. It maps the index of a rejected change to
+// its error, the other changes are applied.
+type MembershipChangeErrors map[int]error
+
+func (e MembershipChangeErrors) Error() string {
+	return fmt.Sprintf("%d membership changes rejected", len(e))
+}
@@ -0,0 +1,120 @@
+package repository
+
+import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+
+// ExclusionGroups maps the ID of a grouped segment to its exclusion group.
+type ExclusionGroups map[int]*entity.Group
+
+// Resolve checks the segments a user is added to against the exclusion
+// groups. memberships are the grouped segments the user is in, active or
+// pending. It returns the memberships to remove for the additions, those of
+// a group with the replace policy, or a *GroupConflictError. Adding two
+// segments of one group at once is a conflict whatever the policy, and so
+// is any conflict when replace is false.
+func (g ExclusionGroups) Resolve(memberships, add []*entity.Segment, replace bool) ([]*entity.Segment, error) {
+	adding := make(map[int]*entity.Segment)
+	for _, seg := range add {
+		group, ok := g[seg.SegID]
+		if !ok {
+			continue
+		}
+
+		if other, ok := adding[group.GroupID]; ok && other.SegID != seg.SegID {
+			return nil, &GroupConflictError{Group: group.Name, Slugs: []string{other.Slug, seg.Slug}}
+		}
+		adding[group.GroupID] = seg
+	}
+
+	held := make(map[int]bool, len(memberships))
+	for _, m := range memberships {
+		held[m.SegID] = true
+	}
+
+	removed := make([]*entity.Segment, 0)
+	for _, m := range memberships {
+		group, ok := g[m.SegID]
+		if !ok {
+			continue
+		}
+
+		// adding a segment the user is already in changes nothing
+		seg, ok := adding[group.GroupID]
+		if !ok || held[seg.SegID] {
+			continue
+		}
+
+		if !replace || group.Policy != entity.GroupPolicyReplace {
+			return nil, &GroupConflictError{Group: group.Name, Slugs: []string{m.Slug, seg.Slug}}
+		}
+		removed = append(removed, m)
+	}
+	return removed, nil
+}
+
+// ResolveChanges resolves the changes left by Capacities.ResolveChanges in
+// order, every change against the memberships left by the ones before it.
+// memberships maps a user to the grouped segments the user is in. rejected
+// are the errors of the changes left out before, by index among all the
+// changes. The replaced memberships are appended to SegListDel of the
+// changes that pass, the errors of the others are added to rejected.
+// A scheduled change replaces nothing, as the removal could not wait for
+// the addition to start.
+func (g ExclusionGroups) ResolveChanges(memberships map[int][]*entity.Segment, changes []*entity.MembershipChange, rejected MembershipChangeErrors) ([]*entity.MembershipChange, MembershipChangeErrors) {
+	resolved := make([]*entity.MembershipChange, 0, len(changes))
+	errs := make(MembershipChangeErrors, len(rejected))
+	for i, err := range rejected {
+		errs[i] = err
+	}
+
+	i := 0
+	for _, c := range changes {
+		for errs[i] != nil {
+			i++
+		}
+
+		kept := without(memberships[c.UserID], c.SegListDel)
+
+		removed, err := g.Resolve(kept, c.SegListAdd, c.ActiveFrom.IsZero())
+		if err != nil {
+			errs[i] = err
+			i++
+			continue
+		}
+		i++
+
+		kept = without(kept, removed)
+		for _, seg := range c.SegListAdd {
+			if _, ok := g[seg.SegID]; ok {
+				kept = append(without(kept, []*entity.Segment{seg}), seg)
+			}
+		}
+		memberships[c.UserID] = kept
+
+		resolved = append(resolved, &entity.MembershipChange{
+			UserID:     c.UserID,
+			SegListAdd: c.SegListAdd,
+			SegListDel: append(append([]*entity.Segment(nil), c.SegListDel...), removed...),
+			ActiveFrom: c.ActiveFrom,
+		})
+	}
+
+	if len(errs) == 0 {
+		return resolved, nil
+	}
+	return resolved, errs
+}
+
+func without(segList, drop []*entity.Segment) []*entity.Segment {
+	dropped := make(map[int]bool, len(drop))
+	for _, seg := range drop {
+		dropped[seg.SegID] = true
+	}
+
+	kept := make([]*entity.Segment, 0, len(segList))
+	for _, seg := range segList {
+		if !dropped[seg.SegID] {
+			kept = append(kept, seg)
+		}
+	}
+	return kept
+}
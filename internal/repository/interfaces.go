@@ -1,12 +1,64 @@
 package repository
 
-import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+import (
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
 
 type SegmentRepository interface {
 	Create(*entity.Segment) error
 	FindBySlug(string) (*entity.Segment, error)
+	FindAll() ([]*entity.Segment, error)
 	Delete(*entity.Segment) error
+	DeleteReparent(*entity.Segment) error
+	UpdateParent(*entity.Segment) error
 	AddUserToSegments(int, []*entity.Segment) error
 	DeleteUserFromSegments(int, []*entity.Segment) error
 	FindByUser(int) ([]*entity.Segment, error)
+	ImportUsersToSegment(*entity.Segment, UserIDReader) (*entity.ImportResult, error)
+	ExportSegmentMembers(*entity.Segment, func(int) error) error
+	ExportMemberships(func(*entity.Membership) error) error
+	ApplyMembershipChanges([]*entity.MembershipChange) error
+	ScheduleUserToSegments(int, []*entity.Segment, time.Time) error
+	FindPendingByUser(int) ([]*entity.PendingMembership, error)
+	CancelPendingUserSegments(int, []*entity.Segment) error
+	FindByUserAsOf(int, time.Time) ([]*entity.Segment, error)
+	TakeHistorySnapshot(time.Time) error
+	CreateGroup(*entity.Group) error
+	FindGroups() ([]*entity.Group, error)
+	DeleteGroup(*entity.Group) error
+	AddPrerequisite(*entity.Prerequisite) error
+	FindPrerequisites() ([]*entity.Prerequisite, error)
+	DeletePrerequisite(*entity.Prerequisite) error
+	SetCapacity(*entity.Capacity) error
+	FindCapacity(string) (*entity.Capacity, error)
+	DeleteCapacity(*entity.Capacity) error
+}
+
+// UserIDReader yields user IDs one by one and returns io.EOF when there are no more.
+type UserIDReader interface {
+	ReadUserID() (int, error)
+}
+
+type WebhookRepository interface {
+	Create(*entity.Webhook) error
+	FindAll() ([]*entity.Webhook, error)
+	Delete(int) error
+	FanOutEvents(int) (int, error)
+	ClaimDeliveries(int, time.Duration) ([]*entity.WebhookDelivery, error)
+	MarkDelivered(int) error
+	MarkFailed(int, string, time.Time, bool) error
+	FindDeliveries(int, string) ([]*entity.WebhookDelivery, error)
+	Redeliver(int) error
+}
+
+// EventRepository reads the outbox in a stable order and keeps
+// the relay offset of every event sink.
+type EventRepository interface {
+	SequenceEvents(int) (int, error)
+	FindAfter(int, int) ([]*entity.Event, error)
+	FindLastSeq() (int, error)
+	FindOffset(string) (int, error)
+	SaveOffset(string, int) error
 }
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// Prerequisites holds the segments every segment requires and, the other
+// way round, the segments that require it.
+type Prerequisites struct {
+	requires   map[int][]*entity.Segment
+	dependents map[int][]*entity.Segment
+}
+
+func NewPrerequisites() *Prerequisites {
+	return &Prerequisites{
+		requires:   make(map[int][]*entity.Segment),
+		dependents: make(map[int][]*entity.Segment),
+	}
+}
+
+// Add records that seg requires required.
+func (p *Prerequisites) Add(seg, required *entity.Segment) {
+	p.requires[seg.SegID] = append(p.requires[seg.SegID], required)
+	p.dependents[required.SegID] = append(p.dependents[required.SegID], seg)
+}
+
+// Empty reports whether no segment has prerequisites.
+func (p *Prerequisites) Empty() bool {
+	return len(p.requires) == 0
+}
+
+// Resolve checks one change of a user against the prerequisites.
+// memberships maps the segments the user is in to the start of the
+// membership, the zero time marks an active one. The additions start at
+// activeFrom, the zero time for right away.
+//
+// It returns the memberships to remove along with del: those that require
+// a removed segment, directly or through each other. An added segment needs
+// every prerequisite to be held by the time it starts or to be added with
+// it, otherwise a *PrerequisiteError is returned. Adding a segment the user
+// is already in is not checked.
+func (p *Prerequisites) Resolve(memberships map[int]time.Time, add, del []*entity.Segment, activeFrom time.Time) ([]*entity.Segment, error) {
+	removed := make(map[int]bool, len(del))
+	queue := make([]int, 0, len(del))
+	for _, seg := range del {
+		if _, ok := memberships[seg.SegID]; ok && !removed[seg.SegID] {
+			removed[seg.SegID] = true
+			queue = append(queue, seg.SegID)
+		}
+	}
+
+	cascaded := make([]*entity.Segment, 0)
+	for len(queue) > 0 {
+		segID := queue[0]
+		queue = queue[1:]
+
+		for _, dep := range p.dependents[segID] {
+			if _, ok := memberships[dep.SegID]; ok && !removed[dep.SegID] {
+				removed[dep.SegID] = true
+				queue = append(queue, dep.SegID)
+				cascaded = append(cascaded, dep)
+			}
+		}
+	}
+
+	adding := make(map[int]bool, len(add))
+	for _, seg := range add {
+		adding[seg.SegID] = true
+	}
+
+	held := func(segID int) bool {
+		start, ok := memberships[segID]
+		if !ok || removed[segID] {
+			return false
+		}
+		return start.IsZero() || !activeFrom.IsZero() && !start.After(activeFrom)
+	}
+
+	for _, seg := range add {
+		if held(seg.SegID) {
+			continue
+		}
+
+		missing := make([]string, 0)
+		for _, required := range p.requires[seg.SegID] {
+			if !adding[required.SegID] && !held(required.SegID) {
+				missing = append(missing, required.Slug)
+			}
+		}
+
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return nil, &PrerequisiteError{Slug: seg.Slug, Missing: missing}
+		}
+	}
+	return cascaded, nil
+}
+
+// ResolveChanges resolves the changes left by ExclusionGroups.ResolveChanges
+// in order, every change against the memberships left by the ones before
+// it. rejected are the errors of the changes the groups left out, by index
+// among all the changes. The cascaded removals are appended to SegListDel
+// of the changes that pass, the errors of the others are added to rejected.
+func (p *Prerequisites) ResolveChanges(memberships map[int]map[int]time.Time, changes []*entity.MembershipChange, rejected MembershipChangeErrors) ([]*entity.MembershipChange, MembershipChangeErrors) {
+	resolved := make([]*entity.MembershipChange, 0, len(changes))
+	errs := make(MembershipChangeErrors, len(rejected))
+	for i, err := range rejected {
+		errs[i] = err
+	}
+
+	i := 0
+	for _, c := range changes {
+		for errs[i] != nil {
+			i++
+		}
+
+		cascaded, err := p.Resolve(memberships[c.UserID], c.SegListAdd, c.SegListDel, c.ActiveFrom)
+		if err != nil {
+			errs[i] = err
+			i++
+			continue
+		}
+		i++
+
+		if memberships[c.UserID] == nil {
+			memberships[c.UserID] = make(map[int]time.Time)
+		}
+		for _, seg := range c.SegListDel {
+			delete(memberships[c.UserID], seg.SegID)
+		}
+		for _, seg := range cascaded {
+			delete(memberships[c.UserID], seg.SegID)
+		}
+		for _, seg := range c.SegListAdd {
+			// a scheduled addition leaves an active membership as it is
+			if start, ok := memberships[c.UserID][seg.SegID]; !ok || !start.IsZero() {
+				memberships[c.UserID][seg.SegID] = c.ActiveFrom
+			}
+		}
+
+		resolved = append(resolved, &entity.MembershipChange{
+			UserID:     c.UserID,
+			SegListAdd: c.SegListAdd,
+			SegListDel: append(append([]*entity.Segment(nil), c.SegListDel...), cascaded...),
+			ActiveFrom: c.ActiveFrom,
+		})
+	}
+
+	if len(errs) == 0 {
+		return resolved, nil
+	}
+	return resolved, errs
+}
@@ -0,0 +1,1167 @@
+// Package repositorytest holds the contract every storage backend must follow.
+// Backends run the suite from their own tests with a factory for empty repositories.
+package repositorytest
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// SegmentRepositoryFactory returns an empty repository. It is called once
+// for every test, resources should be released with t.Cleanup.
+type SegmentRepositoryFactory func(t *testing.T) repository.SegmentRepository
+
+// RunSegmentRepositoryTests checks the repository contract:
+//
+//   - looking up, deleting or referring to a missing segment gives ErrRecordNotFound,
+//     and a change that refers to one is not applied at all;
+//   - creating a segment with a taken slug gives ErrRecordExists, segment IDs
+//     are never reused;
+//   - adding an existing membership is not an error, adding a pending one
+//     activates it and the history no longer has it start at the scheduled
+//     time, as it does not after a reschedule; removing a missing membership
+//     is not an error;
+//   - deleting a segment removes its active and pending memberships;
+//   - a batch change is applied or rejected as a whole, its removals included,
+//     and the additions of a change with ActiveFrom are scheduled as
+//     ScheduleUserToSegments schedules them;
+//   - segments are listed by ID, pending memberships by start time, exports
+//     by user ID and slug, history by the time segments were added;
+//   - a user is added to one segment of an exclusion group at most: a conflict
+//     is rejected, or replaces the membership under the replace policy if the
+//     addition is immediate, and rejected batch changes leave the others applied;
+//   - a segment has one parent at most, a move that would make it its own
+//     ancestor gives ErrSegmentCycle and a segment with children can not be
+//     deleted (ErrHasChildren) unless DeleteReparent moves them to its parent
+//     with the delete;
+//   - a user is added to a segment only with all of its prerequisites, held
+//     by the time the membership starts or added with it (ErrPrerequisiteMissing),
+//     a prerequisite that would make a segment require itself gives
+//     ErrPrerequisiteCycle, and removing, cancelling or replacing a membership
+//     also removes the memberships that require it, recorded in the history;
+//   - a segment with a member limit takes new users while it has places, then
+//     rejects them (ErrSegmentFull) or puts immediate additions on a waitlist
+//     under the waitlist policy; scheduled additions and imports are never
+//     waitlisted, removing a user takes the user off the waitlist, and the
+//     places freed by a removal or a higher limit go to
+//     the waitlisted users in order, skipping those a group or a missing
+//     prerequisite would reject.
+func RunSegmentRepositoryTests(t *testing.T, factory SegmentRepositoryFactory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, repository.SegmentRepository)
+	}{
+		{"Create", testCreate},
+		{"CreateNeverReusesIDs", testCreateNeverReusesIDs},
+		{"FindBySlug", testFindBySlug},
+		{"FindAll", testFindAll},
+		{"Delete", testDelete},
+		{"DeleteCascades", testDeleteCascades},
+		{"CreateWithParent", testCreateWithParent},
+		{"UpdateParent", testUpdateParent},
+		{"UpdateParentCycle", testUpdateParentCycle},
+		{"DeleteWithChildren", testDeleteWithChildren},
+		{"DeleteReparent", testDeleteReparent},
+		{"AddUserToSegments", testAddUserToSegments},
+		{"AddUserToSegmentsUnknownSegment", testAddUserToSegmentsUnknownSegment},
+		{"AddUserToSegmentsActivatesPending", testAddUserToSegmentsActivatesPending},
+		{"DeleteUserFromSegments", testDeleteUserFromSegments},
+		{"FindByUser", testFindByUser},
+		{"ImportUsersToSegment", testImportUsersToSegment},
+		{"ExportSegmentMembers", testExportSegmentMembers},
+		{"ExportMemberships", testExportMemberships},
+		{"ApplyMembershipChanges", testApplyMembershipChanges},
+		{"ApplyMembershipChangesUnknownSegment", testApplyMembershipChangesUnknownSegment},
+		{"ApplyMembershipChangesScheduled", testApplyMembershipChangesScheduled},
+		{"ApplyMembershipChangesRejectsWhole", testApplyMembershipChangesRejectsWhole},
+		{"ScheduleUserToSegments", testScheduleUserToSegments},
+		{"FindPendingByUser", testFindPendingByUser},
+		{"CancelPendingUserSegments", testCancelPendingUserSegments},
+		{"FindByUserAsOf", testFindByUserAsOf},
+		{"FindByUserAsOfActivated", testFindByUserAsOfActivated},
+		{"FindByUserAsOfRescheduled", testFindByUserAsOfRescheduled},
+		{"TakeHistorySnapshot", testTakeHistorySnapshot},
+		{"CreateGroup", testCreateGroup},
+		{"DeleteGroup", testDeleteGroup},
+		{"GroupRejectsConflict", testGroupRejectsConflict},
+		{"GroupReplacesMembership", testGroupReplacesMembership},
+		{"GroupApplyMembershipChanges", testGroupApplyMembershipChanges},
+		{"GroupImportUsersToSegment", testGroupImportUsersToSegment},
+		{"AddPrerequisite", testAddPrerequisite},
+		{"DeletePrerequisite", testDeletePrerequisite},
+		{"PrerequisiteRejectsAddition", testPrerequisiteRejectsAddition},
+		{"PrerequisiteCascadesRemoval", testPrerequisiteCascadesRemoval},
+		{"PrerequisiteApplyMembershipChanges", testPrerequisiteApplyMembershipChanges},
+		{"PrerequisiteImportUsersToSegment", testPrerequisiteImportUsersToSegment},
+		{"SetCapacity", testSetCapacity},
+		{"DeleteCapacity", testDeleteCapacity},
+		{"CapacityRejectsAddition", testCapacityRejectsAddition},
+		{"CapacityWaitlist", testCapacityWaitlist},
+		{"CapacityPromotionSkipsConflicts", testCapacityPromotionSkipsConflicts},
+		{"CapacityApplyMembershipChanges", testCapacityApplyMembershipChanges},
+		{"CapacityImportUsersToSegment", testCapacityImportUsersToSegment},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
+
+// unknownSegment refers to a segment that was never created.
+var unknownSegment = &entity.Segment{SegID: 1 << 30, Slug: "UNKNOWN"}
+
+func createSegments(t *testing.T, r repository.SegmentRepository, slugs ...string) []*entity.Segment {
+	t.Helper()
+
+	segList := make([]*entity.Segment, 0, len(slugs))
+	for _, slug := range slugs {
+		seg := &entity.Segment{Slug: slug}
+		require.NoError(t, r.Create(seg))
+		segList = append(segList, seg)
+	}
+	return segList
+}
+
+func slugs(segList []*entity.Segment) []string {
+	res := make([]string, 0, len(segList))
+	for _, seg := range segList {
+		res = append(res, seg.Slug)
+	}
+	return res
+}
+
+func exportMemberships(t *testing.T, r repository.SegmentRepository) []string {
+	t.Helper()
+
+	res := make([]string, 0)
+	require.NoError(t, r.ExportMemberships(func(m *entity.Membership) error {
+		res = append(res, fmt.Sprintf("%d:%s", m.UserID, m.Slug))
+		return nil
+	}))
+	return res
+}
+
+func exportSegmentMembers(t *testing.T, r repository.SegmentRepository, seg *entity.Segment) []int {
+	t.Helper()
+
+	res := make([]int, 0)
+	require.NoError(t, r.ExportSegmentMembers(seg, func(userID int) error {
+		res = append(res, userID)
+		return nil
+	}))
+	return res
+}
+
+type userIDReader struct {
+	userIDs []int
+}
+
+func (r *userIDReader) ReadUserID() (int, error) {
+	if len(r.userIDs) == 0 {
+		return 0, io.EOF
+	}
+	userID := r.userIDs[0]
+	r.userIDs = r.userIDs[1:]
+	return userID, nil
+}
+
+func testCreate(t *testing.T, r repository.SegmentRepository) {
+	seg := &entity.Segment{Slug: " avito discount 30 "}
+	assert.NoError(t, r.Create(seg))
+	assert.NotZero(t, seg.SegID)
+	assert.Equal(t, "AVITO_DISCOUNT_30", seg.Slug)
+
+	assert.EqualError(t, r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_30"}), repository.ErrRecordExists.Error())
+
+	err := r.Create(&entity.Segment{Slug: "AVITO-DISCOUNT"})
+	assert.Error(t, err)
+	assert.NotEqual(t, repository.ErrRecordExists, err)
+}
+
+func testCreateNeverReusesIDs(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	assert.Less(t, segList[0].SegID, segList[1].SegID)
+
+	require.NoError(t, r.Delete(segList[1]))
+	seg := createSegments(t, r, "AVITO_DISCOUNT_50")[0]
+	assert.Greater(t, seg.SegID, segList[1].SegID)
+}
+
+func testFindBySlug(t *testing.T, r repository.SegmentRepository) {
+	_, err := r.FindBySlug("AVITO_DISCOUNT_30")
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	seg := createSegments(t, r, "AVITO_DISCOUNT_30")[0]
+	found, err := r.FindBySlug(seg.Slug)
+	assert.NoError(t, err)
+	assert.Equal(t, seg, found)
+}
+
+func testFindAll(t *testing.T, r repository.SegmentRepository) {
+	segList, err := r.FindAll()
+	assert.NoError(t, err)
+	assert.Empty(t, segList)
+
+	created := createSegments(t, r, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	assert.NoError(t, r.Delete(created[1]))
+
+	segList, err = r.FindAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Segment{created[0], created[2]}, segList)
+}
+
+func testDelete(t *testing.T, r repository.SegmentRepository) {
+	assert.EqualError(t, r.Delete(unknownSegment), repository.ErrRecordNotFound.Error())
+
+	seg := createSegments(t, r, "AVITO_DISCOUNT_30")[0]
+	assert.NoError(t, r.Delete(seg))
+	assert.EqualError(t, r.Delete(seg), repository.ErrRecordNotFound.Error())
+
+	_, err := r.FindBySlug(seg.Slug)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testDeleteCascades(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList))
+	require.NoError(t, r.ScheduleUserToSegments(2, segList[0:1], time.Now().Add(time.Hour)))
+
+	require.NoError(t, r.Delete(segList[0]))
+
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList[1:], found)
+
+	pendingList, err := r.FindPendingByUser(2)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_50"}, exportMemberships(t, r))
+
+	seg := createSegments(t, r, segList[0].Slug)[0]
+	assert.Empty(t, exportSegmentMembers(t, r, seg))
+}
+
+func testCreateWithParent(t *testing.T, r repository.SegmentRepository) {
+	parent := createSegments(t, r, "AVITO_DISCOUNT")[0]
+
+	child := &entity.Segment{Slug: "AVITO_DISCOUNT_30", Parent: parent.Slug}
+	require.NoError(t, r.Create(child))
+
+	found, err := r.FindBySlug(child.Slug)
+	assert.NoError(t, err)
+	assert.Equal(t, child, found)
+
+	assert.EqualError(t, r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_50", Parent: "UNKNOWN"}), repository.ErrRecordNotFound.Error())
+	_, err = r.FindBySlug("AVITO_DISCOUNT_50")
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testUpdateParent(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT", "AVITO_DISCOUNT_30")
+
+	assert.NoError(t, r.UpdateParent(&entity.Segment{Slug: segList[1].Slug, Parent: segList[0].Slug}))
+
+	found, err := r.FindAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", segList[0].Slug}, []string{found[0].Parent, found[1].Parent})
+
+	assert.NoError(t, r.UpdateParent(&entity.Segment{Slug: segList[1].Slug}))
+
+	found, err = r.FindAll()
+	assert.NoError(t, err)
+	assert.Equal(t, segList, found)
+
+	assert.EqualError(t, r.UpdateParent(&entity.Segment{Slug: unknownSegment.Slug}), repository.ErrRecordNotFound.Error())
+	assert.EqualError(t, r.UpdateParent(&entity.Segment{Slug: segList[1].Slug, Parent: unknownSegment.Slug}), repository.ErrRecordNotFound.Error())
+}
+
+func testUpdateParentCycle(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO", "AVITO_DISCOUNT", "AVITO_DISCOUNT_30")
+	require.NoError(t, r.UpdateParent(&entity.Segment{Slug: segList[1].Slug, Parent: segList[0].Slug}))
+	require.NoError(t, r.UpdateParent(&entity.Segment{Slug: segList[2].Slug, Parent: segList[1].Slug}))
+
+	err := r.UpdateParent(&entity.Segment{Slug: segList[0].Slug, Parent: segList[2].Slug})
+	assert.EqualError(t, err, repository.ErrSegmentCycle.Error())
+
+	found, err := r.FindBySlug(segList[0].Slug)
+	assert.NoError(t, err)
+	assert.Empty(t, found.Parent)
+}
+
+func testDeleteWithChildren(t *testing.T, r repository.SegmentRepository) {
+	parent := createSegments(t, r, "AVITO_DISCOUNT")[0]
+	child := &entity.Segment{Slug: "AVITO_DISCOUNT_30", Parent: parent.Slug}
+	require.NoError(t, r.Create(child))
+	require.NoError(t, r.AddUserToSegments(1, []*entity.Segment{parent}))
+
+	assert.EqualError(t, r.Delete(parent), repository.ErrHasChildren.Error())
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT"}, exportMemberships(t, r))
+
+	require.NoError(t, r.Delete(child))
+	assert.NoError(t, r.Delete(parent))
+}
+
+func testDeleteReparent(t *testing.T, r repository.SegmentRepository) {
+	root := createSegments(t, r, "AVITO")[0]
+	parent := &entity.Segment{Slug: "AVITO_DISCOUNT", Parent: root.Slug}
+	require.NoError(t, r.Create(parent))
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		require.NoError(t, r.Create(&entity.Segment{Slug: slug, Parent: parent.Slug}))
+	}
+	require.NoError(t, r.AddUserToSegments(1, []*entity.Segment{parent}))
+
+	assert.EqualError(t, r.DeleteReparent(unknownSegment), repository.ErrRecordNotFound.Error())
+	assert.NoError(t, r.DeleteReparent(parent))
+
+	segList, err := r.FindAll()
+	assert.NoError(t, err)
+	require.Len(t, segList, 3)
+	assert.Empty(t, segList[0].Parent)
+	assert.Equal(t, root.Slug, segList[1].Parent)
+	assert.Equal(t, root.Slug, segList[2].Parent)
+	assert.Empty(t, exportMemberships(t, r))
+
+	// the children of a root become roots
+	assert.NoError(t, r.DeleteReparent(root))
+	segList, err = r.FindAll()
+	assert.NoError(t, err)
+	require.Len(t, segList, 2)
+	assert.Empty(t, segList[0].Parent)
+	assert.Empty(t, segList[1].Parent)
+}
+
+func testAddUserToSegments(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+
+	assert.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	assert.NoError(t, r.AddUserToSegments(1, segList))
+	assert.NoError(t, r.AddUserToSegments(1, []*entity.Segment{segList[1], segList[1]}))
+
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList, found)
+}
+
+func testAddUserToSegmentsUnknownSegment(t *testing.T, r repository.SegmentRepository) {
+	seg := createSegments(t, r, "AVITO_DISCOUNT_30")[0]
+
+	err := r.AddUserToSegments(1, []*entity.Segment{seg, unknownSegment})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	_, err = r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testAddUserToSegmentsActivatesPending(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30")
+	require.NoError(t, r.ScheduleUserToSegments(1, segList, time.Now().Add(time.Hour)))
+
+	assert.NoError(t, r.AddUserToSegments(1, segList))
+
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList, found)
+
+	pendingList, err := r.FindPendingByUser(1)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+
+	// the scheduled start must not read as a removal later on
+	found, err = r.FindByUserAsOf(1, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, segList, found)
+}
+
+func testDeleteUserFromSegments(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+
+	assert.NoError(t, r.DeleteUserFromSegments(1, []*entity.Segment{segList[0], segList[1], unknownSegment}))
+	assert.NoError(t, r.DeleteUserFromSegments(1, segList))
+	assert.NoError(t, r.DeleteUserFromSegments(2, segList))
+
+	_, err := r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testFindByUser(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+
+	_, err := r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	require.NoError(t, r.ScheduleUserToSegments(1, segList[0:1], time.Now().Add(time.Hour)))
+	_, err = r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	require.NoError(t, r.AddUserToSegments(1, []*entity.Segment{segList[2], segList[1]}))
+	require.NoError(t, r.AddUserToSegments(2, segList[0:1]))
+
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList[1:], found)
+}
+
+func testImportUsersToSegment(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30")
+	require.NoError(t, r.AddUserToSegments(1, segList))
+
+	res, err := r.ImportUsersToSegment(segList[0], &userIDReader{userIDs: []int{1, 2, 3, 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Accepted)
+	assert.Equal(t, 2, res.Duplicate)
+	assert.Equal(t, []int{1, 2, 3}, exportSegmentMembers(t, r, segList[0]))
+
+	res, err = r.ImportUsersToSegment(segList[0], &userIDReader{userIDs: []int{2, 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Accepted)
+	assert.Equal(t, 2, res.Duplicate)
+
+	_, err = r.ImportUsersToSegment(unknownSegment, &userIDReader{userIDs: []int{4}})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testExportSegmentMembers(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(3, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(1, segList))
+	require.NoError(t, r.AddUserToSegments(2, segList[1:2]))
+	require.NoError(t, r.ScheduleUserToSegments(4, segList[0:1], time.Now().Add(time.Hour)))
+
+	assert.Equal(t, []int{1, 3}, exportSegmentMembers(t, r, segList[0]))
+}
+
+func testExportMemberships(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30")
+	require.NoError(t, r.AddUserToSegments(2, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(1, segList))
+	require.NoError(t, r.ScheduleUserToSegments(3, segList[0:1], time.Now().Add(time.Hour)))
+
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_30", "1:AVITO_DISCOUNT_50", "2:AVITO_DISCOUNT_50"}, exportMemberships(t, r))
+}
+
+func testApplyMembershipChanges(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(3, segList[0:1], time.Now().Add(time.Hour)))
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[1:2], SegListDel: segList[0:1]},
+		{UserID: 2, SegListAdd: segList, SegListDel: segList},
+		{UserID: 2, SegListAdd: segList[0:1]},
+		{UserID: 3, SegListAdd: segList[0:1]},
+	})
+	assert.NoError(t, err)
+
+	// removals are applied before additions
+	assert.Equal(t, []string{
+		"1:AVITO_DISCOUNT_50",
+		"2:AVITO_DISCOUNT_30",
+		"2:AVITO_DISCOUNT_50",
+		"3:AVITO_DISCOUNT_30",
+	}, exportMemberships(t, r))
+}
+
+func testApplyMembershipChangesUnknownSegment(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30")
+	require.NoError(t, r.AddUserToSegments(1, segList))
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListDel: segList},
+		{UserID: 2, SegListAdd: []*entity.Segment{unknownSegment}},
+	})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_30"}, exportMemberships(t, r))
+}
+
+func testApplyMembershipChangesScheduled(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES")
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(1, segList[1:2], time.Now().Add(2*time.Hour)))
+
+	activeFrom := time.Now().Add(time.Hour)
+	assert.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList, ActiveFrom: activeFrom},
+	}))
+
+	// the active membership is kept, the pending one is rescheduled
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList[0:1], found)
+
+	pendingList, err := r.FindPendingByUser(1)
+	assert.NoError(t, err)
+	require.Len(t, pendingList, 2)
+	for _, p := range pendingList {
+		assert.WithinDuration(t, activeFrom, p.ActiveFrom, time.Millisecond)
+	}
+}
+
+func testApplyMembershipChangesRejectsWhole(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES")
+	createGroup(t, r, "discounts", entity.GroupPolicyReplace, segList[0:2])
+	setCapacity(t, r, segList[2], 1, entity.OverflowPolicyWaitlist)
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(2, segList[2:3]))
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[2:3], SegListDel: segList[0:1], ActiveFrom: time.Now().Add(time.Hour)},
+		{UserID: 1, SegListAdd: segList[1:2], ActiveFrom: time.Now().Add(time.Hour)},
+	})
+
+	// a scheduled addition neither waits for a place nor replaces a membership
+	var errs repository.MembershipChangeErrors
+	require.ErrorAs(t, err, &errs)
+	assert.ErrorIs(t, errs[0], repository.ErrSegmentFull)
+	assert.ErrorIs(t, errs[1], repository.ErrGroupConflict)
+
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_30", "2:AVITO_VOICE_MESSAGES"}, exportMemberships(t, r))
+	assert.Equal(t, 0, findCapacity(t, r, segList[2]).Waitlisted)
+}
+
+func testScheduleUserToSegments(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+
+	activeFrom := time.Now().Add(time.Hour)
+	assert.NoError(t, r.ScheduleUserToSegments(1, segList, time.Now().Add(2*time.Hour)))
+	assert.NoError(t, r.ScheduleUserToSegments(1, segList, activeFrom))
+
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList[0:1], found)
+
+	pendingList, err := r.FindPendingByUser(1)
+	assert.NoError(t, err)
+	require.Len(t, pendingList, 1)
+	assert.Equal(t, segList[1].Slug, pendingList[0].Slug)
+	assert.WithinDuration(t, activeFrom, pendingList[0].ActiveFrom, time.Millisecond)
+
+	err = r.ScheduleUserToSegments(2, []*entity.Segment{segList[0], unknownSegment}, activeFrom)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	pendingList, err = r.FindPendingByUser(2)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+}
+
+func testFindPendingByUser(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+
+	pendingList, err := r.FindPendingByUser(1)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+
+	require.NoError(t, r.ScheduleUserToSegments(1, segList[0:1], time.Now().Add(2*time.Hour)))
+	require.NoError(t, r.ScheduleUserToSegments(1, segList[1:2], time.Now().Add(time.Hour)))
+
+	pendingList, err = r.FindPendingByUser(1)
+	assert.NoError(t, err)
+	require.Len(t, pendingList, 2)
+	assert.Equal(t, []string{"AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"}, []string{pendingList[0].Slug, pendingList[1].Slug})
+}
+
+func testCancelPendingUserSegments(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(1, segList[1:2], time.Now().Add(time.Hour)))
+
+	assert.NoError(t, r.CancelPendingUserSegments(1, append(segList, unknownSegment)))
+
+	found, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, segList[0:1], found)
+
+	pendingList, err := r.FindPendingByUser(1)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+}
+
+func testFindByUserAsOf(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+
+	beforeAdd := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, r.AddUserToSegments(1, segList[1:2]))
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(2, segList[0:1], time.Now().Add(time.Hour)))
+	time.Sleep(10 * time.Millisecond)
+	afterAdd := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, r.DeleteUserFromSegments(1, segList[1:2]))
+	require.NoError(t, r.Delete(segList[0]))
+
+	_, err := r.FindByUserAsOf(1, beforeAdd)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	found, err := r.FindByUserAsOf(1, afterAdd)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"}, slugs(found))
+
+	_, err = r.FindByUserAsOf(1, time.Now())
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	_, err = r.FindByUserAsOf(2, afterAdd)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testFindByUserAsOfActivated(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	activeFrom := time.Now().Add(time.Hour)
+	require.NoError(t, r.ScheduleUserToSegments(1, segList, activeFrom))
+
+	// the pending memberships are started early and the user removed
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{{UserID: 1, SegListAdd: segList[1:2]}}))
+
+	found, err := r.FindByUserAsOf(1, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}, slugs(found))
+
+	require.NoError(t, r.DeleteUserFromSegments(1, segList))
+
+	_, err = r.FindByUserAsOf(1, activeFrom.Add(time.Minute))
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testFindByUserAsOfRescheduled(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30")
+	now := time.Now()
+
+	// user 1 is rescheduled earlier, user 2 later, user 3 earlier by a batch change
+	require.NoError(t, r.ScheduleUserToSegments(1, segList, now.Add(2*time.Hour)))
+	require.NoError(t, r.ScheduleUserToSegments(1, segList, now.Add(time.Hour)))
+	require.NoError(t, r.ScheduleUserToSegments(2, segList, now.Add(time.Hour)))
+	require.NoError(t, r.ScheduleUserToSegments(2, segList, now.Add(2*time.Hour)))
+	require.NoError(t, r.ScheduleUserToSegments(3, segList, now.Add(2*time.Hour)))
+	require.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 3, SegListAdd: segList, ActiveFrom: now.Add(time.Hour)},
+	}))
+
+	asOf := func(userID int, at time.Time) []string {
+		found, err := r.FindByUserAsOf(userID, at)
+		if err == repository.ErrRecordNotFound {
+			return nil
+		}
+		require.NoError(t, err)
+		return slugs(found)
+	}
+
+	for _, userID := range []int{1, 3} {
+		assert.Nil(t, asOf(userID, now.Add(30*time.Minute)))
+		assert.Equal(t, []string{"AVITO_DISCOUNT_30"}, asOf(userID, now.Add(90*time.Minute)))
+		assert.Equal(t, []string{"AVITO_DISCOUNT_30"}, asOf(userID, now.Add(3*time.Hour)))
+	}
+
+	assert.Nil(t, asOf(2, now.Add(90*time.Minute)))
+	assert.Equal(t, []string{"AVITO_DISCOUNT_30"}, asOf(2, now.Add(3*time.Hour)))
+}
+
+func testTakeHistorySnapshot(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList))
+	time.Sleep(10 * time.Millisecond)
+
+	assert.NoError(t, r.TakeHistorySnapshot(time.Now()))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, r.DeleteUserFromSegments(1, segList[0:1]))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, r.TakeHistorySnapshot(time.Now()))
+
+	found, err := r.FindByUserAsOf(1, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, segList[1:], found)
+}
+
+func createGroup(t *testing.T, r repository.SegmentRepository, name, policy string, segList []*entity.Segment) {
+	t.Helper()
+
+	require.NoError(t, r.CreateGroup(&entity.Group{Name: name, Policy: policy, Slugs: slugs(segList)}))
+}
+
+func testCreateGroup(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES")
+
+	g := &entity.Group{Name: "discounts", Policy: entity.GroupPolicyReject, Slugs: slugs(segList[0:2])}
+	assert.NoError(t, r.CreateGroup(g))
+	assert.NotZero(t, g.GroupID)
+
+	err := r.CreateGroup(&entity.Group{Name: "discounts", Policy: entity.GroupPolicyReject, Slugs: slugs(segList[1:3])})
+	assert.EqualError(t, err, repository.ErrRecordExists.Error())
+
+	// a segment belongs to one group at most
+	err = r.CreateGroup(&entity.Group{Name: "voice", Policy: entity.GroupPolicyReject, Slugs: slugs(segList[1:3])})
+	assert.EqualError(t, err, repository.ErrRecordExists.Error())
+
+	err = r.CreateGroup(&entity.Group{Name: "voice", Policy: entity.GroupPolicyReject, Slugs: []string{"AVITO_VOICE_MESSAGES", "UNKNOWN"}})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	groups, err := r.FindGroups()
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Group{g}, groups)
+}
+
+func testDeleteGroup(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_70")
+	createGroup(t, r, "discounts", entity.GroupPolicyReject, segList)
+
+	// deleting a segment takes it out of its group
+	require.NoError(t, r.Delete(segList[2]))
+	groups, err := r.FindGroups()
+	assert.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, slugs(segList[0:2]), groups[0].Slugs)
+
+	assert.NoError(t, r.DeleteGroup(&entity.Group{Name: "discounts"}))
+	assert.EqualError(t, r.DeleteGroup(&entity.Group{Name: "discounts"}), repository.ErrRecordNotFound.Error())
+
+	groups, err = r.FindGroups()
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+
+	// the segments are not grouped anymore
+	assert.NoError(t, r.AddUserToSegments(1, segList[0:2]))
+}
+
+func testGroupRejectsConflict(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES")
+	createGroup(t, r, "discounts", entity.GroupPolicyReject, segList[0:2])
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+
+	err := r.AddUserToSegments(1, segList[1:3])
+	assert.ErrorIs(t, err, repository.ErrGroupConflict)
+
+	err = r.ScheduleUserToSegments(1, segList[1:2], time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, repository.ErrGroupConflict)
+
+	err = r.AddUserToSegments(2, segList[0:2])
+	assert.ErrorIs(t, err, repository.ErrGroupConflict)
+
+	// adding a segment the user is already in changes nothing
+	assert.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_30"}, exportMemberships(t, r))
+}
+
+func testGroupReplacesMembership(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	createGroup(t, r, "discounts", entity.GroupPolicyReplace, segList)
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+
+	assert.NoError(t, r.AddUserToSegments(1, segList[1:2]))
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_50"}, exportMemberships(t, r))
+
+	// a scheduled addition never replaces a membership
+	err := r.ScheduleUserToSegments(1, segList[0:1], time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, repository.ErrGroupConflict)
+
+	err = r.AddUserToSegments(2, segList)
+	assert.ErrorIs(t, err, repository.ErrGroupConflict)
+}
+
+func testGroupApplyMembershipChanges(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES", "AVITO_VIDEO_MESSAGES")
+	createGroup(t, r, "discounts", entity.GroupPolicyReplace, segList[0:2])
+	createGroup(t, r, "messages", entity.GroupPolicyReject, segList[2:4])
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(2, segList[2:3]))
+	require.NoError(t, r.AddUserToSegments(3, segList[2:3]))
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[1:2]},
+		{UserID: 2, SegListAdd: segList[3:4]},
+		{UserID: 3, SegListAdd: segList[3:4], SegListDel: segList[2:3]},
+	})
+
+	var errs repository.MembershipChangeErrors
+	require.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[1], repository.ErrGroupConflict)
+
+	assert.Equal(t, []string{
+		"1:AVITO_DISCOUNT_50",
+		"2:AVITO_VOICE_MESSAGES",
+		"3:AVITO_VIDEO_MESSAGES",
+	}, exportMemberships(t, r))
+}
+
+func testGroupImportUsersToSegment(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES", "AVITO_VIDEO_MESSAGES")
+	createGroup(t, r, "discounts", entity.GroupPolicyReject, segList[0:2])
+	createGroup(t, r, "messages", entity.GroupPolicyReplace, segList[2:4])
+	require.NoError(t, r.AddUserToSegments(1, []*entity.Segment{segList[1], segList[3]}))
+
+	res, err := r.ImportUsersToSegment(segList[0], &userIDReader{userIDs: []int{1, 2, 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Equal(t, 1, res.Duplicate)
+	assert.Equal(t, 1, res.Rejected)
+
+	res, err = r.ImportUsersToSegment(segList[2], &userIDReader{userIDs: []int{1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Equal(t, 0, res.Rejected)
+
+	assert.Equal(t, []string{
+		"1:AVITO_DISCOUNT_50",
+		"1:AVITO_VOICE_MESSAGES",
+		"2:AVITO_DISCOUNT_30",
+	}, exportMemberships(t, r))
+}
+
+func addPrerequisite(t *testing.T, r repository.SegmentRepository, seg, required *entity.Segment) {
+	t.Helper()
+
+	require.NoError(t, r.AddPrerequisite(&entity.Prerequisite{Slug: seg.Slug, Requires: required.Slug}))
+}
+
+func testAddPrerequisite(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS_ALPHA")
+
+	p := &entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"}
+	assert.NoError(t, r.AddPrerequisite(p))
+	assert.EqualError(t, r.AddPrerequisite(p), repository.ErrRecordExists.Error())
+
+	err := r.AddPrerequisite(&entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "UNKNOWN"})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	addPrerequisite(t, r, segList[2], segList[1])
+
+	// the prerequisites of a prerequisite count as well
+	err = r.AddPrerequisite(&entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS", Requires: "AVITO_PERFORMANCE_VAS_ALPHA"})
+	assert.EqualError(t, err, repository.ErrPrerequisiteCycle.Error())
+
+	prereqs, err := r.FindPrerequisites()
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Prerequisite{
+		{Slug: "AVITO_PERFORMANCE_VAS_ALPHA", Requires: "AVITO_PERFORMANCE_VAS_BETA"},
+		{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"},
+	}, prereqs)
+}
+
+func testDeletePrerequisite(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS_ALPHA")
+	addPrerequisite(t, r, segList[1], segList[0])
+	addPrerequisite(t, r, segList[2], segList[0])
+
+	// deleting a segment drops its prerequisites
+	require.NoError(t, r.Delete(segList[2]))
+
+	p := &entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"}
+	assert.NoError(t, r.DeletePrerequisite(p))
+	assert.EqualError(t, r.DeletePrerequisite(p), repository.ErrRecordNotFound.Error())
+
+	prereqs, err := r.FindPrerequisites()
+	assert.NoError(t, err)
+	assert.Empty(t, prereqs)
+
+	// the segment does not require the other one anymore
+	assert.NoError(t, r.AddUserToSegments(1, segList[1:2]))
+}
+
+func testPrerequisiteRejectsAddition(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA")
+	addPrerequisite(t, r, segList[1], segList[0])
+
+	err := r.AddUserToSegments(1, segList[1:2])
+	var prereqErr *repository.PrerequisiteError
+	require.ErrorAs(t, err, &prereqErr)
+	assert.Equal(t, "AVITO_PERFORMANCE_VAS_BETA", prereqErr.Slug)
+	assert.Equal(t, []string{"AVITO_PERFORMANCE_VAS"}, prereqErr.Missing)
+
+	// a prerequisite added along with the segment is enough
+	assert.NoError(t, r.AddUserToSegments(1, segList))
+
+	// a scheduled membership needs the prerequisite by the time it starts
+	now := time.Now()
+	require.NoError(t, r.ScheduleUserToSegments(2, segList[0:1], now.Add(2*time.Hour)))
+	err = r.ScheduleUserToSegments(2, segList[1:2], now.Add(time.Hour))
+	assert.ErrorIs(t, err, repository.ErrPrerequisiteMissing)
+	assert.NoError(t, r.ScheduleUserToSegments(2, segList[1:2], now.Add(3*time.Hour)))
+
+	err = r.AddUserToSegments(2, segList[1:2])
+	assert.ErrorIs(t, err, repository.ErrPrerequisiteMissing)
+
+	assert.Equal(t, []string{"1:AVITO_PERFORMANCE_VAS", "1:AVITO_PERFORMANCE_VAS_BETA"}, exportMemberships(t, r))
+}
+
+func testPrerequisiteCascadesRemoval(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS_ALPHA", "AVITO_PERFORMANCE_VAS_LITE")
+	addPrerequisite(t, r, segList[1], segList[0])
+	addPrerequisite(t, r, segList[2], segList[1])
+	createGroup(t, r, "vas", entity.GroupPolicyReplace, []*entity.Segment{segList[0], segList[3]})
+
+	require.NoError(t, r.AddUserToSegments(1, segList[0:3]))
+	require.NoError(t, r.AddUserToSegments(2, segList[0:3]))
+	time.Sleep(10 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// the removal goes down the chain of prerequisites
+	assert.NoError(t, r.DeleteUserFromSegments(1, segList[0:1]))
+
+	// a replaced membership is a removal as well
+	assert.NoError(t, r.AddUserToSegments(2, segList[3:4]))
+
+	assert.Equal(t, []string{"2:AVITO_PERFORMANCE_VAS_LITE"}, exportMemberships(t, r))
+
+	found, err := r.FindByUserAsOf(1, beforeDelete)
+	assert.NoError(t, err)
+	assert.Equal(t, slugs(segList[0:3]), slugs(found))
+
+	_, err = r.FindByUserAsOf(1, time.Now())
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	// cancelling a pending membership cancels the pending ones that require it
+	require.NoError(t, r.AddUserToSegments(3, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(3, segList[1:2], time.Now().Add(time.Hour)))
+	assert.NoError(t, r.CancelPendingUserSegments(3, segList[0:1]))
+	pendingList, err := r.FindPendingByUser(3)
+	assert.NoError(t, err)
+	require.Len(t, pendingList, 1)
+
+	require.NoError(t, r.DeleteUserFromSegments(3, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(3, segList[0:1], time.Now().Add(time.Hour)))
+	require.NoError(t, r.ScheduleUserToSegments(3, segList[1:2], time.Now().Add(2*time.Hour)))
+	assert.NoError(t, r.CancelPendingUserSegments(3, segList[0:1]))
+	pendingList, err = r.FindPendingByUser(3)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+}
+
+func testPrerequisiteApplyMembershipChanges(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA", "AVITO_VOICE_MESSAGES")
+	addPrerequisite(t, r, segList[1], segList[0])
+	require.NoError(t, r.AddUserToSegments(3, segList[0:2]))
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[0:2]},
+		{UserID: 2, SegListAdd: segList[1:3]},
+		{UserID: 3, SegListAdd: segList[2:3], SegListDel: segList[0:1]},
+	})
+
+	var errs repository.MembershipChangeErrors
+	require.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[1], repository.ErrPrerequisiteMissing)
+
+	assert.Equal(t, []string{
+		"1:AVITO_PERFORMANCE_VAS",
+		"1:AVITO_PERFORMANCE_VAS_BETA",
+		"3:AVITO_VOICE_MESSAGES",
+	}, exportMemberships(t, r))
+}
+
+func testPrerequisiteImportUsersToSegment(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA")
+	addPrerequisite(t, r, segList[1], segList[0])
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(2, segList[0:1], time.Now().Add(time.Hour)))
+
+	// an import adds the users right away, a pending prerequisite is not enough
+	res, err := r.ImportUsersToSegment(segList[1], &userIDReader{userIDs: []int{1, 1, 2, 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Equal(t, 1, res.Duplicate)
+	assert.Equal(t, 2, res.Rejected)
+
+	assert.Equal(t, []int{1}, exportSegmentMembers(t, r, segList[1]))
+}
+
+func setCapacity(t *testing.T, r repository.SegmentRepository, seg *entity.Segment, maxMembers int, overflow string) {
+	t.Helper()
+
+	require.NoError(t, r.SetCapacity(&entity.Capacity{Slug: seg.Slug, MaxMembers: maxMembers, Overflow: overflow}))
+}
+
+func findCapacity(t *testing.T, r repository.SegmentRepository, seg *entity.Segment) *entity.Capacity {
+	t.Helper()
+
+	c, err := r.FindCapacity(seg.Slug)
+	require.NoError(t, err)
+	return c
+}
+
+func testSetCapacity(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(2, segList[0:1]))
+
+	// the users already in the segment are kept
+	setCapacity(t, r, segList[0], 1, entity.OverflowPolicyReject)
+	assert.Equal(t, &entity.Capacity{
+		Slug:       "AVITO_DISCOUNT_30",
+		MaxMembers: 1,
+		Overflow:   entity.OverflowPolicyReject,
+		Members:    2,
+	}, findCapacity(t, r, segList[0]))
+
+	setCapacity(t, r, segList[0], 5, entity.OverflowPolicyWaitlist)
+	c := findCapacity(t, r, segList[0])
+	assert.Equal(t, entity.OverflowPolicyWaitlist, c.Overflow)
+	assert.Equal(t, 3, c.Remaining)
+
+	err := r.SetCapacity(&entity.Capacity{Slug: "UNKNOWN", MaxMembers: 1, Overflow: entity.OverflowPolicyReject})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	assert.Error(t, r.SetCapacity(&entity.Capacity{Slug: "AVITO_DISCOUNT_50", Overflow: entity.OverflowPolicyReject}))
+
+	_, err = r.FindCapacity("AVITO_DISCOUNT_50")
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func testDeleteCapacity(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	setCapacity(t, r, segList[0], 1, entity.OverflowPolicyWaitlist)
+	setCapacity(t, r, segList[1], 1, entity.OverflowPolicyReject)
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(2, segList[0:1]))
+
+	// deleting a segment drops its limit
+	require.NoError(t, r.Delete(segList[1]))
+	_, err := r.FindCapacity("AVITO_DISCOUNT_50")
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	c := &entity.Capacity{Slug: "AVITO_DISCOUNT_30"}
+	assert.NoError(t, r.DeleteCapacity(c))
+	assert.EqualError(t, r.DeleteCapacity(c), repository.ErrRecordNotFound.Error())
+
+	// the waitlist is dropped along with the limit
+	setCapacity(t, r, segList[0], 2, entity.OverflowPolicyWaitlist)
+	assert.Equal(t, []int{1}, exportSegmentMembers(t, r, segList[0]))
+
+	assert.NoError(t, r.DeleteCapacity(c))
+	assert.NoError(t, r.AddUserToSegments(3, segList[0:1]))
+	assert.NoError(t, r.AddUserToSegments(4, segList[0:1]))
+	assert.Equal(t, []int{1, 3, 4}, exportSegmentMembers(t, r, segList[0]))
+}
+
+func testCapacityRejectsAddition(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES")
+	setCapacity(t, r, segList[0], 1, entity.OverflowPolicyReject)
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+
+	err := r.AddUserToSegments(2, segList)
+	var capErr *repository.CapacityError
+	require.ErrorAs(t, err, &capErr)
+	assert.Equal(t, "AVITO_DISCOUNT_30", capErr.Slug)
+	assert.ErrorIs(t, err, repository.ErrSegmentFull)
+
+	err = r.ScheduleUserToSegments(2, segList[0:1], time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, repository.ErrSegmentFull)
+
+	// adding a segment the user is already in takes no place
+	assert.NoError(t, r.AddUserToSegments(1, segList))
+
+	// a pending membership takes a place as well
+	require.NoError(t, r.DeleteUserFromSegments(1, segList[0:1]))
+	require.NoError(t, r.ScheduleUserToSegments(2, segList[0:1], time.Now().Add(time.Hour)))
+	err = r.AddUserToSegments(3, segList[0:1])
+	assert.ErrorIs(t, err, repository.ErrSegmentFull)
+
+	assert.Equal(t, []string{"1:AVITO_VOICE_MESSAGES"}, exportMemberships(t, r))
+}
+
+func testCapacityWaitlist(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30")
+	setCapacity(t, r, segList[0], 1, entity.OverflowPolicyWaitlist)
+	require.NoError(t, r.AddUserToSegments(1, segList))
+
+	assert.NoError(t, r.AddUserToSegments(2, segList))
+	assert.NoError(t, r.AddUserToSegments(3, segList))
+	assert.NoError(t, r.AddUserToSegments(2, segList))
+	assert.Equal(t, 2, findCapacity(t, r, segList[0]).Waitlisted)
+
+	// a scheduled addition does not wait for a place
+	err := r.ScheduleUserToSegments(4, segList, time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, repository.ErrSegmentFull)
+
+	// a removal frees the place for the first user on the waitlist
+	require.NoError(t, r.DeleteUserFromSegments(1, segList))
+	assert.Equal(t, []int{2}, exportSegmentMembers(t, r, segList[0]))
+
+	// removing a waitlisted user takes the user off the waitlist
+	require.NoError(t, r.DeleteUserFromSegments(3, segList))
+	assert.Equal(t, 0, findCapacity(t, r, segList[0]).Waitlisted)
+
+	// a higher limit gives out the new places
+	require.NoError(t, r.AddUserToSegments(4, segList))
+	require.NoError(t, r.AddUserToSegments(5, segList))
+	setCapacity(t, r, segList[0], 2, entity.OverflowPolicyWaitlist)
+	assert.Equal(t, []int{2, 4}, exportSegmentMembers(t, r, segList[0]))
+
+	c := findCapacity(t, r, segList[0])
+	assert.Equal(t, 2, c.Members)
+	assert.Equal(t, 0, c.Remaining)
+	assert.Equal(t, 1, c.Waitlisted)
+}
+
+func testCapacityPromotionSkipsConflicts(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	createGroup(t, r, "discounts", entity.GroupPolicyReject, segList)
+	setCapacity(t, r, segList[0], 1, entity.OverflowPolicyWaitlist)
+	require.NoError(t, r.AddUserToSegments(1, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(2, segList[0:1]))
+	require.NoError(t, r.AddUserToSegments(3, segList[0:1]))
+
+	// the waitlisted user joins the other segment of the group meanwhile
+	require.NoError(t, r.AddUserToSegments(2, segList[1:2]))
+
+	require.NoError(t, r.DeleteUserFromSegments(1, segList[0:1]))
+	assert.Equal(t, []int{3}, exportSegmentMembers(t, r, segList[0]))
+	assert.Equal(t, 1, findCapacity(t, r, segList[0]).Waitlisted)
+}
+
+func testCapacityApplyMembershipChanges(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES")
+	setCapacity(t, r, segList[0], 1, entity.OverflowPolicyReject)
+	setCapacity(t, r, segList[1], 1, entity.OverflowPolicyWaitlist)
+	require.NoError(t, r.AddUserToSegments(1, segList))
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 2, SegListAdd: segList[0:1]},
+		{UserID: 3, SegListAdd: segList[1:2]},
+		{UserID: 1, SegListDel: segList},
+	})
+
+	var errs repository.MembershipChangeErrors
+	require.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], repository.ErrSegmentFull)
+
+	// the freed places are not given out within the changes, the waitlist
+	// gets them once the changes are applied
+	assert.Equal(t, []string{"3:AVITO_VOICE_MESSAGES"}, exportMemberships(t, r))
+
+	// a removal takes the user off the waitlist
+	require.NoError(t, r.AddUserToSegments(4, segList[1:2]))
+	assert.Equal(t, 1, findCapacity(t, r, segList[1]).Waitlisted)
+	assert.NoError(t, r.ApplyMembershipChanges([]*entity.MembershipChange{{UserID: 4, SegListDel: segList[1:2]}}))
+	assert.Equal(t, 0, findCapacity(t, r, segList[1]).Waitlisted)
+}
+
+func testCapacityImportUsersToSegment(t *testing.T, r repository.SegmentRepository) {
+	segList := createSegments(t, r, "AVITO_DISCOUNT_30")
+	setCapacity(t, r, segList[0], 2, entity.OverflowPolicyWaitlist)
+	require.NoError(t, r.AddUserToSegments(1, segList))
+
+	// the users that fit are let in in the order of the source
+	res, err := r.ImportUsersToSegment(segList[0], &userIDReader{userIDs: []int{3, 3, 2, 4, 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Equal(t, 2, res.Duplicate)
+	assert.Equal(t, 2, res.Rejected)
+
+	assert.Equal(t, []int{1, 3}, exportSegmentMembers(t, r, segList[0]))
+	assert.Equal(t, 0, findCapacity(t, r, segList[0]).Waitlisted)
+}
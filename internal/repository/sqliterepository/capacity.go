@@ -0,0 +1,198 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// SetCapacity limits the number of users in the segment. The users already
+// in it are kept, a higher limit promotes users from the waitlist.
+func (r *SegmentRepository) SetCapacity(c *entity.Capacity) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		seg := &entity.Segment{}
+		err := tx.QueryRow("SELECT seg_id, slug FROM segments WHERE slug = ?", c.Slug).Scan(&seg.SegID, &seg.Slug)
+		if err == sql.ErrNoRows {
+			return repository.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`INSERT INTO segment_capacities (seg_id, max_members, overflow) VALUES (?, ?, ?)
+			ON CONFLICT (seg_id) DO UPDATE SET max_members = excluded.max_members, overflow = excluded.overflow`,
+			seg.SegID, c.MaxMembers, c.Overflow); err != nil {
+			return err
+		}
+		return promoteWaitlists(tx, []*entity.Segment{seg}, now)
+	})
+}
+
+func (r *SegmentRepository) FindCapacity(slug string) (*entity.Capacity, error) {
+	c := &entity.Capacity{}
+	if err := r.db.QueryRow(
+		`SELECT s.slug, c.max_members, c.overflow,
+			(SELECT count(*) FROM users_with_segments WHERE seg_id = c.seg_id),
+			(SELECT count(*) FROM segment_waitlist WHERE seg_id = c.seg_id)
+		FROM segment_capacities c JOIN segments s ON s.seg_id = c.seg_id WHERE s.slug = ?`,
+		slug,
+	).Scan(&c.Slug, &c.MaxMembers, &c.Overflow, &c.Members, &c.Waitlisted); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, repository.ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if c.Members < c.MaxMembers {
+		c.Remaining = c.MaxMembers - c.Members
+	}
+	return c, nil
+}
+
+// DeleteCapacity lifts the limit of the segment and drops its waitlist.
+func (r *SegmentRepository) DeleteCapacity(c *entity.Capacity) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		res, err := tx.Exec(
+			"DELETE FROM segment_capacities WHERE seg_id = (SELECT seg_id FROM segments WHERE slug = ?)",
+			c.Slug)
+		if err != nil {
+			return err
+		}
+		return requireAffected(res)
+	})
+}
+
+// loadCapacities counts the members of the segments with a member limit.
+func loadCapacities(tx *sql.Tx) (repository.Capacities, error) {
+	rows, err := tx.Query(
+		`SELECT c.seg_id, s.slug, c.max_members, c.overflow,
+			(SELECT count(*) FROM users_with_segments WHERE seg_id = c.seg_id)
+		FROM segment_capacities c JOIN segments s ON s.seg_id = c.seg_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	caps := make(repository.Capacities)
+	for rows.Next() {
+		var segID int
+		c := &entity.Capacity{}
+		if err := rows.Scan(&segID, &c.Slug, &c.MaxMembers, &c.Overflow, &c.Members); err != nil {
+			return nil, err
+		}
+		caps[segID] = c
+	}
+	return caps, rows.Err()
+}
+
+// memberOf lists the segments the user is in, active or pending.
+func memberOf(tx *sql.Tx, userID int) (map[int]bool, error) {
+	rows, err := tx.Query("SELECT seg_id FROM users_with_segments WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[int]bool)
+	for rows.Next() {
+		var segID int
+		if err := rows.Scan(&segID); err != nil {
+			return nil, err
+		}
+		memberships[segID] = true
+	}
+	return memberships, rows.Err()
+}
+
+// resolveCapacities checks the additions of the user against the member
+// limits. It returns the segments to add the user to and those to put the
+// user on the waitlist of.
+func resolveCapacities(tx *sql.Tx, caps repository.Capacities, userID int, segList []*entity.Segment) ([]*entity.Segment, []*entity.Segment, error) {
+	if len(caps) == 0 {
+		return segList, nil, nil
+	}
+
+	memberships, err := memberOf(tx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caps.Resolve(memberships, segList)
+}
+
+// waitlist puts the user on the waitlists of the segments, a user already
+// on one keeps the place.
+func waitlist(tx *sql.Tx, userID int, segList []*entity.Segment) error {
+	for _, seg := range segList {
+		if _, err := tx.Exec(
+			"INSERT INTO segment_waitlist (seg_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+			seg.SegID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteWaitlists adds the waitlisted users to the segments with free
+// places, see repository.Capacities.Promote. A user whose addition an
+// exclusion group or a missing prerequisite would reject is skipped.
+func promoteWaitlists(tx *sql.Tx, segList []*entity.Segment, now time.Time) error {
+	caps, err := loadCapacities(tx)
+	if err != nil || len(caps) == 0 {
+		return err
+	}
+
+	groups, err := loadGroups(tx)
+	if err != nil {
+		return err
+	}
+
+	prereqs, err := loadPrerequisites(tx)
+	if err != nil {
+		return err
+	}
+
+	promoted := make(map[int]bool, len(segList))
+	for _, seg := range segList {
+		c, ok := caps[seg.SegID]
+		if !ok || promoted[seg.SegID] {
+			continue
+		}
+		promoted[seg.SegID] = true
+
+		queue, err := queryUserIDs(tx, "SELECT user_id FROM segment_waitlist WHERE seg_id = ? ORDER BY waitlist_id", seg.SegID)
+		if err != nil {
+			return err
+		}
+
+		add := []*entity.Segment{{SegID: seg.SegID, Slug: c.Slug}}
+		userIDs, err := caps.Promote(seg.SegID, queue, func(userID int) (bool, error) {
+			_, err := resolveGroups(tx, groups, userID, add, false)
+			if err == nil {
+				_, err = resolvePrerequisites(tx, prereqs, userID, add, nil, time.Time{}, now, false)
+			}
+
+			if errors.Is(err, repository.ErrGroupConflict) || errors.Is(err, repository.ErrPrerequisiteMissing) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, userID := range userIDs {
+			if err := addMembership(tx, userID, add[0], now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build cgo
+
+package sqliterepository_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/repositorytest"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqliterepository"
+)
+
+func TestSegmentRepository_Conformance(t *testing.T) {
+	repositorytest.RunSegmentRepositoryTests(t, func(t *testing.T) repository.SegmentRepository {
+		db, teardown := sqliterepository.TestDB(t)
+		t.Cleanup(teardown)
+
+		return sqliterepository.NewSegmentRepository(db)
+	})
+}
@@ -0,0 +1,30 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return repository.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Timestamps are stored as Unix nanoseconds, so that they compare
+// correctly whatever the time zone they were written in.
+func toNanos(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromNanos(n int64) time.Time {
+	return time.Unix(0, n)
+}
@@ -0,0 +1,27 @@
+//go:build cgo
+
+package sqliterepository
+
+import (
+	"errors"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/mattn/go-sqlite3"
+)
+
+// normalizeError maps constraint violations to the errors
+// the Postgres repositories return for the same cases.
+func normalizeError(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrConstraint {
+		return err
+	}
+
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return repository.ErrRecordExists
+	case sqlite3.ErrConstraintForeignKey:
+		return repository.ErrRecordNotFound
+	}
+	return err
+}
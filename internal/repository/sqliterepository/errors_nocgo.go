@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package sqliterepository
+
+// normalizeError is never reached without cgo: repository.NewDB refuses
+// to open a SQLite database with repository.ErrSQLiteNotSupported.
+func normalizeError(err error) error {
+	return err
+}
@@ -0,0 +1,112 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+const eventColumns = "event_id, seq, event_type, user_id, seg_id, slug, effective_at, created_at"
+
+type EventRepository struct {
+	db *sql.DB
+}
+
+func NewEventRepository(db *sql.DB) *EventRepository {
+	return &EventRepository{
+		db: db,
+	}
+}
+
+// SequenceEvents numbers up to limit events that have no sequence number yet.
+// Writers take the database lock when they begin, so events are committed
+// in ID order and numbering them in that order leaves no gaps.
+func (r *EventRepository) SequenceEvents(limit int) (int, error) {
+	res, err := r.db.Exec(
+		`UPDATE events SET seq = b.seq
+		FROM (
+			SELECT event_id, (SELECT COALESCE(MAX(seq), 0) FROM events) + row_number() OVER (ORDER BY event_id) AS seq
+			FROM (SELECT event_id FROM events WHERE seq IS NULL ORDER BY event_id LIMIT ?)) b
+		WHERE events.event_id = b.event_id`,
+		limit)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// FindAfter returns up to limit sequenced events that follow seq.
+func (r *EventRepository) FindAfter(seq int, limit int) ([]*entity.Event, error) {
+	events := make([]*entity.Event, 0)
+
+	rows, err := r.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE seq > ? ORDER BY seq LIMIT ?",
+		seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// FindOffset returns the last event sequence number published to the sink,
+// zero if nothing has been published yet.
+func (r *EventRepository) FindOffset(sink string) (int, error) {
+	seq := 0
+	if err := r.db.QueryRow(
+		"SELECT seq FROM event_sink_offsets WHERE sink = ?",
+		sink,
+	).Scan(&seq); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (r *EventRepository) SaveOffset(sink string, seq int) error {
+	_, err := r.db.Exec(
+		`INSERT INTO event_sink_offsets (sink, seq, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (sink) DO UPDATE SET seq = excluded.seq, updated_at = excluded.updated_at`,
+		sink, seq, toNanos(time.Now()))
+	return err
+}
+
+func (r *EventRepository) FindLastSeq() (int, error) {
+	seq := 0
+	err := r.db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM events").Scan(&seq)
+	return seq, err
+}
+
+// scanEvent reads the eventColumns of the current row.
+func scanEvent(rows *sql.Rows, extra ...interface{}) (*entity.Event, error) {
+	e := &entity.Event{}
+	var (
+		seq, userID            sql.NullInt64
+		effectiveAt, createdAt int64
+	)
+
+	dest := append([]interface{}{&e.EventID, &seq, &e.Type, &userID, &e.SegID, &e.Slug, &effectiveAt, &createdAt}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	e.Seq = int(seq.Int64)
+	e.UserID = int(userID.Int64)
+	e.EffectiveAt = fromNanos(effectiveAt)
+	e.CreatedAt = fromNanos(createdAt)
+
+	return e, nil
+}
@@ -0,0 +1,144 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// CreateGroup puts the segments in a new exclusion group. The memberships
+// the users already have are kept, the group applies to later additions.
+func (r *SegmentRepository) CreateGroup(g *entity.Group) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		if err := tx.QueryRow(
+			"INSERT INTO exclusion_groups (name, policy) VALUES (?, ?) RETURNING group_id",
+			g.Name, g.Policy,
+		).Scan(&g.GroupID); err != nil {
+			return normalizeError(err)
+		}
+
+		for _, slug := range g.Slugs {
+			res, err := tx.Exec(
+				"INSERT INTO exclusion_group_segments (seg_id, group_id) SELECT seg_id, ? FROM segments WHERE slug = ?",
+				g.GroupID, slug)
+			if err != nil {
+				return normalizeError(err)
+			}
+
+			if err := requireAffected(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *SegmentRepository) FindGroups() ([]*entity.Group, error) {
+	groups := make([]*entity.Group, 0)
+
+	rows, err := r.db.Query(
+		"SELECT g.group_id, g.name, g.policy, s.slug FROM exclusion_groups g JOIN exclusion_group_segments gs ON gs.group_id = g.group_id JOIN segments s ON s.seg_id = gs.seg_id ORDER BY g.group_id, s.seg_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var g *entity.Group
+	for rows.Next() {
+		var groupID int
+		var name, policy, slug string
+		if err := rows.Scan(&groupID, &name, &policy, &slug); err != nil {
+			return nil, err
+		}
+
+		if g == nil || g.GroupID != groupID {
+			g = &entity.Group{GroupID: groupID, Name: name, Policy: policy, Slugs: make([]string, 0)}
+			groups = append(groups, g)
+		}
+		g.Slugs = append(g.Slugs, slug)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (r *SegmentRepository) DeleteGroup(g *entity.Group) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		res, err := tx.Exec("DELETE FROM exclusion_groups WHERE name = ?", g.Name)
+		if err != nil {
+			return err
+		}
+		return requireAffected(res)
+	})
+}
+
+// loadGroups maps every grouped segment to its exclusion group.
+func loadGroups(tx *sql.Tx) (repository.ExclusionGroups, error) {
+	rows, err := tx.Query(
+		"SELECT gs.seg_id, g.group_id, g.name, g.policy FROM exclusion_group_segments gs JOIN exclusion_groups g ON g.group_id = gs.group_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make(repository.ExclusionGroups)
+	byID := make(map[int]*entity.Group)
+	for rows.Next() {
+		var segID int
+		g := &entity.Group{}
+		if err := rows.Scan(&segID, &g.GroupID, &g.Name, &g.Policy); err != nil {
+			return nil, err
+		}
+
+		if found, ok := byID[g.GroupID]; ok {
+			g = found
+		}
+		byID[g.GroupID] = g
+		groups[segID] = g
+	}
+	return groups, rows.Err()
+}
+
+// groupedMemberships lists the segments of exclusion groups the user is in,
+// active or pending.
+func groupedMemberships(tx *sql.Tx, userID int) ([]*entity.Segment, error) {
+	rows, err := tx.Query(
+		"SELECT s.seg_id, s.slug FROM users_with_segments u JOIN exclusion_group_segments gs ON gs.seg_id = u.seg_id JOIN segments s ON s.seg_id = u.seg_id WHERE u.user_id = ? ORDER BY s.seg_id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segList := make([]*entity.Segment, 0)
+	for rows.Next() {
+		seg := &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug); err != nil {
+			return nil, err
+		}
+		segList = append(segList, seg)
+	}
+	return segList, rows.Err()
+}
+
+// resolveGroups checks the additions of the user against the exclusion
+// groups and returns the memberships to remove for them.
+func resolveGroups(tx *sql.Tx, groups repository.ExclusionGroups, userID int, segList []*entity.Segment, replace bool) ([]*entity.Segment, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	memberships, err := groupedMemberships(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return groups.Resolve(memberships, segList, replace)
+}
@@ -0,0 +1,26 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// TestDB opens a migrated in-memory database that is gone once teardown closes it.
+func TestDB(t *testing.T) (*sql.DB, func()) {
+	t.Helper()
+
+	db, err := repository.NewDB(&repository.Config{DatabaseURL: "sqlite://:memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+	}
+}
@@ -0,0 +1,214 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// emitEvent appends an event to the outbox.
+func emitEvent(tx *sql.Tx, eventType string, userID int, seg *entity.Segment, effectiveAt, at time.Time) error {
+	user := sql.NullInt64{Int64: int64(userID), Valid: userID != 0}
+
+	_, err := tx.Exec(
+		"INSERT INTO events (event_type, user_id, seg_id, slug, effective_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		eventType, user, seg.SegID, seg.Slug, toNanos(effectiveAt), toNanos(at))
+	return err
+}
+
+// recordChange appends a membership change to the history and to the outbox.
+func recordChange(tx *sql.Tx, operation string, userID int, seg *entity.Segment, effectiveAt, at time.Time) error {
+	if _, err := tx.Exec(
+		"INSERT INTO users_with_segments_history (user_id, seg_id, slug, operation, effective_at) VALUES (?, ?, ?, ?, ?)",
+		userID, seg.SegID, seg.Slug, operation, toNanos(effectiveAt)); err != nil {
+		return err
+	}
+
+	eventType := entity.EventUserAdded
+	if operation == entity.OperationRemove {
+		eventType = entity.EventUserRemoved
+	}
+	return emitEvent(tx, eventType, userID, seg, effectiveAt, at)
+}
+
+// insertMembership adds the user to the segment from activeFrom, takes the
+// user off its waitlist and records the change. An existing membership is
+// left as it is. It reports whether a row was added.
+func insertMembership(tx *sql.Tx, userID int, seg *entity.Segment, activeFrom, at time.Time) (bool, error) {
+	res, err := tx.Exec(
+		"INSERT INTO users_with_segments (user_id, seg_id, active_from) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		userID, seg.SegID, toNanos(activeFrom))
+	if err != nil {
+		return false, normalizeError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM segment_waitlist WHERE seg_id = ? AND user_id = ?", seg.SegID, userID); err != nil {
+		return false, err
+	}
+	return true, recordChange(tx, entity.OperationAdd, userID, seg, activeFrom, at)
+}
+
+// addMembership adds the user to the segment at once. An active membership
+// is kept, a pending one is activated and its scheduled addition dropped from
+// the history, so that replay does not add the user again at that time.
+func addMembership(tx *sql.Tx, userID int, seg *entity.Segment, at time.Time) error {
+	var activeFrom int64
+	err := tx.QueryRow(
+		"SELECT active_from FROM users_with_segments WHERE user_id = ? AND seg_id = ? AND active_from > ?",
+		userID, seg.SegID, toNanos(at),
+	).Scan(&activeFrom)
+	if err == sql.ErrNoRows {
+		_, err = insertMembership(tx, userID, seg, at, at)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE users_with_segments SET active_from = ? WHERE user_id = ? AND seg_id = ?",
+		toNanos(at), userID, seg.SegID); err != nil {
+		return err
+	}
+
+	if err := forgetPending(tx, userID, seg, activeFrom); err != nil {
+		return err
+	}
+	return recordChange(tx, entity.OperationAdd, userID, seg, at, at)
+}
+
+// forgetPending drops the history entry of a pending membership, the latest
+// addition of the segment at its start time.
+func forgetPending(tx *sql.Tx, userID int, seg *entity.Segment, activeFrom int64) error {
+	_, err := tx.Exec(
+		`DELETE FROM users_with_segments_history WHERE event_id = (
+			SELECT max(event_id) FROM users_with_segments_history
+			WHERE user_id = ? AND seg_id = ? AND operation = ? AND effective_at = ?)`,
+		userID, seg.SegID, entity.OperationAdd, activeFrom)
+	return err
+}
+
+// scheduleMembership adds the user to the segment from activeFrom.
+// A pending membership is rescheduled: its scheduled addition is dropped
+// from the history and the cancellation takes effect no later than the new
+// start, so that an event consumer never sees the old start after the new
+// one. An active membership is kept.
+func scheduleMembership(tx *sql.Tx, userID int, seg *entity.Segment, activeFrom, at time.Time) error {
+	var pendingFrom int64
+	err := tx.QueryRow(
+		"DELETE FROM users_with_segments WHERE user_id = ? AND seg_id = ? AND active_from > ? RETURNING active_from",
+		userID, seg.SegID, toNanos(at),
+	).Scan(&pendingFrom)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil {
+		if err := forgetPending(tx, userID, seg, pendingFrom); err != nil {
+			return err
+		}
+
+		cancelledAt := fromNanos(pendingFrom)
+		if activeFrom.Before(cancelledAt) {
+			cancelledAt = activeFrom
+		}
+
+		if err := emitEvent(tx, entity.EventUserRemoved, userID, seg, cancelledAt, at); err != nil {
+			return err
+		}
+	}
+
+	_, err = insertMembership(tx, userID, seg, activeFrom, at)
+	return err
+}
+
+// deleteMembership removes the user from the segment and records the change.
+// With pendingOnly only a membership that is not active yet is removed.
+// Removing a pending membership takes effect at its start time, so the add
+// and remove events cancel each other out on replay.
+func deleteMembership(tx *sql.Tx, userID int, seg *entity.Segment, at time.Time, pendingOnly bool) error {
+	query := "DELETE FROM users_with_segments WHERE user_id = ? AND seg_id = ?"
+	args := []interface{}{userID, seg.SegID}
+	if pendingOnly {
+		query += " AND active_from > ?"
+		args = append(args, toNanos(at))
+	}
+
+	var activeFrom int64
+	err := tx.QueryRow(query+" RETURNING active_from", args...).Scan(&activeFrom)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	effectiveAt := at
+	if fromNanos(activeFrom).After(at) {
+		effectiveAt = fromNanos(activeFrom)
+	}
+	return recordChange(tx, entity.OperationRemove, userID, seg, effectiveAt, at)
+}
+
+// FindByUserAsOf rebuilds the user segments at the given moment by replaying
+// the history of the user up to it.
+func (r *SegmentRepository) FindByUserAsOf(userID int, asOf time.Time) ([]*entity.Segment, error) {
+	rows, err := r.db.Query(
+		"SELECT seg_id, slug, operation FROM users_with_segments_history WHERE user_id = ? AND effective_at <= ? ORDER BY effective_at, event_id",
+		userID, toNanos(asOf))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := make(map[int]*entity.Segment)
+	order := make([]int, 0)
+	for rows.Next() {
+		var operation string
+		seg := &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug, &operation); err != nil {
+			return nil, err
+		}
+
+		switch operation {
+		case entity.OperationAdd:
+			if _, ok := segments[seg.SegID]; !ok {
+				order = append(order, seg.SegID)
+			}
+			segments[seg.SegID] = seg
+		case entity.OperationRemove:
+			delete(segments, seg.SegID)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	segList := make([]*entity.Segment, 0, len(segments))
+	for _, segID := range order {
+		if seg, ok := segments[segID]; ok {
+			segList = append(segList, seg)
+			delete(segments, segID)
+		}
+	}
+
+	if len(segList) > 0 {
+		return segList, nil
+	} else {
+		return nil, repository.ErrRecordNotFound
+	}
+}
+
+// TakeHistorySnapshot is a no-op. An embedded database holds a single
+// instance's history, which is cheap enough to replay from the start.
+func (r *SegmentRepository) TakeHistorySnapshot(time.Time) error {
+	return nil
+}
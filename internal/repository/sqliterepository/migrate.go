@@ -0,0 +1,53 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// Migrations embeds the SQLite schema migrations, they are under migrations/.
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
+
+// MigrationSource returns the schema migrations embedded into the binary.
+// The SQLite schema has its own migrations, they do not follow the
+// Postgres ones one to one.
+func MigrationSource() (source.Driver, error) {
+	return iofs.New(Migrations, "migrations")
+}
+
+// NewMigrate returns a migrate instance for the database.
+// Closing the instance closes db as well.
+func NewMigrate(db *sql.DB) (*migrate.Migrate, error) {
+	src, err := MigrationSource()
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := sqlite3.WithInstance(db, &sqlite3.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithInstance("iofs", src, "sqlite3", driver)
+}
+
+// Migrate brings the schema up to date.
+func Migrate(db *sql.DB) error {
+	// the migrate instance is not closed, that would close db
+	m, err := NewMigrate(db)
+	if err != nil {
+		return err
+	}
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
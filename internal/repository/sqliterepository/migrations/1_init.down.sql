@@ -0,0 +1,7 @@
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP TABLE event_sink_offsets;
+DROP TABLE events;
+DROP TABLE users_with_segments_history;
+DROP TABLE users_with_segments;
+DROP TABLE segments;
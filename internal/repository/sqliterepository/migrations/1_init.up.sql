@@ -0,0 +1,67 @@
+CREATE TABLE segments (
+    seg_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slug TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE users_with_segments (
+    user_id INTEGER NOT NULL,
+    seg_id INTEGER NOT NULL REFERENCES segments ON DELETE CASCADE,
+    active_from INTEGER NOT NULL,
+    PRIMARY KEY (user_id, seg_id)
+);
+
+CREATE INDEX users_with_segments_seg_id_idx ON users_with_segments (seg_id);
+
+CREATE TABLE users_with_segments_history (
+    event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    seg_id INTEGER NOT NULL,
+    slug TEXT NOT NULL,
+    operation TEXT NOT NULL CHECK (operation IN ('add', 'remove')),
+    effective_at INTEGER NOT NULL
+);
+
+CREATE INDEX users_with_segments_history_user_id_idx ON users_with_segments_history (user_id, effective_at);
+
+CREATE TABLE events (
+    event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    seq INTEGER UNIQUE,
+    event_type TEXT NOT NULL,
+    user_id INTEGER,
+    seg_id INTEGER NOT NULL,
+    slug TEXT NOT NULL,
+    effective_at INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    webhooks_dispatched INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX events_unsequenced_idx ON events (event_id) WHERE seq IS NULL;
+CREATE INDEX events_webhooks_pending_idx ON events (event_id) WHERE webhooks_dispatched = 0;
+
+CREATE TABLE event_sink_offsets (
+    sink TEXT PRIMARY KEY,
+    seq INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE webhooks (
+    webhook_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT NOT NULL DEFAULT '[]',
+    slugs TEXT NOT NULL DEFAULT '[]',
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+    delivery_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id INTEGER NOT NULL REFERENCES events ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    UNIQUE (webhook_id, event_id)
+);
+
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
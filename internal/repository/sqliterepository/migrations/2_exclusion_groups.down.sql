@@ -0,0 +1,2 @@
+DROP TABLE exclusion_group_segments;
+DROP TABLE exclusion_groups;
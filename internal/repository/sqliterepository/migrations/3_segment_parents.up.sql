@@ -0,0 +1,3 @@
+ALTER TABLE segments ADD COLUMN parent_id INTEGER;
+
+CREATE INDEX segments_parent_id_idx ON segments (parent_id);
@@ -0,0 +1 @@
+DROP TABLE segment_prerequisites;
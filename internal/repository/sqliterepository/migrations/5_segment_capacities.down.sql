@@ -0,0 +1,2 @@
+DROP TABLE segment_waitlist;
+DROP TABLE segment_capacities;
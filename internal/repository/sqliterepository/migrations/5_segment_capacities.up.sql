@@ -0,0 +1,12 @@
+CREATE TABLE segment_capacities (
+    seg_id INTEGER PRIMARY KEY REFERENCES segments ON DELETE CASCADE,
+    max_members INTEGER NOT NULL CHECK (max_members > 0),
+    overflow TEXT NOT NULL CHECK (overflow IN ('reject', 'waitlist'))
+);
+
+CREATE TABLE segment_waitlist (
+    waitlist_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    seg_id INTEGER NOT NULL REFERENCES segment_capacities ON DELETE CASCADE,
+    user_id INTEGER NOT NULL,
+    UNIQUE (seg_id, user_id)
+);
@@ -0,0 +1,150 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// AddPrerequisite makes p.Slug require p.Requires. The memberships the users
+// already have are kept, the prerequisite applies to later changes.
+func (r *SegmentRepository) AddPrerequisite(p *entity.Prerequisite) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		var segID, requiredID int
+		err := tx.QueryRow(
+			"SELECT s.seg_id, q.seg_id FROM segments s, segments q WHERE s.slug = ? AND q.slug = ?",
+			p.Slug, p.Requires,
+		).Scan(&segID, &requiredID)
+		if err == sql.ErrNoRows {
+			return repository.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var cycle bool
+		if err := tx.QueryRow(
+			`WITH RECURSIVE required (seg_id) AS (
+				SELECT ?
+				UNION
+				SELECT p.required_seg_id FROM segment_prerequisites p JOIN required r ON p.seg_id = r.seg_id)
+			SELECT EXISTS (SELECT 1 FROM required WHERE seg_id = ?)`,
+			requiredID, segID,
+		).Scan(&cycle); err != nil {
+			return err
+		}
+
+		if cycle {
+			return repository.ErrPrerequisiteCycle
+		}
+
+		_, err = tx.Exec("INSERT INTO segment_prerequisites (seg_id, required_seg_id) VALUES (?, ?)", segID, requiredID)
+		return normalizeError(err)
+	})
+}
+
+func (r *SegmentRepository) FindPrerequisites() ([]*entity.Prerequisite, error) {
+	prereqs := make([]*entity.Prerequisite, 0)
+
+	rows, err := r.db.Query(
+		"SELECT s.slug, q.slug FROM segment_prerequisites p JOIN segments s ON s.seg_id = p.seg_id JOIN segments q ON q.seg_id = p.required_seg_id ORDER BY s.slug, q.slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &entity.Prerequisite{}
+		if err := rows.Scan(&p.Slug, &p.Requires); err != nil {
+			return nil, err
+		}
+		prereqs = append(prereqs, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return prereqs, nil
+}
+
+func (r *SegmentRepository) DeletePrerequisite(p *entity.Prerequisite) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		res, err := tx.Exec(
+			`DELETE FROM segment_prerequisites
+			WHERE seg_id = (SELECT seg_id FROM segments WHERE slug = ?)
+			AND required_seg_id = (SELECT seg_id FROM segments WHERE slug = ?)`,
+			p.Slug, p.Requires)
+		if err != nil {
+			return err
+		}
+		return requireAffected(res)
+	})
+}
+
+// loadPrerequisites collects the prerequisites of every segment.
+func loadPrerequisites(tx *sql.Tx) (*repository.Prerequisites, error) {
+	rows, err := tx.Query(
+		"SELECT s.seg_id, s.slug, q.seg_id, q.slug FROM segment_prerequisites p JOIN segments s ON s.seg_id = p.seg_id JOIN segments q ON q.seg_id = p.required_seg_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prereqs := repository.NewPrerequisites()
+	for rows.Next() {
+		seg, required := &entity.Segment{}, &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug, &required.SegID, &required.Slug); err != nil {
+			return nil, err
+		}
+		prereqs.Add(seg, required)
+	}
+	return prereqs, rows.Err()
+}
+
+// resolvePrerequisites checks a change of the user against the prerequisites
+// and returns the memberships to remove along with del. With pendingOnly the
+// active memberships are left out.
+func resolvePrerequisites(tx *sql.Tx, prereqs *repository.Prerequisites, userID int, add, del []*entity.Segment, activeFrom, now time.Time, pendingOnly bool) ([]*entity.Segment, error) {
+	if prereqs.Empty() {
+		return nil, nil
+	}
+
+	memberships, err := prerequisiteMemberships(tx, userID, now, pendingOnly)
+	if err != nil {
+		return nil, err
+	}
+	return prereqs.Resolve(memberships, add, del, activeFrom)
+}
+
+// prerequisiteMemberships maps the segments the user is in to the start of
+// a pending membership, active ones to the zero time. pendingOnly leaves
+// the active ones out.
+func prerequisiteMemberships(tx *sql.Tx, userID int, now time.Time, pendingOnly bool) (map[int]time.Time, error) {
+	rows, err := tx.Query("SELECT seg_id, active_from FROM users_with_segments WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[int]time.Time)
+	for rows.Next() {
+		var segID int
+		var activeFrom int64
+		if err := rows.Scan(&segID, &activeFrom); err != nil {
+			return nil, err
+		}
+
+		if activeFrom > toNanos(now) {
+			memberships[segID] = fromNanos(activeFrom)
+		} else if !pendingOnly {
+			memberships[segID] = time.Time{}
+		}
+	}
+	return memberships, rows.Err()
+}
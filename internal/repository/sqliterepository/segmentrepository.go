@@ -0,0 +1,728 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// SegmentRepository keeps segments in an embedded SQLite database. Every
+// write runs in a transaction that holds the database write lock, so the
+// history and the outbox are written in the order the changes are made.
+type SegmentRepository struct {
+	db     *sql.DB
+	notify chan struct{}
+}
+
+func NewSegmentRepository(db *sql.DB) *SegmentRepository {
+	return &SegmentRepository{
+		db:     db,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Notify fires after a write is committed. Bursts are coalesced.
+func (r *SegmentRepository) Notify() <-chan struct{} {
+	return r.notify
+}
+
+// update runs fn in a transaction and fires Notify once it is committed.
+func (r *SegmentRepository) update(fn func(*sql.Tx, time.Time) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx, time.Now()); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (r *SegmentRepository) Create(seg *entity.Segment) error {
+	if err := seg.Validate(); err != nil {
+		return err
+	}
+
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		parentID, err := findParentID(tx, seg)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.QueryRow(
+			"INSERT INTO segments (slug, parent_id) VALUES (?, ?) RETURNING seg_id",
+			seg.Slug, parentID,
+		).Scan(&seg.SegID); err != nil {
+			return normalizeError(err)
+		}
+		return emitEvent(tx, entity.EventSegmentCreated, 0, seg, now, now)
+	})
+}
+
+func (r *SegmentRepository) FindBySlug(slug string) (*entity.Segment, error) {
+	seg := &entity.Segment{}
+	if err := r.db.QueryRow(
+		"SELECT s.seg_id, s.slug, COALESCE(p.slug, '') FROM segments s LEFT JOIN segments p ON p.seg_id = s.parent_id WHERE s.slug = ?",
+		slug,
+	).Scan(
+		&seg.SegID,
+		&seg.Slug,
+		&seg.Parent,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, repository.ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (r *SegmentRepository) FindAll() ([]*entity.Segment, error) {
+	segList := make([]*entity.Segment, 0)
+
+	rows, err := r.db.Query("SELECT s.seg_id, s.slug, COALESCE(p.slug, '') FROM segments s LEFT JOIN segments p ON p.seg_id = s.parent_id ORDER BY s.seg_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		seg := &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug, &seg.Parent); err != nil {
+			return nil, err
+		}
+		segList = append(segList, seg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return segList, nil
+}
+
+// Delete removes the segment and its memberships. The foreign key would
+// cascade, but the memberships are removed one by one to record them.
+func (r *SegmentRepository) Delete(seg *entity.Segment) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		found := &entity.Segment{}
+		err := tx.QueryRow(
+			"SELECT seg_id, slug FROM segments WHERE slug = ?",
+			seg.Slug,
+		).Scan(&found.SegID, &found.Slug)
+		if err == sql.ErrNoRows {
+			return repository.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var hasChildren bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM segments WHERE parent_id = ?)", found.SegID).Scan(&hasChildren); err != nil {
+			return err
+		}
+
+		if hasChildren {
+			return repository.ErrHasChildren
+		}
+		return deleteSegment(tx, found, now)
+	})
+}
+
+// DeleteReparent moves the children of the segment to its parent and
+// deletes it in one transaction.
+func (r *SegmentRepository) DeleteReparent(seg *entity.Segment) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		found := &entity.Segment{}
+		var parentID sql.NullInt64
+		err := tx.QueryRow(
+			"SELECT seg_id, slug, parent_id FROM segments WHERE slug = ?",
+			seg.Slug,
+		).Scan(&found.SegID, &found.Slug, &parentID)
+		if err == sql.ErrNoRows {
+			return repository.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE segments SET parent_id = ? WHERE parent_id = ?", parentID, found.SegID); err != nil {
+			return err
+		}
+		return deleteSegment(tx, found, now)
+	})
+}
+
+// deleteSegment removes the memberships of the segment and the segment.
+func deleteSegment(tx *sql.Tx, seg *entity.Segment, now time.Time) error {
+	userIDs, err := queryUserIDs(tx, "SELECT user_id FROM users_with_segments WHERE seg_id = ? ORDER BY user_id", seg.SegID)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := deleteMembership(tx, userID, seg, now, false); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM segments WHERE seg_id = ?", seg.SegID); err != nil {
+		return err
+	}
+	return emitEvent(tx, entity.EventSegmentDeleted, 0, seg, now, now)
+}
+
+// UpdateParent moves the segment under seg.Parent, an empty parent makes it
+// a root. A parent that is the segment itself or one of its descendants
+// gives ErrSegmentCycle.
+func (r *SegmentRepository) UpdateParent(seg *entity.Segment) error {
+	if err := seg.Validate(); err != nil {
+		return err
+	}
+
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		var segID int
+		err := tx.QueryRow("SELECT seg_id FROM segments WHERE slug = ?", seg.Slug).Scan(&segID)
+		if err == sql.ErrNoRows {
+			return repository.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		parentID, err := findParentID(tx, seg)
+		if err != nil {
+			return err
+		}
+
+		if parentID.Valid {
+			var cycle bool
+			if err := tx.QueryRow(
+				`WITH RECURSIVE ancestors (seg_id) AS (
+					SELECT ?
+					UNION
+					SELECT s.parent_id FROM segments s JOIN ancestors a ON s.seg_id = a.seg_id WHERE s.parent_id IS NOT NULL)
+				SELECT EXISTS (SELECT 1 FROM ancestors WHERE seg_id = ?)`,
+				parentID, segID,
+			).Scan(&cycle); err != nil {
+				return err
+			}
+
+			if cycle {
+				return repository.ErrSegmentCycle
+			}
+		}
+
+		_, err = tx.Exec("UPDATE segments SET parent_id = ? WHERE seg_id = ?", parentID, segID)
+		return err
+	})
+}
+
+// findParentID looks up the parent of the segment, none gives NULL.
+func findParentID(tx *sql.Tx, seg *entity.Segment) (sql.NullInt64, error) {
+	var parentID sql.NullInt64
+	if seg.Parent == "" {
+		return parentID, nil
+	}
+
+	err := tx.QueryRow("SELECT seg_id FROM segments WHERE slug = ?", seg.Parent).Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return parentID, repository.ErrRecordNotFound
+	}
+	return parentID, err
+}
+
+// AddUserToSegments adds the user to the segments right away. Existing
+// memberships are kept, pending ones are activated. A full segment with
+// the waitlist policy puts the user on its waitlist instead.
+func (r *SegmentRepository) AddUserToSegments(userID int, segList []*entity.Segment) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		caps, err := loadCapacities(tx)
+		if err != nil {
+			return err
+		}
+
+		segList, waitlisted, err := resolveCapacities(tx, caps, userID, segList)
+		if err != nil {
+			return err
+		}
+
+		groups, err := loadGroups(tx)
+		if err != nil {
+			return err
+		}
+
+		removed, err := resolveGroups(tx, groups, userID, segList, true)
+		if err != nil {
+			return err
+		}
+
+		prereqs, err := loadPrerequisites(tx)
+		if err != nil {
+			return err
+		}
+
+		cascaded, err := resolvePrerequisites(tx, prereqs, userID, segList, removed, time.Time{}, now, false)
+		if err != nil {
+			return err
+		}
+
+		for _, seg := range append(removed, cascaded...) {
+			if err := deleteMembership(tx, userID, seg, now, false); err != nil {
+				return err
+			}
+		}
+
+		for _, seg := range segList {
+			if err := addMembership(tx, userID, seg, now); err != nil {
+				return err
+			}
+		}
+
+		if err := waitlist(tx, userID, waitlisted); err != nil {
+			return err
+		}
+		return promoteWaitlists(tx, append(removed, cascaded...), now)
+	})
+}
+
+// DeleteUserFromSegments also removes the user from the segments that
+// require the removed ones and takes the user off their waitlists.
+func (r *SegmentRepository) DeleteUserFromSegments(userID int, segList []*entity.Segment) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		prereqs, err := loadPrerequisites(tx)
+		if err != nil {
+			return err
+		}
+
+		cascaded, err := resolvePrerequisites(tx, prereqs, userID, nil, segList, time.Time{}, now, false)
+		if err != nil {
+			return err
+		}
+
+		removed := append(append([]*entity.Segment(nil), segList...), cascaded...)
+		for _, seg := range removed {
+			if err := deleteMembership(tx, userID, seg, now, false); err != nil {
+				return err
+			}
+		}
+
+		for _, seg := range segList {
+			if _, err := tx.Exec("DELETE FROM segment_waitlist WHERE seg_id = ? AND user_id = ?", seg.SegID, userID); err != nil {
+				return err
+			}
+		}
+		return promoteWaitlists(tx, removed, now)
+	})
+}
+
+func (r *SegmentRepository) FindByUser(userID int) ([]*entity.Segment, error) {
+	segList := make([]*entity.Segment, 0)
+
+	rows, err := r.db.Query(
+		"SELECT s.seg_id, s.slug FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id WHERE u.user_id = ? AND u.active_from <= ? ORDER BY s.seg_id",
+		userID, toNanos(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		seg := &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug); err != nil {
+			return nil, err
+		}
+		segList = append(segList, seg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(segList) > 0 {
+		return segList, nil
+	} else {
+		return nil, repository.ErrRecordNotFound
+	}
+}
+
+// ImportUsersToSegment reads all user IDs before the transaction begins,
+// so a slow upload does not hold the write lock. Users that are already
+// members are skipped, so repeating an import is harmless.
+func (r *SegmentRepository) ImportUsersToSegment(seg *entity.Segment, src repository.UserIDReader) (*entity.ImportResult, error) {
+	userIDs := make([]int, 0)
+	for {
+		userID, err := src.ReadUserID()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	res := &entity.ImportResult{Slug: seg.Slug}
+	if err := r.update(func(tx *sql.Tx, now time.Time) error {
+		groups, err := loadGroups(tx)
+		if err != nil {
+			return err
+		}
+
+		prereqs, err := loadPrerequisites(tx)
+		if err != nil {
+			return err
+		}
+
+		caps, err := loadCapacities(tx)
+		if err != nil {
+			return err
+		}
+
+		segList := []*entity.Segment{seg}
+		freed := make([]*entity.Segment, 0)
+		for _, userID := range userIDs {
+			removed, err := resolveGroups(tx, groups, userID, segList, true)
+			if errors.Is(err, repository.ErrGroupConflict) {
+				res.Rejected++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			cascaded, err := resolvePrerequisites(tx, prereqs, userID, segList, removed, time.Time{}, now, false)
+			if errors.Is(err, repository.ErrPrerequisiteMissing) {
+				res.Rejected++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if len(caps) > 0 {
+				memberships, err := memberOf(tx, userID)
+				if err != nil {
+					return err
+				}
+
+				if memberships[seg.SegID] {
+					continue
+				}
+
+				if err := caps.Check(memberships, segList); err != nil {
+					res.Rejected++
+					continue
+				}
+			}
+
+			for _, m := range append(removed, cascaded...) {
+				if err := deleteMembership(tx, userID, m, now, false); err != nil {
+					return err
+				}
+				freed = append(freed, m)
+			}
+
+			added, err := insertMembership(tx, userID, seg, now, now)
+			if err != nil {
+				return err
+			}
+
+			if added {
+				res.Accepted++
+			}
+		}
+		return promoteWaitlists(tx, freed, now)
+	}); err != nil {
+		return nil, err
+	}
+	res.Duplicate = len(userIDs) - res.Accepted - res.Rejected
+
+	return res, nil
+}
+
+// ExportSegmentMembers walks the segment members ordered by user ID and passes
+// each of them to fn without loading the whole result set.
+func (r *SegmentRepository) ExportSegmentMembers(seg *entity.Segment, fn func(int) error) error {
+	rows, err := r.db.Query(
+		"SELECT user_id FROM users_with_segments WHERE seg_id = ? AND active_from <= ? ORDER BY user_id",
+		seg.SegID, toNanos(time.Now()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+
+		if err := fn(userID); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportMemberships walks every user membership ordered by user ID and slug.
+// The membership passed to fn is reused between calls.
+func (r *SegmentRepository) ExportMemberships(fn func(*entity.Membership) error) error {
+	rows, err := r.db.Query(
+		"SELECT u.user_id, s.seg_id, s.slug FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id WHERE u.active_from <= ? ORDER BY u.user_id, s.slug",
+		toNanos(time.Now()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	m := &entity.Membership{}
+	for rows.Next() {
+		if err := rows.Scan(&m.UserID, &m.SegID, &m.Slug); err != nil {
+			return err
+		}
+
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ApplyMembershipChanges applies all changes in one transaction: removals
+// first, then additions. Adding an existing membership or removing a missing
+// one is not an error, adding a pending membership activates it right away.
+// The changes rejected by an exclusion group are left out and reported with
+// repository.MembershipChangeErrors.
+func (r *SegmentRepository) ApplyMembershipChanges(changes []*entity.MembershipChange) error {
+	var errs repository.MembershipChangeErrors
+	if err := r.update(func(tx *sql.Tx, now time.Time) error {
+		caps, err := loadCapacities(tx)
+		if err != nil {
+			return err
+		}
+
+		all := changes
+		var waitlisted map[int][]*entity.Segment
+		if len(caps) > 0 {
+			memberships := make(map[int]map[int]bool)
+			for _, c := range changes {
+				if memberships[c.UserID], err = memberOf(tx, c.UserID); err != nil {
+					return err
+				}
+			}
+			changes, waitlisted, errs = caps.ResolveChanges(memberships, changes)
+		}
+
+		groups, err := loadGroups(tx)
+		if err != nil {
+			return err
+		}
+
+		if len(groups) > 0 {
+			memberships := make(map[int][]*entity.Segment)
+			for _, c := range changes {
+				if memberships[c.UserID], err = groupedMemberships(tx, c.UserID); err != nil {
+					return err
+				}
+			}
+			changes, errs = groups.ResolveChanges(memberships, changes, errs)
+		}
+
+		prereqs, err := loadPrerequisites(tx)
+		if err != nil {
+			return err
+		}
+
+		if !prereqs.Empty() {
+			memberships := make(map[int]map[int]time.Time)
+			for _, c := range changes {
+				if memberships[c.UserID], err = prerequisiteMemberships(tx, c.UserID, now, false); err != nil {
+					return err
+				}
+			}
+			changes, errs = prereqs.ResolveChanges(memberships, changes, errs)
+		}
+
+		for _, c := range changes {
+			for _, seg := range c.SegListDel {
+				if err := deleteMembership(tx, c.UserID, seg, now, false); err != nil {
+					return err
+				}
+
+				if _, err := tx.Exec("DELETE FROM segment_waitlist WHERE seg_id = ? AND user_id = ?", seg.SegID, c.UserID); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, c := range changes {
+			for _, seg := range c.SegListAdd {
+				if c.ActiveFrom.IsZero() {
+					if err := addMembership(tx, c.UserID, seg, now); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if err := scheduleMembership(tx, c.UserID, seg, c.ActiveFrom, now); err != nil {
+					return err
+				}
+			}
+		}
+
+		for i, c := range all {
+			if errs[i] == nil {
+				if err := waitlist(tx, c.UserID, waitlisted[i]); err != nil {
+					return err
+				}
+			}
+		}
+
+		// the places taken by additions of changes rejected later are freed too
+		touched := make([]*entity.Segment, 0)
+		for _, c := range changes {
+			touched = append(append(touched, c.SegListDel...), c.SegListAdd...)
+		}
+		return promoteWaitlists(tx, touched, now)
+	}); err != nil {
+		return err
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// ScheduleUserToSegments adds the user to the segments starting from activeFrom.
+// Pending memberships are rescheduled, active ones are left untouched.
+// A scheduled addition never replaces a membership of an exclusion group
+// and is never waitlisted.
+func (r *SegmentRepository) ScheduleUserToSegments(userID int, segList []*entity.Segment, activeFrom time.Time) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		caps, err := loadCapacities(tx)
+		if err != nil {
+			return err
+		}
+
+		if len(caps) > 0 {
+			memberships, err := memberOf(tx, userID)
+			if err != nil {
+				return err
+			}
+
+			if err := caps.Check(memberships, segList); err != nil {
+				return err
+			}
+		}
+
+		groups, err := loadGroups(tx)
+		if err != nil {
+			return err
+		}
+
+		if _, err := resolveGroups(tx, groups, userID, segList, false); err != nil {
+			return err
+		}
+
+		prereqs, err := loadPrerequisites(tx)
+		if err != nil {
+			return err
+		}
+
+		if _, err := resolvePrerequisites(tx, prereqs, userID, segList, nil, activeFrom, now, false); err != nil {
+			return err
+		}
+
+		for _, seg := range segList {
+			if err := scheduleMembership(tx, userID, seg, activeFrom, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *SegmentRepository) FindPendingByUser(userID int) ([]*entity.PendingMembership, error) {
+	pendingList := make([]*entity.PendingMembership, 0)
+
+	rows, err := r.db.Query(
+		"SELECT s.seg_id, s.slug, u.active_from FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id WHERE u.user_id = ? AND u.active_from > ? ORDER BY u.active_from",
+		userID, toNanos(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &entity.PendingMembership{}
+		var activeFrom int64
+		if err := rows.Scan(&p.SegID, &p.Slug, &activeFrom); err != nil {
+			return nil, err
+		}
+		p.ActiveFrom = fromNanos(activeFrom)
+		pendingList = append(pendingList, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return pendingList, nil
+}
+
+// CancelPendingUserSegments also cancels the pending memberships that
+// require the cancelled ones.
+func (r *SegmentRepository) CancelPendingUserSegments(userID int, segList []*entity.Segment) error {
+	return r.update(func(tx *sql.Tx, now time.Time) error {
+		prereqs, err := loadPrerequisites(tx)
+		if err != nil {
+			return err
+		}
+
+		cascaded, err := resolvePrerequisites(tx, prereqs, userID, nil, segList, time.Time{}, now, true)
+		if err != nil {
+			return err
+		}
+
+		cancelled := append(append([]*entity.Segment(nil), segList...), cascaded...)
+		for _, seg := range cancelled {
+			if err := deleteMembership(tx, userID, seg, now, true); err != nil {
+				return err
+			}
+		}
+		return promoteWaitlists(tx, cancelled, now)
+	})
+}
+
+func queryUserIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := make([]int, 0)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
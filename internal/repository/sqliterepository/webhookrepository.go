@@ -0,0 +1,292 @@
+package sqliterepository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// WebhookRepository stores the webhook filters as JSON arrays.
+type WebhookRepository struct {
+	db *sql.DB
+}
+
+func NewWebhookRepository(db *sql.DB) *WebhookRepository {
+	return &WebhookRepository{
+		db: db,
+	}
+}
+
+func (r *WebhookRepository) Create(w *entity.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	if w.EventTypes == nil {
+		w.EventTypes = []string{}
+	}
+
+	if w.Slugs == nil {
+		w.Slugs = []string{}
+	}
+
+	eventTypes, err := json.Marshal(w.EventTypes)
+	if err != nil {
+		return err
+	}
+
+	slugs, err := json.Marshal(w.Slugs)
+	if err != nil {
+		return err
+	}
+
+	w.CreatedAt = time.Now()
+	return r.db.QueryRow(
+		"INSERT INTO webhooks (url, secret, event_types, slugs, created_at) VALUES (?, ?, ?, ?, ?) RETURNING webhook_id",
+		w.URL, w.Secret, string(eventTypes), string(slugs), toNanos(w.CreatedAt),
+	).Scan(&w.WebhookID)
+}
+
+func (r *WebhookRepository) FindAll() ([]*entity.Webhook, error) {
+	return findWebhooks(r.db)
+}
+
+func (r *WebhookRepository) Delete(webhookID int) error {
+	res, err := r.db.Exec(
+		"DELETE FROM webhooks WHERE webhook_id = ?",
+		webhookID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// FanOutEvents turns up to limit outbox events into pending deliveries for every
+// matching webhook. The filters are matched in Go, there are no arrays to query.
+func (r *WebhookRepository) FanOutEvents(limit int) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	webhooks, err := findWebhooks(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(
+		"SELECT "+eventColumns+" FROM events WHERE webhooks_dispatched = 0 ORDER BY event_id LIMIT ?",
+		limit)
+	if err != nil {
+		return 0, err
+	}
+
+	events := make([]*entity.Event, 0)
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	now := toNanos(time.Now())
+	for _, e := range events {
+		for _, w := range webhooks {
+			if !w.Matches(e) {
+				continue
+			}
+
+			if _, err := tx.Exec(
+				"INSERT INTO webhook_deliveries (webhook_id, event_id, next_attempt_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+				w.WebhookID, e.EventID, now); err != nil {
+				return 0, err
+			}
+		}
+
+		if _, err := tx.Exec(
+			"UPDATE events SET webhooks_dispatched = 1 WHERE event_id = ?",
+			e.EventID); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(events), tx.Commit()
+}
+
+// ClaimDeliveries takes up to limit due deliveries and hides them from other
+// workers for the lease duration.
+func (r *WebhookRepository) ClaimDeliveries(limit int, lease time.Duration) ([]*entity.WebhookDelivery, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	deliveries, err := findDeliveries(tx,
+		`WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.delivery_id LIMIT ?`,
+		toNanos(now), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseEnd := now.Add(lease)
+	for _, d := range deliveries {
+		if _, err := tx.Exec(
+			"UPDATE webhook_deliveries SET next_attempt_at = ? WHERE delivery_id = ?",
+			toNanos(leaseEnd), d.DeliveryID); err != nil {
+			return nil, err
+		}
+		d.NextAttemptAt = leaseEnd
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *WebhookRepository) MarkDelivered(deliveryID int) error {
+	res, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, last_error = '' WHERE delivery_id = ?",
+		deliveryID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (r *WebhookRepository) MarkFailed(deliveryID int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	status := entity.DeliveryStatusPending
+	if dead {
+		status = entity.DeliveryStatusDead
+	}
+
+	res, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE delivery_id = ?",
+		status, lastError, toNanos(nextAttemptAt), deliveryID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// FindDeliveries returns the latest deliveries of the webhook,
+// optionally only those with the given status.
+func (r *WebhookRepository) FindDeliveries(webhookID int, status string) ([]*entity.WebhookDelivery, error) {
+	deliveries, err := findDeliveries(r.db,
+		`WHERE d.webhook_id = ? AND (? = '' OR d.status = ?)
+		ORDER BY d.delivery_id DESC LIMIT 1000`,
+		webhookID, status, status)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range deliveries {
+		d.URL, d.Secret = "", ""
+	}
+	return deliveries, nil
+}
+
+// Redeliver puts a delivery back into the queue with a fresh attempt budget.
+func (r *WebhookRepository) Redeliver(deliveryID int) error {
+	res, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = 'pending', attempts = 0, last_error = '', next_attempt_at = ? WHERE delivery_id = ?",
+		toNanos(time.Now()), deliveryID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+func findWebhooks(q querier) ([]*entity.Webhook, error) {
+	webhooks := make([]*entity.Webhook, 0)
+
+	rows, err := q.Query(
+		"SELECT webhook_id, url, secret, event_types, slugs, created_at FROM webhooks ORDER BY webhook_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		w := &entity.Webhook{}
+		var (
+			eventTypes, slugs string
+			createdAt         int64
+		)
+		if err := rows.Scan(&w.WebhookID, &w.URL, &w.Secret, &eventTypes, &slugs, &createdAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(eventTypes), &w.EventTypes); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(slugs), &w.Slugs); err != nil {
+			return nil, err
+		}
+		w.CreatedAt = fromNanos(createdAt)
+
+		webhooks = append(webhooks, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// findDeliveries returns the deliveries selected by the clause
+// together with their event and target.
+func findDeliveries(q querier, clause string, args ...interface{}) ([]*entity.WebhookDelivery, error) {
+	deliveries := make([]*entity.WebhookDelivery, 0)
+
+	columns := "e." + strings.ReplaceAll(eventColumns, ", ", ", e.")
+	rows, err := q.Query(
+		`SELECT `+columns+`, d.delivery_id, d.webhook_id, d.status, d.attempts, d.next_attempt_at, d.last_error, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.webhook_id = d.webhook_id
+		JOIN events e ON e.event_id = d.event_id `+clause,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := &entity.WebhookDelivery{}
+		var nextAttemptAt int64
+
+		e, err := scanEvent(rows, &d.DeliveryID, &d.WebhookID, &d.Status, &d.Attempts, &nextAttemptAt, &d.LastError, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+		d.Event = e
+		d.NextAttemptAt = fromNanos(nextAttemptAt)
+
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,315 @@
+package sqlrepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/lib/pq"
+)
+
+// SetCapacity limits the number of users in the segment. The users already
+// in it are kept, a higher limit promotes users from the waitlist.
+func (r *SegmentRepository) SetCapacity(c *entity.Capacity) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seg := &entity.Segment{}
+	err = tx.QueryRow(
+		`INSERT INTO segment_capacities (seg_id, max_members, overflow)
+		SELECT seg_id, $2, $3 FROM segments WHERE slug = $1
+		ON CONFLICT (seg_id) DO UPDATE SET max_members = excluded.max_members, overflow = excluded.overflow
+		RETURNING seg_id`,
+		c.Slug, c.MaxMembers, c.Overflow,
+	).Scan(&seg.SegID)
+	if err == sql.ErrNoRows {
+		return repository.ErrRecordNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := promoteWaitlists(tx, []*entity.Segment{seg}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SegmentRepository) FindCapacity(slug string) (*entity.Capacity, error) {
+	c := &entity.Capacity{}
+	if err := r.db.QueryRow(
+		`SELECT s.slug, c.max_members, c.overflow,
+			(SELECT count(*) FROM users_with_segments WHERE seg_id = c.seg_id),
+			(SELECT count(*) FROM segment_waitlist WHERE seg_id = c.seg_id)
+		FROM segment_capacities c JOIN segments s ON s.seg_id = c.seg_id WHERE s.slug = $1`,
+		slug,
+	).Scan(&c.Slug, &c.MaxMembers, &c.Overflow, &c.Members, &c.Waitlisted); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, repository.ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if c.Members < c.MaxMembers {
+		c.Remaining = c.MaxMembers - c.Members
+	}
+	return c, nil
+}
+
+// DeleteCapacity lifts the limit of the segment and drops its waitlist.
+func (r *SegmentRepository) DeleteCapacity(c *entity.Capacity) error {
+	res, err := r.db.Exec(
+		"DELETE FROM segment_capacities WHERE seg_id = (SELECT seg_id FROM segments WHERE slug = $1)",
+		c.Slug)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// lockCapacities locks the member limits of the segments in the order of
+// their IDs and counts the members. Every change that adds to a segment with
+// a limit locks it first, so the changes are applied one at a time and can
+// not both take the last place. The members are counted by a statement of
+// its own, which sees the changes committed while waiting for the lock.
+func lockCapacities(tx *sql.Tx, segIDs []int64) (repository.Capacities, error) {
+	if _, err := tx.Exec(
+		"SELECT seg_id FROM segment_capacities WHERE seg_id = ANY($1) ORDER BY seg_id FOR UPDATE",
+		pq.Array(segIDs)); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT c.seg_id, s.slug, c.max_members, c.overflow,
+			(SELECT count(*) FROM users_with_segments WHERE seg_id = c.seg_id)
+		FROM segment_capacities c JOIN segments s ON s.seg_id = c.seg_id WHERE c.seg_id = ANY($1)`,
+		pq.Array(segIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	caps := make(repository.Capacities)
+	for rows.Next() {
+		var segID int
+		c := &entity.Capacity{}
+		if err := rows.Scan(&segID, &c.Slug, &c.MaxMembers, &c.Overflow, &c.Members); err != nil {
+			return nil, err
+		}
+		caps[segID] = c
+	}
+	return caps, rows.Err()
+}
+
+// memberOf maps every user to the segments the user is in, active or pending.
+func memberOf(tx *sql.Tx, userIDs []int64) (map[int]map[int]bool, error) {
+	rows, err := tx.Query("SELECT user_id, seg_id FROM users_with_segments WHERE user_id = ANY($1)", pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[int]map[int]bool)
+	for rows.Next() {
+		var userID, segID int
+		if err := rows.Scan(&userID, &segID); err != nil {
+			return nil, err
+		}
+
+		if memberships[userID] == nil {
+			memberships[userID] = make(map[int]bool)
+		}
+		memberships[userID][segID] = true
+	}
+	return memberships, rows.Err()
+}
+
+// resolveCapacities locks the member limits of the segments and checks the
+// additions of the user against them. It returns the segments to add the
+// user to and those to put the user on the waitlist of.
+func resolveCapacities(tx *sql.Tx, userID int, segList []*entity.Segment) ([]*entity.Segment, []*entity.Segment, error) {
+	caps, err := lockCapacities(tx, segIDs(segList))
+	if err != nil || len(caps) == 0 {
+		return segList, nil, err
+	}
+
+	memberships, err := memberOf(tx, []int64{int64(userID)})
+	if err != nil {
+		return nil, nil, err
+	}
+	return caps.Resolve(memberships[userID], segList)
+}
+
+// resolveChangeCapacities locks the member limits of the added and removed
+// segments, the latter for their waitlists to be promoted, and resolves the
+// changes against them, see repository.Capacities.
+func resolveChangeCapacities(tx *sql.Tx, changes []*entity.MembershipChange) ([]*entity.MembershipChange, map[int][]*entity.Segment, repository.MembershipChangeErrors, error) {
+	var userIDs, changeSegIDs []int64
+	for _, c := range changes {
+		userIDs = append(userIDs, int64(c.UserID))
+		changeSegIDs = append(changeSegIDs, segIDs(c.SegListAdd)...)
+		changeSegIDs = append(changeSegIDs, segIDs(c.SegListDel)...)
+	}
+
+	caps, err := lockCapacities(tx, changeSegIDs)
+	if err != nil || len(caps) == 0 {
+		return changes, nil, nil, err
+	}
+
+	memberships, err := memberOf(tx, userIDs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	changes, waitlist, errs := caps.ResolveChanges(memberships, changes)
+	return changes, waitlist, errs, nil
+}
+
+// waitlist puts the users on the waitlists of the segments in the given
+// order, a user already on one keeps the place.
+func waitlist(tx *sql.Tx, userIDs, segIDs []int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO segment_waitlist (seg_id, user_id)
+		SELECT w.seg_id, w.user_id FROM unnest($1::bigint[], $2::bigint[]) WITH ORDINALITY AS w(user_id, seg_id, n)
+		ORDER BY w.n
+		ON CONFLICT DO NOTHING`,
+		pq.Array(userIDs), pq.Array(segIDs))
+	return err
+}
+
+// promoteWaitlists adds the waitlisted users to the segments with free
+// places, and to the segments that require them, in the transaction that
+// freed the places, so no other change can take them in between. The member
+// limits of the segments are locked together in the order of their IDs.
+func promoteWaitlists(tx *sql.Tx, segList []*entity.Segment) error {
+	if len(segList) == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(
+		`WITH RECURSIVE dependents (seg_id) AS (
+			SELECT unnest($1::bigint[])
+			UNION
+			SELECT p.seg_id FROM segment_prerequisites p JOIN dependents d ON p.required_seg_id = d.seg_id)
+		SELECT DISTINCT seg_id FROM segment_waitlist WHERE seg_id IN (SELECT seg_id FROM dependents) ORDER BY seg_id`,
+		pq.Array(segIDs(segList)))
+	if err != nil {
+		return err
+	}
+
+	waiting := make([]int64, 0)
+	for rows.Next() {
+		var segID int64
+		if err := rows.Scan(&segID); err != nil {
+			rows.Close()
+			return err
+		}
+		waiting = append(waiting, segID)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil || len(waiting) == 0 {
+		return err
+	}
+
+	caps, err := lockCapacities(tx, waiting)
+	if err != nil {
+		return err
+	}
+
+	for _, segID := range waiting {
+		if err := promoteWaitlist(tx, caps, int(segID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteWaitlist adds the waitlisted users to the segment, see
+// repository.Capacities.Promote. A user whose addition an exclusion group
+// or a missing prerequisite would reject is skipped.
+func promoteWaitlist(tx *sql.Tx, caps repository.Capacities, segID int) error {
+	c, ok := caps[segID]
+	if !ok || c.Members >= c.MaxMembers {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT user_id FROM segment_waitlist WHERE seg_id = $1 ORDER BY waitlist_id", segID)
+	if err != nil {
+		return err
+	}
+
+	queue := make([]int, 0)
+	userIDs := make([]int64, 0)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		queue = append(queue, userID)
+		userIDs = append(userIDs, int64(userID))
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	groups, err := lockGroups(tx, []int64{int64(segID)})
+	if err != nil {
+		return err
+	}
+
+	grouped, err := groupedMemberships(tx, groups, userIDs)
+	if err != nil {
+		return err
+	}
+
+	prereqs, err := lockPrerequisites(tx, []int64{int64(segID)}, nil)
+	if err != nil {
+		return err
+	}
+
+	memberships, err := prerequisiteMemberships(tx, userIDs, false)
+	if err != nil {
+		return err
+	}
+
+	add := []*entity.Segment{{SegID: segID, Slug: c.Slug}}
+	promoted, err := caps.Promote(segID, queue, func(userID int) (bool, error) {
+		if _, err := groups.Resolve(grouped[userID], add, false); err != nil {
+			return false, nil
+		}
+
+		_, err := prereqs.Resolve(memberships[userID], add, nil, time.Time{})
+		return err == nil, nil
+	})
+	if err != nil || len(promoted) == 0 {
+		return err
+	}
+
+	addUsers := make([]int64, 0, len(promoted))
+	addSegs := make([]int64, 0, len(promoted))
+	for _, userID := range promoted {
+		addUsers = append(addUsers, int64(userID))
+		addSegs = append(addSegs, int64(segID))
+	}
+
+	if _, err := tx.Exec(addMembershipsQuery, pq.Array(addUsers), pq.Array(addSegs)); err != nil {
+		return normalizeError(err)
+	}
+	return nil
+}
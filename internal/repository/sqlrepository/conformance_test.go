@@ -0,0 +1,21 @@
+package sqlrepository_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/repositorytest"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqlrepository"
+	_ "github.com/lib/pq"
+)
+
+func TestSegmentRepository_Conformance(t *testing.T) {
+	repositorytest.RunSegmentRepositoryTests(t, func(t *testing.T) repository.SegmentRepository {
+		db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+		t.Cleanup(func() {
+			teardown("events", "users_with_segments_history", "history_snapshot_members", "history_snapshots", "users_with_segments", "exclusion_groups", "segments")
+		})
+
+		return sqlrepository.NewSegmentRepository(db)
+	})
+}
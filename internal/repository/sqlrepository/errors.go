@@ -0,0 +1,30 @@
+package sqlrepository
+
+import (
+	"errors"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/lib/pq"
+)
+
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+// normalizeError maps constraint violations to domain errors,
+// so that every backend reports them the same way.
+func normalizeError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code {
+	case uniqueViolation:
+		return repository.ErrRecordExists
+	case foreignKeyViolation:
+		return repository.ErrRecordNotFound
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package sqlrepository
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// eventsChannel is notified by a trigger whenever events are inserted.
+const eventsChannel = "events"
+
+// EventListener turns the events channel notifications into wake-ups.
+// Bursts are coalesced, and a wake-up is also sent after a reconnect
+// because notifications may have been lost while the connection was down.
+type EventListener struct {
+	listener *pq.Listener
+	notify   chan struct{}
+}
+
+func NewEventListener(databaseURL string) (*EventListener, error) {
+	l := pq.NewListener(databaseURL, 10*time.Second, time.Minute, nil)
+	if err := l.Listen(eventsChannel); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	el := &EventListener{
+		listener: l,
+		notify:   make(chan struct{}, 1),
+	}
+	go el.run()
+
+	return el, nil
+}
+
+func (l *EventListener) Notify() <-chan struct{} {
+	return l.notify
+}
+
+func (l *EventListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *EventListener) run() {
+	for range l.listener.Notify {
+		select {
+		case l.notify <- struct{}{}:
+		default:
+		}
+	}
+	close(l.notify)
+}
@@ -0,0 +1,108 @@
+package sqlrepository
+
+import (
+	"database/sql"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// sequenceLockID is the advisory lock key held while events are sequenced.
+const sequenceLockID = 20261019130000
+
+type EventRepository struct {
+	db *sql.DB
+}
+
+func NewEventRepository(db *sql.DB) *EventRepository {
+	return &EventRepository{
+		db: db,
+	}
+}
+
+// SequenceEvents numbers up to limit committed events that have no sequence
+// number yet. Event IDs are taken before commit, so a slow transaction can
+// commit an ID lower than one already read. Numbering only what is visible,
+// one sequencer at a time, gives an order with no gaps to skip over.
+func (r *EventRepository) SequenceEvents(limit int) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", sequenceLockID); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		`UPDATE events e SET seq = b.seq
+		FROM (
+			SELECT event_id, (SELECT COALESCE(MAX(seq), 0) FROM events) + row_number() OVER (ORDER BY event_id) AS seq
+			FROM (SELECT event_id FROM events WHERE seq IS NULL ORDER BY event_id LIMIT $1) p) b
+		WHERE e.event_id = b.event_id`,
+		limit)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// FindAfter returns up to limit sequenced events that follow seq.
+func (r *EventRepository) FindAfter(seq int, limit int) ([]*entity.Event, error) {
+	events := make([]*entity.Event, 0)
+
+	rows, err := r.db.Query(
+		"SELECT event_id, seq, event_type, user_id, seg_id, slug, effective_at, created_at FROM events WHERE seq > $1 ORDER BY seq LIMIT $2",
+		seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &entity.Event{}
+		userID := sql.NullInt64{}
+		if err := rows.Scan(&e.EventID, &e.Seq, &e.Type, &userID, &e.SegID, &e.Slug, &e.EffectiveAt, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.UserID = int(userID.Int64)
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// FindOffset returns the last event sequence number published to the sink,
+// zero if nothing has been published yet.
+func (r *EventRepository) FindOffset(sink string) (int, error) {
+	seq := 0
+	if err := r.db.QueryRow(
+		"SELECT seq FROM event_sink_offsets WHERE sink = $1",
+		sink,
+	).Scan(&seq); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (r *EventRepository) SaveOffset(sink string, seq int) error {
+	_, err := r.db.Exec(
+		`INSERT INTO event_sink_offsets (sink, seq) VALUES ($1, $2)
+		ON CONFLICT (sink) DO UPDATE SET seq = EXCLUDED.seq, updated_at = now()`,
+		sink, seq)
+	return err
+}
+
+func (r *EventRepository) FindLastSeq() (int, error) {
+	seq := 0
+	err := r.db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM events").Scan(&seq)
+	return seq, err
+}
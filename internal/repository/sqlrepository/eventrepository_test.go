@@ -0,0 +1,60 @@
+package sqlrepository_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/sqlrepository"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventRepository_FindAfter(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown("event_sink_offsets", "events", "users_with_segments_history", "users_with_segments", "segments")
+
+	r := sqlrepository.NewSegmentRepository(db)
+	er := sqlrepository.NewEventRepository(db)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	r.AddUserToSegments(1, segList)
+	r.DeleteUserFromSegments(1, segList)
+
+	events, err := er.FindAfter(0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	n, err := er.SequenceEvents(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = er.SequenceEvents(10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	events, err = er.FindAfter(1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, entity.EventUserAdded, events[0].Type)
+	assert.Equal(t, entity.EventUserRemoved, events[1].Type)
+	assert.Equal(t, events[0].Seq+1, events[1].Seq)
+}
+
+func TestEventRepository_SaveOffset(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown("event_sink_offsets", "events", "users_with_segments_history", "users_with_segments", "segments")
+
+	er := sqlrepository.NewEventRepository(db)
+
+	offset, err := er.FindOffset("stdout")
+	assert.NoError(t, err)
+	assert.Zero(t, offset)
+
+	assert.NoError(t, er.SaveOffset("stdout", 3))
+	assert.NoError(t, er.SaveOffset("stdout", 5))
+
+	offset, err = er.FindOffset("stdout")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, offset)
+}
@@ -0,0 +1,191 @@
+package sqlrepository
+
+import (
+	"database/sql"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/lib/pq"
+)
+
+// deleteGroupMembershipsQuery removes the imported users from the given
+// segments, which an import replaces by the segment of the same group, and
+// from the segments that require them, directly or through each other.
+var deleteGroupMembershipsQuery = recordChangesQuery(`
+		RECURSIVE removing (user_id, seg_id) AS (
+			SELECT u.user_id, u.seg_id FROM users_with_segments u
+			WHERE u.user_id IN (SELECT user_id FROM users_import) AND u.seg_id = ANY($1::bigint[])
+				AND u.user_id NOT IN (SELECT user_id FROM users_with_segments WHERE seg_id = $2)
+			UNION
+			SELECT u.user_id, u.seg_id FROM removing r
+				JOIN segment_prerequisites p ON p.required_seg_id = r.seg_id
+				JOIN users_with_segments u ON u.user_id = r.user_id AND u.seg_id = p.seg_id),
+		del AS (
+			DELETE FROM users_with_segments u USING removing r
+			WHERE u.user_id = r.user_id AND u.seg_id = r.seg_id
+			RETURNING u.user_id, u.seg_id, u.active_from),
+		changed AS (
+			SELECT del.user_id, del.seg_id, s.slug, GREATEST(now(), del.active_from) AS effective_at
+			FROM del JOIN segments s ON s.seg_id = del.seg_id)`,
+	entity.OperationRemove)
+
+// CreateGroup puts the segments in a new exclusion group. The memberships
+// the users already have are kept, the group applies to later additions.
+func (r *SegmentRepository) CreateGroup(g *entity.Group) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(
+		"INSERT INTO exclusion_groups (name, policy) VALUES ($1, $2) RETURNING group_id",
+		g.Name, g.Policy,
+	).Scan(&g.GroupID); err != nil {
+		return normalizeError(err)
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO exclusion_group_segments (seg_id, group_id) SELECT seg_id, $1 FROM segments WHERE slug = ANY($2)",
+		g.GroupID, pq.Array(g.Slugs))
+	if err != nil {
+		return normalizeError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if int(n) != len(g.Slugs) {
+		return repository.ErrRecordNotFound
+	}
+	return tx.Commit()
+}
+
+func (r *SegmentRepository) FindGroups() ([]*entity.Group, error) {
+	groups := make([]*entity.Group, 0)
+
+	rows, err := r.db.Query(
+		"SELECT g.group_id, g.name, g.policy, s.slug FROM exclusion_groups g JOIN exclusion_group_segments gs ON gs.group_id = g.group_id JOIN segments s ON s.seg_id = gs.seg_id ORDER BY g.group_id, s.seg_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var g *entity.Group
+	for rows.Next() {
+		var groupID int
+		var name, policy, slug string
+		if err := rows.Scan(&groupID, &name, &policy, &slug); err != nil {
+			return nil, err
+		}
+
+		if g == nil || g.GroupID != groupID {
+			g = &entity.Group{GroupID: groupID, Name: name, Policy: policy, Slugs: make([]string, 0)}
+			groups = append(groups, g)
+		}
+		g.Slugs = append(g.Slugs, slug)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (r *SegmentRepository) DeleteGroup(g *entity.Group) error {
+	res, err := r.db.Exec("DELETE FROM exclusion_groups WHERE name = $1", g.Name)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// lockGroups locks the exclusion groups of the segments and maps every
+// segment of them to its group. The groups are locked in the order of their
+// IDs, so the changes that touch the same group are applied one at a time
+// and can not both pass the check.
+func lockGroups(tx *sql.Tx, segIDs []int64) (repository.ExclusionGroups, error) {
+	rows, err := tx.Query(
+		`SELECT gs.seg_id, g.group_id, g.name, g.policy
+		FROM exclusion_groups g JOIN exclusion_group_segments gs ON gs.group_id = g.group_id
+		WHERE g.group_id IN (SELECT group_id FROM exclusion_group_segments WHERE seg_id = ANY($1))
+		ORDER BY g.group_id
+		FOR UPDATE OF g`,
+		pq.Array(segIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make(repository.ExclusionGroups)
+	byID := make(map[int]*entity.Group)
+	for rows.Next() {
+		var segID int
+		g := &entity.Group{}
+		if err := rows.Scan(&segID, &g.GroupID, &g.Name, &g.Policy); err != nil {
+			return nil, err
+		}
+
+		if found, ok := byID[g.GroupID]; ok {
+			g = found
+		}
+		byID[g.GroupID] = g
+		groups[segID] = g
+	}
+	return groups, rows.Err()
+}
+
+// groupedMemberships maps every user to the segments of the groups the user
+// is in, active or pending.
+func groupedMemberships(tx *sql.Tx, groups repository.ExclusionGroups, userIDs []int64) (map[int][]*entity.Segment, error) {
+	segIDs := make([]int64, 0, len(groups))
+	for segID := range groups {
+		segIDs = append(segIDs, int64(segID))
+	}
+
+	rows, err := tx.Query(
+		"SELECT u.user_id, s.seg_id, s.slug FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id WHERE u.user_id = ANY($1) AND u.seg_id = ANY($2) ORDER BY u.user_id, s.seg_id",
+		pq.Array(userIDs), pq.Array(segIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[int][]*entity.Segment)
+	for rows.Next() {
+		var userID int
+		seg := &entity.Segment{}
+		if err := rows.Scan(&userID, &seg.SegID, &seg.Slug); err != nil {
+			return nil, err
+		}
+		memberships[userID] = append(memberships[userID], seg)
+	}
+	return memberships, rows.Err()
+}
+
+// resolveGroups locks the exclusion groups of the segments and checks the
+// additions of the user against them. It returns the memberships to remove
+// for the additions.
+func resolveGroups(tx *sql.Tx, userID int, segList []*entity.Segment, replace bool) ([]*entity.Segment, error) {
+	segIDs := make([]int64, 0, len(segList))
+	for _, seg := range segList {
+		segIDs = append(segIDs, int64(seg.SegID))
+	}
+
+	groups, err := lockGroups(tx, segIDs)
+	if err != nil || len(groups) == 0 {
+		return nil, err
+	}
+
+	memberships, err := groupedMemberships(tx, groups, []int64{int64(userID)})
+	if err != nil {
+		return nil, err
+	}
+	return groups.Resolve(memberships[userID], segList, replace)
+}
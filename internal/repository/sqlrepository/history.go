@@ -0,0 +1,288 @@
+package sqlrepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// recordChangesQuery builds a statement that appends the rows of the changed CTE
+// to the membership history and to the event outbox. The last of the given CTEs
+// must be named changed and return user_id, seg_id, slug and effective_at.
+func recordChangesQuery(ctes, operation string) string {
+	eventType := entity.EventUserAdded
+	if operation == entity.OperationRemove {
+		eventType = entity.EventUserRemoved
+	}
+
+	return "WITH " + ctes + `,
+		history AS (
+			INSERT INTO users_with_segments_history (user_id, seg_id, slug, operation, effective_at)
+			SELECT user_id, seg_id, slug, '` + operation + `', effective_at FROM changed)
+		INSERT INTO events (event_type, user_id, seg_id, slug, effective_at)
+		SELECT '` + eventType + `', user_id, seg_id, slug, effective_at FROM changed`
+}
+
+// forgetPendingCTE drops the history entries of the pending memberships of
+// the pending CTE, the latest addition of each at its start time, so that an
+// activated membership is not added again at the scheduled start on replay.
+const forgetPendingCTE = `
+		forgotten AS (
+			DELETE FROM users_with_segments_history h USING pending p
+			WHERE h.event_id = (
+				SELECT max(event_id) FROM users_with_segments_history
+				WHERE user_id = p.user_id AND seg_id = p.seg_id AND operation = 'add' AND effective_at = p.active_from))`
+
+// Removing a pending membership takes effect at its start time,
+// so the add and remove events cancel each other out on replay.
+// Activating a pending membership drops its scheduled addition.
+// Adding a membership takes the user off the waitlist of the segment.
+var (
+	addMembershipQuery = recordChangesQuery(`
+		pending AS (
+			SELECT user_id, seg_id, active_from FROM users_with_segments
+			WHERE user_id = $1 AND seg_id = $2 AND active_from > now()),`+forgetPendingCTE+`,
+		ins AS (
+			INSERT INTO users_with_segments (user_id, seg_id) VALUES ($1, $2)
+			ON CONFLICT (user_id, seg_id) DO UPDATE SET active_from = now() WHERE users_with_segments.active_from > now()
+			RETURNING user_id, seg_id, active_from),
+		unwaitlisted AS (
+			DELETE FROM segment_waitlist w USING ins WHERE w.user_id = ins.user_id AND w.seg_id = ins.seg_id),
+		changed AS (
+			SELECT user_id, seg_id, $3::varchar AS slug, active_from AS effective_at FROM ins)`,
+		entity.OperationAdd)
+
+	scheduleMembershipQuery = recordChangesQuery(`
+		ins AS (
+			INSERT INTO users_with_segments (user_id, seg_id, active_from) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+			RETURNING user_id, seg_id, active_from),
+		unwaitlisted AS (
+			DELETE FROM segment_waitlist w USING ins WHERE w.user_id = ins.user_id AND w.seg_id = ins.seg_id),
+		changed AS (
+			SELECT user_id, seg_id, $4::varchar AS slug, active_from AS effective_at FROM ins)`,
+		entity.OperationAdd)
+
+	importMembershipsQuery = recordChangesQuery(`
+		ins AS (
+			INSERT INTO users_with_segments (user_id, seg_id) SELECT DISTINCT user_id, $1::bigint FROM users_import
+			ON CONFLICT DO NOTHING
+			RETURNING user_id, seg_id, active_from),
+		unwaitlisted AS (
+			DELETE FROM segment_waitlist w USING ins WHERE w.user_id = ins.user_id AND w.seg_id = ins.seg_id),
+		changed AS (
+			SELECT user_id, seg_id, $2::varchar AS slug, active_from AS effective_at FROM ins)`,
+		entity.OperationAdd)
+
+	addMembershipsQuery = recordChangesQuery(`
+		pending AS (
+			SELECT u.user_id, u.seg_id, u.active_from FROM users_with_segments u
+			JOIN unnest($1::bigint[], $2::bigint[]) AS a(user_id, seg_id) ON u.user_id = a.user_id AND u.seg_id = a.seg_id
+			WHERE u.active_from > now()),`+forgetPendingCTE+`,
+		ins AS (
+			INSERT INTO users_with_segments (user_id, seg_id) SELECT DISTINCT * FROM unnest($1::bigint[], $2::bigint[])
+			ON CONFLICT (user_id, seg_id) DO UPDATE SET active_from = now() WHERE users_with_segments.active_from > now()
+			RETURNING user_id, seg_id, active_from),
+		unwaitlisted AS (
+			DELETE FROM segment_waitlist w USING ins WHERE w.user_id = ins.user_id AND w.seg_id = ins.seg_id),
+		changed AS (
+			SELECT ins.user_id, ins.seg_id, s.slug, ins.active_from AS effective_at
+			FROM ins JOIN segments s ON s.seg_id = ins.seg_id)`,
+		entity.OperationAdd)
+
+	deleteMembershipQuery = recordChangesQuery(`
+		del AS (
+			DELETE FROM users_with_segments WHERE user_id = $1 AND seg_id = $2
+			RETURNING user_id, seg_id, active_from),
+		changed AS (
+			SELECT user_id, seg_id, $3::varchar AS slug, GREATEST(now(), active_from) AS effective_at FROM del)`,
+		entity.OperationRemove)
+
+	// reschedulePendingMembershipQuery removes a pending membership that is
+	// scheduled anew. Its scheduled addition is dropped from the history and
+	// the cancellation takes effect no later than the new start, so that an
+	// event consumer never sees the old start after the new one.
+	reschedulePendingMembershipQuery = `
+		WITH pending AS (
+			DELETE FROM users_with_segments WHERE user_id = $1 AND seg_id = $2 AND active_from > now()
+			RETURNING user_id, seg_id, active_from),` + forgetPendingCTE + `
+		INSERT INTO events (event_type, user_id, seg_id, slug, effective_at)
+		SELECT '` + entity.EventUserRemoved + `', user_id, seg_id, $3::varchar, LEAST(active_from, $4::timestamptz) FROM pending`
+
+	deletePendingMembershipQuery = recordChangesQuery(`
+		del AS (
+			DELETE FROM users_with_segments WHERE user_id = $1 AND seg_id = $2 AND active_from > now()
+			RETURNING user_id, seg_id, active_from),
+		changed AS (
+			SELECT user_id, seg_id, $3::varchar AS slug, active_from AS effective_at FROM del)`,
+		entity.OperationRemove)
+
+	deleteMembershipsQuery = recordChangesQuery(`
+		del AS (
+			DELETE FROM users_with_segments u USING unnest($1::bigint[], $2::bigint[]) AS d(user_id, seg_id)
+			WHERE u.user_id = d.user_id AND u.seg_id = d.seg_id
+			RETURNING u.user_id, u.seg_id, u.active_from),
+		changed AS (
+			SELECT del.user_id, del.seg_id, s.slug, GREATEST(now(), del.active_from) AS effective_at
+			FROM del JOIN segments s ON s.seg_id = del.seg_id)`,
+		entity.OperationRemove)
+
+	deleteSegmentMembershipsQuery = recordChangesQuery(`
+		del AS (
+			DELETE FROM users_with_segments WHERE seg_id = (SELECT seg_id FROM segments WHERE slug = $1)
+			RETURNING user_id, seg_id, active_from),
+		changed AS (
+			SELECT user_id, seg_id, $1::varchar AS slug, GREATEST(now(), active_from) AS effective_at FROM del)`,
+		entity.OperationRemove)
+)
+
+// FindByUserAsOf rebuilds the user segments at the given moment from the latest
+// history snapshot taken before it and the history events that follow the snapshot.
+func (r *SegmentRepository) FindByUserAsOf(userID int, asOf time.Time) ([]*entity.Segment, error) {
+	var (
+		snapshotID int
+		takenAt    time.Time
+	)
+
+	err := r.db.QueryRow(
+		"SELECT snapshot_id, taken_at FROM history_snapshots WHERE taken_at <= $1 ORDER BY taken_at DESC LIMIT 1",
+		asOf,
+	).Scan(&snapshotID, &takenAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	segments := make(map[int]*entity.Segment)
+	order := make([]int, 0)
+
+	if snapshotID != 0 {
+		rows, err := r.db.Query(
+			"SELECT seg_id, slug FROM history_snapshot_members WHERE snapshot_id = $1 AND user_id = $2 ORDER BY seg_id",
+			snapshotID, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			seg := &entity.Segment{}
+			if err := rows.Scan(&seg.SegID, &seg.Slug); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			segments[seg.SegID] = seg
+			order = append(order, seg.SegID)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var rows *sql.Rows
+	if snapshotID != 0 {
+		rows, err = r.db.Query(
+			"SELECT seg_id, slug, operation FROM users_with_segments_history WHERE user_id = $1 AND effective_at > $2 AND effective_at <= $3 ORDER BY effective_at, event_id",
+			userID, takenAt, asOf)
+	} else {
+		rows, err = r.db.Query(
+			"SELECT seg_id, slug, operation FROM users_with_segments_history WHERE user_id = $1 AND effective_at <= $2 ORDER BY effective_at, event_id",
+			userID, asOf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var operation string
+		seg := &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug, &operation); err != nil {
+			return nil, err
+		}
+
+		switch operation {
+		case entity.OperationAdd:
+			if _, ok := segments[seg.SegID]; !ok {
+				order = append(order, seg.SegID)
+			}
+			segments[seg.SegID] = seg
+		case entity.OperationRemove:
+			delete(segments, seg.SegID)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	segList := make([]*entity.Segment, 0, len(segments))
+	for _, segID := range order {
+		if seg, ok := segments[segID]; ok {
+			segList = append(segList, seg)
+			delete(segments, segID)
+		}
+	}
+
+	if len(segList) > 0 {
+		return segList, nil
+	} else {
+		return nil, repository.ErrRecordNotFound
+	}
+}
+
+// TakeHistorySnapshot stores the membership state as of takenAt. It starts from
+// the previous snapshot and folds in the history events that came after it.
+func (r *SegmentRepository) TakeHistorySnapshot(takenAt time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		prevID      int
+		prevTakenAt time.Time
+	)
+
+	err = tx.QueryRow(
+		"SELECT snapshot_id, taken_at FROM history_snapshots ORDER BY taken_at DESC LIMIT 1",
+	).Scan(&prevID, &prevTakenAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if prevID != 0 && !takenAt.After(prevTakenAt) {
+		return nil
+	}
+
+	var snapshotID int
+	if err := tx.QueryRow(
+		"INSERT INTO history_snapshots (taken_at) VALUES ($1) RETURNING snapshot_id",
+		takenAt,
+	).Scan(&snapshotID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO history_snapshot_members (snapshot_id, user_id, seg_id, slug)
+		SELECT $1, user_id, seg_id, slug FROM (
+			SELECT DISTINCT ON (user_id, seg_id) user_id, seg_id, slug, operation FROM (
+				SELECT user_id, seg_id, slug, 'add' AS operation, $3::timestamptz AS effective_at, 0::bigint AS event_id
+				FROM history_snapshot_members WHERE snapshot_id = $4
+				UNION ALL
+				SELECT user_id, seg_id, slug, operation, effective_at, event_id
+				FROM users_with_segments_history
+				WHERE effective_at <= $2 AND ($4 = 0 OR effective_at > $3)
+			) events
+			ORDER BY user_id, seg_id, effective_at DESC, event_id DESC
+		) last_events
+		WHERE operation = 'add'`,
+		snapshotID, takenAt, prevTakenAt, prevID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,55 @@
+package sqlrepository
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/lib/pq"
+)
+
+const undefinedTable = "42P01"
+
+// MigrationSource returns the schema migrations embedded into the binary.
+func MigrationSource() (source.Driver, error) {
+	return iofs.New(migrations.FS, ".")
+}
+
+// NewMigrate returns a migrate instance for the database.
+// Closing the instance closes db as well.
+func NewMigrate(db *sql.DB) (*migrate.Migrate, error) {
+	src, err := MigrationSource()
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithInstance("iofs", src, "postgres", driver)
+}
+
+// SchemaVersion returns the version of the last applied migration and
+// whether it failed halfway, without creating the version table.
+// The version is zero when no migration has been applied yet.
+func SchemaVersion(db *sql.DB) (uint, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := db.QueryRow("SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	var pqErr *pq.Error
+	if err == sql.ErrNoRows || errors.As(err, &pqErr) && pqErr.Code == undefinedTable {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(version), dirty, nil
+}
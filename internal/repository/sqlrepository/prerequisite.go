@@ -0,0 +1,237 @@
+package sqlrepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/lib/pq"
+)
+
+// prerequisiteLockID is the advisory lock key held while a prerequisite is
+// added, so that two additions can not make a cycle together.
+const prerequisiteLockID = 20261019170000
+
+// AddPrerequisite makes p.Slug require p.Requires. The memberships the users
+// already have are kept, the prerequisite applies to later changes.
+func (r *SegmentRepository) AddPrerequisite(p *entity.Prerequisite) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", prerequisiteLockID); err != nil {
+		return err
+	}
+
+	var segID, requiredID int
+	err = tx.QueryRow(
+		"SELECT s.seg_id, q.seg_id FROM segments s, segments q WHERE s.slug = $1 AND q.slug = $2",
+		p.Slug, p.Requires,
+	).Scan(&segID, &requiredID)
+	if err == sql.ErrNoRows {
+		return repository.ErrRecordNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var cycle bool
+	if err := tx.QueryRow(
+		`WITH RECURSIVE required (seg_id) AS (
+			SELECT $1::bigint
+			UNION
+			SELECT p.required_seg_id FROM segment_prerequisites p JOIN required r ON p.seg_id = r.seg_id)
+		SELECT EXISTS (SELECT 1 FROM required WHERE seg_id = $2)`,
+		requiredID, segID,
+	).Scan(&cycle); err != nil {
+		return err
+	}
+
+	if cycle {
+		return repository.ErrPrerequisiteCycle
+	}
+
+	if _, err := tx.Exec("INSERT INTO segment_prerequisites (seg_id, required_seg_id) VALUES ($1, $2)", segID, requiredID); err != nil {
+		return normalizeError(err)
+	}
+	return tx.Commit()
+}
+
+func (r *SegmentRepository) FindPrerequisites() ([]*entity.Prerequisite, error) {
+	prereqs := make([]*entity.Prerequisite, 0)
+
+	rows, err := r.db.Query(
+		"SELECT s.slug, q.slug FROM segment_prerequisites p JOIN segments s ON s.seg_id = p.seg_id JOIN segments q ON q.seg_id = p.required_seg_id ORDER BY s.slug, q.slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &entity.Prerequisite{}
+		if err := rows.Scan(&p.Slug, &p.Requires); err != nil {
+			return nil, err
+		}
+		prereqs = append(prereqs, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return prereqs, nil
+}
+
+func (r *SegmentRepository) DeletePrerequisite(p *entity.Prerequisite) error {
+	res, err := r.db.Exec(
+		`DELETE FROM segment_prerequisites
+		WHERE seg_id = (SELECT seg_id FROM segments WHERE slug = $1)
+		AND required_seg_id = (SELECT seg_id FROM segments WHERE slug = $2)`,
+		p.Slug, p.Requires)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// lockPrerequisites locks the prerequisites of the added segments and those
+// on the removed ones, directly or through other segments, and collects them.
+// A change that adds a segment and one that removes its prerequisite lock the
+// same rows, so the one applied second sees the other one.
+func lockPrerequisites(tx *sql.Tx, addSegIDs, delSegIDs []int64) (*repository.Prerequisites, error) {
+	rows, err := tx.Query(
+		`WITH RECURSIVE dependents (seg_id) AS (
+			SELECT unnest($2::bigint[])
+			UNION
+			SELECT p.seg_id FROM segment_prerequisites p JOIN dependents d ON p.required_seg_id = d.seg_id)
+		SELECT s.seg_id, s.slug, q.seg_id, q.slug
+		FROM segment_prerequisites p
+			JOIN segments s ON s.seg_id = p.seg_id
+			JOIN segments q ON q.seg_id = p.required_seg_id
+		WHERE p.seg_id = ANY($1) OR p.required_seg_id IN (SELECT seg_id FROM dependents)
+		ORDER BY p.seg_id, p.required_seg_id
+		FOR UPDATE OF p`,
+		pq.Array(addSegIDs), pq.Array(delSegIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prereqs := repository.NewPrerequisites()
+	for rows.Next() {
+		seg, required := &entity.Segment{}, &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug, &required.SegID, &required.Slug); err != nil {
+			return nil, err
+		}
+		prereqs.Add(seg, required)
+	}
+	return prereqs, rows.Err()
+}
+
+// prerequisiteMemberships maps every user to the segments the user is in and
+// those to the start of a pending membership, active ones to the zero time.
+// pendingOnly leaves the active ones out.
+func prerequisiteMemberships(tx *sql.Tx, userIDs []int64, pendingOnly bool) (map[int]map[int]time.Time, error) {
+	rows, err := tx.Query(
+		`SELECT user_id, seg_id, CASE WHEN active_from > now() THEN active_from END
+		FROM users_with_segments WHERE user_id = ANY($1) AND (NOT $2 OR active_from > now())`,
+		pq.Array(userIDs), pendingOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[int]map[int]time.Time)
+	for rows.Next() {
+		var userID, segID int
+		var activeFrom pq.NullTime
+		if err := rows.Scan(&userID, &segID, &activeFrom); err != nil {
+			return nil, err
+		}
+
+		if memberships[userID] == nil {
+			memberships[userID] = make(map[int]time.Time)
+		}
+		memberships[userID][segID] = activeFrom.Time
+	}
+	return memberships, rows.Err()
+}
+
+// resolvePrerequisites locks the prerequisites of the segments and checks
+// a change of the user against them. It returns the memberships to remove
+// along with del.
+func resolvePrerequisites(tx *sql.Tx, userID int, add, del []*entity.Segment, activeFrom time.Time, pendingOnly bool) ([]*entity.Segment, error) {
+	prereqs, err := lockPrerequisites(tx, segIDs(add), segIDs(del))
+	if err != nil || prereqs.Empty() {
+		return nil, err
+	}
+
+	memberships, err := prerequisiteMemberships(tx, []int64{int64(userID)}, pendingOnly)
+	if err != nil {
+		return nil, err
+	}
+	return prereqs.Resolve(memberships[userID], add, del, activeFrom)
+}
+
+// resolveChangePrerequisites locks the prerequisites of the changed segments
+// and resolves the changes against them, see repository.Prerequisites.
+func resolveChangePrerequisites(tx *sql.Tx, changes []*entity.MembershipChange, rejected repository.MembershipChangeErrors) ([]*entity.MembershipChange, repository.MembershipChangeErrors, error) {
+	var userIDs, addSegIDs, delSegIDs []int64
+	for _, c := range changes {
+		userIDs = append(userIDs, int64(c.UserID))
+		addSegIDs = append(addSegIDs, segIDs(c.SegListAdd)...)
+		delSegIDs = append(delSegIDs, segIDs(c.SegListDel)...)
+	}
+
+	prereqs, err := lockPrerequisites(tx, addSegIDs, delSegIDs)
+	if err != nil || prereqs.Empty() {
+		return changes, rejected, err
+	}
+
+	memberships, err := prerequisiteMemberships(tx, userIDs, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes, errs := prereqs.ResolveChanges(memberships, changes, rejected)
+	return changes, errs, nil
+}
+
+// resolveImportPrerequisites locks the prerequisites of the segment and of
+// the dependents of the replaced segments and drops the staged users that
+// are not members yet and miss an active prerequisite. It returns the number
+// of dropped users.
+func resolveImportPrerequisites(tx *sql.Tx, seg *entity.Segment, replaced []int64) (int, error) {
+	prereqs, err := lockPrerequisites(tx, []int64{int64(seg.SegID)}, replaced)
+	if err != nil || prereqs.Empty() {
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		`DELETE FROM users_import i WHERE i.user_id NOT IN (SELECT user_id FROM users_with_segments WHERE seg_id = $1)
+			AND EXISTS (
+				SELECT 1 FROM segment_prerequisites p WHERE p.seg_id = $1 AND NOT EXISTS (
+					SELECT 1 FROM users_with_segments u
+					WHERE u.user_id = i.user_id AND u.seg_id = p.required_seg_id AND u.active_from <= now()))`,
+		seg.SegID)
+	if err != nil {
+		return 0, err
+	}
+
+	rejected, err := res.RowsAffected()
+	return int(rejected), err
+}
+
+func segIDs(segList []*entity.Segment) []int64 {
+	ids := make([]int64, 0, len(segList))
+	for _, seg := range segList {
+		ids = append(ids, int64(seg.SegID))
+	}
+	return ids
+}
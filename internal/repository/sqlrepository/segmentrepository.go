@@ -2,11 +2,19 @@ package sqlrepository
 
 import (
 	"database/sql"
+	"io"
+	"time"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/lib/pq"
 )
 
+// hierarchyLockID is the advisory lock key held while a segment is moved,
+// so that two moves can not make a cycle together, and while the children
+// of a deleted segment are moved to its parent.
+const hierarchyLockID = 20261019160000
+
 type SegmentRepository struct {
 	db *sql.DB
 }
@@ -22,20 +30,34 @@ func (r *SegmentRepository) Create(seg *entity.Segment) error {
 		return err
 	}
 
-	return r.db.QueryRow(
-		"INSERT INTO segments (slug) VALUES ($1) RETURNING seg_id",
-		seg.Slug,
+	err := r.db.QueryRow(
+		`WITH parent AS (
+			SELECT seg_id FROM segments WHERE slug = $2),
+		seg AS (
+			INSERT INTO segments (slug, parent_id)
+			SELECT $1, (SELECT seg_id FROM parent) WHERE $2 = '' OR EXISTS (SELECT 1 FROM parent)
+			RETURNING seg_id, slug),
+		event AS (
+			INSERT INTO events (event_type, seg_id, slug, effective_at)
+			SELECT 'segment.created', seg_id, slug, now() FROM seg)
+		SELECT seg_id FROM seg`,
+		seg.Slug, seg.Parent,
 	).Scan(&seg.SegID)
+	if err == sql.ErrNoRows {
+		return repository.ErrRecordNotFound
+	}
+	return normalizeError(err)
 }
 
 func (r *SegmentRepository) FindBySlug(slug string) (*entity.Segment, error) {
 	seg := &entity.Segment{}
 	if err := r.db.QueryRow(
-		"SELECT seg_id, slug FROM segments WHERE slug = $1",
+		"SELECT s.seg_id, s.slug, COALESCE(p.slug, '') FROM segments s LEFT JOIN segments p ON p.seg_id = s.parent_id WHERE s.slug = $1",
 		slug,
 	).Scan(
 		&seg.SegID,
 		&seg.Slug,
+		&seg.Parent,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, repository.ErrRecordNotFound
@@ -45,53 +67,271 @@ func (r *SegmentRepository) FindBySlug(slug string) (*entity.Segment, error) {
 	return seg, nil
 }
 
+func (r *SegmentRepository) FindAll() ([]*entity.Segment, error) {
+	segList := make([]*entity.Segment, 0)
+
+	rows, err := r.db.Query("SELECT s.seg_id, s.slug, COALESCE(p.slug, '') FROM segments s LEFT JOIN segments p ON p.seg_id = s.parent_id ORDER BY s.seg_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		seg := &entity.Segment{}
+		if err := rows.Scan(&seg.SegID, &seg.Slug, &seg.Parent); err != nil {
+			return nil, err
+		}
+		segList = append(segList, seg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return segList, nil
+}
+
 func (r *SegmentRepository) Delete(seg *entity.Segment) error {
-	_, err := r.db.Exec(
-		"DELETE FROM segments WHERE slug = $1",
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hasChildren bool
+	if err := tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM segments WHERE parent_id = (SELECT seg_id FROM segments WHERE slug = $1))",
+		seg.Slug,
+	).Scan(&hasChildren); err != nil {
+		return err
+	}
+
+	if hasChildren {
+		return repository.ErrHasChildren
+	}
+
+	if err := deleteSegment(tx, seg); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteReparent moves the children of the segment to its parent and
+// deletes it in one transaction. The hierarchy lock keeps a concurrent move
+// from putting a segment under it in between.
+func (r *SegmentRepository) DeleteReparent(seg *entity.Segment) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", hierarchyLockID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE segments c SET parent_id = p.parent_id
+		FROM segments p WHERE p.slug = $1 AND c.parent_id = p.seg_id`,
+		seg.Slug); err != nil {
+		return err
+	}
+
+	if err := deleteSegment(tx, seg); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteSegment removes the memberships of the segment and the segment.
+func deleteSegment(tx *sql.Tx, seg *entity.Segment) error {
+	if _, err := tx.Exec(deleteSegmentMembershipsQuery, seg.Slug); err != nil {
+		return err
+	}
+
+	// a child created since the check fails the delete on the foreign key
+	res, err := tx.Exec(
+		`WITH del AS (
+			DELETE FROM segments WHERE slug = $1 RETURNING seg_id, slug)
+		INSERT INTO events (event_type, seg_id, slug, effective_at)
+		SELECT 'segment.deleted', seg_id, slug, now() FROM del`,
 		seg.Slug)
 	if err != nil {
+		if normalizeError(err) == repository.ErrRecordNotFound {
+			return repository.ErrHasChildren
+		}
 		return err
 	}
-	return nil
+	return requireAffected(res)
+}
+
+// UpdateParent moves the segment under seg.Parent, an empty parent makes it
+// a root. A parent that is the segment itself or one of its descendants
+// gives ErrSegmentCycle.
+func (r *SegmentRepository) UpdateParent(seg *entity.Segment) error {
+	if err := seg.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", hierarchyLockID); err != nil {
+		return err
+	}
+
+	var segID int
+	var parentID sql.NullInt64
+	err = tx.QueryRow(
+		"SELECT seg_id, (SELECT seg_id FROM segments WHERE slug = $2) FROM segments WHERE slug = $1",
+		seg.Slug, seg.Parent,
+	).Scan(&segID, &parentID)
+	if err == sql.ErrNoRows {
+		return repository.ErrRecordNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if seg.Parent != "" && !parentID.Valid {
+		return repository.ErrRecordNotFound
+	}
+
+	if parentID.Valid {
+		var cycle bool
+		if err := tx.QueryRow(
+			`WITH RECURSIVE ancestors (seg_id) AS (
+				SELECT $1::bigint
+				UNION
+				SELECT s.parent_id FROM segments s JOIN ancestors a ON s.seg_id = a.seg_id WHERE s.parent_id IS NOT NULL)
+			SELECT EXISTS (SELECT 1 FROM ancestors WHERE seg_id = $2)`,
+			parentID, segID,
+		).Scan(&cycle); err != nil {
+			return err
+		}
+
+		if cycle {
+			return repository.ErrSegmentCycle
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE segments SET parent_id = $1 WHERE seg_id = $2", parentID, segID); err != nil {
+		return normalizeError(err)
+	}
+	return tx.Commit()
 }
 
+// AddUserToSegments adds the user to the segments right away. Existing
+// memberships are kept, pending ones are activated. A full segment with the
+// waitlist policy puts the user on its waitlist.
 func (r *SegmentRepository) AddUserToSegments(userID int, segList []*entity.Segment) error {
-	stmt, err := r.db.Prepare(
-		"INSERT INTO users_with_segments (user_id, seg_id) VALUES ($1, $2)")
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	segList, waitlisted, err := resolveCapacities(tx, userID, segList)
+	if err != nil {
+		return err
+	}
+
+	removed, err := resolveGroups(tx, userID, segList, true)
+	if err != nil {
+		return err
+	}
+
+	cascaded, err := resolvePrerequisites(tx, userID, segList, removed, time.Time{}, false)
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range append(removed, cascaded...) {
+		if _, err := tx.Exec(deleteMembershipQuery, userID, seg.SegID, seg.Slug); err != nil {
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare(addMembershipQuery)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
 	for _, seg := range segList {
-		_, err := stmt.Exec(userID, seg.SegID)
+		_, err := stmt.Exec(userID, seg.SegID, seg.Slug)
 		if err != nil {
-			return err
+			return normalizeError(err)
 		}
 	}
-	return nil
+
+	users := make([]int64, len(waitlisted))
+	for i := range users {
+		users[i] = int64(userID)
+	}
+
+	if err := waitlist(tx, users, segIDs(waitlisted)); err != nil {
+		return err
+	}
+
+	if err := promoteWaitlists(tx, removed); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// DeleteUserFromSegments also removes the user from the segments that
+// require the removed ones and takes the user off their waitlists.
 func (r *SegmentRepository) DeleteUserFromSegments(userID int, segList []*entity.Segment) error {
-	stmt, err := r.db.Prepare(
-		"DELETE FROM users_with_segments WHERE user_id = $1 AND seg_id = $2")
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	for _, seg := range segList {
-		_, err := stmt.Exec(userID, seg.SegID)
+	// the member limits are locked first, as the additions lock them, for
+	// the waitlists to be promoted
+	if _, err := lockCapacities(tx, segIDs(segList)); err != nil {
+		return err
+	}
+
+	cascaded, err := resolvePrerequisites(tx, userID, nil, segList, time.Time{}, false)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(deleteMembershipQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, seg := range append(append([]*entity.Segment(nil), segList...), cascaded...) {
+		_, err := stmt.Exec(userID, seg.SegID, seg.Slug)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+
+	if _, err := tx.Exec(
+		"DELETE FROM segment_waitlist WHERE user_id = $1 AND seg_id = ANY($2)",
+		userID, pq.Array(segIDs(segList))); err != nil {
+		return err
+	}
+
+	if err := promoteWaitlists(tx, segList); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (r *SegmentRepository) FindByUser(userID int) ([]*entity.Segment, error) {
 	segList := make([]*entity.Segment, 0)
 
 	rows, err := r.db.Query(
-		"SELECT seg_id, slug FROM segments WHERE seg_id IN (SELECT seg_id FROM users_with_segments WHERE user_id = $1)",
+		"SELECT seg_id, slug FROM segments WHERE seg_id IN (SELECT seg_id FROM users_with_segments WHERE user_id = $1 AND active_from <= now()) ORDER BY seg_id",
 		userID)
 
 	if err != nil {
@@ -120,3 +360,500 @@ func (r *SegmentRepository) FindByUser(userID int) ([]*entity.Segment, error) {
 		return nil, repository.ErrRecordNotFound
 	}
 }
+
+// ImportUsersToSegment streams user IDs into a temporary staging table with COPY
+// and merges them into the segment in one transaction. Users that are already
+// members are skipped, so repeating an import is harmless. A member limit
+// lets in the users that fit in the order of the source, the rest are
+// rejected rather than waitlisted.
+func (r *SegmentRepository) ImportUsersToSegment(seg *entity.Segment, src repository.UserIDReader) (*entity.ImportResult, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"CREATE TEMP TABLE users_import (user_id BIGINT NOT NULL, pos BIGSERIAL) ON COMMIT DROP"); err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("users_import", "user_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	staged := 0
+	for {
+		userID, err := src.ReadUserID()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stmt.Close()
+			return nil, err
+		}
+
+		if _, err := stmt.Exec(userID); err != nil {
+			stmt.Close()
+			return nil, err
+		}
+		staged++
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return nil, err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	caps, err := lockCapacities(tx, []int64{int64(seg.SegID)})
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := lockGroups(tx, []int64{int64(seg.SegID)})
+	if err != nil {
+		return nil, err
+	}
+
+	others := make([]int64, 0, len(groups))
+	for segID := range groups {
+		if segID != seg.SegID {
+			others = append(others, int64(segID))
+		}
+	}
+
+	replace := len(groups) > 0 && groups[seg.SegID].Policy == entity.GroupPolicyReplace
+	var replaced []int64
+	if replace {
+		replaced = others
+	}
+
+	rejected, err := resolveImportPrerequisites(tx, seg, replaced)
+	if err != nil {
+		return nil, err
+	}
+
+	// The users an exclusion group rejects are dropped before the places
+	// are given out, the memberships it replaces are removed only for the
+	// users let in.
+	if !replace {
+		n, err := resolveImportGroups(tx, seg, groups, others)
+		if err != nil {
+			return nil, err
+		}
+		rejected += n
+	}
+
+	n, err := resolveImportCapacity(tx, seg, caps)
+	if err != nil {
+		return nil, err
+	}
+	rejected += n
+
+	if replace {
+		if _, err := resolveImportGroups(tx, seg, groups, others); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := tx.Exec(importMembershipsQuery, seg.SegID, seg.Slug)
+	if err != nil {
+		return nil, normalizeError(err)
+	}
+
+	accepted, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	freed := make([]*entity.Segment, 0, len(replaced))
+	for _, segID := range replaced {
+		freed = append(freed, &entity.Segment{SegID: int(segID)})
+	}
+
+	if err := promoteWaitlists(tx, freed); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &entity.ImportResult{
+		Slug:      seg.Slug,
+		Accepted:  int(accepted),
+		Duplicate: staged - int(accepted) - rejected,
+		Rejected:  rejected,
+	}, nil
+}
+
+// resolveImportGroups applies the locked exclusion group of the segment to
+// the staged users that are not members yet. Under the reject policy the
+// users in another segment of the group are dropped from the import and
+// counted, under the replace policy they are removed from the other segment
+// and from the segments that require it.
+func resolveImportGroups(tx *sql.Tx, seg *entity.Segment, groups repository.ExclusionGroups, others []int64) (int, error) {
+	if len(groups) == 0 {
+		return 0, nil
+	}
+
+	if groups[seg.SegID].Policy == entity.GroupPolicyReplace {
+		_, err := tx.Exec(deleteGroupMembershipsQuery, pq.Array(others), seg.SegID)
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		`DELETE FROM users_import WHERE user_id IN (SELECT user_id FROM users_with_segments WHERE seg_id = ANY($1))
+			AND user_id NOT IN (SELECT user_id FROM users_with_segments WHERE seg_id = $2)`,
+		pq.Array(others), seg.SegID)
+	if err != nil {
+		return 0, err
+	}
+
+	rejected, err := res.RowsAffected()
+	return int(rejected), err
+}
+
+// resolveImportCapacity drops the staged users that are not members yet and
+// do not fit in the locked member limit of the segment, keeping the first
+// ones of the source. It returns the number of dropped users.
+func resolveImportCapacity(tx *sql.Tx, seg *entity.Segment, caps repository.Capacities) (int, error) {
+	c, ok := caps[seg.SegID]
+	if !ok {
+		return 0, nil
+	}
+
+	remaining := 0
+	if c.Members < c.MaxMembers {
+		remaining = c.MaxMembers - c.Members
+	}
+
+	res, err := tx.Exec(
+		`WITH candidates AS (
+			SELECT user_id, min(pos) AS pos FROM users_import
+			WHERE user_id NOT IN (SELECT user_id FROM users_with_segments WHERE seg_id = $1)
+			GROUP BY user_id)
+		DELETE FROM users_import WHERE user_id IN (
+			SELECT user_id FROM candidates ORDER BY pos OFFSET $2)`,
+		seg.SegID, remaining)
+	if err != nil {
+		return 0, err
+	}
+
+	rejected, err := res.RowsAffected()
+	return int(rejected), err
+}
+
+// ExportSegmentMembers walks the segment members ordered by user ID and passes
+// each of them to fn without loading the whole result set.
+func (r *SegmentRepository) ExportSegmentMembers(seg *entity.Segment, fn func(int) error) error {
+	rows, err := r.db.Query(
+		"SELECT user_id FROM users_with_segments WHERE seg_id = $1 AND active_from <= now() ORDER BY user_id",
+		seg.SegID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+
+		if err := fn(userID); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportMemberships walks every user membership ordered by user ID and slug.
+// The membership passed to fn is reused between calls.
+func (r *SegmentRepository) ExportMemberships(fn func(*entity.Membership) error) error {
+	rows, err := r.db.Query(
+		"SELECT u.user_id, s.seg_id, s.slug FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id WHERE u.active_from <= now() ORDER BY u.user_id, s.slug")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	m := &entity.Membership{}
+	for rows.Next() {
+		if err := rows.Scan(&m.UserID, &m.SegID, &m.Slug); err != nil {
+			return err
+		}
+
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ApplyMembershipChanges applies all changes in one transaction with two
+// set-based statements: removals first, then additions. Adding an existing
+// membership or removing a missing one is not an error, adding a pending
+// membership activates it right away. The scheduled additions are inserted
+// one by one, as ScheduleUserToSegments does. The changes rejected by a
+// member limit, an exclusion group or a missing prerequisite are left out
+// and reported with repository.MembershipChangeErrors.
+func (r *SegmentRepository) ApplyMembershipChanges(changes []*entity.MembershipChange) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	all := changes
+	changes, waitlisted, errs, err := resolveChangeCapacities(tx, changes)
+	if err != nil {
+		return err
+	}
+
+	changes, errs, err = resolveChangeGroups(tx, changes, errs)
+	if err != nil {
+		return err
+	}
+
+	changes, errs, err = resolveChangePrerequisites(tx, changes, errs)
+	if err != nil {
+		return err
+	}
+
+	var addUsers, addSegs, delUsers, delSegs []int64
+	scheduled := make([]*entity.MembershipChange, 0)
+	for _, c := range changes {
+		if !c.ActiveFrom.IsZero() {
+			scheduled = append(scheduled, c)
+		} else {
+			for _, seg := range c.SegListAdd {
+				addUsers = append(addUsers, int64(c.UserID))
+				addSegs = append(addSegs, int64(seg.SegID))
+			}
+		}
+
+		for _, seg := range c.SegListDel {
+			delUsers = append(delUsers, int64(c.UserID))
+			delSegs = append(delSegs, int64(seg.SegID))
+		}
+	}
+
+	if len(delUsers) > 0 {
+		if _, err := tx.Exec(deleteMembershipsQuery, pq.Array(delUsers), pq.Array(delSegs)); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`DELETE FROM segment_waitlist w USING unnest($1::bigint[], $2::bigint[]) AS d(user_id, seg_id)
+			WHERE w.user_id = d.user_id AND w.seg_id = d.seg_id`,
+			pq.Array(delUsers), pq.Array(delSegs)); err != nil {
+			return err
+		}
+	}
+
+	if len(addUsers) > 0 {
+		if _, err := tx.Exec(addMembershipsQuery, pq.Array(addUsers), pq.Array(addSegs)); err != nil {
+			return normalizeError(err)
+		}
+	}
+
+	for _, c := range scheduled {
+		if err := scheduleMemberships(tx, c.UserID, c.SegListAdd, c.ActiveFrom); err != nil {
+			return err
+		}
+	}
+
+	var waitUsers, waitSegs []int64
+	for i, c := range all {
+		if _, ok := errs[i]; ok {
+			continue
+		}
+
+		for _, seg := range waitlisted[i] {
+			waitUsers = append(waitUsers, int64(c.UserID))
+			waitSegs = append(waitSegs, int64(seg.SegID))
+		}
+	}
+
+	if err := waitlist(tx, waitUsers, waitSegs); err != nil {
+		return err
+	}
+
+	freed := make([]*entity.Segment, 0, len(delSegs))
+	for _, segID := range delSegs {
+		freed = append(freed, &entity.Segment{SegID: int(segID)})
+	}
+
+	if err := promoteWaitlists(tx, freed); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// resolveChangeGroups locks the exclusion groups of the added segments and
+// resolves the changes against them, see repository.ExclusionGroups.
+func resolveChangeGroups(tx *sql.Tx, changes []*entity.MembershipChange, rejected repository.MembershipChangeErrors) ([]*entity.MembershipChange, repository.MembershipChangeErrors, error) {
+	var userIDs, segIDs []int64
+	for _, c := range changes {
+		userIDs = append(userIDs, int64(c.UserID))
+		for _, seg := range c.SegListAdd {
+			segIDs = append(segIDs, int64(seg.SegID))
+		}
+	}
+
+	groups, err := lockGroups(tx, segIDs)
+	if err != nil || len(groups) == 0 {
+		return changes, rejected, err
+	}
+
+	memberships, err := groupedMemberships(tx, groups, userIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes, errs := groups.ResolveChanges(memberships, changes, rejected)
+	return changes, errs, nil
+}
+
+// ScheduleUserToSegments adds the user to the segments starting from activeFrom.
+// Pending memberships are rescheduled, active ones are left untouched.
+// A scheduled addition never replaces a membership of an exclusion group
+// and never waits for a place in a full segment.
+func (r *SegmentRepository) ScheduleUserToSegments(userID int, segList []*entity.Segment, activeFrom time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	caps, err := lockCapacities(tx, segIDs(segList))
+	if err != nil {
+		return err
+	}
+
+	if len(caps) > 0 {
+		memberships, err := memberOf(tx, []int64{int64(userID)})
+		if err != nil {
+			return err
+		}
+
+		if err := caps.Check(memberships[userID], segList); err != nil {
+			return err
+		}
+	}
+
+	if _, err := resolveGroups(tx, userID, segList, false); err != nil {
+		return err
+	}
+
+	if _, err := resolvePrerequisites(tx, userID, segList, nil, activeFrom, false); err != nil {
+		return err
+	}
+
+	if err := scheduleMemberships(tx, userID, segList, activeFrom); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scheduleMemberships adds the user to the segments from activeFrom.
+// Pending memberships are rescheduled, active ones are kept.
+func scheduleMemberships(tx *sql.Tx, userID int, segList []*entity.Segment, activeFrom time.Time) error {
+	cancel, err := tx.Prepare(reschedulePendingMembershipQuery)
+	if err != nil {
+		return err
+	}
+	defer cancel.Close()
+
+	stmt, err := tx.Prepare(scheduleMembershipQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, seg := range segList {
+		if _, err := cancel.Exec(userID, seg.SegID, seg.Slug, activeFrom); err != nil {
+			return err
+		}
+
+		if _, err := stmt.Exec(userID, seg.SegID, activeFrom, seg.Slug); err != nil {
+			return normalizeError(err)
+		}
+	}
+	return nil
+}
+
+func (r *SegmentRepository) FindPendingByUser(userID int) ([]*entity.PendingMembership, error) {
+	pendingList := make([]*entity.PendingMembership, 0)
+
+	rows, err := r.db.Query(
+		"SELECT s.seg_id, s.slug, u.active_from FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id WHERE u.user_id = $1 AND u.active_from > now() ORDER BY u.active_from",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &entity.PendingMembership{}
+		if err := rows.Scan(&p.SegID, &p.Slug, &p.ActiveFrom); err != nil {
+			return nil, err
+		}
+		pendingList = append(pendingList, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return pendingList, nil
+}
+
+// CancelPendingUserSegments also cancels the pending memberships that
+// require the cancelled ones.
+func (r *SegmentRepository) CancelPendingUserSegments(userID int, segList []*entity.Segment) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockCapacities(tx, segIDs(segList)); err != nil {
+		return err
+	}
+
+	cascaded, err := resolvePrerequisites(tx, userID, nil, segList, time.Time{}, true)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(deletePendingMembershipQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, seg := range append(append([]*entity.Segment(nil), segList...), cascaded...) {
+		if _, err := stmt.Exec(userID, seg.SegID, seg.Slug); err != nil {
+			return err
+		}
+	}
+
+	if err := promoteWaitlists(tx, segList); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,7 +1,10 @@
 package sqlrepository_test
 
 import (
+	"fmt"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
@@ -10,9 +13,20 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// segmentTables are truncated after every test, the changes of memberships
+// also leave rows in the history, its snapshots and the events.
+var segmentTables = []string{
+	"events",
+	"history_snapshot_members",
+	"history_snapshots",
+	"users_with_segments_history",
+	"users_with_segments",
+	"segments",
+}
+
 func TestSegmentRepository_Create(t *testing.T) {
 	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
-	defer teardown("segments")
+	defer teardown(segmentTables...)
 
 	r := sqlrepository.NewSegmentRepository(db)
 	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
@@ -22,7 +36,7 @@ func TestSegmentRepository_Create(t *testing.T) {
 
 func TestSegmentRepository_FindBySlug(t *testing.T) {
 	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
-	defer teardown("segments")
+	defer teardown(segmentTables...)
 
 	r := sqlrepository.NewSegmentRepository(db)
 	seg1 := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
@@ -37,7 +51,7 @@ func TestSegmentRepository_FindBySlug(t *testing.T) {
 
 func TestSegmentRepository_Delete(t *testing.T) {
 	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
-	defer teardown("users_with_segments", "segments")
+	defer teardown(segmentTables...)
 
 	r := sqlrepository.NewSegmentRepository(db)
 
@@ -62,7 +76,7 @@ func TestSegmentRepository_Delete(t *testing.T) {
 
 func TestSegmentRepository_AddUserToSegments(t *testing.T) {
 	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
-	defer teardown("users_with_segments", "segments")
+	defer teardown(segmentTables...)
 
 	r := sqlrepository.NewSegmentRepository(db)
 
@@ -84,7 +98,7 @@ func TestSegmentRepository_AddUserToSegments(t *testing.T) {
 
 func TestSegmentRepository_DeleteUserFromSegments(t *testing.T) {
 	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
-	defer teardown("users_with_segments", "segments")
+	defer teardown(segmentTables...)
 
 	r := sqlrepository.NewSegmentRepository(db)
 
@@ -104,7 +118,7 @@ func TestSegmentRepository_DeleteUserFromSegments(t *testing.T) {
 
 func TestSegmentRepository_FindByUser(t *testing.T) {
 	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
-	defer teardown("users_with_segments", "segments")
+	defer teardown(segmentTables...)
 
 	r := sqlrepository.NewSegmentRepository(db)
 
@@ -125,3 +139,259 @@ func TestSegmentRepository_FindByUser(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, segList2)
 }
+
+type userIDReader struct {
+	userIDs []int
+}
+
+func (r *userIDReader) ReadUserID() (int, error) {
+	if len(r.userIDs) == 0 {
+		return 0, io.EOF
+	}
+	userID := r.userIDs[0]
+	r.userIDs = r.userIDs[1:]
+	return userID, nil
+}
+
+func TestSegmentRepository_ImportUsersToSegment(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	r.Create(seg)
+	r.AddUserToSegments(1, []*entity.Segment{seg})
+
+	res, err := r.ImportUsersToSegment(seg, &userIDReader{userIDs: []int{1, 2, 3, 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Accepted)
+	assert.Equal(t, 2, res.Duplicate)
+
+	res, err = r.ImportUsersToSegment(seg, &userIDReader{userIDs: []int{2, 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Accepted)
+	assert.Equal(t, 2, res.Duplicate)
+}
+
+func TestSegmentRepository_ExportSegmentMembers(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(2, segList[0:1])
+	r.AddUserToSegments(1, segList)
+
+	userIDs := make([]int, 0)
+	err := r.ExportSegmentMembers(segList[0], func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, userIDs)
+}
+
+func TestSegmentRepository_ExportMemberships(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_50"},
+		{Slug: "AVITO_DISCOUNT_30"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(2, segList[0:1])
+	r.AddUserToSegments(1, segList)
+
+	slugs := make([]string, 0)
+	err := r.ExportMemberships(func(m *entity.Membership) error {
+		slugs = append(slugs, fmt.Sprintf("%d:%s", m.UserID, m.Slug))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_30", "1:AVITO_DISCOUNT_50", "2:AVITO_DISCOUNT_50"}, slugs)
+}
+
+func TestSegmentRepository_ApplyMembershipChanges(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(1, segList[0:1])
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[1:2], SegListDel: segList[0:1]},
+		{UserID: 2, SegListAdd: segList[0:2]},
+		{UserID: 2, SegListAdd: segList[0:1]},
+	})
+	assert.NoError(t, err)
+
+	segList1, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList1, 1)
+
+	segList2, err := r.FindByUser(2)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 2)
+}
+
+func TestSegmentRepository_ScheduleUserToSegments(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+
+	err := r.ScheduleUserToSegments(userID, segList[0:1], time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	err = r.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+
+	segList2, err := r.FindByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+}
+
+func TestSegmentRepository_FindPendingByUser(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(userID, segList[0:1])
+	r.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(time.Hour))
+
+	pendingList, err := r.FindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, pendingList, 1)
+}
+
+func TestSegmentRepository_CancelPendingUserSegments(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(userID, segList[0:1])
+	r.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(time.Hour))
+
+	err := r.CancelPendingUserSegments(userID, segList)
+	assert.NoError(t, err)
+
+	segList2, err := r.FindByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+}
+
+func TestSegmentRepository_FindByUserAsOf(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+
+	beforeAdd := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	r.AddUserToSegments(userID, segList)
+	r.ScheduleUserToSegments(userID+1, segList[0:1], time.Now().Add(time.Hour))
+	time.Sleep(10 * time.Millisecond)
+	afterAdd := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	r.DeleteUserFromSegments(userID, segList[0:1])
+	r.Delete(segList[1])
+
+	_, err := r.FindByUserAsOf(userID, beforeAdd)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList2, err := r.FindByUserAsOf(userID, afterAdd)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 2)
+
+	_, err = r.FindByUserAsOf(userID, time.Now())
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList3, err := r.FindByUserAsOf(userID+1, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, segList3, 1)
+}
+
+func TestSegmentRepository_TakeHistorySnapshot(t *testing.T) {
+	db, teardown := sqlrepository.TestDB(t, testDatabaseURL)
+	defer teardown(segmentTables...)
+
+	r := sqlrepository.NewSegmentRepository(db)
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(userID, segList)
+	time.Sleep(10 * time.Millisecond)
+
+	assert.NoError(t, r.TakeHistorySnapshot(time.Now()))
+	time.Sleep(10 * time.Millisecond)
+	r.DeleteUserFromSegments(userID, segList[0:1])
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, r.TakeHistorySnapshot(time.Now()))
+
+	segList2, err := r.FindByUserAsOf(userID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Segment{segList[1]}, segList2)
+}
@@ -0,0 +1,236 @@
+package sqlrepository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/lib/pq"
+)
+
+type WebhookRepository struct {
+	db *sql.DB
+}
+
+func NewWebhookRepository(db *sql.DB) *WebhookRepository {
+	return &WebhookRepository{
+		db: db,
+	}
+}
+
+func (r *WebhookRepository) Create(w *entity.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	if w.EventTypes == nil {
+		w.EventTypes = []string{}
+	}
+
+	if w.Slugs == nil {
+		w.Slugs = []string{}
+	}
+
+	return r.db.QueryRow(
+		"INSERT INTO webhooks (url, secret, event_types, slugs) VALUES ($1, $2, $3, $4) RETURNING webhook_id, created_at",
+		w.URL, w.Secret, pq.Array(w.EventTypes), pq.Array(w.Slugs),
+	).Scan(&w.WebhookID, &w.CreatedAt)
+}
+
+func (r *WebhookRepository) FindAll() ([]*entity.Webhook, error) {
+	webhooks := make([]*entity.Webhook, 0)
+
+	rows, err := r.db.Query(
+		"SELECT webhook_id, url, secret, event_types, slugs, created_at FROM webhooks ORDER BY webhook_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		w := &entity.Webhook{}
+		if err := rows.Scan(
+			&w.WebhookID,
+			&w.URL,
+			&w.Secret,
+			pq.Array(&w.EventTypes),
+			pq.Array(&w.Slugs),
+			&w.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (r *WebhookRepository) Delete(webhookID int) error {
+	res, err := r.db.Exec(
+		"DELETE FROM webhooks WHERE webhook_id = $1",
+		webhookID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// FanOutEvents turns up to limit outbox events into pending deliveries for every
+// matching webhook. Events are locked while they are fanned out, so several
+// instances can run it side by side.
+func (r *WebhookRepository) FanOutEvents(limit int) (int, error) {
+	res, err := r.db.Exec(
+		`WITH batch AS (
+			SELECT event_id, event_type, slug FROM events WHERE NOT webhooks_dispatched
+			ORDER BY event_id LIMIT $1 FOR UPDATE SKIP LOCKED),
+		deliveries AS (
+			INSERT INTO webhook_deliveries (webhook_id, event_id)
+			SELECT w.webhook_id, b.event_id FROM batch b JOIN webhooks w
+			ON (cardinality(w.event_types) = 0 OR b.event_type = ANY(w.event_types))
+			AND (cardinality(w.slugs) = 0 OR b.slug = ANY(w.slugs))
+			ON CONFLICT DO NOTHING)
+		UPDATE events SET webhooks_dispatched = true WHERE event_id IN (SELECT event_id FROM batch)`,
+		limit)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// ClaimDeliveries takes up to limit due deliveries and hides them from other
+// workers for the lease duration.
+func (r *WebhookRepository) ClaimDeliveries(limit int, lease time.Duration) ([]*entity.WebhookDelivery, error) {
+	deliveries := make([]*entity.WebhookDelivery, 0)
+
+	rows, err := r.db.Query(
+		`UPDATE webhook_deliveries d SET next_attempt_at = now() + make_interval(secs => $2)
+		FROM webhooks w, events e
+		WHERE d.delivery_id IN (
+			SELECT delivery_id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, delivery_id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		AND w.webhook_id = d.webhook_id AND e.event_id = d.event_id
+		RETURNING d.delivery_id, d.webhook_id, d.status, d.attempts, d.next_attempt_at, d.last_error, w.url, w.secret,
+			e.event_id, e.event_type, e.user_id, e.seg_id, e.slug, e.effective_at, e.created_at`,
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanDelivery(rows, true)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *WebhookRepository) MarkDelivered(deliveryID int) error {
+	res, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, last_error = '' WHERE delivery_id = $1",
+		deliveryID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (r *WebhookRepository) MarkFailed(deliveryID int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	status := entity.DeliveryStatusPending
+	if dead {
+		status = entity.DeliveryStatusDead
+	}
+
+	res, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = $4 WHERE delivery_id = $1",
+		deliveryID, status, lastError, nextAttemptAt)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// FindDeliveries returns the latest deliveries of the webhook,
+// optionally only those with the given status.
+func (r *WebhookRepository) FindDeliveries(webhookID int, status string) ([]*entity.WebhookDelivery, error) {
+	deliveries := make([]*entity.WebhookDelivery, 0)
+
+	rows, err := r.db.Query(
+		`SELECT d.delivery_id, d.webhook_id, d.status, d.attempts, d.next_attempt_at, d.last_error,
+			e.event_id, e.event_type, e.user_id, e.seg_id, e.slug, e.effective_at, e.created_at
+		FROM webhook_deliveries d JOIN events e ON e.event_id = d.event_id
+		WHERE d.webhook_id = $1 AND ($2 = '' OR d.status = $2)
+		ORDER BY d.delivery_id DESC LIMIT 1000`,
+		webhookID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanDelivery(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Redeliver puts a delivery back into the queue with a fresh attempt budget.
+func (r *WebhookRepository) Redeliver(deliveryID int) error {
+	res, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = 'pending', attempts = 0, last_error = '', next_attempt_at = now() WHERE delivery_id = $1",
+		deliveryID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func scanDelivery(rows *sql.Rows, withTarget bool) (*entity.WebhookDelivery, error) {
+	d := &entity.WebhookDelivery{Event: &entity.Event{}}
+	userID := sql.NullInt64{}
+
+	dest := []interface{}{&d.DeliveryID, &d.WebhookID, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError}
+	if withTarget {
+		dest = append(dest, &d.URL, &d.Secret)
+	}
+	dest = append(dest,
+		&d.Event.EventID, &d.Event.Type, &userID, &d.Event.SegID, &d.Event.Slug, &d.Event.EffectiveAt, &d.Event.CreatedAt)
+
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	d.Event.UserID = int(userID.Int64)
+
+	return d, nil
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return repository.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package testrepository_test
+
+import (
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/repositorytest"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+)
+
+func TestSegmentRepository_Conformance(t *testing.T) {
+	repositorytest.RunSegmentRepositoryTests(t, func(t *testing.T) repository.SegmentRepository {
+		return testrepository.NewSegmentRepository()
+	})
+}
+
+func TestSegmentRepository_ConformancePersistent(t *testing.T) {
+	repositorytest.RunSegmentRepositoryTests(t, func(t *testing.T) repository.SegmentRepository {
+		r, err := testrepository.Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			r.Close()
+		})
+		return r
+	})
+}
@@ -0,0 +1,83 @@
+package testrepository
+
+import (
+	"sync"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// EventRepository relays the events emitted by the wrapped SegmentRepository.
+type EventRepository struct {
+	mu                sync.Mutex
+	segmentRepository *SegmentRepository
+	offsets           map[string]int
+	sequenced         int
+}
+
+func NewEventRepository(r *SegmentRepository) *EventRepository {
+	return &EventRepository{
+		segmentRepository: r,
+		offsets:           make(map[string]int),
+	}
+}
+
+func (r *EventRepository) SequenceEvents(limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.segmentRepository.mu.Lock()
+	defer r.segmentRepository.mu.Unlock()
+
+	events := r.segmentRepository.events[r.sequenced:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	for _, e := range events {
+		r.sequenced++
+		e.Seq = r.sequenced
+	}
+	return len(events), nil
+}
+
+func (r *EventRepository) FindAfter(seq int, limit int) ([]*entity.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.segmentRepository.mu.RLock()
+	defer r.segmentRepository.mu.RUnlock()
+
+	events := make([]*entity.Event, 0)
+	for _, e := range r.segmentRepository.events[:r.sequenced] {
+		if len(events) == limit {
+			break
+		}
+
+		if e.Seq > seq {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (r *EventRepository) FindLastSeq() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.sequenced, nil
+}
+
+func (r *EventRepository) FindOffset(sink string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.offsets[sink], nil
+}
+
+func (r *EventRepository) SaveOffset(sink string, seq int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.offsets[sink] = seq
+	return nil
+}
@@ -1,90 +1,757 @@
 package testrepository
 
 import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
 )
 
-type Pair struct {
-	userID int
-	segID  int
+type membership struct {
+	seg        *entity.Segment
+	activeFrom time.Time
+}
+
+func (m *membership) active(now time.Time) bool {
+	return !m.activeFrom.After(now)
+}
+
+type historyEvent struct {
+	seg         *entity.Segment
+	operation   string
+	effectiveAt time.Time
 }
 
+// SegmentRepository keeps segments and memberships in memory and is safe
+// for concurrent use. Memberships are indexed both by user and by segment.
+// A repository opened with Open also persists every change, see store.go.
 type SegmentRepository struct {
-	segments          map[int]*entity.Segment
-	usersWithSegments map[Pair]*entity.Segment
+	mu          sync.RWMutex
+	segments    map[int]*entity.Segment
+	slugs       map[string]*entity.Segment
+	byUser      map[int]map[int]*membership
+	bySegment   map[int]map[int]struct{}
+	history     map[int][]*historyEvent
+	events      []*entity.Event
+	lastSegID   int
+	parents     map[int]int
+	groups      map[int]*entity.Group
+	segGroups   repository.ExclusionGroups
+	lastGroupID int
+	prereqs     map[int][]int
+	limits      map[int]*entity.Capacity
+	waitlists   map[int][]int
+	notify      chan struct{}
+	store       *store
 }
 
 func NewSegmentRepository() *SegmentRepository {
 	return &SegmentRepository{
-		segments:          make(map[int]*entity.Segment),
-		usersWithSegments: make(map[Pair]*entity.Segment),
+		segments:  make(map[int]*entity.Segment),
+		slugs:     make(map[string]*entity.Segment),
+		byUser:    make(map[int]map[int]*membership),
+		bySegment: make(map[int]map[int]struct{}),
+		history:   make(map[int][]*historyEvent),
+		events:    make([]*entity.Event, 0),
+		parents:   make(map[int]int),
+		groups:    make(map[int]*entity.Group),
+		segGroups: make(repository.ExclusionGroups),
+		prereqs:   make(map[int][]int),
+		limits:    make(map[int]*entity.Capacity),
+		waitlists: make(map[int][]int),
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// Notify fires after new events are emitted. Bursts are coalesced.
+func (r *SegmentRepository) Notify() <-chan struct{} {
+	return r.notify
+}
+
+// commit writes the operations to the log, if any, and applies them.
+// The caller holds the write lock.
+func (r *SegmentRepository) commit(ops []*op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	rec := &record{At: time.Now(), Ops: ops}
+	if r.store != nil {
+		if err := r.store.append(rec); err != nil {
+			return err
+		}
+	}
+
+	r.apply(rec)
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (r *SegmentRepository) apply(rec *record) {
+	for _, o := range rec.Ops {
+		switch o.Op {
+		case opCreate:
+			seg := &entity.Segment{SegID: o.SegID, Slug: o.Slug}
+			r.segments[seg.SegID] = seg
+			r.slugs[seg.Slug] = seg
+			if o.ParentID != 0 {
+				r.parents[seg.SegID] = o.ParentID
+			}
+			if seg.SegID > r.lastSegID {
+				r.lastSegID = seg.SegID
+			}
+			r.emit(entity.EventSegmentCreated, 0, seg, rec.At, rec.At)
+
+		case opDelete:
+			seg := r.segments[o.SegID]
+			for userID := range r.bySegment[o.SegID] {
+				r.remove(userID, o.SegID, rec.At)
+			}
+			delete(r.bySegment, o.SegID)
+			delete(r.segments, o.SegID)
+			delete(r.slugs, seg.Slug)
+			delete(r.segGroups, o.SegID)
+			delete(r.parents, o.SegID)
+			r.deletePrerequisites(o.SegID)
+			delete(r.limits, o.SegID)
+			delete(r.waitlists, o.SegID)
+			r.emit(entity.EventSegmentDeleted, 0, seg, rec.At, rec.At)
+
+		case opAdd:
+			activeFrom := o.ActiveFrom
+			if activeFrom.IsZero() {
+				activeFrom = rec.At
+			}
+			r.add(o.UserID, r.segments[o.SegID], activeFrom, rec.At)
+			r.unwaitlist(o.UserID, o.SegID)
+
+		case opActivate:
+			r.activate(o.UserID, o.SegID, rec.At)
+
+		case opReschedule:
+			r.reschedule(o.UserID, o.SegID, o.ActiveFrom, rec.At)
+
+		case opRemove:
+			r.remove(o.UserID, o.SegID, rec.At)
+
+		case opReparent:
+			if o.ParentID == 0 {
+				delete(r.parents, o.SegID)
+			} else {
+				r.parents[o.SegID] = o.ParentID
+			}
+
+		case opCreateGroup:
+			r.createGroup(o.GroupID, o.Name, o.Policy, o.SegIDs)
+
+		case opDeleteGroup:
+			for segID, g := range r.segGroups {
+				if g.GroupID == o.GroupID {
+					delete(r.segGroups, segID)
+				}
+			}
+			delete(r.groups, o.GroupID)
+
+		case opAddPrerequisite:
+			r.prereqs[o.SegID] = append(r.prereqs[o.SegID], o.RequiredID)
+
+		case opDeletePrerequisite:
+			r.prereqs[o.SegID] = without(r.prereqs[o.SegID], o.RequiredID)
+			if len(r.prereqs[o.SegID]) == 0 {
+				delete(r.prereqs, o.SegID)
+			}
+
+		case opSetCapacity:
+			r.limits[o.SegID] = &entity.Capacity{MaxMembers: o.MaxMembers, Overflow: o.Policy}
+
+		case opDeleteCapacity:
+			delete(r.limits, o.SegID)
+			delete(r.waitlists, o.SegID)
+
+		case opWaitlist:
+			r.waitlists[o.SegID] = append(r.waitlists[o.SegID], o.UserID)
+
+		case opUnwaitlist:
+			r.unwaitlist(o.UserID, o.SegID)
+		}
+	}
+}
+
+// add stores the membership and records it in the history.
+func (r *SegmentRepository) add(userID int, seg *entity.Segment, activeFrom time.Time, at time.Time) {
+	if r.byUser[userID] == nil {
+		r.byUser[userID] = make(map[int]*membership)
+	}
+	r.byUser[userID][seg.SegID] = &membership{seg: seg, activeFrom: activeFrom}
+
+	if r.bySegment[seg.SegID] == nil {
+		r.bySegment[seg.SegID] = make(map[int]struct{})
+	}
+	r.bySegment[seg.SegID][userID] = struct{}{}
+
+	r.history[userID] = append(r.history[userID], &historyEvent{
+		seg:         seg,
+		operation:   entity.OperationAdd,
+		effectiveAt: activeFrom,
+	})
+	r.emit(entity.EventUserAdded, userID, seg, activeFrom, at)
+}
+
+// activate starts a pending membership at once. The pending addition is
+// dropped from the history, so that the user is not added again at the
+// scheduled start on replay.
+func (r *SegmentRepository) activate(userID int, segID int, at time.Time) {
+	m := r.byUser[userID][segID]
+	r.forgetPending(userID, m)
+	m.activeFrom = at
+
+	r.history[userID] = append(r.history[userID], &historyEvent{
+		seg:         m.seg,
+		operation:   entity.OperationAdd,
+		effectiveAt: at,
+	})
+	r.emit(entity.EventUserAdded, userID, m.seg, at, at)
+}
+
+// reschedule moves the start of a pending membership. The scheduled addition
+// is dropped from the history and the cancellation takes effect no later
+// than the new start, so that an event consumer never sees the old start
+// after the new one.
+func (r *SegmentRepository) reschedule(userID int, segID int, activeFrom time.Time, at time.Time) {
+	m := r.byUser[userID][segID]
+	r.forgetPending(userID, m)
+
+	cancelledAt := m.activeFrom
+	if activeFrom.Before(cancelledAt) {
+		cancelledAt = activeFrom
+	}
+	r.emit(entity.EventUserRemoved, userID, m.seg, cancelledAt, at)
+
+	m.activeFrom = activeFrom
+	r.history[userID] = append(r.history[userID], &historyEvent{
+		seg:         m.seg,
+		operation:   entity.OperationAdd,
+		effectiveAt: activeFrom,
+	})
+	r.emit(entity.EventUserAdded, userID, m.seg, activeFrom, at)
+}
+
+// forgetPending drops the history entry of the pending membership, the
+// latest addition of the segment at its start time.
+func (r *SegmentRepository) forgetPending(userID int, m *membership) {
+	h := r.history[userID]
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].seg.SegID == m.seg.SegID && h[i].operation == entity.OperationAdd && h[i].effectiveAt.Equal(m.activeFrom) {
+			r.history[userID] = append(h[:i:i], h[i+1:]...)
+			return
+		}
 	}
 }
 
+// remove drops the membership and records it in the history. Removing
+// a pending membership takes effect at its start time.
+func (r *SegmentRepository) remove(userID int, segID int, at time.Time) {
+	m, ok := r.byUser[userID][segID]
+	if !ok {
+		return
+	}
+
+	delete(r.byUser[userID], segID)
+	if len(r.byUser[userID]) == 0 {
+		delete(r.byUser, userID)
+	}
+	delete(r.bySegment[segID], userID)
+
+	effectiveAt := at
+	if m.activeFrom.After(effectiveAt) {
+		effectiveAt = m.activeFrom
+	}
+
+	r.history[userID] = append(r.history[userID], &historyEvent{
+		seg:         m.seg,
+		operation:   entity.OperationRemove,
+		effectiveAt: effectiveAt,
+	})
+	r.emit(entity.EventUserRemoved, userID, m.seg, effectiveAt, at)
+}
+
+func (r *SegmentRepository) createGroup(groupID int, name, policy string, segIDs []int) {
+	g := &entity.Group{GroupID: groupID, Name: name, Policy: policy}
+	r.groups[groupID] = g
+	for _, segID := range segIDs {
+		r.segGroups[segID] = g
+	}
+
+	if groupID > r.lastGroupID {
+		r.lastGroupID = groupID
+	}
+}
+
+// groupSegIDs lists the segments of the group ordered by ID.
+func (r *SegmentRepository) groupSegIDs(g *entity.Group) []int {
+	segIDs := make([]int, 0)
+	for segID, sg := range r.segGroups {
+		if sg.GroupID == g.GroupID {
+			segIDs = append(segIDs, segID)
+		}
+	}
+	sort.Ints(segIDs)
+	return segIDs
+}
+
+// groupedMemberships lists the segments of exclusion groups the user is in,
+// active or pending. The caller holds the lock.
+func (r *SegmentRepository) groupedMemberships(userID int) []*entity.Segment {
+	segList := make([]*entity.Segment, 0)
+	for segID, m := range r.byUser[userID] {
+		if _, ok := r.segGroups[segID]; ok {
+			segList = append(segList, m.seg)
+		}
+	}
+	return segList
+}
+
+// deletePrerequisites drops the prerequisites of the segment and those
+// on it. The caller holds the lock.
+func (r *SegmentRepository) deletePrerequisites(segID int) {
+	delete(r.prereqs, segID)
+	for id, required := range r.prereqs {
+		r.prereqs[id] = without(required, segID)
+		if len(r.prereqs[id]) == 0 {
+			delete(r.prereqs, id)
+		}
+	}
+}
+
+// prerequisites collects the prerequisites of every segment. The caller holds the lock.
+func (r *SegmentRepository) prerequisites() *repository.Prerequisites {
+	p := repository.NewPrerequisites()
+	for segID, required := range r.prereqs {
+		for _, id := range required {
+			p.Add(r.segments[segID], r.segments[id])
+		}
+	}
+	return p
+}
+
+// prerequisiteMemberships maps the segments the user is in to the start of
+// a pending membership, active ones to the zero time. pendingOnly leaves the
+// active ones out. The caller holds the lock.
+func (r *SegmentRepository) prerequisiteMemberships(userID int, now time.Time, pendingOnly bool) map[int]time.Time {
+	memberships := make(map[int]time.Time, len(r.byUser[userID]))
+	for segID, m := range r.byUser[userID] {
+		if !m.active(now) {
+			memberships[segID] = m.activeFrom
+		} else if !pendingOnly {
+			memberships[segID] = time.Time{}
+		}
+	}
+	return memberships
+}
+
+// requires reports whether the segment requires the other one, directly
+// or through other segments. The caller holds the lock.
+func (r *SegmentRepository) requires(segID, otherID int) bool {
+	visited := make(map[int]bool)
+	queue := []int{segID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		for _, required := range r.prereqs[id] {
+			if required == otherID {
+				return true
+			}
+			if !visited[required] {
+				visited[required] = true
+				queue = append(queue, required)
+			}
+		}
+	}
+	return false
+}
+
+// capacities counts the members of the segments with a member limit.
+// The caller holds the lock.
+func (r *SegmentRepository) capacities() repository.Capacities {
+	caps := make(repository.Capacities, len(r.limits))
+	for segID, c := range r.limits {
+		caps[segID] = &entity.Capacity{
+			Slug:       r.segments[segID].Slug,
+			MaxMembers: c.MaxMembers,
+			Overflow:   c.Overflow,
+			Members:    len(r.bySegment[segID]),
+		}
+	}
+	return caps
+}
+
+// memberOf lists the segments the user is in, active or pending.
+// The caller holds the lock.
+func (r *SegmentRepository) memberOf(userID int) map[int]bool {
+	memberships := make(map[int]bool, len(r.byUser[userID]))
+	for segID := range r.byUser[userID] {
+		memberships[segID] = true
+	}
+	return memberships
+}
+
+// waitlisted reports whether the user is on the waitlist of the segment.
+// The caller holds the lock.
+func (r *SegmentRepository) waitlisted(userID, segID int) bool {
+	for _, id := range r.waitlists[segID] {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// waitlist puts the user on the waitlists of the segments, a user already
+// on one keeps the place. The caller holds the lock.
+func (r *SegmentRepository) waitlist(userID int, segList []*entity.Segment) []*op {
+	ops := make([]*op, 0, len(segList))
+	for _, seg := range segList {
+		if !r.waitlisted(userID, seg.SegID) {
+			ops = append(ops, &op{Op: opWaitlist, UserID: userID, SegID: seg.SegID})
+		}
+	}
+	return ops
+}
+
+func (r *SegmentRepository) unwaitlist(userID, segID int) {
+	if !r.waitlisted(userID, segID) {
+		return
+	}
+
+	r.waitlists[segID] = without(r.waitlists[segID], userID)
+	if len(r.waitlists[segID]) == 0 {
+		delete(r.waitlists, segID)
+	}
+}
+
+// promote adds the waitlisted users to the segments with free places, see
+// repository.Capacities.Promote. A user whose addition an exclusion group
+// or a missing prerequisite would reject is skipped. Every segment is
+// committed on its own, so that the checks for the next one see the users
+// promoted to it. The caller holds the write lock.
+func (r *SegmentRepository) promote(segList []*entity.Segment) error {
+	caps := r.capacities()
+	prereqs := r.prerequisites()
+	promoted := make(map[int]bool, len(segList))
+	for _, s := range segList {
+		if promoted[s.SegID] || len(r.waitlists[s.SegID]) == 0 {
+			continue
+		}
+		promoted[s.SegID] = true
+
+		seg := r.segments[s.SegID]
+		add := []*entity.Segment{seg}
+		now := time.Now()
+		userIDs, err := caps.Promote(seg.SegID, r.waitlists[seg.SegID], func(userID int) (bool, error) {
+			if _, err := r.segGroups.Resolve(r.groupedMemberships(userID), add, false); err != nil {
+				return false, nil
+			}
+
+			_, err := prereqs.Resolve(r.prerequisiteMemberships(userID, now, false), add, nil, time.Time{})
+			return err == nil, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		ops := make([]*op, 0, len(userIDs))
+		for _, userID := range userIDs {
+			ops = append(ops, &op{Op: opAdd, UserID: userID, SegID: seg.SegID})
+		}
+
+		if err := r.commit(ops); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func without(ids []int, id int) []int {
+	kept := make([]int, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+// emit appends an event to the outbox.
+func (r *SegmentRepository) emit(eventType string, userID int, seg *entity.Segment, effectiveAt time.Time, at time.Time) {
+	r.events = append(r.events, &entity.Event{
+		EventID:     len(r.events) + 1,
+		Type:        eventType,
+		UserID:      userID,
+		SegID:       seg.SegID,
+		Slug:        seg.Slug,
+		EffectiveAt: effectiveAt,
+		CreatedAt:   at,
+	})
+}
+
+// segment copies the segment with the slug of its parent. The caller holds the lock.
+func (r *SegmentRepository) segment(seg *entity.Segment) *entity.Segment {
+	found := &entity.Segment{SegID: seg.SegID, Slug: seg.Slug}
+	if parentID, ok := r.parents[seg.SegID]; ok {
+		found.Parent = r.segments[parentID].Slug
+	}
+	return found
+}
+
+// parentID looks up the parent of the segment, none gives 0. The caller holds the lock.
+func (r *SegmentRepository) parentID(seg *entity.Segment) (int, error) {
+	if seg.Parent == "" {
+		return 0, nil
+	}
+
+	parent, ok := r.slugs[seg.Parent]
+	if !ok {
+		return 0, repository.ErrRecordNotFound
+	}
+	return parent.SegID, nil
+}
+
+// requireSegments checks that every segment exists. The caller holds the lock.
+func (r *SegmentRepository) requireSegments(segList []*entity.Segment) error {
+	for _, seg := range segList {
+		if _, ok := r.segments[seg.SegID]; !ok {
+			return repository.ErrRecordNotFound
+		}
+	}
+	return nil
+}
+
 func (r *SegmentRepository) Create(seg *entity.Segment) error {
 	if err := seg.Validate(); err != nil {
 		return err
 	}
 
-	seg.SegID = len(r.segments) + 1
-	r.segments[seg.SegID] = seg
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.slugs[seg.Slug]; ok {
+		return repository.ErrRecordExists
+	}
+
+	parentID, err := r.parentID(seg)
+	if err != nil {
+		return err
+	}
+
+	segID := r.lastSegID + 1
+	if err := r.commit([]*op{{Op: opCreate, SegID: segID, Slug: seg.Slug, ParentID: parentID}}); err != nil {
+		return err
+	}
+	seg.SegID = segID
 
 	return nil
 }
 
 func (r *SegmentRepository) FindBySlug(slug string) (*entity.Segment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seg, ok := r.slugs[slug]
+	if !ok {
+		return nil, repository.ErrRecordNotFound
+	}
+	return r.segment(seg), nil
+}
+
+func (r *SegmentRepository) FindAll() ([]*entity.Segment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	segList := make([]*entity.Segment, 0, len(r.segments))
 	for _, seg := range r.segments {
-		if seg.Slug == slug {
-			return seg, nil
-		}
+		segList = append(segList, r.segment(seg))
 	}
-	return nil, repository.ErrRecordNotFound
+	sort.Slice(segList, func(i, j int) bool {
+		return segList[i].SegID < segList[j].SegID
+	})
+	return segList, nil
 }
 
 func (r *SegmentRepository) Delete(seg *entity.Segment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if _, ok := r.segments[seg.SegID]; !ok {
 		return repository.ErrRecordNotFound
 	}
-	delete(r.segments, seg.SegID)
 
-	for key := range r.usersWithSegments {
-		if key.segID == seg.SegID {
-			delete(r.usersWithSegments, key)
+	for _, parentID := range r.parents {
+		if parentID == seg.SegID {
+			return repository.ErrHasChildren
 		}
 	}
-	return nil
+	return r.commit([]*op{{Op: opDelete, SegID: seg.SegID}})
 }
 
+// DeleteReparent moves the children of the segment to its parent and
+// deletes it in one commit.
+func (r *SegmentRepository) DeleteReparent(seg *entity.Segment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.segments[seg.SegID]; !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	ops := make([]*op, 0)
+	for childID, parentID := range r.parents {
+		if parentID == seg.SegID {
+			ops = append(ops, &op{Op: opReparent, SegID: childID, ParentID: r.parents[seg.SegID]})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].SegID < ops[j].SegID
+	})
+	return r.commit(append(ops, &op{Op: opDelete, SegID: seg.SegID}))
+}
+
+// UpdateParent moves the segment under seg.Parent, an empty parent makes it
+// a root. A parent that is the segment itself or one of its descendants
+// gives ErrSegmentCycle.
+func (r *SegmentRepository) UpdateParent(seg *entity.Segment) error {
+	if err := seg.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, ok := r.slugs[seg.Slug]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	parentID, err := r.parentID(seg)
+	if err != nil {
+		return err
+	}
+
+	for id := parentID; id != 0; id = r.parents[id] {
+		if id == found.SegID {
+			return repository.ErrSegmentCycle
+		}
+	}
+	return r.commit([]*op{{Op: opReparent, SegID: found.SegID, ParentID: parentID}})
+}
+
+// AddUserToSegments adds the user to the segments right away. Existing
+// memberships are kept, pending ones are activated. A full segment with
+// the waitlist policy puts the user on its waitlist instead.
 func (r *SegmentRepository) AddUserToSegments(userID int, segList []*entity.Segment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.requireSegments(segList); err != nil {
+		return err
+	}
+
+	segList, waitlisted, err := r.capacities().Resolve(r.memberOf(userID), segList)
+	if err != nil {
+		return err
+	}
+
+	removed, err := r.segGroups.Resolve(r.groupedMemberships(userID), segList, true)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	cascaded, err := r.prerequisites().Resolve(r.prerequisiteMemberships(userID, now, false), segList, removed, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	ops := make([]*op, 0, len(segList)+len(removed)+len(cascaded))
+	for _, seg := range append(removed, cascaded...) {
+		ops = append(ops, &op{Op: opRemove, UserID: userID, SegID: seg.SegID})
+	}
+
+	added := make(map[int]bool, len(segList))
 	for _, seg := range segList {
-		if _, ok := r.segments[seg.SegID]; !ok {
-			return repository.ErrRecordNotFound
+		if added[seg.SegID] {
+			continue
+		}
+		added[seg.SegID] = true
+
+		if m, ok := r.byUser[userID][seg.SegID]; ok {
+			if !m.active(now) {
+				ops = append(ops, &op{Op: opActivate, UserID: userID, SegID: seg.SegID})
+			}
+			continue
 		}
-		r.usersWithSegments[Pair{userID: userID, segID: seg.SegID}] = seg
+		ops = append(ops, &op{Op: opAdd, UserID: userID, SegID: seg.SegID})
 	}
-	return nil
+
+	if err := r.commit(append(ops, r.waitlist(userID, waitlisted)...)); err != nil {
+		return err
+	}
+	return r.promote(append(removed, cascaded...))
 }
 
+// DeleteUserFromSegments also removes the user from the segments that
+// require the removed ones and takes the user off their waitlists.
 func (r *SegmentRepository) DeleteUserFromSegments(userID int, segList []*entity.Segment) error {
-	for _, segDel := range segList {
-		for key := range r.usersWithSegments {
-			if key.segID == segDel.SegID && key.userID == userID {
-				delete(r.usersWithSegments, key)
-			}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cascaded, err := r.prerequisites().Resolve(r.prerequisiteMemberships(userID, time.Now(), false), nil, segList, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	ops := make([]*op, 0, len(segList)+len(cascaded))
+	removed := make(map[int]bool, len(segList))
+	for _, seg := range append(append([]*entity.Segment(nil), segList...), cascaded...) {
+		if _, ok := r.byUser[userID][seg.SegID]; ok && !removed[seg.SegID] {
+			removed[seg.SegID] = true
+			ops = append(ops, &op{Op: opRemove, UserID: userID, SegID: seg.SegID})
 		}
 	}
-	return nil
+
+	for _, seg := range segList {
+		if r.waitlisted(userID, seg.SegID) {
+			ops = append(ops, &op{Op: opUnwaitlist, UserID: userID, SegID: seg.SegID})
+		}
+	}
+
+	if err := r.commit(ops); err != nil {
+		return err
+	}
+	return r.promote(append(append([]*entity.Segment(nil), segList...), cascaded...))
 }
 
 func (r *SegmentRepository) FindByUser(userID int) ([]*entity.Segment, error) {
-	segList := make([]*entity.Segment, 0)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	for key, seg := range r.usersWithSegments {
-		if key.userID == userID {
-			segList = append(segList, seg)
+	now := time.Now()
+	segList := make([]*entity.Segment, 0, len(r.byUser[userID]))
+	for _, m := range r.byUser[userID] {
+		if m.active(now) {
+			segList = append(segList, &entity.Segment{SegID: m.seg.SegID, Slug: m.seg.Slug})
 		}
 	}
+	sort.Slice(segList, func(i, j int) bool {
+		return segList[i].SegID < segList[j].SegID
+	})
 
 	if len(segList) > 0 {
 		return segList, nil
@@ -92,3 +759,584 @@ func (r *SegmentRepository) FindByUser(userID int) ([]*entity.Segment, error) {
 		return nil, repository.ErrRecordNotFound
 	}
 }
+
+// ImportUsersToSegment reads all user IDs before taking the lock, so a slow
+// upload does not hold up other requests.
+func (r *SegmentRepository) ImportUsersToSegment(seg *entity.Segment, src repository.UserIDReader) (*entity.ImportResult, error) {
+	userIDs := make([]int, 0)
+	for {
+		userID, err := src.ReadUserID()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.segments[seg.SegID]; !ok {
+		return nil, repository.ErrRecordNotFound
+	}
+
+	now := time.Now()
+	prereqs := r.prerequisites()
+	caps := r.capacities()
+	res := &entity.ImportResult{Slug: seg.Slug}
+	ops := make([]*op, 0, len(userIDs))
+	added := make(map[int]bool, len(userIDs))
+	freed := make([]*entity.Segment, 0)
+	for _, userID := range userIDs {
+		if _, ok := r.byUser[userID][seg.SegID]; ok || added[userID] {
+			res.Duplicate++
+			continue
+		}
+
+		segList := []*entity.Segment{seg}
+		removed, err := r.segGroups.Resolve(r.groupedMemberships(userID), segList, true)
+		if err != nil {
+			res.Rejected++
+			continue
+		}
+
+		cascaded, err := prereqs.Resolve(r.prerequisiteMemberships(userID, now, false), segList, removed, time.Time{})
+		if err != nil {
+			res.Rejected++
+			continue
+		}
+
+		if err := caps.Check(nil, segList); err != nil {
+			res.Rejected++
+			continue
+		}
+
+		for _, m := range append(removed, cascaded...) {
+			ops = append(ops, &op{Op: opRemove, UserID: userID, SegID: m.SegID})
+			freed = append(freed, m)
+		}
+
+		added[userID] = true
+		ops = append(ops, &op{Op: opAdd, UserID: userID, SegID: seg.SegID})
+	}
+
+	if err := r.commit(ops); err != nil {
+		return nil, err
+	}
+	res.Accepted = len(added)
+
+	if err := r.promote(freed); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ExportSegmentMembers copies the member IDs and streams them without the lock.
+func (r *SegmentRepository) ExportSegmentMembers(seg *entity.Segment, fn func(int) error) error {
+	r.mu.RLock()
+	now := time.Now()
+	userIDs := make([]int, 0, len(r.bySegment[seg.SegID]))
+	for userID := range r.bySegment[seg.SegID] {
+		if r.byUser[userID][seg.SegID].active(now) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Ints(userIDs)
+	for _, userID := range userIDs {
+		if err := fn(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SegmentRepository) ExportMemberships(fn func(*entity.Membership) error) error {
+	r.mu.RLock()
+	now := time.Now()
+	memberships := make([]*entity.Membership, 0)
+	for userID, segs := range r.byUser {
+		for _, m := range segs {
+			if m.active(now) {
+				memberships = append(memberships, &entity.Membership{UserID: userID, SegID: m.seg.SegID, Slug: m.seg.Slug})
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(memberships, func(i, j int) bool {
+		if memberships[i].UserID != memberships[j].UserID {
+			return memberships[i].UserID < memberships[j].UserID
+		}
+		return memberships[i].Slug < memberships[j].Slug
+	})
+
+	for _, m := range memberships {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SegmentRepository) ApplyMembershipChanges(changes []*entity.MembershipChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range changes {
+		if err := r.requireSegments(c.SegListAdd); err != nil {
+			return err
+		}
+
+		if err := r.requireSegments(c.SegListDel); err != nil {
+			return err
+		}
+	}
+
+	all := changes
+	memberOf := make(map[int]map[int]bool)
+	for _, c := range changes {
+		memberOf[c.UserID] = r.memberOf(c.UserID)
+	}
+	changes, waitlist, errs := r.capacities().ResolveChanges(memberOf, changes)
+
+	memberships := make(map[int][]*entity.Segment)
+	for _, c := range changes {
+		memberships[c.UserID] = r.groupedMemberships(c.UserID)
+	}
+	changes, errs = r.segGroups.ResolveChanges(memberships, changes, errs)
+
+	now := time.Now()
+	prereqMemberships := make(map[int]map[int]time.Time)
+	for _, c := range changes {
+		prereqMemberships[c.UserID] = r.prerequisiteMemberships(c.UserID, now, false)
+	}
+	changes, errs = r.prerequisites().ResolveChanges(prereqMemberships, changes, errs)
+
+	type pair struct {
+		userID int
+		segID  int
+	}
+
+	ops := make([]*op, 0)
+	removed := make(map[pair]bool)
+	unwaitlisted := make(map[pair]bool)
+	for _, c := range changes {
+		for _, seg := range c.SegListDel {
+			key := pair{userID: c.UserID, segID: seg.SegID}
+			if _, ok := r.byUser[c.UserID][seg.SegID]; ok && !removed[key] {
+				removed[key] = true
+				ops = append(ops, &op{Op: opRemove, UserID: c.UserID, SegID: seg.SegID})
+			}
+
+			if r.waitlisted(c.UserID, seg.SegID) && !unwaitlisted[key] {
+				unwaitlisted[key] = true
+				ops = append(ops, &op{Op: opUnwaitlist, UserID: c.UserID, SegID: seg.SegID})
+			}
+		}
+	}
+
+	added := make(map[pair]bool)
+	for _, c := range changes {
+		for _, seg := range c.SegListAdd {
+			key := pair{userID: c.UserID, segID: seg.SegID}
+			if added[key] {
+				continue
+			}
+			added[key] = true
+
+			if m, ok := r.byUser[c.UserID][seg.SegID]; ok && !removed[key] {
+				if m.active(now) {
+					continue
+				}
+
+				// a pending membership is activated or rescheduled
+				if c.ActiveFrom.IsZero() {
+					ops = append(ops, &op{Op: opActivate, UserID: c.UserID, SegID: seg.SegID})
+				} else {
+					ops = append(ops, &op{Op: opReschedule, UserID: c.UserID, SegID: seg.SegID, ActiveFrom: c.ActiveFrom})
+				}
+				continue
+			}
+			ops = append(ops, &op{Op: opAdd, UserID: c.UserID, SegID: seg.SegID, ActiveFrom: c.ActiveFrom})
+		}
+	}
+
+	waitlisted := make(map[pair]bool)
+	for i, c := range all {
+		if errs[i] != nil {
+			continue
+		}
+
+		for _, seg := range waitlist[i] {
+			key := pair{userID: c.UserID, segID: seg.SegID}
+			if !waitlisted[key] && !r.waitlisted(c.UserID, seg.SegID) {
+				waitlisted[key] = true
+				ops = append(ops, &op{Op: opWaitlist, UserID: c.UserID, SegID: seg.SegID})
+			}
+		}
+	}
+
+	if err := r.commit(ops); err != nil {
+		return err
+	}
+
+	// the places taken by additions of changes rejected later are freed too
+	touched := make([]*entity.Segment, 0)
+	for _, c := range changes {
+		touched = append(append(touched, c.SegListDel...), c.SegListAdd...)
+	}
+
+	if err := r.promote(touched); err != nil {
+		return err
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// ScheduleUserToSegments adds the user to the segments starting from activeFrom.
+// A scheduled addition never replaces a membership of an exclusion group,
+// as the removal could not wait for it to start, and is never waitlisted.
+func (r *SegmentRepository) ScheduleUserToSegments(userID int, segList []*entity.Segment, activeFrom time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.requireSegments(segList); err != nil {
+		return err
+	}
+
+	if err := r.capacities().Check(r.memberOf(userID), segList); err != nil {
+		return err
+	}
+
+	if _, err := r.segGroups.Resolve(r.groupedMemberships(userID), segList, false); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := r.prerequisites().Resolve(r.prerequisiteMemberships(userID, now, false), segList, nil, activeFrom); err != nil {
+		return err
+	}
+
+	ops := make([]*op, 0, len(segList))
+	scheduled := make(map[int]bool, len(segList))
+	for _, seg := range segList {
+		if scheduled[seg.SegID] {
+			continue
+		}
+		scheduled[seg.SegID] = true
+
+		if m, ok := r.byUser[userID][seg.SegID]; ok {
+			if !m.active(now) {
+				ops = append(ops, &op{Op: opReschedule, UserID: userID, SegID: seg.SegID, ActiveFrom: activeFrom})
+			}
+			continue
+		}
+		ops = append(ops, &op{Op: opAdd, UserID: userID, SegID: seg.SegID, ActiveFrom: activeFrom})
+	}
+	return r.commit(ops)
+}
+
+func (r *SegmentRepository) FindPendingByUser(userID int) ([]*entity.PendingMembership, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	pendingList := make([]*entity.PendingMembership, 0)
+	for _, m := range r.byUser[userID] {
+		if !m.active(now) {
+			pendingList = append(pendingList, &entity.PendingMembership{
+				SegID:      m.seg.SegID,
+				Slug:       m.seg.Slug,
+				ActiveFrom: m.activeFrom,
+			})
+		}
+	}
+	sort.Slice(pendingList, func(i, j int) bool {
+		return pendingList[i].ActiveFrom.Before(pendingList[j].ActiveFrom)
+	})
+
+	return pendingList, nil
+}
+
+// CancelPendingUserSegments also cancels the pending memberships that
+// require the cancelled ones.
+func (r *SegmentRepository) CancelPendingUserSegments(userID int, segList []*entity.Segment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	cascaded, err := r.prerequisites().Resolve(r.prerequisiteMemberships(userID, now, true), nil, segList, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	ops := make([]*op, 0, len(segList)+len(cascaded))
+	cancelled := make(map[int]bool, len(segList))
+	for _, seg := range append(append([]*entity.Segment(nil), segList...), cascaded...) {
+		if m, ok := r.byUser[userID][seg.SegID]; ok && !m.active(now) && !cancelled[seg.SegID] {
+			cancelled[seg.SegID] = true
+			ops = append(ops, &op{Op: opRemove, UserID: userID, SegID: seg.SegID})
+		}
+	}
+
+	if err := r.commit(ops); err != nil {
+		return err
+	}
+	return r.promote(append(append([]*entity.Segment(nil), segList...), cascaded...))
+}
+
+func (r *SegmentRepository) FindByUserAsOf(userID int, asOf time.Time) ([]*entity.Segment, error) {
+	r.mu.RLock()
+	events := make([]*historyEvent, 0)
+	for _, e := range r.history[userID] {
+		if !e.effectiveAt.After(asOf) {
+			events = append(events, e)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].effectiveAt.Before(events[j].effectiveAt)
+	})
+
+	segments := make(map[int]bool)
+	segList := make([]*entity.Segment, 0)
+	for _, e := range events {
+		switch e.operation {
+		case entity.OperationAdd:
+			if !segments[e.seg.SegID] {
+				segList = append(segList, e.seg)
+			}
+			segments[e.seg.SegID] = true
+		case entity.OperationRemove:
+			delete(segments, e.seg.SegID)
+		}
+	}
+
+	res := make([]*entity.Segment, 0, len(segments))
+	for _, seg := range segList {
+		if segments[seg.SegID] {
+			res = append(res, &entity.Segment{SegID: seg.SegID, Slug: seg.Slug})
+			delete(segments, seg.SegID)
+		}
+	}
+
+	if len(res) > 0 {
+		return res, nil
+	} else {
+		return nil, repository.ErrRecordNotFound
+	}
+}
+
+// TakeHistorySnapshot is a no-op, the history is replayed from memory.
+func (r *SegmentRepository) TakeHistorySnapshot(time.Time) error {
+	return nil
+}
+
+// CreateGroup puts the segments in a new exclusion group. The memberships
+// the users already have are kept, the group applies to later additions.
+func (r *SegmentRepository) CreateGroup(g *entity.Group) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, group := range r.groups {
+		if group.Name == g.Name {
+			return repository.ErrRecordExists
+		}
+	}
+
+	segIDs := make([]int, 0, len(g.Slugs))
+	for _, slug := range g.Slugs {
+		seg, ok := r.slugs[slug]
+		if !ok {
+			return repository.ErrRecordNotFound
+		}
+
+		if _, ok := r.segGroups[seg.SegID]; ok {
+			return repository.ErrRecordExists
+		}
+		segIDs = append(segIDs, seg.SegID)
+	}
+
+	groupID := r.lastGroupID + 1
+	if err := r.commit([]*op{{Op: opCreateGroup, GroupID: groupID, Name: g.Name, Policy: g.Policy, SegIDs: segIDs}}); err != nil {
+		return err
+	}
+	g.GroupID = groupID
+
+	return nil
+}
+
+func (r *SegmentRepository) FindGroups() ([]*entity.Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	groups := make([]*entity.Group, 0, len(r.groups))
+	for _, g := range r.groups {
+		group := &entity.Group{GroupID: g.GroupID, Name: g.Name, Policy: g.Policy, Slugs: make([]string, 0)}
+		for _, segID := range r.groupSegIDs(g) {
+			group.Slugs = append(group.Slugs, r.segments[segID].Slug)
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].GroupID < groups[j].GroupID
+	})
+	return groups, nil
+}
+
+func (r *SegmentRepository) DeleteGroup(g *entity.Group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, group := range r.groups {
+		if group.Name == g.Name {
+			return r.commit([]*op{{Op: opDeleteGroup, GroupID: group.GroupID}})
+		}
+	}
+	return repository.ErrRecordNotFound
+}
+
+// AddPrerequisite makes p.Slug require p.Requires. The memberships the users
+// already have are kept, the prerequisite applies to later changes.
+func (r *SegmentRepository) AddPrerequisite(p *entity.Prerequisite) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seg, ok := r.slugs[p.Slug]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	required, ok := r.slugs[p.Requires]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	for _, id := range r.prereqs[seg.SegID] {
+		if id == required.SegID {
+			return repository.ErrRecordExists
+		}
+	}
+
+	if r.requires(required.SegID, seg.SegID) {
+		return repository.ErrPrerequisiteCycle
+	}
+	return r.commit([]*op{{Op: opAddPrerequisite, SegID: seg.SegID, RequiredID: required.SegID}})
+}
+
+func (r *SegmentRepository) FindPrerequisites() ([]*entity.Prerequisite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	prereqs := make([]*entity.Prerequisite, 0)
+	for segID, required := range r.prereqs {
+		for _, id := range required {
+			prereqs = append(prereqs, &entity.Prerequisite{Slug: r.segments[segID].Slug, Requires: r.segments[id].Slug})
+		}
+	}
+	sort.Slice(prereqs, func(i, j int) bool {
+		if prereqs[i].Slug != prereqs[j].Slug {
+			return prereqs[i].Slug < prereqs[j].Slug
+		}
+		return prereqs[i].Requires < prereqs[j].Requires
+	})
+	return prereqs, nil
+}
+
+func (r *SegmentRepository) DeletePrerequisite(p *entity.Prerequisite) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seg, ok := r.slugs[p.Slug]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	required, ok := r.slugs[p.Requires]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	for _, id := range r.prereqs[seg.SegID] {
+		if id == required.SegID {
+			return r.commit([]*op{{Op: opDeletePrerequisite, SegID: seg.SegID, RequiredID: required.SegID}})
+		}
+	}
+	return repository.ErrRecordNotFound
+}
+
+// SetCapacity limits the number of users in the segment. The users already
+// in it are kept, a higher limit promotes users from the waitlist.
+func (r *SegmentRepository) SetCapacity(c *entity.Capacity) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seg, ok := r.slugs[c.Slug]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	if err := r.commit([]*op{{Op: opSetCapacity, SegID: seg.SegID, MaxMembers: c.MaxMembers, Policy: c.Overflow}}); err != nil {
+		return err
+	}
+	return r.promote([]*entity.Segment{seg})
+}
+
+func (r *SegmentRepository) FindCapacity(slug string) (*entity.Capacity, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seg, ok := r.slugs[slug]
+	if !ok {
+		return nil, repository.ErrRecordNotFound
+	}
+
+	c, ok := r.capacities()[seg.SegID]
+	if !ok {
+		return nil, repository.ErrRecordNotFound
+	}
+
+	if c.Members < c.MaxMembers {
+		c.Remaining = c.MaxMembers - c.Members
+	}
+	c.Waitlisted = len(r.waitlists[seg.SegID])
+
+	return c, nil
+}
+
+// DeleteCapacity lifts the limit of the segment and drops its waitlist.
+func (r *SegmentRepository) DeleteCapacity(c *entity.Capacity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seg, ok := r.slugs[c.Slug]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	if _, ok := r.limits[seg.SegID]; !ok {
+		return repository.ErrRecordNotFound
+	}
+	return r.commit([]*op{{Op: opDeleteCapacity, SegID: seg.SegID}})
+}
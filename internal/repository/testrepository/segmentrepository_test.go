@@ -1,7 +1,11 @@
 package testrepository_test
 
 import (
+	"fmt"
+	"io"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
@@ -109,3 +113,264 @@ func TestSegmentRepository_FindByUser(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, segList2)
 }
+
+type userIDReader struct {
+	userIDs []int
+}
+
+func (r *userIDReader) ReadUserID() (int, error) {
+	if len(r.userIDs) == 0 {
+		return 0, io.EOF
+	}
+	userID := r.userIDs[0]
+	r.userIDs = r.userIDs[1:]
+	return userID, nil
+}
+
+func TestSegmentRepository_ImportUsersToSegment(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	_, err := r.ImportUsersToSegment(seg, &userIDReader{userIDs: []int{1}})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	r.Create(seg)
+	r.AddUserToSegments(1, []*entity.Segment{seg})
+
+	res, err := r.ImportUsersToSegment(seg, &userIDReader{userIDs: []int{1, 2, 3, 3}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Accepted)
+	assert.Equal(t, 2, res.Duplicate)
+}
+
+func TestSegmentRepository_ExportSegmentMembers(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(2, segList[0:1])
+	r.AddUserToSegments(1, segList)
+
+	userIDs := make([]int, 0)
+	err := r.ExportSegmentMembers(segList[0], func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, userIDs)
+}
+
+func TestSegmentRepository_ExportMemberships(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_50"},
+		{Slug: "AVITO_DISCOUNT_30"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(2, segList[0:1])
+	r.AddUserToSegments(1, segList)
+
+	slugs := make([]string, 0)
+	err := r.ExportMemberships(func(m *entity.Membership) error {
+		slugs = append(slugs, fmt.Sprintf("%d:%s", m.UserID, m.Slug))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:AVITO_DISCOUNT_30", "1:AVITO_DISCOUNT_50", "2:AVITO_DISCOUNT_50"}, slugs)
+}
+
+func TestSegmentRepository_ApplyMembershipChanges(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+		{Slug: "AVITO_VOICE_MESSAGES"},
+	}
+
+	err := r.ApplyMembershipChanges([]*entity.MembershipChange{{UserID: 1, SegListAdd: segList[2:]}})
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(1, segList[0:1])
+
+	err = r.ApplyMembershipChanges([]*entity.MembershipChange{
+		{UserID: 1, SegListAdd: segList[1:2], SegListDel: segList[0:1]},
+		{UserID: 2, SegListAdd: segList[0:2]},
+	})
+	assert.NoError(t, err)
+
+	segList1, err := r.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList1, 1)
+
+	segList2, err := r.FindByUser(2)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 2)
+}
+
+func TestSegmentRepository_ScheduleUserToSegments(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	err := r.ScheduleUserToSegments(userID, segList, time.Now().Add(time.Hour))
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+
+	err = r.ScheduleUserToSegments(userID, segList[0:1], time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	err = r.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+
+	segList2, err := r.FindByUser(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Segment{segList[1]}, segList2)
+}
+
+func TestSegmentRepository_FindPendingByUser(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(userID, segList[0:1])
+	r.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(time.Hour))
+
+	pendingList, err := r.FindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, pendingList, 1)
+	assert.Equal(t, segList[1].Slug, pendingList[0].Slug)
+}
+
+func TestSegmentRepository_CancelPendingUserSegments(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(userID, segList[0:1])
+	r.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(time.Hour))
+
+	err := r.CancelPendingUserSegments(userID, segList)
+	assert.NoError(t, err)
+
+	pendingList, err := r.FindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+
+	segList2, err := r.FindByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+}
+
+func TestSegmentRepository_FindByUserAsOf(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	r.Create(segList[0])
+	r.Create(segList[1])
+
+	beforeAdd := time.Now()
+	time.Sleep(time.Millisecond)
+	r.AddUserToSegments(userID, segList)
+	r.ScheduleUserToSegments(userID+1, segList[0:1], time.Now().Add(time.Hour))
+	time.Sleep(time.Millisecond)
+	afterAdd := time.Now()
+	time.Sleep(time.Millisecond)
+	r.DeleteUserFromSegments(userID, segList[0:1])
+	r.Delete(segList[1])
+
+	_, err := r.FindByUserAsOf(userID, beforeAdd)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList2, err := r.FindByUserAsOf(userID, afterAdd)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 2)
+
+	_, err = r.FindByUserAsOf(userID, time.Now())
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList3, err := r.FindByUserAsOf(userID+1, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, segList3, 1)
+}
+
+func TestSegmentRepository_MonotonicIDs(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	seg1 := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	seg2 := &entity.Segment{Slug: "AVITO_DISCOUNT_50"}
+	r.Create(seg1)
+	r.Create(seg2)
+
+	assert.NoError(t, r.Delete(seg1))
+
+	seg3 := &entity.Segment{Slug: "AVITO_DISCOUNT_70"}
+	assert.NoError(t, r.Create(seg3))
+	assert.Equal(t, 3, seg3.SegID)
+
+	assert.EqualError(t, r.Create(&entity.Segment{Slug: seg2.Slug}), repository.ErrRecordExists.Error())
+}
+
+func TestSegmentRepository_Concurrency(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}, {Slug: "AVITO_DISCOUNT_50"}}
+	r.Create(segList[0])
+	r.Create(segList[1])
+
+	var wg sync.WaitGroup
+	for userID := 1; userID <= 50; userID++ {
+		wg.Add(1)
+		go func(userID int) {
+			defer wg.Done()
+
+			r.AddUserToSegments(userID, segList)
+			r.FindByUser(userID)
+			r.DeleteUserFromSegments(userID, segList[:1])
+			r.ExportSegmentMembers(segList[1], func(int) error { return nil })
+		}(userID)
+	}
+	wg.Wait()
+
+	userIDs := make([]int, 0)
+	r.ExportSegmentMembers(segList[1], func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	assert.Len(t, userIDs, 50)
+
+	assert.NoError(t, r.Delete(segList[1]))
+	_, err := r.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
@@ -0,0 +1,407 @@
+package testrepository
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.ndjson"
+)
+
+const (
+	opCreate     = "create"
+	opDelete     = "delete"
+	opAdd        = "add"
+	opActivate   = "activate"
+	opReschedule = "reschedule"
+	opRemove     = "remove"
+	opReparent   = "reparent"
+
+	opCreateGroup = "create_group"
+	opDeleteGroup = "delete_group"
+
+	opAddPrerequisite    = "add_prerequisite"
+	opDeletePrerequisite = "delete_prerequisite"
+
+	opSetCapacity    = "set_capacity"
+	opDeleteCapacity = "delete_capacity"
+	opWaitlist       = "waitlist"
+	opUnwaitlist     = "unwaitlist"
+)
+
+// op is a single change to the repository state.
+type op struct {
+	Op         string    `json:"op"`
+	SegID      int       `json:"seg_id"`
+	Slug       string    `json:"slug,omitempty"`
+	ParentID   int       `json:"parent_id,omitempty"`
+	UserID     int       `json:"user_id,omitempty"`
+	ActiveFrom time.Time `json:"active_from"`
+	GroupID    int       `json:"group_id,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Policy     string    `json:"policy,omitempty"`
+	SegIDs     []int     `json:"seg_ids,omitempty"`
+	RequiredID int       `json:"required_id,omitempty"`
+	MaxMembers int       `json:"max_members,omitempty"`
+}
+
+// record is the changes of one call, applied all at once. The operations
+// are resolved against the state when they are logged, so replaying the log
+// gives the same state, history and events.
+type record struct {
+	N   int       `json:"n"`
+	At  time.Time `json:"at"`
+	Ops []*op     `json:"ops"`
+}
+
+type snapshotMembership struct {
+	UserID     int       `json:"user_id"`
+	SegID      int       `json:"seg_id"`
+	ActiveFrom time.Time `json:"active_from"`
+}
+
+type snapshotHistory struct {
+	UserID      int       `json:"user_id"`
+	SegID       int       `json:"seg_id"`
+	Slug        string    `json:"slug"`
+	Operation   string    `json:"operation"`
+	EffectiveAt time.Time `json:"effective_at"`
+}
+
+type snapshotGroup struct {
+	GroupID int    `json:"group_id"`
+	Name    string `json:"name"`
+	Policy  string `json:"policy"`
+	SegIDs  []int  `json:"seg_ids"`
+}
+
+type snapshotPrerequisite struct {
+	SegID      int `json:"seg_id"`
+	RequiredID int `json:"required_id"`
+}
+
+type snapshotCapacity struct {
+	SegID      int    `json:"seg_id"`
+	MaxMembers int    `json:"max_members"`
+	Overflow   string `json:"overflow"`
+	Waitlist   []int  `json:"waitlist"`
+}
+
+type snapshot struct {
+	LastRecord    int                     `json:"last_record"`
+	LastSegID     int                     `json:"last_seg_id"`
+	LastGroupID   int                     `json:"last_group_id"`
+	Segments      []*entity.Segment       `json:"segments"`
+	Groups        []*snapshotGroup        `json:"groups"`
+	Prerequisites []*snapshotPrerequisite `json:"prerequisites"`
+	Capacities    []*snapshotCapacity     `json:"capacities"`
+	Memberships   []*snapshotMembership   `json:"memberships"`
+	History       []*snapshotHistory      `json:"history"`
+	Events        []*entity.Event         `json:"events"`
+}
+
+// store persists the repository in a directory: a snapshot of the whole
+// state and a write-ahead log of the records made after it. Every record
+// is synced to disk before it is applied.
+type store struct {
+	dir        string
+	wal        *os.File
+	lastRecord int
+}
+
+// Open loads the repository persisted in dir, creating the directory if
+// needed. An empty dir gives a repository that is kept in memory only.
+// Webhooks and relay offsets are not persisted.
+func Open(dir string) (*SegmentRepository, error) {
+	r := NewSegmentRepository()
+	if dir == "" {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &store{dir: dir}
+	if err := r.loadSnapshot(s); err != nil {
+		return nil, err
+	}
+
+	size, err := r.replayWAL(s)
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wal.Truncate(size); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	s.wal = wal
+	r.store = s
+
+	return r, nil
+}
+
+func (s *store) append(rec *record) error {
+	rec.N = s.lastRecord + 1
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.wal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.lastRecord = rec.N
+
+	return nil
+}
+
+// Snapshot writes the whole state to the snapshot file and empties the log.
+// A crash between the two is harmless: records already in the snapshot are
+// skipped on replay.
+func (r *SegmentRepository) Snapshot() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.store
+	if s == nil {
+		return nil
+	}
+
+	snap := &snapshot{
+		LastRecord:    s.lastRecord,
+		LastSegID:     r.lastSegID,
+		LastGroupID:   r.lastGroupID,
+		Segments:      make([]*entity.Segment, 0, len(r.segments)),
+		Groups:        make([]*snapshotGroup, 0, len(r.groups)),
+		Prerequisites: make([]*snapshotPrerequisite, 0),
+		Capacities:    make([]*snapshotCapacity, 0, len(r.limits)),
+		Memberships:   make([]*snapshotMembership, 0),
+		History:       make([]*snapshotHistory, 0),
+		Events:        r.events,
+	}
+
+	for _, seg := range r.segments {
+		snap.Segments = append(snap.Segments, r.segment(seg))
+	}
+
+	for _, g := range r.groups {
+		snap.Groups = append(snap.Groups, &snapshotGroup{GroupID: g.GroupID, Name: g.Name, Policy: g.Policy, SegIDs: r.groupSegIDs(g)})
+	}
+
+	for segID, required := range r.prereqs {
+		for _, id := range required {
+			snap.Prerequisites = append(snap.Prerequisites, &snapshotPrerequisite{SegID: segID, RequiredID: id})
+		}
+	}
+
+	for segID, c := range r.limits {
+		snap.Capacities = append(snap.Capacities, &snapshotCapacity{
+			SegID:      segID,
+			MaxMembers: c.MaxMembers,
+			Overflow:   c.Overflow,
+			Waitlist:   r.waitlists[segID],
+		})
+	}
+
+	for userID, segs := range r.byUser {
+		for segID, m := range segs {
+			snap.Memberships = append(snap.Memberships, &snapshotMembership{UserID: userID, SegID: segID, ActiveFrom: m.activeFrom})
+		}
+	}
+
+	for userID, events := range r.history {
+		for _, e := range events {
+			snap.History = append(snap.History, &snapshotHistory{
+				UserID:      userID,
+				SegID:       e.seg.SegID,
+				Slug:        e.seg.Slug,
+				Operation:   e.operation,
+				EffectiveAt: e.effectiveAt,
+			})
+		}
+	}
+
+	if err := writeFile(filepath.Join(s.dir, snapshotFile), snap); err != nil {
+		return err
+	}
+
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// Close takes a final snapshot and closes the log.
+func (r *SegmentRepository) Close() error {
+	if r.store == nil {
+		return nil
+	}
+
+	if err := r.Snapshot(); err != nil {
+		return err
+	}
+	return r.store.wal.Close()
+}
+
+func (r *SegmentRepository) loadSnapshot(s *store) error {
+	f, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snap := &snapshot{}
+	if err := json.NewDecoder(f).Decode(snap); err != nil {
+		return err
+	}
+
+	s.lastRecord = snap.LastRecord
+	r.lastSegID = snap.LastSegID
+	r.events = snap.Events
+
+	for _, seg := range snap.Segments {
+		r.segments[seg.SegID] = seg
+		r.slugs[seg.Slug] = seg
+	}
+
+	for _, seg := range snap.Segments {
+		if seg.Parent != "" {
+			r.parents[seg.SegID] = r.slugs[seg.Parent].SegID
+			seg.Parent = ""
+		}
+	}
+
+	r.lastGroupID = snap.LastGroupID
+	for _, g := range snap.Groups {
+		r.createGroup(g.GroupID, g.Name, g.Policy, g.SegIDs)
+	}
+
+	for _, p := range snap.Prerequisites {
+		r.prereqs[p.SegID] = append(r.prereqs[p.SegID], p.RequiredID)
+	}
+
+	for _, c := range snap.Capacities {
+		r.limits[c.SegID] = &entity.Capacity{MaxMembers: c.MaxMembers, Overflow: c.Overflow}
+		if len(c.Waitlist) > 0 {
+			r.waitlists[c.SegID] = c.Waitlist
+		}
+	}
+
+	for _, m := range snap.Memberships {
+		seg := r.segments[m.SegID]
+		if r.byUser[m.UserID] == nil {
+			r.byUser[m.UserID] = make(map[int]*membership)
+		}
+		r.byUser[m.UserID][m.SegID] = &membership{seg: seg, activeFrom: m.ActiveFrom}
+
+		if r.bySegment[m.SegID] == nil {
+			r.bySegment[m.SegID] = make(map[int]struct{})
+		}
+		r.bySegment[m.SegID][m.UserID] = struct{}{}
+	}
+
+	for _, h := range snap.History {
+		seg, ok := r.segments[h.SegID]
+		if !ok {
+			seg = &entity.Segment{SegID: h.SegID, Slug: h.Slug}
+		}
+		r.history[h.UserID] = append(r.history[h.UserID], &historyEvent{
+			seg:         seg,
+			operation:   h.Operation,
+			effectiveAt: h.EffectiveAt,
+		})
+	}
+	return nil
+}
+
+// replayWAL applies the logged records that are newer than the snapshot and
+// returns the size of the complete records. A torn last line, left by a crash
+// in the middle of a write, is not counted, so that it can be cut off.
+func (r *SegmentRepository) replayWAL(s *store) (int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, walFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	size := int64(0)
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		rec := &record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return 0, err
+		}
+		size += int64(len(line))
+
+		if rec.N <= s.lastRecord {
+			continue
+		}
+		r.apply(rec)
+		s.lastRecord = rec.N
+	}
+}
+
+// writeFile replaces the file atomically.
+func writeFile(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	if err := json.NewEncoder(bw).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
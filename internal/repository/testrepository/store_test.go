@@ -0,0 +1,160 @@
+package testrepository_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen_ReplayWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	r, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}, {Slug: "AVITO_DISCOUNT_50"}}
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(1, segList)
+	r.ScheduleUserToSegments(2, segList[:1], time.Now().Add(time.Hour))
+	r.Delete(segList[1])
+
+	// no Close, as after a crash
+	r2, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	segList2, err := r2.FindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Segment{segList[0]}, segList2)
+
+	pendingList, err := r2.FindPendingByUser(2)
+	assert.NoError(t, err)
+	assert.Len(t, pendingList, 1)
+
+	_, err = r2.FindBySlug(segList[1].Slug)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_70"}
+	assert.NoError(t, r2.Create(seg))
+	assert.Equal(t, 3, seg.SegID)
+}
+
+func TestOpen_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	r, _ := testrepository.Open(dir)
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	r.AddUserToSegments(1, segList)
+	asOf := time.Now()
+
+	assert.NoError(t, r.Snapshot())
+	info, _ := os.Stat(filepath.Join(dir, "wal.ndjson"))
+	assert.Zero(t, info.Size())
+
+	r.DeleteUserFromSegments(1, segList)
+	assert.NoError(t, r.Close())
+
+	r2, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	_, err = r2.FindByUser(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList2, err := r2.FindByUserAsOf(1, asOf)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+
+	er := testrepository.NewEventRepository(r2)
+	n, _ := er.SequenceEvents(10)
+	assert.Equal(t, 3, n)
+}
+
+func TestOpen_Groups(t *testing.T) {
+	dir := t.TempDir()
+
+	r, _ := testrepository.Open(dir)
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_50"})
+	r.CreateGroup(&entity.Group{Name: "discounts", Policy: entity.GroupPolicyReplace, Slugs: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}})
+	groups, _ := r.FindGroups()
+
+	// replayed from the log
+	r2, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	groups2, err := r2.FindGroups()
+	assert.NoError(t, err)
+	assert.Equal(t, groups, groups2)
+
+	// loaded from the snapshot
+	assert.NoError(t, r2.Close())
+	r3, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	groups3, err := r3.FindGroups()
+	assert.NoError(t, err)
+	assert.Equal(t, groups, groups3)
+
+	g := &entity.Group{Name: "other", Policy: entity.GroupPolicyReject, Slugs: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}}
+	assert.EqualError(t, r3.CreateGroup(g), repository.ErrRecordExists.Error())
+}
+
+func TestOpen_Parents(t *testing.T) {
+	dir := t.TempDir()
+
+	r, _ := testrepository.Open(dir)
+	r.Create(&entity.Segment{Slug: "AVITO"})
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT", Parent: "AVITO"})
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+	r.UpdateParent(&entity.Segment{Slug: "AVITO_DISCOUNT_30", Parent: "AVITO_DISCOUNT"})
+	segList, _ := r.FindAll()
+
+	// replayed from the log
+	r2, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	segList2, err := r2.FindAll()
+	assert.NoError(t, err)
+	assert.Equal(t, segList, segList2)
+
+	// loaded from the snapshot
+	assert.NoError(t, r2.Close())
+	r3, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	segList3, err := r3.FindAll()
+	assert.NoError(t, err)
+	assert.Equal(t, segList, segList3)
+
+	err = r3.UpdateParent(&entity.Segment{Slug: "AVITO", Parent: "AVITO_DISCOUNT_30"})
+	assert.EqualError(t, err, repository.ErrSegmentCycle.Error())
+}
+
+func TestOpen_TornWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	r, _ := testrepository.Open(dir)
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+
+	f, _ := os.OpenFile(filepath.Join(dir, "wal.ndjson"), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"n":2,"at":"2026-10-19T12:00:00Z","ops":[{"op":"cre`)
+	f.Close()
+
+	r2, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, r2.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_50"}))
+
+	r3, err := testrepository.Open(dir)
+	assert.NoError(t, err)
+
+	seg, err := r3.FindBySlug("AVITO_DISCOUNT_50")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, seg.SegID)
+}
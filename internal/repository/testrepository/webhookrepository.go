@@ -0,0 +1,228 @@
+package testrepository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// WebhookRepository delivers the events emitted by the wrapped SegmentRepository.
+type WebhookRepository struct {
+	mu                sync.Mutex
+	segmentRepository *SegmentRepository
+	webhooks          map[int]*entity.Webhook
+	deliveries        map[int]*entity.WebhookDelivery
+	dispatched        int
+	lastWebhookID     int
+	lastDeliveryID    int
+}
+
+func NewWebhookRepository(r *SegmentRepository) *WebhookRepository {
+	return &WebhookRepository{
+		segmentRepository: r,
+		webhooks:          make(map[int]*entity.Webhook),
+		deliveries:        make(map[int]*entity.WebhookDelivery),
+	}
+}
+
+func (r *WebhookRepository) Create(w *entity.Webhook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	r.lastWebhookID++
+	w.WebhookID = r.lastWebhookID
+	w.CreatedAt = time.Now()
+	r.webhooks[w.WebhookID] = w
+
+	return nil
+}
+
+func (r *WebhookRepository) FindAll() ([]*entity.Webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.findAll(), nil
+}
+
+func (r *WebhookRepository) findAll() []*entity.Webhook {
+	webhooks := make([]*entity.Webhook, 0, len(r.webhooks))
+	for _, w := range r.webhooks {
+		webhooks = append(webhooks, w)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].WebhookID < webhooks[j].WebhookID
+	})
+
+	return webhooks
+}
+
+func (r *WebhookRepository) Delete(webhookID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.webhooks[webhookID]; !ok {
+		return repository.ErrRecordNotFound
+	}
+	delete(r.webhooks, webhookID)
+
+	for deliveryID, d := range r.deliveries {
+		if d.WebhookID == webhookID {
+			delete(r.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (r *WebhookRepository) FanOutEvents(limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.segmentRepository.mu.RLock()
+	events := r.segmentRepository.events[r.dispatched:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	// deliveries keep their own copy, the outbox events are still
+	// written to when they are sequenced
+	copies := make([]*entity.Event, len(events))
+	for i, e := range events {
+		c := *e
+		copies[i] = &c
+	}
+	r.segmentRepository.mu.RUnlock()
+
+	webhooks := r.findAll()
+	for _, e := range copies {
+		for _, w := range webhooks {
+			if !w.Matches(e) {
+				continue
+			}
+
+			r.lastDeliveryID++
+			d := &entity.WebhookDelivery{
+				DeliveryID:    r.lastDeliveryID,
+				WebhookID:     w.WebhookID,
+				Status:        entity.DeliveryStatusPending,
+				NextAttemptAt: time.Now(),
+				Event:         e,
+			}
+			r.deliveries[d.DeliveryID] = d
+		}
+	}
+	r.dispatched += len(events)
+
+	return len(events), nil
+}
+
+func (r *WebhookRepository) ClaimDeliveries(limit int, lease time.Duration) ([]*entity.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	deliveries := make([]*entity.WebhookDelivery, 0)
+	for _, d := range r.deliveries {
+		if d.Status == entity.DeliveryStatusPending && !d.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].DeliveryID < deliveries[j].DeliveryID
+	})
+
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	claimed := make([]*entity.WebhookDelivery, len(deliveries))
+	for i, d := range deliveries {
+		d.NextAttemptAt = now.Add(lease)
+
+		w := r.webhooks[d.WebhookID]
+		c := *d
+		c.URL = w.URL
+		c.Secret = w.Secret
+		claimed[i] = &c
+	}
+
+	return claimed, nil
+}
+
+func (r *WebhookRepository) MarkDelivered(deliveryID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.deliveries[deliveryID]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	d.Status = entity.DeliveryStatusDelivered
+	d.Attempts++
+	d.LastError = ""
+
+	return nil
+}
+
+func (r *WebhookRepository) MarkFailed(deliveryID int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.deliveries[deliveryID]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	d.Status = entity.DeliveryStatusPending
+	if dead {
+		d.Status = entity.DeliveryStatusDead
+	}
+	d.Attempts++
+	d.LastError = lastError
+	d.NextAttemptAt = nextAttemptAt
+
+	return nil
+}
+
+func (r *WebhookRepository) FindDeliveries(webhookID int, status string) ([]*entity.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deliveries := make([]*entity.WebhookDelivery, 0)
+	for _, d := range r.deliveries {
+		if d.WebhookID == webhookID && (status == "" || d.Status == status) {
+			c := *d
+			deliveries = append(deliveries, &c)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].DeliveryID > deliveries[j].DeliveryID
+	})
+
+	return deliveries, nil
+}
+
+func (r *WebhookRepository) Redeliver(deliveryID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.deliveries[deliveryID]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+
+	d.Status = entity.DeliveryStatusPending
+	d.Attempts = 0
+	d.LastError = ""
+	d.NextAttemptAt = time.Now()
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package testrepository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookRepository_Create(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	wr := testrepository.NewWebhookRepository(r)
+
+	w := &entity.Webhook{URL: "https://pricing.example.com/hooks", Secret: "0123456789abcdef"}
+	assert.NoError(t, wr.Create(w))
+	assert.NotZero(t, w.WebhookID)
+	assert.Error(t, wr.Create(&entity.Webhook{URL: "pricing"}))
+
+}
+
+func TestWebhookRepository_Delete(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	wr := testrepository.NewWebhookRepository(r)
+
+	w := &entity.Webhook{URL: "https://pricing.example.com/hooks", Secret: "0123456789abcdef"}
+	wr.Create(w)
+
+	assert.NoError(t, wr.Delete(w.WebhookID))
+	assert.EqualError(t, wr.Delete(w.WebhookID), repository.ErrRecordNotFound.Error())
+
+	webhooks, err := wr.FindAll()
+	assert.NoError(t, err)
+	assert.Empty(t, webhooks)
+
+}
+
+func TestWebhookRepository_FanOutEvents(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	wr := testrepository.NewWebhookRepository(r)
+
+	wr.Create(&entity.Webhook{
+		URL:        "https://pricing.example.com/hooks",
+		Secret:     "0123456789abcdef",
+		EventTypes: []string{entity.EventUserAdded},
+	})
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	r.Create(segList[0])
+	r.AddUserToSegments(1, segList)
+
+	n, err := wr.FanOutEvents(100)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = wr.FanOutEvents(100)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	deliveries, err := wr.ClaimDeliveries(100, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, entity.EventUserAdded, deliveries[0].Event.Type)
+
+	deliveries2, err := wr.ClaimDeliveries(100, time.Minute)
+	assert.NoError(t, err)
+	assert.Empty(t, deliveries2)
+
+	assert.NoError(t, wr.MarkFailed(deliveries[0].DeliveryID, "timeout", time.Now(), true))
+	assert.NoError(t, wr.Redeliver(deliveries[0].DeliveryID))
+	assert.EqualError(t, wr.Redeliver(deliveries[0].DeliveryID+1), repository.ErrRecordNotFound.Error())
+
+	assert.NoError(t, wr.MarkDelivered(deliveries[0].DeliveryID))
+	deliveries, err = wr.FindDeliveries(deliveries[0].WebhookID, entity.DeliveryStatusDelivered)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+}
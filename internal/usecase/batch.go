@@ -0,0 +1,120 @@
+package usecase
+
+import (
+	"errors"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+// batchChunkSize is the number of batch items applied in one repository transaction.
+const batchChunkSize = 500
+
+// ApplyMembershipBatch resolves the slug conflicts and the slugs of every item
+// and applies the valid items in chunked transactions. An item that can not be
+// resolved or is rejected by an exclusion group or a prerequisite fails on its
+// own, a failed chunk fails all of its items.
+func (uc *AppUseCase) ApplyMembershipBatch(items []*entity.BatchItem) *entity.BatchResult {
+	res := &entity.BatchResult{
+		Total: len(items),
+		Items: make([]*entity.BatchItemResult, len(items)),
+	}
+
+	segments := make(map[string]*entity.Segment)
+	find := func(slug string) (*entity.Segment, error) {
+		seg, ok := segments[slug]
+		if !ok {
+			var err error
+			if seg, err = uc.segmentRepository.FindBySlug(slug); err != nil {
+				return nil, err
+			}
+			segments[slug] = seg
+		}
+		return seg, nil
+	}
+
+	changes := make([]*entity.MembershipChange, 0, batchChunkSize)
+	positions := make([]int, 0, batchChunkSize)
+	chunkUsers := make(map[int]bool)
+
+	flush := func() {
+		if len(changes) == 0 {
+			return
+		}
+
+		err := uc.segmentRepository.ApplyMembershipChanges(changes)
+
+		var errs repository.MembershipChangeErrors
+		rejected := errors.As(err, &errs)
+		for j, i := range positions {
+			if rejected {
+				res.Items[i] = batchItemResult(items[i].UserID, errs[j])
+			} else {
+				res.Items[i] = batchItemResult(items[i].UserID, err)
+			}
+		}
+
+		changes = changes[:0]
+		positions = positions[:0]
+		chunkUsers = make(map[int]bool)
+	}
+
+	for i, item := range items {
+		if item.UserID <= 0 {
+			res.Items[i] = batchItemResult(item.UserID, ErrInvalidUserID)
+			continue
+		}
+
+		change, err := uc.membershipChange(item.UserID, item.SlugListAdd, item.SlugListDel, find)
+		if err != nil {
+			res.Items[i] = batchItemResult(item.UserID, err)
+			continue
+		}
+
+		change.SegListAdd, err = uc.withPrerequisites(change.SegListAdd, change.SegListDel, nil)
+		if err != nil {
+			res.Items[i] = batchItemResult(item.UserID, err)
+			continue
+		}
+
+		// the repository removes before it adds, so a second change of the same
+		// user goes to the next chunk to keep the items in request order
+		if chunkUsers[item.UserID] {
+			flush()
+		}
+		chunkUsers[item.UserID] = true
+
+		changes = append(changes, change)
+		positions = append(positions, i)
+
+		if len(changes) == batchChunkSize {
+			flush()
+		}
+	}
+	flush()
+
+	for _, item := range res.Items {
+		if item.Status == entity.BatchStatusOK {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+
+	return res
+}
+
+func batchItemResult(userID int, err error) *entity.BatchItemResult {
+	if err != nil {
+		return &entity.BatchItemResult{
+			UserID: userID,
+			Status: entity.BatchStatusError,
+			Error:  err.Error(),
+		}
+	}
+
+	return &entity.BatchItemResult{
+		UserID: userID,
+		Status: entity.BatchStatusOK,
+	}
+}
@@ -0,0 +1,20 @@
+package usecase
+
+import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+
+// CapacitySet limits the number of users in the segment, an empty overflow
+// policy is taken from the configuration.
+func (uc *AppUseCase) CapacitySet(c *entity.Capacity) error {
+	if c.Overflow == "" {
+		c.Overflow = uc.config.OverflowPolicy
+	}
+	return uc.segmentRepository.SetCapacity(c)
+}
+
+func (uc *AppUseCase) CapacityFind(slug string) (*entity.Capacity, error) {
+	return uc.segmentRepository.FindCapacity(slug)
+}
+
+func (uc *AppUseCase) CapacityDelete(c *entity.Capacity) error {
+	return uc.segmentRepository.DeleteCapacity(c)
+}
@@ -0,0 +1,36 @@
+package usecase
+
+import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+
+const (
+	// ConflictPolicyReject fails a change that names a slug twice,
+	// in one list or in both.
+	ConflictPolicyReject = "reject"
+	// ConflictPolicyLastWins drops the repeated slugs, a slug that is both
+	// added and removed is added, as additions are applied after removals.
+	ConflictPolicyLastWins = "last_wins"
+)
+
+const (
+	// PrerequisitePolicyReject fails an addition to a segment without
+	// its prerequisites.
+	PrerequisitePolicyReject = "reject"
+	// PrerequisitePolicyCascade adds the missing prerequisites along
+	// with the segment. Imports are rejected whatever the policy.
+	PrerequisitePolicyCascade = "cascade"
+)
+
+type Config struct {
+	ConflictPolicy     string `toml:"conflict_policy"`
+	PrerequisitePolicy string `toml:"prerequisite_policy"`
+	// OverflowPolicy is the overflow policy of a member limit set without one.
+	OverflowPolicy string `toml:"overflow_policy"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ConflictPolicy:     ConflictPolicyReject,
+		PrerequisitePolicy: PrerequisitePolicyReject,
+		OverflowPolicy:     entity.OverflowPolicyReject,
+	}
+}
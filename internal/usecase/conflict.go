@@ -0,0 +1,99 @@
+package usecase
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// SlugConflictError lists the slugs a membership change names more than once.
+type SlugConflictError struct {
+	Slugs []string
+}
+
+func (e *SlugConflictError) Error() string {
+	return ErrSlugConflict.Error() + ": " + strings.Join(e.Slugs, ", ")
+}
+
+func (e *SlugConflictError) Is(target error) bool {
+	return target == ErrSlugConflict
+}
+
+// ResolveSlugConflicts applies the conflict policy to the slug lists of one
+// membership change. With the reject policy the lists are returned unchanged
+// unless a slug repeats, with last wins the repeats are dropped.
+func (uc *AppUseCase) ResolveSlugConflicts(slugListAdd, slugListDel []string) ([]string, []string, error) {
+	return resolveSlugConflicts(uc.config.ConflictPolicy, slugListAdd, slugListDel)
+}
+
+// membershipChange applies the conflict policy to the slug lists of the user
+// and resolves the slugs left with find.
+func (uc *AppUseCase) membershipChange(userID int, slugListAdd, slugListDel []string, find func(string) (*entity.Segment, error)) (*entity.MembershipChange, error) {
+	slugListAdd, slugListDel, err := uc.ResolveSlugConflicts(slugListAdd, slugListDel)
+	if err != nil {
+		return nil, err
+	}
+
+	resolve := func(slugs []string) ([]*entity.Segment, error) {
+		segList := make([]*entity.Segment, 0, len(slugs))
+		for _, slug := range slugs {
+			seg, err := find(slug)
+			if err != nil {
+				return nil, fmt.Errorf("segment %s: %w", slug, err)
+			}
+			segList = append(segList, seg)
+		}
+		return segList, nil
+	}
+
+	change := &entity.MembershipChange{UserID: userID}
+	if change.SegListAdd, err = resolve(slugListAdd); err != nil {
+		return nil, err
+	}
+	if change.SegListDel, err = resolve(slugListDel); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+func resolveSlugConflicts(policy string, slugListAdd, slugListDel []string) ([]string, []string, error) {
+	added := make(map[string]bool, len(slugListAdd))
+	removed := make(map[string]bool, len(slugListDel))
+	conflicts := make([]string, 0)
+	conflicted := make(map[string]bool)
+
+	conflict := func(slug string) {
+		if !conflicted[slug] {
+			conflicted[slug] = true
+			conflicts = append(conflicts, slug)
+		}
+	}
+
+	add := make([]string, 0, len(slugListAdd))
+	for _, slug := range slugListAdd {
+		if added[slug] {
+			conflict(slug)
+			continue
+		}
+		added[slug] = true
+		add = append(add, slug)
+	}
+
+	del := make([]string, 0, len(slugListDel))
+	for _, slug := range slugListDel {
+		if removed[slug] || added[slug] {
+			conflict(slug)
+			continue
+		}
+		removed[slug] = true
+		del = append(del, slug)
+	}
+
+	// with last wins the repeats are already dropped and a slug that is
+	// both added and removed is kept in the add list only
+	if len(conflicts) > 0 && policy != ConflictPolicyLastWins {
+		return nil, nil, &SlugConflictError{Slugs: conflicts}
+	}
+	return add, del, nil
+}
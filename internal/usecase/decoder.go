@@ -0,0 +1,142 @@
+package usecase
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// MaxLineSize bounds an NDJSON line. A longer line is skipped and counted
+// as malformed, the rest of the stream is imported.
+const MaxLineSize = 1 << 20
+
+// errMalformedRow is returned for a row that can not be parsed at all.
+var errMalformedRow = errors.New("malformed row")
+
+// userIDDecoder reads user IDs from a CSV or NDJSON stream row by row.
+// Rows that can not be parsed are skipped and counted as malformed, rows
+// that do not hold a positive user ID are skipped and counted as invalid.
+type userIDDecoder struct {
+	next      func() (string, error)
+	invalid   int
+	malformed int
+}
+
+func newUserIDDecoder(r io.Reader, format string) (*userIDDecoder, error) {
+	d := &userIDDecoder{}
+
+	switch format {
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		header := true
+
+		d.next = func() (string, error) {
+			for {
+				record, err := cr.Read()
+				if err == io.EOF {
+					return "", err
+				}
+				if _, ok := err.(*csv.ParseError); ok {
+					return "", errMalformedRow
+				}
+				if err != nil {
+					return "", err
+				}
+
+				field := strings.TrimSpace(record[0])
+				if header {
+					header = false
+					if strings.EqualFold(field, "user_id") {
+						continue
+					}
+				}
+				return field, nil
+			}
+		}
+	case FormatNDJSON:
+		br := bufio.NewReaderSize(r, MaxLineSize)
+		d.next = func() (string, error) {
+			for {
+				line, err := br.ReadSlice('\n')
+				if err == bufio.ErrBufferFull {
+					for err == bufio.ErrBufferFull {
+						_, err = br.ReadSlice('\n')
+					}
+					if err != nil && err != io.EOF {
+						return "", err
+					}
+					return "", errMalformedRow
+				}
+				if err != nil && err != io.EOF {
+					return "", err
+				}
+
+				line = bytes.TrimSpace(line)
+				if len(line) == 0 {
+					if err == io.EOF {
+						return "", io.EOF
+					}
+					continue
+				}
+				return decodeNDJSONLine(line)
+			}
+		}
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	return d, nil
+}
+
+// decodeNDJSONLine takes the user ID from a bare value or an object with
+// a user_id field, a number or a string.
+func decodeNDJSONLine(line []byte) (string, error) {
+	if line[0] != '{' {
+		return string(line), nil
+	}
+
+	row := struct {
+		UserID json.RawMessage `json:"user_id"`
+	}{}
+	if err := json.Unmarshal(line, &row); err != nil {
+		return "", errMalformedRow
+	}
+
+	var field string
+	if err := json.Unmarshal(row.UserID, &field); err == nil {
+		return field, nil
+	}
+	return string(row.UserID), nil
+}
+
+func (d *userIDDecoder) ReadUserID() (int, error) {
+	for {
+		field, err := d.next()
+		if err == errMalformedRow {
+			d.malformed++
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		userID, err := strconv.Atoi(field)
+		if err != nil || userID <= 0 {
+			d.invalid++
+			continue
+		}
+		return userID, nil
+	}
+}
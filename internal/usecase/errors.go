@@ -0,0 +1,9 @@
+package usecase
+
+import "errors"
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	ErrInvalidUserID     = errors.New("invalid user_id")
+	ErrSlugConflict      = errors.New("conflicting slugs")
+)
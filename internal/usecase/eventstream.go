@@ -0,0 +1,169 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	eventBatchSize         = 500
+	subscriptionBufferSize = 256
+)
+
+// Subscription receives the live events that match its filter. A subscriber
+// that falls behind does not hold up the others: once its buffer is full,
+// live events are dropped for it and it is marked lagged, so that it can
+// catch up from the outbox at its own pace.
+type Subscription struct {
+	Events <-chan *entity.Event
+	events chan *entity.Event
+	filter *entity.EventFilter
+	lagged int32
+}
+
+// Lagged reports whether live events were dropped since the last call.
+func (s *Subscription) Lagged() bool {
+	return atomic.SwapInt32(&s.lagged, 0) == 1
+}
+
+type eventBroker struct {
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
+	lastSeq       int
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+func (b *eventBroker) publish(e *entity.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subscriptions {
+		if !s.filter.Matches(e) {
+			continue
+		}
+
+		select {
+		case s.events <- e:
+		default:
+			atomic.StoreInt32(&s.lagged, 1)
+		}
+	}
+}
+
+func (uc *AppUseCase) EventSubscribe(filter *entity.EventFilter) *Subscription {
+	events := make(chan *entity.Event, subscriptionBufferSize)
+	s := &Subscription{
+		Events: events,
+		events: events,
+		filter: filter,
+	}
+
+	uc.broker.mu.Lock()
+	uc.broker.subscriptions[s] = struct{}{}
+	uc.broker.mu.Unlock()
+
+	return s
+}
+
+func (uc *AppUseCase) EventUnsubscribe(s *Subscription) {
+	uc.broker.mu.Lock()
+	delete(uc.broker.subscriptions, s)
+	uc.broker.mu.Unlock()
+}
+
+// EventReplay passes every event after seq that matches the filter to fn
+// and returns the sequence number of the last event read.
+func (uc *AppUseCase) EventReplay(seq int, filter *entity.EventFilter, fn func(*entity.Event) error) (int, error) {
+	if err := uc.sequenceEvents(); err != nil {
+		return seq, err
+	}
+
+	for {
+		events, err := uc.eventRepository.FindAfter(seq, eventBatchSize)
+		if err != nil {
+			return seq, err
+		}
+
+		for _, e := range events {
+			if filter.Matches(e) {
+				if err := fn(e); err != nil {
+					return seq, err
+				}
+			}
+			seq = e.Seq
+		}
+
+		if len(events) < eventBatchSize {
+			return seq, nil
+		}
+	}
+}
+
+// RunEventBroker fans new events out to the subscriptions every time
+// notify fires, until ctx is done or notify is closed.
+func (uc *AppUseCase) RunEventBroker(ctx context.Context, notify <-chan struct{}) error {
+	lastSeq, err := uc.eventRepository.FindLastSeq()
+	if err != nil {
+		return err
+	}
+	uc.broker.lastSeq = lastSeq
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-notify:
+			if !ok {
+				return nil
+			}
+
+			if err := uc.broadcastEvents(); err != nil {
+				logrus.Errorf("Events: broadcast error: %s", err)
+			}
+		}
+	}
+}
+
+func (uc *AppUseCase) broadcastEvents() error {
+	if err := uc.sequenceEvents(); err != nil {
+		return err
+	}
+
+	for {
+		events, err := uc.eventRepository.FindAfter(uc.broker.lastSeq, eventBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			uc.broker.publish(e)
+			uc.broker.lastSeq = e.Seq
+		}
+
+		if len(events) < eventBatchSize {
+			return nil
+		}
+	}
+}
+
+func (uc *AppUseCase) sequenceEvents() error {
+	for {
+		n, err := uc.eventRepository.SequenceEvents(eventBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if n < eventBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package usecase
+
+import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+
+func (uc *AppUseCase) GroupCreate(g *entity.Group) error {
+	return uc.segmentRepository.CreateGroup(g)
+}
+
+func (uc *AppUseCase) GroupFindAll() ([]*entity.Group, error) {
+	return uc.segmentRepository.FindGroups()
+}
+
+func (uc *AppUseCase) GroupDelete(g *entity.Group) error {
+	return uc.segmentRepository.DeleteGroup(g)
+}
@@ -0,0 +1,89 @@
+package usecase
+
+import (
+	"sort"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
+
+// SegmentSetParent moves the segment under seg.Parent, an empty parent
+// makes it a root segment.
+func (uc *AppUseCase) SegmentSetParent(seg *entity.Segment) error {
+	return uc.segmentRepository.UpdateParent(seg)
+}
+
+// SegmentDelete deletes the segment. A segment with children is not deleted
+// under the reject policy, under the reparent policy the children are moved
+// to its parent in the same transaction.
+func (uc *AppUseCase) SegmentDelete(seg *entity.Segment, children string) error {
+	if children == entity.ChildrenPolicyReparent {
+		return uc.segmentRepository.DeleteReparent(seg)
+	}
+	return uc.segmentRepository.Delete(seg)
+}
+
+// SegmentFindByUserExpanded returns the segments of the user together with
+// their ancestors, which the user is in through them, ordered by ID.
+func (uc *AppUseCase) SegmentFindByUserExpanded(userID int) ([]*entity.UserSegment, error) {
+	direct, err := uc.segmentRepository.FindByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	segList, err := uc.segmentRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	return expandSegments(direct, segList), nil
+}
+
+// expandSegments adds the ancestors of the direct segments, found in
+// segList, to them.
+func expandSegments(direct, segList []*entity.Segment) []*entity.UserSegment {
+	bySlug := make(map[string]*entity.Segment, len(segList))
+	for _, seg := range segList {
+		bySlug[seg.Slug] = seg
+	}
+
+	res := make([]*entity.UserSegment, 0, len(direct))
+	found := make(map[string]*entity.UserSegment, len(direct))
+	for _, seg := range direct {
+		us := &entity.UserSegment{SegID: seg.SegID, Slug: seg.Slug, Source: entity.SourceDirect}
+		res = append(res, us)
+		found[seg.Slug] = us
+	}
+
+	for _, seg := range direct {
+		// a segment deleted since FindByUser has no ancestors to add
+		parent := ""
+		if s, ok := bySlug[seg.Slug]; ok {
+			parent = s.Parent
+		}
+
+		// the repositories keep the hierarchy acyclic, the bound only
+		// guards against a cycle made between the two reads
+		for i := 0; parent != "" && i < len(segList); i++ {
+			ancestor, ok := bySlug[parent]
+			if !ok {
+				break
+			}
+
+			us, ok := found[ancestor.Slug]
+			if !ok {
+				us = &entity.UserSegment{SegID: ancestor.SegID, Slug: ancestor.Slug, Source: entity.SourceInherited}
+				res = append(res, us)
+				found[ancestor.Slug] = us
+			}
+
+			if us.Source == entity.SourceInherited {
+				us.Via = append(us.Via, seg.Slug)
+			}
+			parent = ancestor.Parent
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].SegID < res[j].SegID
+	})
+	return res
+}
@@ -1,12 +1,49 @@
 package usecase
 
-import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+)
 
 type UseCase interface {
 	SegmentCreate(*entity.Segment) error
 	SegmentFindBySlug(string) (*entity.Segment, error)
-	SegmentDelete(*entity.Segment) error
+	SegmentFindAll() ([]*entity.Segment, error)
+	SegmentSetParent(*entity.Segment) error
+	SegmentDelete(*entity.Segment, string) error
 	AddUserToSegments(int, []*entity.Segment) error
 	DeleteUserFromSegments(int, []*entity.Segment) error
+	UpdateUserSegments(int, []string, []string, *time.Time) (*entity.MembershipChange, error)
 	SegmentFindByUser(int) ([]*entity.Segment, error)
+	SegmentFindByUserExpanded(int) ([]*entity.UserSegment, error)
+	ImportUsersToSegment(*entity.Segment, io.Reader, string) (*entity.ImportResult, error)
+	ExportSegmentMembers(*entity.Segment, func(int) error) error
+	ExportMemberships(func(*entity.Membership) error) error
+	ApplyMembershipBatch([]*entity.BatchItem) *entity.BatchResult
+	ScheduleUserToSegments(int, []*entity.Segment, time.Time) error
+	SegmentFindPendingByUser(int) ([]*entity.PendingMembership, error)
+	CancelPendingUserSegments(int, []*entity.Segment) error
+	SegmentFindByUserAsOf(int, time.Time) ([]*entity.Segment, error)
+	TakeHistorySnapshot() error
+	GroupCreate(*entity.Group) error
+	GroupFindAll() ([]*entity.Group, error)
+	GroupDelete(*entity.Group) error
+	PrerequisiteAdd(*entity.Prerequisite) error
+	PrerequisiteFindAll() ([]*entity.Prerequisite, error)
+	PrerequisiteDelete(*entity.Prerequisite) error
+	CapacitySet(*entity.Capacity) error
+	CapacityFind(string) (*entity.Capacity, error)
+	CapacityDelete(*entity.Capacity) error
+	WebhookCreate(*entity.Webhook) error
+	WebhookFindAll() ([]*entity.Webhook, error)
+	WebhookDelete(int) error
+	WebhookFindDeliveries(int, string) ([]*entity.WebhookDelivery, error)
+	WebhookRedeliver(int) error
+	EventSubscribe(*entity.EventFilter) *Subscription
+	EventUnsubscribe(*Subscription)
+	EventReplay(int, *entity.EventFilter, func(*entity.Event) error) (int, error)
+	RunEventBroker(context.Context, <-chan struct{}) error
 }
@@ -0,0 +1,106 @@
+package usecase
+
+import (
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+)
+
+func (uc *AppUseCase) PrerequisiteAdd(p *entity.Prerequisite) error {
+	return uc.segmentRepository.AddPrerequisite(p)
+}
+
+func (uc *AppUseCase) PrerequisiteFindAll() ([]*entity.Prerequisite, error) {
+	return uc.segmentRepository.FindPrerequisites()
+}
+
+func (uc *AppUseCase) PrerequisiteDelete(p *entity.Prerequisite) error {
+	return uc.segmentRepository.DeletePrerequisite(p)
+}
+
+// withPrerequisites appends the prerequisites of the segments, directly or
+// through each other, under the cascade policy. The segments in held are
+// taken to be there already, along with their own prerequisites. A
+// prerequisite the same change removes is not added back, the change fails
+// with *repository.PrerequisiteError instead.
+func (uc *AppUseCase) withPrerequisites(segList, removed []*entity.Segment, held map[string]bool) ([]*entity.Segment, error) {
+	if uc.config.PrerequisitePolicy != PrerequisitePolicyCascade || len(segList) == 0 {
+		return segList, nil
+	}
+
+	prereqs, err := uc.segmentRepository.FindPrerequisites()
+	if err != nil {
+		return nil, err
+	}
+
+	requires := make(map[string][]string)
+	for _, p := range prereqs {
+		requires[p.Slug] = append(requires[p.Slug], p.Requires)
+	}
+
+	res := append([]*entity.Segment(nil), segList...)
+	added := make(map[string]bool, len(segList))
+	for _, seg := range segList {
+		added[seg.Slug] = true
+	}
+
+	dropped := make(map[string]bool, len(removed))
+	for _, seg := range removed {
+		dropped[seg.Slug] = true
+	}
+
+	for i := 0; i < len(res); i++ {
+		var missing []string
+		for _, slug := range requires[res[i].Slug] {
+			if added[slug] {
+				continue
+			}
+			if dropped[slug] {
+				missing = append(missing, slug)
+				continue
+			}
+			if held[slug] {
+				continue
+			}
+
+			seg, err := uc.segmentRepository.FindBySlug(slug)
+			if err != nil {
+				return nil, err
+			}
+			added[slug] = true
+			res = append(res, seg)
+		}
+
+		if len(missing) > 0 {
+			return nil, &repository.PrerequisiteError{Slug: res[i].Slug, Missing: missing}
+		}
+	}
+	return res, nil
+}
+
+// heldBy lists the segments the user is in or is going to be in by activeFrom.
+func (uc *AppUseCase) heldBy(userID int, activeFrom time.Time) (map[string]bool, error) {
+	held := make(map[string]bool)
+
+	segList, err := uc.segmentRepository.FindByUser(userID)
+	if err != nil && err != repository.ErrRecordNotFound {
+		return nil, err
+	}
+
+	for _, seg := range segList {
+		held[seg.Slug] = true
+	}
+
+	pendingList, err := uc.segmentRepository.FindPendingByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pendingList {
+		if !p.ActiveFrom.After(activeFrom) {
+			held[p.Slug] = true
+		}
+	}
+	return held, nil
+}
@@ -1,17 +1,33 @@
 package usecase
 
 import (
+	"errors"
+	"io"
+	"time"
+
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
 )
 
+// historySnapshotLag keeps snapshots behind the transactions that may still be in flight,
+// so their history events are never left out of a snapshot.
+const historySnapshotLag = 5 * time.Minute
+
 type AppUseCase struct {
+	config            *Config
 	segmentRepository repository.SegmentRepository
+	webhookRepository repository.WebhookRepository
+	eventRepository   repository.EventRepository
+	broker            *eventBroker
 }
 
-func NewAppUseCase(r repository.SegmentRepository) *AppUseCase {
+func NewAppUseCase(config *Config, r repository.SegmentRepository, wr repository.WebhookRepository, er repository.EventRepository) *AppUseCase {
 	return &AppUseCase{
+		config:            config,
 		segmentRepository: r,
+		webhookRepository: wr,
+		eventRepository:   er,
+		broker:            newEventBroker(),
 	}
 }
 
@@ -23,11 +39,15 @@ func (uc *AppUseCase) SegmentFindBySlug(slug string) (*entity.Segment, error) {
 	return uc.segmentRepository.FindBySlug(slug)
 }
 
-func (uc *AppUseCase) SegmentDelete(seg *entity.Segment) error {
-	return uc.segmentRepository.Delete(seg)
+func (uc *AppUseCase) SegmentFindAll() ([]*entity.Segment, error) {
+	return uc.segmentRepository.FindAll()
 }
 
 func (uc *AppUseCase) AddUserToSegments(userID int, segList []*entity.Segment) error {
+	segList, err := uc.withPrerequisites(segList, nil, nil)
+	if err != nil {
+		return err
+	}
 	return uc.segmentRepository.AddUserToSegments(userID, segList)
 }
 
@@ -35,6 +55,111 @@ func (uc *AppUseCase) DeleteUserFromSegments(userID int, segList []*entity.Segme
 	return uc.segmentRepository.DeleteUserFromSegments(userID, segList)
 }
 
+// UpdateUserSegments changes the segments of the user as the HTTP API, the
+// batches and the operator commands do: the conflict policy is applied to
+// the slug lists, the slugs are resolved and the user is removed from the
+// segments and added to the rest, from activeFrom if it is set, in one
+// change. A change the repository rejects is not applied at all, the
+// removals included. It returns the change applied, the slug lists as left
+// by the policy.
+func (uc *AppUseCase) UpdateUserSegments(userID int, slugListAdd, slugListDel []string, activeFrom *time.Time) (*entity.MembershipChange, error) {
+	change, err := uc.membershipChange(userID, slugListAdd, slugListDel, uc.segmentRepository.FindBySlug)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := &entity.MembershipChange{UserID: userID, SegListDel: change.SegListDel}
+	if activeFrom != nil && activeFrom.After(time.Now()) {
+		applied.ActiveFrom = *activeFrom
+		change.ActiveFrom = *activeFrom
+
+		// a scheduled addition only brings along the prerequisites under the
+		// cascade policy, see ScheduleUserToSegments
+		applied.SegListAdd = change.SegListAdd
+		if uc.config.PrerequisitePolicy == PrerequisitePolicyCascade {
+			held, err := uc.heldBy(userID, *activeFrom)
+			if err != nil {
+				return nil, err
+			}
+
+			if applied.SegListAdd, err = uc.withPrerequisites(change.SegListAdd, change.SegListDel, held); err != nil {
+				return nil, err
+			}
+		}
+	} else if applied.SegListAdd, err = uc.withPrerequisites(change.SegListAdd, change.SegListDel, nil); err != nil {
+		return nil, err
+	}
+
+	err = uc.segmentRepository.ApplyMembershipChanges([]*entity.MembershipChange{applied})
+
+	var errs repository.MembershipChangeErrors
+	if errors.As(err, &errs) {
+		return nil, errs[0]
+	}
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
 func (uc *AppUseCase) SegmentFindByUser(userID int) ([]*entity.Segment, error) {
 	return uc.segmentRepository.FindByUser(userID)
 }
+
+func (uc *AppUseCase) ImportUsersToSegment(seg *entity.Segment, r io.Reader, format string) (*entity.ImportResult, error) {
+	d, err := newUserIDDecoder(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := uc.segmentRepository.ImportUsersToSegment(seg, d)
+	if err != nil {
+		return nil, err
+	}
+	res.Invalid = d.invalid
+	res.Malformed = d.malformed
+
+	return res, nil
+}
+
+func (uc *AppUseCase) ExportSegmentMembers(seg *entity.Segment, fn func(int) error) error {
+	return uc.segmentRepository.ExportSegmentMembers(seg, fn)
+}
+
+func (uc *AppUseCase) ExportMemberships(fn func(*entity.Membership) error) error {
+	return uc.segmentRepository.ExportMemberships(fn)
+}
+
+func (uc *AppUseCase) ScheduleUserToSegments(userID int, segList []*entity.Segment, activeFrom time.Time) error {
+	if !activeFrom.After(time.Now()) {
+		return uc.AddUserToSegments(userID, segList)
+	}
+
+	if uc.config.PrerequisitePolicy == PrerequisitePolicyCascade {
+		held, err := uc.heldBy(userID, activeFrom)
+		if err != nil {
+			return err
+		}
+
+		if segList, err = uc.withPrerequisites(segList, nil, held); err != nil {
+			return err
+		}
+	}
+	return uc.segmentRepository.ScheduleUserToSegments(userID, segList, activeFrom)
+}
+
+func (uc *AppUseCase) SegmentFindPendingByUser(userID int) ([]*entity.PendingMembership, error) {
+	return uc.segmentRepository.FindPendingByUser(userID)
+}
+
+func (uc *AppUseCase) CancelPendingUserSegments(userID int, segList []*entity.Segment) error {
+	return uc.segmentRepository.CancelPendingUserSegments(userID, segList)
+}
+
+func (uc *AppUseCase) SegmentFindByUserAsOf(userID int, asOf time.Time) ([]*entity.Segment, error) {
+	return uc.segmentRepository.FindByUserAsOf(userID, asOf)
+}
+
+func (uc *AppUseCase) TakeHistorySnapshot() error {
+	return uc.segmentRepository.TakeHistorySnapshot(time.Now().Add(-historySnapshotLag))
+}
@@ -1,7 +1,12 @@
 package usecase_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
 	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
@@ -12,7 +17,7 @@ import (
 
 func TestAppUseCase_SegmentCreate(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
 
 	assert.NoError(t, uc.SegmentCreate(seg))
@@ -20,7 +25,7 @@ func TestAppUseCase_SegmentCreate(t *testing.T) {
 
 func TestAppUseCase_SegmentFindBySlug(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 	seg1 := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
 	_, err := uc.SegmentFindBySlug(seg1.Slug)
 	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
@@ -33,7 +38,7 @@ func TestAppUseCase_SegmentFindBySlug(t *testing.T) {
 
 func TestAppUseCase_SegmentDelete(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 
 	userID := 1
 	segList := []*entity.Segment{
@@ -46,16 +51,16 @@ func TestAppUseCase_SegmentDelete(t *testing.T) {
 	uc.SegmentCreate(segList[1])
 	uc.AddUserToSegments(userID, segList[0:2])
 
-	err := uc.SegmentDelete(segList[0])
+	err := uc.SegmentDelete(segList[0], entity.ChildrenPolicyReject)
 	assert.NoError(t, err)
 
-	err = uc.SegmentDelete(segList[2])
+	err = uc.SegmentDelete(segList[2], entity.ChildrenPolicyReject)
 	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
 }
 
 func TestAppUseCase_AddUserToSegments(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 
 	userID := 1
 	segList := []*entity.Segment{
@@ -75,7 +80,7 @@ func TestAppUseCase_AddUserToSegments(t *testing.T) {
 
 func TestAppUseCase_DeleteUserFromSegments(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 
 	userID := 1
 	segList := []*entity.Segment{
@@ -91,9 +96,79 @@ func TestAppUseCase_DeleteUserFromSegments(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAppUseCase_UpdateUserSegments(t *testing.T) {
+	config := usecase.NewConfig()
+	config.ConflictPolicy = usecase.ConflictPolicyLastWins
+
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	userID := 1
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"} {
+		uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+
+	_, err := uc.UpdateUserSegments(userID, []string{"AVITO_UNKNOWN"}, nil, nil)
+	assert.ErrorIs(t, err, repository.ErrRecordNotFound)
+
+	change, err := uc.UpdateUserSegments(userID, []string{"AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, change.SegListAdd, 2)
+
+	change, err = uc.UpdateUserSegments(userID, []string{"AVITO_DISCOUNT_50"}, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_50"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "AVITO_DISCOUNT_50", change.SegListAdd[0].Slug)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", change.SegListDel[0].Slug)
+	assert.Len(t, change.SegListDel, 1)
+
+	segList, err := uc.SegmentFindByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, segList, 2)
+
+	activeFrom := time.Now().Add(time.Hour)
+	_, err = uc.UpdateUserSegments(userID, []string{"AVITO_VOICE_MESSAGES"}, nil, &activeFrom)
+	assert.NoError(t, err)
+
+	pendingList, err := uc.SegmentFindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, pendingList, 1)
+
+	config.ConflictPolicy = usecase.ConflictPolicyReject
+	_, err = uc.UpdateUserSegments(userID, []string{"AVITO_DISCOUNT_30"}, []string{"AVITO_DISCOUNT_30"}, nil)
+	assert.ErrorIs(t, err, usecase.ErrSlugConflict)
+}
+
+func TestAppUseCase_UpdateUserSegments_Rejected(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"} {
+		uc.SegmentCreate(&entity.Segment{Slug: slug})
+	}
+	assert.NoError(t, uc.CapacitySet(&entity.Capacity{Slug: "AVITO_DISCOUNT_50", MaxMembers: 1, Overflow: entity.OverflowPolicyReject}))
+
+	_, err := uc.UpdateUserSegments(1, []string{"AVITO_DISCOUNT_50"}, nil, nil)
+	assert.NoError(t, err)
+	_, err = uc.UpdateUserSegments(2, []string{"AVITO_VOICE_MESSAGES"}, nil, nil)
+	assert.NoError(t, err)
+
+	// the full segment rejects the change before the removal is applied
+	_, err = uc.UpdateUserSegments(2, []string{"AVITO_DISCOUNT_50"}, []string{"AVITO_VOICE_MESSAGES"}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentFull)
+
+	activeFrom := time.Now().Add(time.Hour)
+	_, err = uc.UpdateUserSegments(2, []string{"AVITO_DISCOUNT_50"}, []string{"AVITO_VOICE_MESSAGES"}, &activeFrom)
+	assert.ErrorIs(t, err, repository.ErrSegmentFull)
+
+	segList, err := uc.SegmentFindByUser(2)
+	assert.NoError(t, err)
+	assert.Len(t, segList, 1)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", segList[0].Slug)
+}
+
 func TestAppUseCase_SegmentFindByUser(t *testing.T) {
 	r := testrepository.NewSegmentRepository()
-	uc := usecase.NewAppUseCase(r)
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
 
 	userID := 1
 	segList1 := []*entity.Segment{
@@ -112,3 +187,702 @@ func TestAppUseCase_SegmentFindByUser(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, segList2)
 }
+
+func TestAppUseCase_SegmentFindByUserExpanded(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO"},
+		{Slug: "AVITO_DISCOUNT", Parent: "AVITO"},
+		{Slug: "AVITO_DISCOUNT_30", Parent: "AVITO_DISCOUNT"},
+		{Slug: "AVITO_DISCOUNT_50", Parent: "AVITO_DISCOUNT"},
+		{Slug: "AVITO_VOICE_MESSAGES"},
+	}
+	for _, seg := range segList {
+		uc.SegmentCreate(seg)
+	}
+
+	_, err := uc.SegmentFindByUserExpanded(1)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	uc.AddUserToSegments(1, []*entity.Segment{segList[2], segList[3], segList[4]})
+
+	found, err := uc.SegmentFindByUserExpanded(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.UserSegment{
+		{SegID: 1, Slug: "AVITO", Source: entity.SourceInherited, Via: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}},
+		{SegID: 2, Slug: "AVITO_DISCOUNT", Source: entity.SourceInherited, Via: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}},
+		{SegID: 3, Slug: "AVITO_DISCOUNT_30", Source: entity.SourceDirect},
+		{SegID: 4, Slug: "AVITO_DISCOUNT_50", Source: entity.SourceDirect},
+		{SegID: 5, Slug: "AVITO_VOICE_MESSAGES", Source: entity.SourceDirect},
+	}, found)
+
+	uc.AddUserToSegments(1, segList[1:2])
+
+	found, err = uc.SegmentFindByUserExpanded(1)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.SourceDirect, found[1].Source)
+	assert.Empty(t, found[1].Via)
+	assert.Equal(t, []string{"AVITO_DISCOUNT", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}, found[0].Via)
+}
+
+func TestAppUseCase_SegmentDeleteWithChildren(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO"},
+		{Slug: "AVITO_DISCOUNT", Parent: "AVITO"},
+		{Slug: "AVITO_DISCOUNT_30", Parent: "AVITO_DISCOUNT"},
+		{Slug: "AVITO_DISCOUNT_50", Parent: "AVITO_DISCOUNT"},
+	}
+	for _, seg := range segList {
+		uc.SegmentCreate(seg)
+	}
+
+	err := uc.SegmentDelete(segList[1], entity.ChildrenPolicyReject)
+	assert.EqualError(t, err, repository.ErrHasChildren.Error())
+
+	assert.NoError(t, uc.SegmentDelete(segList[1], entity.ChildrenPolicyReparent))
+
+	found, err := uc.SegmentFindAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.Segment{
+		{SegID: 1, Slug: "AVITO"},
+		{SegID: 3, Slug: "AVITO_DISCOUNT_30", Parent: "AVITO"},
+		{SegID: 4, Slug: "AVITO_DISCOUNT_50", Parent: "AVITO"},
+	}, found)
+
+	assert.NoError(t, uc.SegmentDelete(segList[0], entity.ChildrenPolicyReparent))
+
+	found, err = uc.SegmentFindAll()
+	assert.NoError(t, err)
+	assert.Empty(t, found[0].Parent)
+	assert.Empty(t, found[1].Parent)
+}
+
+func TestAppUseCase_ImportUsersToSegment(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	uc.SegmentCreate(seg)
+
+	testCases := []struct {
+		name              string
+		body              string
+		format            string
+		expectedAccepted  int
+		expectedDuplicate int
+		expectedInvalid   int
+		expectedMalformed int
+		expectedErr       error
+	}{
+		{
+			name:             "csv",
+			body:             "user_id\n1\n2\n",
+			format:           usecase.FormatCSV,
+			expectedAccepted: 2,
+		},
+		{
+			name:              "csv with invalid rows",
+			body:              "2,extra\nabc\n-5\n3\n",
+			format:            usecase.FormatCSV,
+			expectedAccepted:  1,
+			expectedDuplicate: 1,
+			expectedInvalid:   2,
+		},
+		{
+			name:              "ndjson",
+			body:              "4\n{\"user_id\": 5}\n\n{\"user_id\": \"x\"}\n{\"user_id\": 1}\n",
+			format:            usecase.FormatNDJSON,
+			expectedAccepted:  2,
+			expectedDuplicate: 1,
+			expectedInvalid:   1,
+		},
+		{
+			name:              "ndjson with malformed lines",
+			body:              "{\"user_id\": 6\n{\"user_id\": \"7\"}\n" + strings.Repeat("8", usecase.MaxLineSize+1) + "\n9",
+			format:            usecase.FormatNDJSON,
+			expectedAccepted:  2,
+			expectedMalformed: 2,
+		},
+		{
+			name:              "csv with malformed rows",
+			body:              "10\n\"11\n",
+			format:            usecase.FormatCSV,
+			expectedAccepted:  1,
+			expectedMalformed: 1,
+		},
+		{
+			name:        "unsupported format",
+			body:        "1\n",
+			format:      "xml",
+			expectedErr: usecase.ErrUnsupportedFormat,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := uc.ImportUsersToSegment(seg, strings.NewReader(tc.body), tc.format)
+			if tc.expectedErr != nil {
+				assert.EqualError(t, err, tc.expectedErr.Error())
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAccepted, res.Accepted)
+			assert.Equal(t, tc.expectedDuplicate, res.Duplicate)
+			assert.Equal(t, tc.expectedInvalid, res.Invalid)
+			assert.Equal(t, tc.expectedMalformed, res.Malformed)
+		})
+	}
+}
+
+func TestAppUseCase_ExportSegmentMembers(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	uc.SegmentCreate(seg)
+	uc.AddUserToSegments(1, []*entity.Segment{seg})
+
+	userIDs := make([]int, 0)
+	err := uc.ExportSegmentMembers(seg, func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, userIDs)
+}
+
+func TestAppUseCase_ExportMemberships(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	uc.SegmentCreate(seg)
+	uc.AddUserToSegments(1, []*entity.Segment{seg})
+
+	memberships := make([]entity.Membership, 0)
+	err := uc.ExportMemberships(func(m *entity.Membership) error {
+		memberships = append(memberships, *m)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Membership{{UserID: 1, SegID: seg.SegID, Slug: seg.Slug}}, memberships)
+}
+
+func TestAppUseCase_ApplyMembershipBatch(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	uc.SegmentCreate(segList[0])
+	uc.SegmentCreate(segList[1])
+
+	items := []*entity.BatchItem{
+		{UserID: 1, SlugListAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}},
+		{UserID: 2, SlugListAdd: []string{"NOT_FOUND"}},
+		{UserID: 0, SlugListAdd: []string{"AVITO_DISCOUNT_30"}},
+		{UserID: 1, SlugListDel: []string{"AVITO_DISCOUNT_50"}},
+		{UserID: 2, SlugListAdd: []string{"AVITO_DISCOUNT_30"}, SlugListDel: []string{"AVITO_DISCOUNT_30"}},
+	}
+	for userID := 3; userID < 1203; userID++ {
+		items = append(items, &entity.BatchItem{UserID: userID, SlugListAdd: []string{"AVITO_DISCOUNT_30"}})
+	}
+
+	res := uc.ApplyMembershipBatch(items)
+	assert.Equal(t, len(items), res.Total)
+	assert.Equal(t, len(items)-3, res.Succeeded)
+	assert.Equal(t, 3, res.Failed)
+	assert.Equal(t, entity.BatchStatusError, res.Items[1].Status)
+	assert.Equal(t, usecase.ErrInvalidUserID.Error(), res.Items[2].Error)
+	assert.Equal(t, "conflicting slugs: AVITO_DISCOUNT_30", res.Items[4].Error)
+
+	segList1, err := uc.SegmentFindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList1, 1)
+
+	segList2, err := uc.SegmentFindByUser(1202)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+}
+
+func TestAppUseCase_ApplyMembershipBatch_ExclusionGroup(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	uc.SegmentCreate(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+	uc.SegmentCreate(&entity.Segment{Slug: "AVITO_DISCOUNT_50"})
+	assert.NoError(t, uc.GroupCreate(&entity.Group{
+		Name:   "discounts",
+		Policy: entity.GroupPolicyReject,
+		Slugs:  []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"},
+	}))
+
+	res := uc.ApplyMembershipBatch([]*entity.BatchItem{
+		{UserID: 1, SlugListAdd: []string{"AVITO_DISCOUNT_30"}},
+		{UserID: 2, SlugListAdd: []string{"AVITO_DISCOUNT_50"}},
+		{UserID: 1, SlugListAdd: []string{"AVITO_DISCOUNT_50"}},
+	})
+	assert.Equal(t, 2, res.Succeeded)
+	assert.Equal(t, 1, res.Failed)
+	assert.Equal(t, entity.BatchStatusOK, res.Items[1].Status)
+	assert.Equal(t, "exclusion group conflict discounts: AVITO_DISCOUNT_30, AVITO_DISCOUNT_50", res.Items[2].Error)
+}
+
+func TestAppUseCase_AddUserToSegments_Prerequisites(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  string
+		wantErr error
+		want    []string
+	}{
+		{
+			name:    "reject",
+			policy:  usecase.PrerequisitePolicyReject,
+			wantErr: repository.ErrPrerequisiteMissing,
+		},
+		{
+			name:   "cascade",
+			policy: usecase.PrerequisitePolicyCascade,
+			want:   []string{"AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS_ALPHA"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := usecase.NewConfig()
+			config.PrerequisitePolicy = tc.policy
+
+			r := testrepository.NewSegmentRepository()
+			uc := usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+			segList := []*entity.Segment{
+				{Slug: "AVITO_PERFORMANCE_VAS"},
+				{Slug: "AVITO_PERFORMANCE_VAS_BETA"},
+				{Slug: "AVITO_PERFORMANCE_VAS_ALPHA"},
+			}
+			for _, seg := range segList {
+				uc.SegmentCreate(seg)
+			}
+			assert.NoError(t, uc.PrerequisiteAdd(&entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"}))
+			assert.NoError(t, uc.PrerequisiteAdd(&entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_ALPHA", Requires: "AVITO_PERFORMANCE_VAS_BETA"}))
+
+			err := uc.AddUserToSegments(1, segList[2:3])
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			found, err := uc.SegmentFindByUser(1)
+			assert.NoError(t, err)
+			slugs := make([]string, 0, len(found))
+			for _, seg := range found {
+				slugs = append(slugs, seg.Slug)
+			}
+			assert.Equal(t, tc.want, slugs)
+
+			// removing the prerequisite removes the segments that require it
+			assert.NoError(t, uc.DeleteUserFromSegments(1, segList[0:1]))
+			_, err = uc.SegmentFindByUser(1)
+			assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+		})
+	}
+}
+
+func TestAppUseCase_ScheduleUserToSegments_CascadePrerequisites(t *testing.T) {
+	config := usecase.NewConfig()
+	config.PrerequisitePolicy = usecase.PrerequisitePolicyCascade
+
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	uc.SegmentCreate(&entity.Segment{Slug: "AVITO_PERFORMANCE_VAS"})
+	uc.SegmentCreate(&entity.Segment{Slug: "AVITO_PERFORMANCE_VAS_BETA"})
+	assert.NoError(t, uc.PrerequisiteAdd(&entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"}))
+
+	now := time.Now()
+	vas, _ := uc.SegmentFindBySlug("AVITO_PERFORMANCE_VAS")
+	beta, _ := uc.SegmentFindBySlug("AVITO_PERFORMANCE_VAS_BETA")
+
+	// a prerequisite that starts earlier is kept as it is
+	assert.NoError(t, uc.ScheduleUserToSegments(1, []*entity.Segment{vas}, now.Add(time.Hour)))
+	assert.NoError(t, uc.ScheduleUserToSegments(1, []*entity.Segment{beta}, now.Add(2*time.Hour)))
+
+	// a missing one is scheduled along with the segment
+	assert.NoError(t, uc.ScheduleUserToSegments(2, []*entity.Segment{beta}, now.Add(2*time.Hour)))
+
+	for _, userID := range []int{1, 2} {
+		pendingList, err := uc.SegmentFindPendingByUser(userID)
+		assert.NoError(t, err)
+		assert.Len(t, pendingList, 2)
+	}
+
+	pendingList, _ := uc.SegmentFindPendingByUser(1)
+	assert.WithinDuration(t, now.Add(time.Hour), pendingList[0].ActiveFrom, time.Second)
+}
+
+func TestAppUseCase_UpdateUserSegments_CascadeRemovedPrerequisite(t *testing.T) {
+	config := usecase.NewConfig()
+	config.PrerequisitePolicy = usecase.PrerequisitePolicyCascade
+
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	uc.SegmentCreate(&entity.Segment{Slug: "AVITO_PERFORMANCE_VAS"})
+	uc.SegmentCreate(&entity.Segment{Slug: "AVITO_PERFORMANCE_VAS_BETA"})
+	assert.NoError(t, uc.PrerequisiteAdd(&entity.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"}))
+
+	_, err := uc.UpdateUserSegments(1, []string{"AVITO_PERFORMANCE_VAS"}, nil, nil)
+	assert.NoError(t, err)
+
+	// the prerequisite the change removes is not added back by the cascade
+	activeFrom := time.Now().Add(time.Hour)
+	for _, at := range []*time.Time{nil, &activeFrom} {
+		_, err = uc.UpdateUserSegments(1, []string{"AVITO_PERFORMANCE_VAS_BETA"}, []string{"AVITO_PERFORMANCE_VAS"}, at)
+		assert.ErrorIs(t, err, repository.ErrPrerequisiteMissing)
+
+		var prereqErr *repository.PrerequisiteError
+		if assert.True(t, errors.As(err, &prereqErr)) {
+			assert.Equal(t, []string{"AVITO_PERFORMANCE_VAS"}, prereqErr.Missing)
+		}
+	}
+
+	segList, err := uc.SegmentFindByUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "AVITO_PERFORMANCE_VAS", segList[0].Slug)
+
+	pendingList, err := uc.SegmentFindPendingByUser(1)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+
+	res := uc.ApplyMembershipBatch([]*entity.BatchItem{
+		{UserID: 1, SlugListAdd: []string{"AVITO_PERFORMANCE_VAS_BETA"}, SlugListDel: []string{"AVITO_PERFORMANCE_VAS"}},
+		{UserID: 2, SlugListAdd: []string{"AVITO_PERFORMANCE_VAS_BETA"}},
+	})
+	assert.Equal(t, 1, res.Succeeded)
+	assert.Equal(t, "missing prerequisite of AVITO_PERFORMANCE_VAS_BETA: AVITO_PERFORMANCE_VAS", res.Items[0].Error)
+
+	segList, err = uc.SegmentFindByUser(1)
+	assert.NoError(t, err)
+	assert.Len(t, segList, 1)
+}
+
+func TestAppUseCase_CapacitySet(t *testing.T) {
+	config := usecase.NewConfig()
+	config.OverflowPolicy = entity.OverflowPolicyWaitlist
+
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}, {Slug: "AVITO_DISCOUNT_50"}}
+	for _, seg := range segList {
+		uc.SegmentCreate(seg)
+	}
+
+	// the overflow policy defaults to the configured one
+	assert.NoError(t, uc.CapacitySet(&entity.Capacity{Slug: "AVITO_DISCOUNT_30", MaxMembers: 1}))
+	assert.NoError(t, uc.CapacitySet(&entity.Capacity{Slug: "AVITO_DISCOUNT_50", MaxMembers: 1, Overflow: entity.OverflowPolicyReject}))
+
+	c, err := uc.CapacityFind("AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.OverflowPolicyWaitlist, c.Overflow)
+
+	res := uc.ApplyMembershipBatch([]*entity.BatchItem{
+		{UserID: 1, SlugListAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}},
+		{UserID: 2, SlugListAdd: []string{"AVITO_DISCOUNT_30"}},
+		{UserID: 3, SlugListAdd: []string{"AVITO_DISCOUNT_50"}},
+	})
+	assert.Equal(t, 2, res.Succeeded)
+	assert.Equal(t, "segment is full: AVITO_DISCOUNT_50", res.Items[2].Error)
+
+	c, err = uc.CapacityFind("AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c.Waitlisted)
+
+	assert.NoError(t, uc.CapacityDelete(&entity.Capacity{Slug: "AVITO_DISCOUNT_30"}))
+	_, err = uc.CapacityFind("AVITO_DISCOUNT_30")
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func TestAppUseCase_ResolveSlugConflicts(t *testing.T) {
+	testCases := []struct {
+		name        string
+		policy      string
+		slugListAdd []string
+		slugListDel []string
+		expectedAdd []string
+		expectedDel []string
+		conflicts   []string
+	}{
+		{
+			name:        "no conflicts",
+			policy:      usecase.ConflictPolicyReject,
+			slugListAdd: []string{"AVITO_DISCOUNT_30"},
+			slugListDel: []string{"AVITO_DISCOUNT_50"},
+			expectedAdd: []string{"AVITO_DISCOUNT_30"},
+			expectedDel: []string{"AVITO_DISCOUNT_50"},
+		},
+		{
+			name:        "empty lists",
+			policy:      usecase.ConflictPolicyReject,
+			expectedAdd: []string{},
+			expectedDel: []string{},
+		},
+		{
+			name:        "reject add and del",
+			policy:      usecase.ConflictPolicyReject,
+			slugListAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"},
+			slugListDel: []string{"AVITO_DISCOUNT_50"},
+			conflicts:   []string{"AVITO_DISCOUNT_50"},
+		},
+		{
+			name:        "reject repeated in add",
+			policy:      usecase.ConflictPolicyReject,
+			slugListAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_30"},
+			conflicts:   []string{"AVITO_DISCOUNT_30"},
+		},
+		{
+			name:        "reject repeated in del",
+			policy:      usecase.ConflictPolicyReject,
+			slugListDel: []string{"AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"},
+			conflicts:   []string{"AVITO_DISCOUNT_50"},
+		},
+		{
+			name:        "last wins add and del",
+			policy:      usecase.ConflictPolicyLastWins,
+			slugListAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"},
+			slugListDel: []string{"AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"},
+			expectedAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"},
+			expectedDel: []string{"AVITO_VOICE_MESSAGES"},
+		},
+		{
+			name:        "last wins repeated",
+			policy:      usecase.ConflictPolicyLastWins,
+			slugListAdd: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_30"},
+			slugListDel: []string{"AVITO_DISCOUNT_50", "AVITO_DISCOUNT_50"},
+			expectedAdd: []string{"AVITO_DISCOUNT_30"},
+			expectedDel: []string{"AVITO_DISCOUNT_50"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := usecase.NewConfig()
+			config.ConflictPolicy = tc.policy
+
+			r := testrepository.NewSegmentRepository()
+			uc := usecase.NewAppUseCase(config, r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+			add, del, err := uc.ResolveSlugConflicts(tc.slugListAdd, tc.slugListDel)
+			if tc.conflicts != nil {
+				assert.ErrorIs(t, err, usecase.ErrSlugConflict)
+				assert.Equal(t, &usecase.SlugConflictError{Slugs: tc.conflicts}, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAdd, add)
+			assert.Equal(t, tc.expectedDel, del)
+		})
+	}
+}
+
+func TestAppUseCase_ScheduleUserToSegments(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	userID := 1
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+
+	uc.SegmentCreate(segList[0])
+	uc.SegmentCreate(segList[1])
+
+	err := uc.ScheduleUserToSegments(userID, segList[0:1], time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	_, err = uc.SegmentFindByUser(userID)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	err = uc.ScheduleUserToSegments(userID, segList[1:2], time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+
+	segList2, err := uc.SegmentFindByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+}
+
+func TestAppUseCase_SegmentFindPendingByUser(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	userID := 1
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	uc.SegmentCreate(seg)
+
+	pendingList, err := uc.SegmentFindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+
+	uc.ScheduleUserToSegments(userID, []*entity.Segment{seg}, time.Now().Add(time.Hour))
+	pendingList, err = uc.SegmentFindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Len(t, pendingList, 1)
+}
+
+func TestAppUseCase_CancelPendingUserSegments(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	userID := 1
+	seg := &entity.Segment{Slug: "AVITO_DISCOUNT_30"}
+	uc.SegmentCreate(seg)
+	uc.ScheduleUserToSegments(userID, []*entity.Segment{seg}, time.Now().Add(time.Hour))
+
+	err := uc.CancelPendingUserSegments(userID, []*entity.Segment{seg})
+	assert.NoError(t, err)
+
+	pendingList, err := uc.SegmentFindPendingByUser(userID)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+}
+
+func TestAppUseCase_SegmentFindByUserAsOf(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	userID := 1
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	uc.SegmentCreate(segList[0])
+
+	beforeAdd := time.Now()
+	time.Sleep(time.Millisecond)
+	uc.AddUserToSegments(userID, segList)
+	time.Sleep(time.Millisecond)
+	afterAdd := time.Now()
+	time.Sleep(time.Millisecond)
+	uc.SegmentDelete(segList[0], entity.ChildrenPolicyReject)
+
+	_, err := uc.SegmentFindByUserAsOf(userID, beforeAdd)
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+
+	segList2, err := uc.SegmentFindByUserAsOf(userID, afterAdd)
+	assert.NoError(t, err)
+	assert.Len(t, segList2, 1)
+
+	_, err = uc.SegmentFindByUserAsOf(userID, time.Now())
+	assert.EqualError(t, err, repository.ErrRecordNotFound.Error())
+}
+
+func TestAppUseCase_WebhookCreate(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	w := &entity.Webhook{URL: "https://pricing.example.com/hooks", Secret: "0123456789abcdef"}
+	assert.NoError(t, uc.WebhookCreate(w))
+	assert.Error(t, uc.WebhookCreate(&entity.Webhook{URL: "pricing"}))
+
+	webhooks, err := uc.WebhookFindAll()
+	assert.NoError(t, err)
+	assert.Len(t, webhooks, 1)
+}
+
+func TestAppUseCase_WebhookDelete(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	w := &entity.Webhook{URL: "https://pricing.example.com/hooks", Secret: "0123456789abcdef"}
+	uc.WebhookCreate(w)
+
+	assert.NoError(t, uc.WebhookDelete(w.WebhookID))
+	assert.EqualError(t, uc.WebhookDelete(w.WebhookID), repository.ErrRecordNotFound.Error())
+}
+
+func TestAppUseCase_EventReplay(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}, {Slug: "AVITO_DISCOUNT_50"}}
+	uc.SegmentCreate(segList[0])
+	uc.SegmentCreate(segList[1])
+	uc.AddUserToSegments(1, segList)
+	uc.AddUserToSegments(2, segList)
+
+	events := make([]*entity.Event, 0)
+	filter := &entity.EventFilter{UserID: 1, Slugs: []string{"AVITO_DISCOUNT_50"}}
+	lastSeq, err := uc.EventReplay(0, filter, func(e *entity.Event) error {
+		events = append(events, e)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 6, lastSeq)
+	assert.Len(t, events, 1)
+	assert.Equal(t, 1, events[0].UserID)
+}
+
+func TestAppUseCase_RunEventBroker(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	segList := []*entity.Segment{{Slug: "AVITO_DISCOUNT_30"}}
+	uc.SegmentCreate(segList[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notify := make(chan struct{})
+	go uc.RunEventBroker(ctx, notify)
+
+	sub := uc.EventSubscribe(&entity.EventFilter{UserID: 1})
+	defer uc.EventUnsubscribe(sub)
+
+	uc.AddUserToSegments(2, segList)
+	uc.AddUserToSegments(1, segList)
+	notify <- struct{}{}
+
+	select {
+	case e := <-sub.Events:
+		assert.Equal(t, entity.EventUserAdded, e.Type)
+		assert.Equal(t, 1, e.UserID)
+		assert.Equal(t, 3, e.Seq)
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	assert.False(t, sub.Lagged())
+}
+
+func TestAppUseCase_RunEventBroker_Lagged(t *testing.T) {
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notify := make(chan struct{})
+	go uc.RunEventBroker(ctx, notify)
+
+	sub := uc.EventSubscribe(&entity.EventFilter{})
+	defer uc.EventUnsubscribe(sub)
+
+	for i := 0; i < 300; i++ {
+		uc.SegmentCreate(&entity.Segment{Slug: fmt.Sprintf("AVITO_SEG_%d", i)})
+	}
+	notify <- struct{}{}
+	notify <- struct{}{}
+
+	assert.Len(t, sub.Events, cap(sub.Events))
+	assert.True(t, sub.Lagged())
+	assert.False(t, sub.Lagged())
+}
@@ -0,0 +1,23 @@
+package usecase
+
+import "github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+
+func (uc *AppUseCase) WebhookCreate(w *entity.Webhook) error {
+	return uc.webhookRepository.Create(w)
+}
+
+func (uc *AppUseCase) WebhookFindAll() ([]*entity.Webhook, error) {
+	return uc.webhookRepository.FindAll()
+}
+
+func (uc *AppUseCase) WebhookDelete(webhookID int) error {
+	return uc.webhookRepository.Delete(webhookID)
+}
+
+func (uc *AppUseCase) WebhookFindDeliveries(webhookID int, status string) ([]*entity.WebhookDelivery, error) {
+	return uc.webhookRepository.FindDeliveries(webhookID, status)
+}
+
+func (uc *AppUseCase) WebhookRedeliver(deliveryID int) error {
+	return uc.webhookRepository.Redeliver(deliveryID)
+}
@@ -0,0 +1,23 @@
+package webhook
+
+import "time"
+
+type Config struct {
+	PollInterval time.Duration `toml:"poll_interval"`
+	BatchSize    int           `toml:"batch_size"`
+	MaxAttempts  int           `toml:"max_attempts"`
+	BaseBackoff  time.Duration `toml:"base_backoff"`
+	MaxBackoff   time.Duration `toml:"max_backoff"`
+	Timeout      time.Duration `toml:"timeout"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		PollInterval: time.Second,
+		BatchSize:    100,
+		MaxAttempts:  8,
+		BaseBackoff:  10 * time.Second,
+		MaxBackoff:   time.Hour,
+		Timeout:      10 * time.Second,
+	}
+}
@@ -0,0 +1,159 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Dispatcher moves outbox events to the subscribed webhooks. Failed deliveries
+// are retried with exponential backoff until they run out of attempts and are
+// marked dead.
+type Dispatcher struct {
+	config *Config
+	repo   repository.WebhookRepository
+	client *http.Client
+	logger *logrus.Logger
+}
+
+func NewDispatcher(config *Config, r repository.WebhookRepository) *Dispatcher {
+	return &Dispatcher{
+		config: config,
+		repo:   r,
+		client: &http.Client{Timeout: config.Timeout},
+		logger: logrus.New(),
+	}
+}
+
+// Run dispatches events every poll interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.DispatchOnce(); err != nil {
+			d.logger.Errorf("Webhook: dispatch error: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchOnce fans out new events and makes one attempt for every due delivery.
+func (d *Dispatcher) DispatchOnce() error {
+	for {
+		n, err := d.repo.FanOutEvents(d.config.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		if n < d.config.BatchSize {
+			break
+		}
+	}
+
+	// the lease outlives every attempt of the batch, so a crashed
+	// instance only delays the deliveries it had claimed
+	lease := time.Duration(d.config.BatchSize+1) * d.config.Timeout
+	deliveries, err := d.repo.ClaimDeliveries(d.config.BatchSize, lease)
+	if err != nil {
+		return err
+	}
+
+	for _, del := range deliveries {
+		if err := d.deliver(del); err != nil {
+			attempts := del.Attempts + 1
+			dead := attempts >= d.config.MaxAttempts
+			if err := d.repo.MarkFailed(del.DeliveryID, err.Error(), time.Now().Add(d.backoff(attempts)), dead); err != nil {
+				return err
+			}
+
+			d.logger.Warnf("Webhook: delivery %d to %s failed (attempt %d): %s", del.DeliveryID, del.URL, attempts, err)
+			continue
+		}
+
+		if err := d.repo.MarkDelivered(del.DeliveryID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) deliver(del *entity.WebhookDelivery) error {
+	body, err := json.Marshal(del.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, del.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, del.Event.Type)
+	req.Header.Set(HeaderDelivery, strconv.Itoa(del.DeliveryID))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(del.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt: the base backoff
+// doubled for every attempt made so far, capped at the max backoff.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.config.BaseBackoff
+	for i := 1; i < attempts && delay < d.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > d.config.MaxBackoff {
+		return d.config.MaxBackoff
+	}
+	return delay
+}
+
+// Sign returns the signature header value for a delivery body: the hex encoded
+// HMAC-SHA256 of the timestamp and the body joined by a dot.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
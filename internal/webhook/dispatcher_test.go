@@ -0,0 +1,96 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/entity"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "0123456789abcdef"
+
+func TestDispatcher_DispatchOnce(t *testing.T) {
+	events := make([]*entity.Event, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+		if r.Header.Get(webhook.HeaderSignature) != webhook.Sign(testSecret, timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		e := &entity.Event{}
+		json.Unmarshal(body, e)
+		events = append(events, e)
+	}))
+	defer ts.Close()
+
+	r := testrepository.NewSegmentRepository()
+	wr := testrepository.NewWebhookRepository(r)
+	d := webhook.NewDispatcher(webhook.NewConfig(), wr)
+
+	w := &entity.Webhook{
+		URL:        ts.URL,
+		Secret:     testSecret,
+		EventTypes: []string{entity.EventUserAdded},
+		Slugs:      []string{"AVITO_DISCOUNT_30"},
+	}
+	wr.Create(w)
+
+	segList := []*entity.Segment{
+		{Slug: "AVITO_DISCOUNT_30"},
+		{Slug: "AVITO_DISCOUNT_50"},
+	}
+	r.Create(segList[0])
+	r.Create(segList[1])
+	r.AddUserToSegments(1, segList)
+
+	assert.NoError(t, d.DispatchOnce())
+	assert.Len(t, events, 1)
+	assert.Equal(t, entity.EventUserAdded, events[0].Type)
+	assert.Equal(t, 1, events[0].UserID)
+
+	deliveries, err := wr.FindDeliveries(w.WebhookID, entity.DeliveryStatusDelivered)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+}
+
+func TestDispatcher_DispatchOnce_Retries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	r := testrepository.NewSegmentRepository()
+	wr := testrepository.NewWebhookRepository(r)
+
+	config := webhook.NewConfig()
+	config.BaseBackoff = 0
+	config.MaxAttempts = 2
+	d := webhook.NewDispatcher(config, wr)
+
+	w := &entity.Webhook{URL: ts.URL, Secret: testSecret}
+	wr.Create(w)
+	r.Create(&entity.Segment{Slug: "AVITO_DISCOUNT_30"})
+
+	assert.NoError(t, d.DispatchOnce())
+	deliveries, _ := wr.FindDeliveries(w.WebhookID, entity.DeliveryStatusPending)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+
+	assert.NoError(t, d.DispatchOnce())
+	deliveries, _ = wr.FindDeliveries(w.WebhookID, entity.DeliveryStatusDead)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, "unexpected status 503", deliveries[0].LastError)
+
+	assert.NoError(t, wr.Redeliver(deliveries[0].DeliveryID))
+	deliveries, _ = wr.FindDeliveries(w.WebhookID, entity.DeliveryStatusPending)
+	assert.Len(t, deliveries, 1)
+}
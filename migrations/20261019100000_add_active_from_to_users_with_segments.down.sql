@@ -0,0 +1 @@
+ALTER TABLE users_with_segments DROP COLUMN active_from;
\ No newline at end of file
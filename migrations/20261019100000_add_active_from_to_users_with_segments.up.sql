@@ -0,0 +1 @@
+ALTER TABLE users_with_segments ADD COLUMN active_from TIMESTAMPTZ NOT NULL DEFAULT now();
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP TABLE history_snapshot_members;
+DROP TABLE history_snapshots;
+DROP TABLE users_with_segments_history;
\ No newline at end of file
@@ -0,0 +1,28 @@
+CREATE TABLE users_with_segments_history (
+    event_id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    seg_id BIGINT NOT NULL,
+    slug VARCHAR NOT NULL,
+    operation VARCHAR NOT NULL CHECK (operation IN ('add', 'remove')),
+    effective_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX users_with_segments_history_user_idx ON users_with_segments_history (user_id, effective_at, event_id);
+CREATE INDEX users_with_segments_history_effective_idx ON users_with_segments_history (effective_at);
+
+INSERT INTO users_with_segments_history (user_id, seg_id, slug, operation, effective_at)
+SELECT u.user_id, u.seg_id, s.slug, 'add', u.active_from
+FROM users_with_segments u JOIN segments s ON s.seg_id = u.seg_id;
+
+CREATE TABLE history_snapshots (
+    snapshot_id BIGSERIAL PRIMARY KEY,
+    taken_at TIMESTAMPTZ NOT NULL UNIQUE
+);
+
+CREATE TABLE history_snapshot_members (
+    snapshot_id BIGINT REFERENCES history_snapshots ON DELETE CASCADE,
+    user_id BIGINT,
+    seg_id BIGINT,
+    slug VARCHAR NOT NULL,
+    PRIMARY KEY (snapshot_id, user_id, seg_id)
+);
\ No newline at end of file
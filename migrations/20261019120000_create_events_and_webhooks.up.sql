@@ -0,0 +1,34 @@
+CREATE TABLE events (
+    event_id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR NOT NULL,
+    user_id BIGINT,
+    seg_id BIGINT NOT NULL,
+    slug VARCHAR NOT NULL,
+    effective_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    webhooks_dispatched BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX events_webhooks_pending_idx ON events (event_id) WHERE NOT webhooks_dispatched;
+
+CREATE TABLE webhooks (
+    webhook_id BIGSERIAL PRIMARY KEY,
+    url VARCHAR NOT NULL,
+    secret VARCHAR NOT NULL,
+    event_types VARCHAR[] NOT NULL DEFAULT '{}',
+    slugs VARCHAR[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE webhook_deliveries (
+    delivery_id BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id BIGINT NOT NULL REFERENCES events ON DELETE CASCADE,
+    status VARCHAR NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error VARCHAR NOT NULL DEFAULT '',
+    UNIQUE (webhook_id, event_id)
+);
+
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP TABLE event_sink_offsets;
+
+DROP INDEX events_unsequenced_idx;
+
+ALTER TABLE events DROP COLUMN seq;
@@ -0,0 +1,9 @@
+ALTER TABLE events ADD COLUMN seq BIGINT UNIQUE;
+
+CREATE INDEX events_unsequenced_idx ON events (event_id) WHERE seq IS NULL;
+
+CREATE TABLE event_sink_offsets (
+    sink VARCHAR PRIMARY KEY,
+    seq BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,9 @@
+CREATE FUNCTION notify_events() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('events', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER events_notify AFTER INSERT ON events
+FOR EACH STATEMENT EXECUTE FUNCTION notify_events();
@@ -0,0 +1,12 @@
+CREATE TABLE exclusion_groups (
+    group_id BIGSERIAL PRIMARY KEY,
+    name VARCHAR NOT NULL UNIQUE,
+    policy VARCHAR NOT NULL CHECK (policy IN ('reject', 'replace'))
+);
+
+CREATE TABLE exclusion_group_segments (
+    seg_id BIGINT PRIMARY KEY REFERENCES segments ON DELETE CASCADE,
+    group_id BIGINT NOT NULL REFERENCES exclusion_groups ON DELETE CASCADE
+);
+
+CREATE INDEX exclusion_group_segments_group_id_idx ON exclusion_group_segments (group_id);
@@ -0,0 +1,3 @@
+ALTER TABLE segments ADD COLUMN parent_id BIGINT REFERENCES segments (seg_id);
+
+CREATE INDEX segments_parent_id_idx ON segments (parent_id);
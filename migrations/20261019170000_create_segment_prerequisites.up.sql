@@ -0,0 +1,7 @@
+CREATE TABLE segment_prerequisites (
+    seg_id BIGINT NOT NULL REFERENCES segments ON DELETE CASCADE,
+    required_seg_id BIGINT NOT NULL REFERENCES segments ON DELETE CASCADE,
+    PRIMARY KEY (seg_id, required_seg_id)
+);
+
+CREATE INDEX segment_prerequisites_required_seg_id_idx ON segment_prerequisites (required_seg_id);
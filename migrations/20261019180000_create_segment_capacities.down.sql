@@ -0,0 +1,3 @@
+DROP INDEX users_with_segments_seg_id_idx;
+DROP TABLE segment_waitlist;
+DROP TABLE segment_capacities;
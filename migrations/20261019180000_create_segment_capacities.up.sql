@@ -0,0 +1,14 @@
+CREATE TABLE segment_capacities (
+    seg_id BIGINT PRIMARY KEY REFERENCES segments ON DELETE CASCADE,
+    max_members INTEGER NOT NULL CHECK (max_members > 0),
+    overflow TEXT NOT NULL CHECK (overflow IN ('reject', 'waitlist'))
+);
+
+CREATE TABLE segment_waitlist (
+    waitlist_id BIGSERIAL PRIMARY KEY,
+    seg_id BIGINT NOT NULL REFERENCES segment_capacities ON DELETE CASCADE,
+    user_id BIGINT NOT NULL,
+    UNIQUE (seg_id, user_id)
+);
+
+CREATE INDEX users_with_segments_seg_id_idx ON users_with_segments (seg_id);
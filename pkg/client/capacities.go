@@ -0,0 +1,34 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// SetCapacity limits the number of users in the segment and returns the
+// limit with the current number of members. Adding a user to the full
+// segment fails with ErrConflict under OverflowPolicyReject and puts the
+// user on its waitlist under OverflowPolicyWaitlist.
+func (c *Client) SetCapacity(ctx context.Context, capacity *Capacity) (*Capacity, error) {
+	set := &Capacity{}
+	body := &Capacity{Slug: capacity.Slug, MaxMembers: capacity.MaxMembers, Overflow: capacity.Overflow}
+	if err := c.call(ctx, http.MethodPut, "/seg/capacity", nil, body, set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// GetCapacity fails with ErrNotFound if the segment has no limit.
+func (c *Client) GetCapacity(ctx context.Context, slug string) (*Capacity, error) {
+	capacity := &Capacity{}
+	if err := c.call(ctx, http.MethodGet, "/seg/capacity", url.Values{"slug": {slug}}, nil, capacity); err != nil {
+		return nil, err
+	}
+	return capacity, nil
+}
+
+// DeleteCapacity lifts the limit of the segment and drops its waitlist.
+func (c *Client) DeleteCapacity(ctx context.Context, slug string) error {
+	return c.call(ctx, http.MethodDelete, "/seg/capacity", nil, map[string]string{"slug": slug}, nil)
+}
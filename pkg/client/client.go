@@ -0,0 +1,211 @@
+// Package client is a Go client of the dynamic user segmentation service.
+//
+// GET, PUT and DELETE requests are retried with exponential backoff on 5xx
+// and 429 responses and on network errors. POST requests are not idempotent,
+// they are retried only if the connection to the service failed. Non-2xx responses left after the retries are
+// returned as *Error, compare them with ErrNotFound and the rest using errors.Is.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// HTTPClient sends the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+	// BaseBackoff is the delay before the first retry, it doubles
+	// with every retry up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+func NewConfig() *Config {
+	return &Config{
+		MaxRetries:  3,
+		BaseBackoff: 100 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+	}
+}
+
+type Client struct {
+	baseURL    string
+	config     *Config
+	httpClient *http.Client
+}
+
+// New returns a client of the service at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, config *Config) *Client {
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		config:     config,
+		httpClient: httpClient,
+	}
+}
+
+// request is a single API call. The body is sent again on every attempt,
+// a stream can only be read once, so a request with one is not retried.
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	body        []byte
+	stream      io.Reader
+	contentType string
+}
+
+// call sends in as JSON and decodes the response into out, both may be nil.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	req := &request{method: method, path: path, query: query}
+	if in != nil {
+		body, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		req.body, req.contentType = body, "application/json"
+	}
+
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send returns the first 2xx response, the caller closes its body.
+func (c *Client) send(ctx context.Context, r *request) (*http.Response, error) {
+	u := c.baseURL + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+
+	maxRetries := c.config.MaxRetries
+	if r.stream != nil {
+		maxRetries = 0
+	}
+
+	backoff := c.config.BaseBackoff
+	for attempt := 0; ; attempt++ {
+		body := r.stream
+		if body == nil && r.body != nil {
+			body = bytes.NewReader(r.body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, r.method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		if r.contentType != "" {
+			req.Header.Set("Content-Type", r.contentType)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		var retryAfter time.Duration
+		if err == nil {
+			err = readError(resp)
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+
+		if !retryable(r.method, err) || attempt >= maxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := backoff
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if backoff *= 2; backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// readError turns an error response into *Error and closes it.
+// The service reports errors as {"error": "message"}, invalid requests
+// also list the fields and conflicting changes the slugs.
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	body := struct {
+		Error     string        `json:"error"`
+		Fields    []*FieldError `json:"fields"`
+		Conflicts []string      `json:"conflicts"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Message:    body.Error,
+		Fields:     body.Fields,
+		Conflicts:  body.Conflicts,
+	}
+}
+
+// retryable reports whether the call may succeed if repeated:
+// network errors, 429 and 5xx responses. A non-idempotent request,
+// e.g. a POST, may have been applied even if it failed, it is repeated
+// only if it never left the client.
+func retryable(method string, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		return dialFailed(err)
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+// dialFailed reports whether the connection to the service failed,
+// so the request was not sent.
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseRetryAfter reads the delay in seconds, the HTTP date form is ignored.
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
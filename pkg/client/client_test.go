@@ -0,0 +1,489 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/controller/httpserver"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/repository/testrepository"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/internal/usecase"
+	"github.com/AnatoliyBr/dynamic-user-segmentation-service/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) *client.Client {
+	t.Helper()
+
+	r := testrepository.NewSegmentRepository()
+	uc := usecase.NewAppUseCase(usecase.NewConfig(), r, testrepository.NewWebhookRepository(r), testrepository.NewEventRepository(r))
+
+	ts := httptest.NewServer(httpserver.NewServer(httpserver.NewConfig(), uc))
+	t.Cleanup(ts.Close)
+
+	return client.New(ts.URL, client.NewConfig())
+}
+
+func TestClient_Segments(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	seg, err := c.CreateSegment(ctx, "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Equal(t, &client.Segment{SegID: 1, Slug: "AVITO_DISCOUNT_30"}, seg)
+
+	_, err = c.CreateSegment(ctx, "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, client.ErrUnprocessable)
+
+	_, err = c.CreateSegment(ctx, "?#@*&%!")
+	assert.ErrorIs(t, err, client.ErrUnprocessable)
+
+	assert.NoError(t, c.DeleteSegment(ctx, "AVITO_DISCOUNT_30"))
+
+	err = c.DeleteSegment(ctx, "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, client.ErrNotFound)
+
+	var apiErr *client.Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, "record not found", apiErr.Message)
+}
+
+func TestClient_UserSegments(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for _, slug := range []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		_, err := c.CreateSegment(ctx, slug)
+		require.NoError(t, err)
+	}
+
+	segList, err := c.GetUserSegments(ctx, 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, segList)
+
+	assert.NoError(t, c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{
+		UserID: 1000,
+		Add:    []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"},
+	}))
+	addedAt := time.Now()
+
+	activeFrom := time.Now().Add(time.Hour)
+	assert.NoError(t, c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{
+		UserID:     1000,
+		Add:        []string{"AVITO_DISCOUNT_50"},
+		Remove:     []string{"AVITO_VOICE_MESSAGES"},
+		ActiveFrom: &activeFrom,
+	}))
+
+	err = c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1000, Add: []string{"AVITO_UNKNOWN"}})
+	assert.ErrorIs(t, err, client.ErrNotFound)
+
+	err = c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1000, Add: []string{"AVITO DISCOUNT"}})
+	assert.ErrorIs(t, err, client.ErrBadRequest)
+
+	var apiErr *client.Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, []*client.FieldError{{Field: "slug_list_add[0]", Error: `"AVITO DISCOUNT" must be in a valid format`}}, apiErr.Fields)
+
+	err = c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1000, Add: []string{"AVITO_DISCOUNT_30"}, Remove: []string{"AVITO_DISCOUNT_30"}})
+	assert.ErrorIs(t, err, client.ErrConflict)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, []string{"AVITO_DISCOUNT_30"}, apiErr.Conflicts)
+
+	segList, err = c.GetUserSegments(ctx, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []*client.Segment{{SegID: 2, Slug: "AVITO_DISCOUNT_30"}}, segList)
+
+	segList, err = c.GetUserSegmentsAsOf(ctx, 1000, addedAt)
+	assert.NoError(t, err)
+	assert.Len(t, segList, 2)
+
+	pendingList, err := c.GetPendingSegments(ctx, 1000)
+	assert.NoError(t, err)
+	require.Len(t, pendingList, 1)
+	assert.Equal(t, "AVITO_DISCOUNT_50", pendingList[0].Slug)
+	assert.WithinDuration(t, activeFrom, pendingList[0].ActiveFrom, time.Second)
+
+	assert.NoError(t, c.CancelPendingSegments(ctx, 1000, []string{"AVITO_DISCOUNT_50"}))
+
+	pendingList, err = c.GetPendingSegments(ctx, 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingList)
+}
+
+func TestClient_BatchImportExport(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		_, err := c.CreateSegment(ctx, slug)
+		require.NoError(t, err)
+	}
+
+	res, err := c.ApplyBatch(ctx, []*client.BatchItem{
+		{UserID: 1000, Add: []string{"AVITO_DISCOUNT_30"}},
+		{UserID: 1001, Add: []string{"AVITO_UNKNOWN"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Succeeded)
+	assert.Equal(t, client.BatchStatusError, res.Items[1].Status)
+
+	_, err = c.ApplyBatch(ctx, nil)
+	assert.ErrorIs(t, err, client.ErrBadRequest)
+
+	imported, err := c.ImportUsers(ctx, "AVITO_DISCOUNT_50", strings.NewReader("1000\n1002\nalice\n"), client.FormatCSV)
+	assert.NoError(t, err)
+	assert.Equal(t, &client.ImportResult{Slug: "AVITO_DISCOUNT_50", Accepted: 2, Invalid: 1}, imported)
+
+	_, err = c.ImportUsers(ctx, "AVITO_DISCOUNT_50", strings.NewReader(""), "xml")
+	assert.ErrorIs(t, err, client.ErrUnsupportedFormat)
+
+	userIDs := make([]int, 0)
+	assert.NoError(t, c.ExportSegmentMembers(ctx, "AVITO_DISCOUNT_50", func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	}))
+	assert.Equal(t, []int{1000, 1002}, userIDs)
+
+	memberships := make([]*client.Membership, 0)
+	assert.NoError(t, c.ExportMemberships(ctx, func(m *client.Membership) error {
+		memberships = append(memberships, m)
+		return nil
+	}))
+	assert.Equal(t, []*client.Membership{
+		{UserID: 1000, Slug: "AVITO_DISCOUNT_30"},
+		{UserID: 1000, Slug: "AVITO_DISCOUNT_50"},
+		{UserID: 1002, Slug: "AVITO_DISCOUNT_50"},
+	}, memberships)
+
+	errStop := errors.New("stop")
+	assert.ErrorIs(t, c.ExportMemberships(ctx, func(*client.Membership) error {
+		return errStop
+	}), errStop)
+}
+
+func TestClient_Webhooks(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	webhook, err := c.CreateWebhook(ctx, &client.WebhookCreate{
+		URL:        "https://example.com/hooks/segments",
+		Secret:     "0123456789abcdef",
+		EventTypes: []string{"user.added"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, webhook.WebhookID)
+
+	_, err = c.CreateWebhook(ctx, &client.WebhookCreate{URL: "example", Secret: "short"})
+	assert.ErrorIs(t, err, client.ErrUnprocessable)
+
+	webhooks, err := c.ListWebhooks(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, webhooks, 1)
+
+	deliveries, err := c.ListDeliveries(ctx, webhook.WebhookID, client.DeliveryStatusDead)
+	assert.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	assert.ErrorIs(t, c.Redeliver(ctx, 42), client.ErrNotFound)
+	assert.NoError(t, c.DeleteWebhook(ctx, webhook.WebhookID))
+	assert.ErrorIs(t, c.DeleteWebhook(ctx, webhook.WebhookID), client.ErrNotFound)
+}
+
+func TestClient_Groups(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for _, slug := range []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"} {
+		_, err := c.CreateSegment(ctx, slug)
+		require.NoError(t, err)
+	}
+
+	group, err := c.CreateGroup(ctx, &client.GroupCreate{
+		Name:   "discounts",
+		Policy: client.GroupPolicyReject,
+		Slugs:  []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, group.GroupID)
+
+	groups, err := c.ListGroups(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*client.Group{group}, groups)
+
+	require.NoError(t, c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1, Add: []string{"AVITO_DISCOUNT_30"}}))
+	err = c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1, Add: []string{"AVITO_DISCOUNT_50"}})
+	assert.ErrorIs(t, err, client.ErrConflict)
+
+	var clientErr *client.Error
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}, clientErr.Conflicts)
+
+	assert.NoError(t, c.DeleteGroup(ctx, "discounts"))
+	assert.ErrorIs(t, c.DeleteGroup(ctx, "discounts"), client.ErrNotFound)
+}
+
+func TestClient_Prerequisites(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for _, slug := range []string{"AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA"} {
+		_, err := c.CreateSegment(ctx, slug)
+		require.NoError(t, err)
+	}
+
+	p, err := c.AddPrerequisite(ctx, "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS")
+	assert.NoError(t, err)
+	assert.Equal(t, &client.Prerequisite{Slug: "AVITO_PERFORMANCE_VAS_BETA", Requires: "AVITO_PERFORMANCE_VAS"}, p)
+
+	_, err = c.AddPrerequisite(ctx, "AVITO_PERFORMANCE_VAS", "AVITO_PERFORMANCE_VAS_BETA")
+	assert.ErrorIs(t, err, client.ErrConflict)
+
+	prereqs, err := c.ListPrerequisites(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*client.Prerequisite{p}, prereqs)
+
+	err = c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1, Add: []string{"AVITO_PERFORMANCE_VAS_BETA"}})
+	var clientErr *client.Error
+	require.ErrorAs(t, err, &clientErr)
+	assert.Equal(t, []string{"AVITO_PERFORMANCE_VAS"}, clientErr.Conflicts)
+
+	assert.NoError(t, c.DeletePrerequisite(ctx, "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS"))
+	assert.ErrorIs(t, c.DeletePrerequisite(ctx, "AVITO_PERFORMANCE_VAS_BETA", "AVITO_PERFORMANCE_VAS"), client.ErrNotFound)
+}
+
+func TestClient_Capacities(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := c.CreateSegment(ctx, "AVITO_DISCOUNT_30")
+	require.NoError(t, err)
+
+	capacity, err := c.SetCapacity(ctx, &client.Capacity{Slug: "AVITO_DISCOUNT_30", MaxMembers: 1, Overflow: client.OverflowPolicyWaitlist})
+	assert.NoError(t, err)
+	assert.Equal(t, &client.Capacity{Slug: "AVITO_DISCOUNT_30", MaxMembers: 1, Overflow: client.OverflowPolicyWaitlist, Remaining: 1}, capacity)
+
+	require.NoError(t, c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1, Add: []string{"AVITO_DISCOUNT_30"}}))
+	require.NoError(t, c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 2, Add: []string{"AVITO_DISCOUNT_30"}}))
+
+	capacity, err = c.GetCapacity(ctx, "AVITO_DISCOUNT_30")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, capacity.Members)
+	assert.Equal(t, 1, capacity.Waitlisted)
+
+	_, err = c.SetCapacity(ctx, &client.Capacity{Slug: "AVITO_DISCOUNT_30", MaxMembers: 1, Overflow: client.OverflowPolicyReject})
+	require.NoError(t, err)
+
+	err = c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 3, Add: []string{"AVITO_DISCOUNT_30"}})
+	var clientErr *client.Error
+	require.ErrorAs(t, err, &clientErr)
+	assert.ErrorIs(t, err, client.ErrConflict)
+	assert.Equal(t, []string{"AVITO_DISCOUNT_30"}, clientErr.Conflicts)
+
+	assert.NoError(t, c.DeleteCapacity(ctx, "AVITO_DISCOUNT_30"))
+	_, err = c.GetCapacity(ctx, "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestClient_Hierarchy(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := c.CreateSegment(ctx, "AVITO_DISCOUNT")
+	require.NoError(t, err)
+
+	child, err := c.CreateChildSegment(ctx, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT")
+	assert.NoError(t, err)
+	assert.Equal(t, &client.Segment{SegID: 2, Slug: "AVITO_DISCOUNT_30", Parent: "AVITO_DISCOUNT"}, child)
+
+	_, err = c.SetSegmentParent(ctx, "AVITO_DISCOUNT", "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, client.ErrConflict)
+
+	segList, err := c.GetUserSegmentsExpanded(ctx, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, segList)
+
+	require.NoError(t, c.UpdateUserSegments(ctx, &client.UserSegmentsUpdate{UserID: 1, Add: []string{"AVITO_DISCOUNT_30"}}))
+
+	segList, err = c.GetUserSegmentsExpanded(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []*client.UserSegment{
+		{SegID: 1, Slug: "AVITO_DISCOUNT", Source: client.SourceInherited, Via: []string{"AVITO_DISCOUNT_30"}},
+		{SegID: 2, Slug: "AVITO_DISCOUNT_30", Source: client.SourceDirect},
+	}, segList)
+
+	assert.ErrorIs(t, c.DeleteSegment(ctx, "AVITO_DISCOUNT"), client.ErrConflict)
+	assert.NoError(t, c.DeleteSegmentWithChildren(ctx, "AVITO_DISCOUNT", client.ChildrenPolicyReparent))
+
+	seg, err := c.SetSegmentParent(ctx, "AVITO_DISCOUNT_30", "")
+	assert.NoError(t, err)
+	assert.Empty(t, seg.Parent)
+}
+
+func TestClient_IncompleteExport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Export-Status")
+		w.Write([]byte("{\"user_id\":1000}\n"))
+		if r.URL.Path == "/seg/export" {
+			w.Write([]byte("{\"error\":\"connection reset\"}\n"))
+		}
+		w.Header().Set("X-Export-Status", "failed")
+	}))
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.NewConfig())
+	ctx := context.Background()
+
+	userIDs := make([]int, 0)
+	err := c.ExportSegmentMembers(ctx, "AVITO_DISCOUNT_30", func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	assert.ErrorIs(t, err, client.ErrIncompleteExport)
+	assert.Contains(t, err.Error(), "connection reset")
+	assert.Equal(t, []int{1000}, userIDs)
+
+	assert.ErrorIs(t, c.ExportMemberships(ctx, func(*client.Membership) error {
+		return nil
+	}), client.ErrIncompleteExport)
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(`{"slug": "AVITO_DISCOUNT_30", "max_members": 10}`))
+		}
+	}))
+	defer ts.Close()
+
+	config := client.NewConfig()
+	config.BaseBackoff = time.Millisecond
+	c := client.New(ts.URL, config)
+
+	capacity, err := c.SetCapacity(context.Background(), &client.Capacity{Slug: "AVITO_DISCOUNT_30", MaxMembers: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, capacity.MaxMembers)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestClient_RetriesPost(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	var dials int32
+	config := client.NewConfig()
+	config.BaseBackoff = time.Millisecond
+	config.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	c := client.New(ts.URL, config)
+
+	// the service may have created the segment before failing,
+	// only the attempt that could not connect is repeated
+	_, err := c.CreateSegment(context.Background(), "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, client.ErrServer)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClient_RetriesExhausted(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"error": "upstream is down"}`))
+	}))
+	defer ts.Close()
+
+	config := client.NewConfig()
+	config.MaxRetries = 2
+	config.BaseBackoff = time.Millisecond
+	c := client.New(ts.URL, config)
+
+	err := c.DeleteSegment(context.Background(), "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, client.ErrServer)
+	assert.NotErrorIs(t, err, client.ErrNotFound)
+	assert.Contains(t, err.Error(), "upstream is down")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// streamed bodies can only be sent once
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.ImportUsers(context.Background(), "AVITO_DISCOUNT_30", strings.NewReader("1000\n"), client.FormatCSV)
+	assert.ErrorIs(t, err, client.ErrServer)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+}
+
+func TestClient_NoRetryOnClientError(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.NewConfig())
+	assert.ErrorIs(t, c.DeleteSegment(context.Background(), "AVITO_DISCOUNT_30"), client.ErrNotFound)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestClient_UserSegmentsNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	// a 404 not sent by the service, e.g. of a wrong base URL,
+	// is not mistaken for a user without segments
+	c := client.New(ts.URL, client.NewConfig())
+	_, err := c.GetUserSegments(context.Background(), 1000)
+	assert.ErrorIs(t, err, client.ErrNotFound)
+
+	_, err = c.GetUserSegmentsExpanded(context.Background(), 1000)
+	assert.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestClient_ContextCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	config := client.NewConfig()
+	config.BaseBackoff = time.Hour
+	c := client.New(ts.URL, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := c.DeleteSegment(ctx, "AVITO_DISCOUNT_30")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error is a response of the service with a non-2xx status.
+// Compare it with the sentinel errors using errors.Is.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Fields lists the invalid request fields of a 400 response.
+	Fields []*FieldError
+	// Conflicts lists the slugs repeated in a change rejected with 409,
+	// the conflicting segments of an exclusion group or the missing
+	// prerequisites.
+	Conflicts []string
+}
+
+// FieldError is a single invalid field, e.g. slug_list_add[1].
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("segments: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("segments: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches the sentinel errors by status code, ErrServer matches any 5xx.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t.Message != "" {
+		return false
+	}
+	return t.StatusCode == e.StatusCode || t == ErrServer && e.StatusCode >= 500
+}
+
+var (
+	// ErrBadRequest is returned for a malformed request body or query.
+	ErrBadRequest = &Error{StatusCode: http.StatusBadRequest}
+	// ErrNotFound is returned when a segment, group, webhook or delivery does not exist.
+	ErrNotFound = &Error{StatusCode: http.StatusNotFound}
+	// ErrConflict is returned when a change names a slug more than once
+	// and the service rejects such changes, when it would put a user
+	// in two segments of an exclusion group or in a segment without its
+	// prerequisites, or when it would break the segment hierarchy or make
+	// a segment require itself.
+	ErrConflict = &Error{StatusCode: http.StatusConflict}
+	// ErrNotAcceptable is returned for an unknown export format.
+	ErrNotAcceptable = &Error{StatusCode: http.StatusNotAcceptable}
+	// ErrTooLarge is returned for a batch above the server limit.
+	ErrTooLarge = &Error{StatusCode: http.StatusRequestEntityTooLarge}
+	// ErrUnsupportedFormat is returned for an unknown import format.
+	ErrUnsupportedFormat = &Error{StatusCode: http.StatusUnsupportedMediaType}
+	// ErrUnprocessable is returned when the data is rejected,
+	// e.g. an invalid or already taken slug.
+	ErrUnprocessable = &Error{StatusCode: http.StatusUnprocessableEntity}
+	// ErrTooManyRequests is returned once the retries run out on 429 responses.
+	ErrTooManyRequests = &Error{StatusCode: http.StatusTooManyRequests}
+	// ErrServer matches any 5xx response left after the retries.
+	ErrServer = &Error{StatusCode: http.StatusInternalServerError}
+)
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// CreateGroup puts segments in an exclusion group, so that a user is
+// in one of them at most.
+func (c *Client) CreateGroup(ctx context.Context, group *GroupCreate) (*Group, error) {
+	created := &Group{}
+	if err := c.call(ctx, http.MethodPost, "/groups", nil, group, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) ListGroups(ctx context.Context) ([]*Group, error) {
+	groups := make([]*Group, 0)
+	if err := c.call(ctx, http.MethodGet, "/groups", nil, nil, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// DeleteGroup deletes the group, its segments and memberships are kept.
+func (c *Client) DeleteGroup(ctx context.Context, name string) error {
+	return c.call(ctx, http.MethodDelete, "/groups/"+url.PathEscape(name), nil, nil, nil)
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// CreateChildSegment creates a segment under an existing parent segment.
+func (c *Client) CreateChildSegment(ctx context.Context, slug, parent string) (*Segment, error) {
+	seg := &Segment{}
+	if err := c.call(ctx, http.MethodPost, "/seg", nil, map[string]string{"slug": slug, "parent": parent}, seg); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// SetSegmentParent moves the segment under parent, an empty parent makes
+// it a root segment. A move that would make the segment its own ancestor
+// fails with ErrConflict.
+func (c *Client) SetSegmentParent(ctx context.Context, slug, parent string) (*Segment, error) {
+	seg := &Segment{}
+	if err := c.call(ctx, http.MethodPut, "/seg/parent", nil, map[string]string{"slug": slug, "parent": parent}, seg); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// DeleteSegmentWithChildren deletes the segment, its child segments are
+// handled by the policy: ChildrenPolicyReject fails with ErrConflict,
+// ChildrenPolicyReparent moves them to the parent of the segment.
+func (c *Client) DeleteSegmentWithChildren(ctx context.Context, slug, policy string) error {
+	return c.call(ctx, http.MethodDelete, "/seg", nil, map[string]string{"slug": slug, "children": policy}, nil)
+}
+
+// GetUserSegmentsExpanded returns the active segments of the user with
+// the ancestors the user is in through them, an empty list if there are none.
+func (c *Client) GetUserSegmentsExpanded(ctx context.Context, userID int) ([]*UserSegment, error) {
+	segList := make([]*UserSegment, 0)
+	err := c.call(ctx, http.MethodGet, "/seg", nil, map[string]interface{}{"user_id": userID, "expand": true}, &segList)
+	if noSegments(err) {
+		return make([]*UserSegment, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return segList, nil
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// AddPrerequisite makes the segment require another one. A prerequisite
+// that would make a segment require itself fails with ErrConflict.
+func (c *Client) AddPrerequisite(ctx context.Context, slug, requires string) (*Prerequisite, error) {
+	created := &Prerequisite{}
+	if err := c.call(ctx, http.MethodPost, "/prerequisites", nil, &Prerequisite{Slug: slug, Requires: requires}, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) ListPrerequisites(ctx context.Context) ([]*Prerequisite, error) {
+	prereqs := make([]*Prerequisite, 0)
+	if err := c.call(ctx, http.MethodGet, "/prerequisites", nil, nil, &prereqs); err != nil {
+		return nil, err
+	}
+	return prereqs, nil
+}
+
+// DeletePrerequisite deletes the prerequisite, the memberships are kept.
+func (c *Client) DeletePrerequisite(ctx context.Context, slug, requires string) error {
+	return c.call(ctx, http.MethodDelete, "/prerequisites/"+url.PathEscape(slug)+"/"+url.PathEscape(requires), nil, nil, nil)
+}
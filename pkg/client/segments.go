@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func (c *Client) CreateSegment(ctx context.Context, slug string) (*Segment, error) {
+	seg := &Segment{}
+	if err := c.call(ctx, http.MethodPost, "/seg", nil, map[string]string{"slug": slug}, seg); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// DeleteSegment deletes the segment along with its memberships.
+func (c *Client) DeleteSegment(ctx context.Context, slug string) error {
+	return c.call(ctx, http.MethodDelete, "/seg", nil, map[string]string{"slug": slug}, nil)
+}
+
+func (c *Client) UpdateUserSegments(ctx context.Context, update *UserSegmentsUpdate) error {
+	return c.call(ctx, http.MethodPut, "/seg", nil, update, nil)
+}
+
+// GetUserSegments returns the active segments of the user,
+// an empty list if there are none.
+func (c *Client) GetUserSegments(ctx context.Context, userID int) ([]*Segment, error) {
+	return c.getUserSegments(ctx, map[string]interface{}{"user_id": userID})
+}
+
+// GetUserSegmentsAsOf returns the segments the user was in at the given time.
+func (c *Client) GetUserSegmentsAsOf(ctx context.Context, userID int, asOf time.Time) ([]*Segment, error) {
+	return c.getUserSegments(ctx, map[string]interface{}{"user_id": userID, "as_of": asOf})
+}
+
+// getUserSegments sends the request in the body of a GET, as the
+// service expects. A user without segments is reported as not found.
+func (c *Client) getUserSegments(ctx context.Context, body map[string]interface{}) ([]*Segment, error) {
+	segList := make([]*Segment, 0)
+	err := c.call(ctx, http.MethodGet, "/seg", nil, body, &segList)
+	if noSegments(err) {
+		return make([]*Segment, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return segList, nil
+}
+
+// noSegments reports whether err is the 404 the service returns for a user
+// without segments, any other 404, e.g. of a proxy, is returned as is.
+func noSegments(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) &&
+		apiErr.StatusCode == http.StatusNotFound && apiErr.Message == "record not found"
+}
+
+func (c *Client) GetPendingSegments(ctx context.Context, userID int) ([]*PendingMembership, error) {
+	pendingList := make([]*PendingMembership, 0)
+	query := url.Values{"user_id": {strconv.Itoa(userID)}}
+	if err := c.call(ctx, http.MethodGet, "/seg/pending", query, nil, &pendingList); err != nil {
+		return nil, err
+	}
+	return pendingList, nil
+}
+
+func (c *Client) CancelPendingSegments(ctx context.Context, userID int, slugs []string) error {
+	body := map[string]interface{}{"user_id": userID, "slug_list": slugs}
+	return c.call(ctx, http.MethodDelete, "/seg/pending", nil, body, nil)
+}
+
+// ApplyBatch applies the changes of many users, every item succeeds
+// or fails on its own, see BatchResult.
+func (c *Client) ApplyBatch(ctx context.Context, items []*BatchItem) (*BatchResult, error) {
+	res := &BatchResult{}
+	if err := c.call(ctx, http.MethodPut, "/seg/batch", nil, map[string]interface{}{"items": items}, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ImportUsers adds the user IDs read from r to the segment. The data is
+// streamed, so the request is not retried.
+func (c *Client) ImportUsers(ctx context.Context, slug string, r io.Reader, format string) (*ImportResult, error) {
+	resp, err := c.send(ctx, &request{
+		method: http.MethodPost,
+		path:   "/seg/import",
+		query:  url.Values{"slug": {slug}, "format": {format}},
+		stream: r,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res := &ImportResult{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ExportSegmentMembers calls fn with every user of the segment
+// as the rows arrive. An error returned by fn stops the export.
+func (c *Client) ExportSegmentMembers(ctx context.Context, slug string, fn func(userID int) error) error {
+	return c.export(ctx, "/seg/export", url.Values{"slug": {slug}}, func(dec func(interface{}) error) error {
+		row := struct {
+			UserID int `json:"user_id"`
+		}{}
+		if err := dec(&row); err != nil {
+			return err
+		}
+		return fn(row.UserID)
+	})
+}
+
+// ExportMemberships calls fn with every membership ordered by user and slug.
+func (c *Client) ExportMemberships(ctx context.Context, fn func(*Membership) error) error {
+	return c.export(ctx, "/users/export", nil, func(dec func(interface{}) error) error {
+		m := &Membership{}
+		if err := dec(m); err != nil {
+			return err
+		}
+		return fn(m)
+	})
+}
+
+// ErrIncompleteExport is returned when the service stops an export half
+// way, the rows already passed to fn are not the full result.
+var ErrIncompleteExport = errors.New("segments: export is incomplete")
+
+// export reads an NDJSON export line by line. An export is complete once
+// the service reports it in the X-Export-Status trailer, a {"error": ...}
+// line or a missing trailer means it was cut short.
+func (c *Client) export(ctx context.Context, path string, query url.Values, row func(func(interface{}) error) error) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("format", FormatNDJSON)
+
+	resp, err := c.send(ctx, &request{method: http.MethodGet, path: path, query: query})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		if bytes.HasPrefix(line, []byte(`{"error":`)) {
+			failed := struct {
+				Error string `json:"error"`
+			}{}
+			if err := json.Unmarshal(line, &failed); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %s", ErrIncompleteExport, failed.Error)
+		}
+
+		if err := row(func(v interface{}) error {
+			return json.Unmarshal(line, v)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	if resp.Trailer.Get("X-Export-Status") != "complete" {
+		return ErrIncompleteExport
+	}
+	return nil
+}
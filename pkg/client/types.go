@@ -0,0 +1,171 @@
+package client
+
+import "time"
+
+// The types mirror the JSON of the service API.
+
+type Segment struct {
+	SegID  int    `json:"seg_id"`
+	Slug   string `json:"slug"`
+	Parent string `json:"parent,omitempty"`
+}
+
+const (
+	SourceDirect    = "direct"
+	SourceInherited = "inherited"
+)
+
+// UserSegment is a segment of the user with the way the user is in it:
+// directly or through the segments listed in Via.
+type UserSegment struct {
+	SegID  int      `json:"seg_id"`
+	Slug   string   `json:"slug"`
+	Source string   `json:"source"`
+	Via    []string `json:"via,omitempty"`
+}
+
+const (
+	ChildrenPolicyReject   = "reject"
+	ChildrenPolicyReparent = "reparent"
+)
+
+// PendingMembership is a scheduled membership that is not active yet.
+type PendingMembership struct {
+	SegID      int       `json:"seg_id"`
+	Slug       string    `json:"slug"`
+	ActiveFrom time.Time `json:"active_from"`
+}
+
+type Membership struct {
+	UserID int    `json:"user_id"`
+	Slug   string `json:"slug"`
+}
+
+// UserSegmentsUpdate adds the user to some segments and removes
+// from others. With ActiveFrom set the additions are scheduled.
+type UserSegmentsUpdate struct {
+	UserID     int        `json:"user_id"`
+	Add        []string   `json:"slug_list_add"`
+	Remove     []string   `json:"slug_list_del"`
+	ActiveFrom *time.Time `json:"active_from,omitempty"`
+}
+
+type BatchItem struct {
+	UserID int      `json:"user_id"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+const (
+	BatchStatusOK    = "ok"
+	BatchStatusError = "error"
+)
+
+type BatchItemResult struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+	Total     int                `json:"total"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Items     []*BatchItemResult `json:"items"`
+}
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+type ImportResult struct {
+	Slug      string `json:"slug"`
+	Accepted  int    `json:"accepted"`
+	Duplicate int    `json:"duplicate"`
+	Invalid   int    `json:"invalid"`
+	Malformed int    `json:"malformed"`
+	Rejected  int    `json:"rejected"`
+}
+
+const (
+	GroupPolicyReject  = "reject"
+	GroupPolicyReplace = "replace"
+)
+
+type GroupCreate struct {
+	Name   string   `json:"name"`
+	Policy string   `json:"policy"`
+	Slugs  []string `json:"slugs"`
+}
+
+type Group struct {
+	GroupID int      `json:"group_id"`
+	Name    string   `json:"name"`
+	Policy  string   `json:"policy"`
+	Slugs   []string `json:"slugs"`
+}
+
+// Prerequisite makes a user need the Requires segment to be in Slug.
+type Prerequisite struct {
+	Slug     string `json:"slug"`
+	Requires string `json:"requires"`
+}
+
+const (
+	OverflowPolicyReject   = "reject"
+	OverflowPolicyWaitlist = "waitlist"
+)
+
+// Capacity limits the number of users in a segment. An empty Overflow
+// takes the policy configured on the server.
+type Capacity struct {
+	Slug       string `json:"slug"`
+	MaxMembers int    `json:"max_members"`
+	Overflow   string `json:"overflow,omitempty"`
+	Members    int    `json:"members,omitempty"`
+	Remaining  int    `json:"remaining,omitempty"`
+	Waitlisted int    `json:"waitlisted,omitempty"`
+}
+
+type WebhookCreate struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"event_types"`
+	Slugs      []string `json:"slugs"`
+}
+
+type Webhook struct {
+	WebhookID  int       `json:"webhook_id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Slugs      []string  `json:"slugs"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusDead      = "dead"
+)
+
+type WebhookDelivery struct {
+	DeliveryID    int       `json:"delivery_id"`
+	WebhookID     int       `json:"webhook_id"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	Event         *Event    `json:"event"`
+}
+
+type Event struct {
+	EventID     int       `json:"event_id"`
+	Seq         int       `json:"seq,omitempty"`
+	Type        string    `json:"event_type"`
+	UserID      int       `json:"user_id,omitempty"`
+	SegID       int       `json:"seg_id"`
+	Slug        string    `json:"slug"`
+	EffectiveAt time.Time `json:"effective_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
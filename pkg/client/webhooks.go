@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+func (c *Client) CreateWebhook(ctx context.Context, webhook *WebhookCreate) (*Webhook, error) {
+	created := &Webhook{}
+	if err := c.call(ctx, http.MethodPost, "/webhooks", nil, webhook, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	webhooks := make([]*Webhook, 0)
+	if err := c.call(ctx, http.MethodGet, "/webhooks", nil, nil, &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, webhookID int) error {
+	return c.call(ctx, http.MethodDelete, fmt.Sprintf("/webhooks/%d", webhookID), nil, nil, nil)
+}
+
+// ListDeliveries returns the deliveries of the webhook, status
+// filters them by one of the DeliveryStatus values if not empty.
+func (c *Client) ListDeliveries(ctx context.Context, webhookID int, status string) ([]*WebhookDelivery, error) {
+	var query url.Values
+	if status != "" {
+		query = url.Values{"status": {status}}
+	}
+
+	deliveries := make([]*WebhookDelivery, 0)
+	if err := c.call(ctx, http.MethodGet, fmt.Sprintf("/webhooks/%d/deliveries", webhookID), query, nil, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Redeliver schedules a dead delivery to be sent again.
+func (c *Client) Redeliver(ctx context.Context, deliveryID int) error {
+	return c.call(ctx, http.MethodPost, fmt.Sprintf("/webhooks/deliveries/%d/redeliver", deliveryID), nil, nil, nil)
+}